@@ -0,0 +1,982 @@
+package audio
+
+// AAC in ADTS framing, as JT/T 1078 devices send payload types 19, 21 and
+// 24: the frame parsing the muxers need to pass it through, and a decoder
+// of the AAC LC core (ISO/IEC 14496-3) for listening. HE-AAC is decoded
+// without its SBR extension, at the core sample rate and bandwidth, which
+// is plenty for 8 kHz output. Main profile prediction, LTP, SSR gain
+// control and coupling channels are not supported; frames using them are
+// skipped.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var aacSampleRates = [13]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AACConfig is the format of an AAC stream, read from its ADTS headers.
+type AACConfig struct {
+	ObjectType     int // MPEG-4 audio object type, 2 = AAC LC
+	FrequencyIndex int
+	SampleRate     int
+	Channels       int // channel configuration, 0 = set by a PCE
+}
+
+// ASC is the 2-byte AudioSpecificConfig of the stream, for FLV sequence
+// headers and MP4 esds boxes.
+func (c AACConfig) ASC() []byte {
+	return []byte{byte(c.ObjectType<<3 | c.FrequencyIndex>>1), byte(c.FrequencyIndex<<7 | c.Channels<<3)}
+}
+
+// Codec is the RFC 6381 codec string of the stream, such as mp4a.40.2.
+func (c AACConfig) Codec() string {
+	return fmt.Sprintf("mp4a.40.%d", c.ObjectType)
+}
+
+// ADTSFrame is one frame of an ADTS stream.
+type ADTSFrame struct {
+	Config AACConfig
+	Data   []byte // raw data blocks, without header and CRC
+	Blocks int    // raw data blocks in Data, 1024 samples each
+	crc    bool   // each block is followed by its CRC
+}
+
+// SplitADTS splits an audio payload into its ADTS frames. It returns nil
+// when the payload does not start with an ADTS header; trailing bytes that
+// do not form a whole frame are dropped.
+func SplitADTS(payload []byte) []ADTSFrame {
+	var frames []ADTSFrame
+	for len(payload) >= 7 && payload[0] == 0xFF && payload[1]&0xF6 == 0xF0 {
+		length := int(payload[3]&0x03)<<11 | int(payload[4])<<3 | int(payload[5])>>5
+		blocks := int(payload[6]&0x03) + 1
+		header := 7
+		crc := payload[1]&0x01 == 0
+		if crc {
+			header += 2 * blocks // block positions and header CRC
+		}
+		frequency := int(payload[2] >> 2 & 0x0F)
+		if length < header || length > len(payload) || frequency >= len(aacSampleRates) {
+			break
+		}
+		frames = append(frames, ADTSFrame{
+			Config: AACConfig{
+				ObjectType:     int(payload[2]>>6) + 1,
+				FrequencyIndex: frequency,
+				SampleRate:     aacSampleRates[frequency],
+				Channels:       int(payload[2]&0x01)<<2 | int(payload[3]>>6),
+			},
+			Data:   payload[header:length],
+			Blocks: blocks,
+			crc:    crc && blocks > 1,
+		})
+		payload = payload[length:]
+	}
+	return frames
+}
+
+// Syntax elements of a raw data block
+const (
+	aacElementSCE = iota
+	aacElementCPE
+	aacElementCCE
+	aacElementLFE
+	aacElementDSE
+	aacElementPCE
+	aacElementFIL
+	aacElementEND
+)
+
+// Window sequences
+const (
+	aacOnlyLong = iota
+	aacLongStart
+	aacEightShort
+	aacLongStop
+)
+
+// Band types beyond the spectral codebooks 1 to 11
+const (
+	aacZeroBand       = 0
+	aacNoiseBand      = 13
+	aacIntensityBand2 = 14 // out of phase
+	aacIntensityBand  = 15
+)
+
+var errAACUnsupported = errors.New("unsupported AAC tool")
+var errAACInvalid = errors.New("invalid AAC data")
+
+// aacBits reads a raw data block most significant bit first. Reads past
+// the end give zeros and are caught by overrun.
+type aacBits struct {
+	data []byte
+	pos  int
+}
+
+func (b *aacBits) read(n int) int {
+	v := 0
+	for ; n > 0; n-- {
+		v <<= 1
+		if i := b.pos >> 3; i < len(b.data) {
+			v |= int(b.data[i]>>(7-b.pos&7)) & 1
+		}
+		b.pos++
+	}
+	return v
+}
+
+func (b *aacBits) overrun() bool {
+	return b.pos > 8*len(b.data)
+}
+
+// aacHuffman is a codebook as a binary tree: children >= 0 are nodes,
+// negative ones the complement of a symbol.
+type aacHuffman [][2]int32
+
+func newAACHuffman(codes []uint32, bits []uint8) aacHuffman {
+	tree := aacHuffman{{}}
+	for symbol, code := range codes {
+		node := 0
+		for i := int(bits[symbol]) - 1; i >= 0; i-- {
+			bit := code >> i & 1
+			if i == 0 {
+				tree[node][bit] = ^int32(symbol)
+				break
+			}
+			if tree[node][bit] == 0 {
+				tree = append(tree, [2]int32{})
+				tree[node][bit] = int32(len(tree) - 1)
+			}
+			node = int(tree[node][bit])
+		}
+	}
+	return tree
+}
+
+// decode reads one code word, or gives -1 for bits no code word starts with.
+func (h aacHuffman) decode(b *aacBits) int {
+	node := int32(0)
+	for !b.overrun() {
+		node = h[node][b.read(1)]
+		if node < 0 {
+			return int(^node)
+		}
+		if node == 0 {
+			return -1
+		}
+	}
+	return -1
+}
+
+// aacBook is how the symbols of a spectral codebook map to values.
+type aacBook struct {
+	dimension int  // values per code word
+	unsigned  bool // signs follow as separate bits
+	modulus   int  // values each position of a symbol takes
+	offset    int  // subtracted from each position to sign it
+}
+
+var aacBooks = [12]aacBook{
+	1: {4, false, 3, 1}, 2: {4, false, 3, 1},
+	3: {4, true, 3, 0}, 4: {4, true, 3, 0},
+	5: {2, false, 9, 4}, 6: {2, false, 9, 4},
+	7: {2, true, 8, 0}, 8: {2, true, 8, 0},
+	9: {2, true, 13, 0}, 10: {2, true, 13, 0},
+	11: {2, true, 17, 0},
+}
+
+var (
+	aacScalefactorBook aacHuffman
+	aacSpectralBooks   [12]aacHuffman
+
+	// |q|^(4/3) of the quantized values up to the largest escape value
+	aacPow43 [8192]float64
+
+	// Rising halves of the sine and KBD windows, by window shape
+	aacLongWindows  [2][1024]float64
+	aacShortWindows [2][128]float64
+
+	aacLongIMDCT  = newAACIMDCT(2048)
+	aacShortIMDCT = newAACIMDCT(256)
+)
+
+func init() {
+	codes := make([]uint32, len(aacScalefactorCodes))
+	copy(codes, aacScalefactorCodes[:])
+	aacScalefactorBook = newAACHuffman(codes, aacScalefactorBits[:])
+	for i := range aacSpectralCodes {
+		codes = make([]uint32, len(aacSpectralCodes[i]))
+		for j, code := range aacSpectralCodes[i] {
+			codes[j] = uint32(code)
+		}
+		aacSpectralBooks[i+1] = newAACHuffman(codes, aacSpectralBits[i])
+	}
+
+	for i := range aacPow43 {
+		aacPow43[i] = math.Pow(float64(i), 4.0/3.0)
+	}
+
+	for n := range aacLongWindows[0] {
+		aacLongWindows[0][n] = math.Sin(math.Pi / 2048 * (float64(n) + 0.5))
+	}
+	for n := range aacShortWindows[0] {
+		aacShortWindows[0][n] = math.Sin(math.Pi / 256 * (float64(n) + 0.5))
+	}
+	kbdWindow(aacLongWindows[1][:], 4)
+	kbdWindow(aacShortWindows[1][:], 6)
+}
+
+// kbdWindow fills the rising half of a Kaiser-Bessel derived window.
+func kbdWindow(window []float64, alpha float64) {
+	half := len(window)
+	kaiser := make([]float64, half+1)
+	sum := 0.0
+	for j := range kaiser {
+		x := 2*float64(j)/float64(half) - 1
+		kaiser[j] = besselI0(math.Pi * alpha * math.Sqrt(1-x*x))
+		sum += kaiser[j]
+	}
+	acc := 0.0
+	for n := range window {
+		acc += kaiser[n]
+		window[n] = math.Sqrt(acc / sum)
+	}
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > sum*1e-12; k++ {
+		term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+		sum += term
+	}
+	return sum
+}
+
+// aacIMDCT is the inverse MDCT of one window length, computed with an FFT
+// of that length.
+type aacIMDCT struct {
+	size        int
+	pre, post   []complex128 // twiddles before and after the FFT
+	fft         []complex128 // FFT roots of unity
+	permutation []int        // bit reversal
+}
+
+func newAACIMDCT(size int) *aacIMDCT {
+	m := &aacIMDCT{
+		size:        size,
+		pre:         make([]complex128, size/2),
+		post:        make([]complex128, size),
+		fft:         make([]complex128, size/2),
+		permutation: make([]int, size),
+	}
+	theta := 2 * math.Pi / float64(size)
+	n0 := (float64(size)/2 + 1) / 2
+	for k := range m.pre {
+		m.pre[k] = complexExp(theta * n0 * float64(k))
+	}
+	for n := range m.post {
+		m.post[n] = complexExp(theta * (float64(n) + n0) / 2)
+	}
+	for k := range m.fft {
+		m.fft[k] = complexExp(theta * float64(k))
+	}
+	bits := 0
+	for 1<<bits < size {
+		bits++
+	}
+	for i := range m.permutation {
+		r := 0
+		for b := 0; b < bits; b++ {
+			r |= (i >> b & 1) << (bits - 1 - b)
+		}
+		m.permutation[i] = r
+	}
+	return m
+}
+
+func complexExp(x float64) complex128 {
+	return complex(math.Cos(x), math.Sin(x))
+}
+
+// transform computes out[n] = 2/N * sum X[k] cos(2pi/N (n + n0)(k + 1/2))
+// for the N/2 spectral values in and N output samples.
+func (m *aacIMDCT) transform(in, out []float64) {
+	z := make([]complex128, m.size)
+	for k, x := range in[:m.size/2] {
+		z[m.permutation[k]] = complex(x, 0) * m.pre[k]
+	}
+	for span := 1; span < m.size; span <<= 1 {
+		step := m.size / (2 * span)
+		for start := 0; start < m.size; start += 2 * span {
+			for j := 0; j < span; j++ {
+				t := m.fft[j*step] * z[start+j+span]
+				z[start+j+span] = z[start+j] - t
+				z[start+j] += t
+			}
+		}
+	}
+	scale := 2 / float64(m.size)
+	for n := range out[:m.size] {
+		out[n] = real(m.post[n]*z[n]) * scale
+	}
+}
+
+// aacICS is one individual channel stream of a raw data block.
+type aacICS struct {
+	windowSequence int
+	windowShape    int
+	maxSFB         int
+	groups         []int    // windows per window group
+	swb            []uint16 // band offsets of the window length
+	bandTypes      [8][64]int
+	scales         [8][64]float64 // gain, intensity or noise scale per band
+
+	pulses     [][2]int // position and amplitude
+	tns        [8][]aacTNSFilter
+	quantized  [1024]int
+	spectrum   [1024]float64
+	noiseBands [8][64]bool
+}
+
+type aacTNSFilter struct {
+	length, order int
+	backward      bool
+	lpc           [13]float64
+}
+
+// aacChannel is the state kept between frames for one output channel.
+type aacChannel struct {
+	overlap [1024]float64
+	shape   int
+}
+
+// aacDecoder decodes the AAC LC core of one stream to mono PCM.
+type aacDecoder struct {
+	config   AACConfig
+	channels [2]aacChannel
+	random   uint32
+	ics      [2]aacICS
+	pending  []int16 // decoded samples not yet resampled
+}
+
+// decode decodes the ADTS frames of a payload to 8 kHz samples. Frames
+// that cannot be decoded are skipped.
+func (d *aacDecoder) decode(payload []byte) []int16 {
+	for _, frame := range SplitADTS(payload) {
+		if frame.Config != d.config {
+			*d = aacDecoder{config: frame.Config, random: d.random}
+		}
+		b := &aacBits{data: frame.Data}
+		for i := 0; i < frame.Blocks; i++ {
+			samples, err := d.decodeBlock(b)
+			if err != nil {
+				break
+			}
+			d.pending = append(d.pending, samples...)
+			b.pos = (b.pos + 7) &^ 7
+			if frame.crc {
+				b.pos += 16
+			}
+		}
+	}
+	if d.config.SampleRate == 8000 {
+		out := d.pending
+		d.pending = nil
+		return out
+	}
+	// Samples short of a whole output sample wait for the next frame
+	out := resample(d.pending, d.config.SampleRate, 8000)
+	used := len(out) * d.config.SampleRate / 8000
+	d.pending = append([]int16(nil), d.pending[used:]...)
+	return out
+}
+
+// decodeBlock decodes one raw data block to mono samples at the stream
+// rate. Only the first single or pair of channels is output.
+func (d *aacDecoder) decodeBlock(b *aacBits) ([]int16, error) {
+	var out []int16
+	for {
+		element := b.read(3)
+		if b.overrun() {
+			return nil, errAACInvalid
+		}
+		switch element {
+		case aacElementSCE, aacElementLFE:
+			b.read(4) // element_instance_tag
+			ics := &d.ics[0]
+			if err := d.readICS(b, ics, false); err != nil {
+				return nil, err
+			}
+			if out != nil || element == aacElementLFE {
+				continue
+			}
+			d.dequantize(ics, nil, nil)
+			d.applyTNS(ics)
+			left := d.filterbank(ics, &d.channels[0])
+			out = make([]int16, len(left))
+			for i, v := range left {
+				out[i] = clampFloat(v)
+			}
+		case aacElementCPE:
+			samples, err := d.decodePair(b, out == nil)
+			if err != nil {
+				return nil, err
+			}
+			if out == nil {
+				out = samples
+			}
+		case aacElementCCE:
+			return nil, errAACUnsupported
+		case aacElementDSE:
+			b.read(4)
+			align := b.read(1) == 1
+			count := b.read(8)
+			if count == 255 {
+				count += b.read(8)
+			}
+			if align {
+				b.pos = (b.pos + 7) &^ 7
+			}
+			b.pos += 8 * count
+		case aacElementPCE:
+			skipProgramConfig(b)
+		case aacElementFIL:
+			count := b.read(4)
+			if count == 15 {
+				count += b.read(8) - 1
+			}
+			b.pos += 8 * count
+		case aacElementEND:
+			if out == nil {
+				return nil, errAACInvalid
+			}
+			return out, nil
+		}
+		if b.overrun() {
+			return nil, errAACInvalid
+		}
+	}
+}
+
+// decodePair decodes a channel pair element, mixed down to mono when
+// output is set.
+func (d *aacDecoder) decodePair(b *aacBits, output bool) ([]int16, error) {
+	b.read(4) // element_instance_tag
+	left, right := &d.ics[0], &d.ics[1]
+	commonWindow := b.read(1) == 1
+	var msUsed [8][64]bool
+	msPresent := 0
+	if commonWindow {
+		if err := d.readICSInfo(b, left); err != nil {
+			return nil, err
+		}
+		right.windowSequence, right.windowShape, right.maxSFB = left.windowSequence, left.windowShape, left.maxSFB
+		right.groups = append(right.groups[:0], left.groups...)
+		right.swb = left.swb
+		msPresent = b.read(2)
+		for g := range left.groups {
+			for sfb := 0; sfb < left.maxSFB; sfb++ {
+				switch msPresent {
+				case 1:
+					msUsed[g][sfb] = b.read(1) == 1
+				case 2:
+					msUsed[g][sfb] = true
+				}
+			}
+		}
+		if msPresent == 3 {
+			return nil, errAACInvalid
+		}
+	}
+	if err := d.readICS(b, left, commonWindow); err != nil {
+		return nil, err
+	}
+	if err := d.readICS(b, right, commonWindow); err != nil {
+		return nil, err
+	}
+	if !output {
+		return nil, nil
+	}
+
+	d.dequantize(left, nil, nil)
+	d.dequantize(right, left, &msUsed)
+	if commonWindow {
+		for g, window := 0, 0; g < len(left.groups); g++ {
+			for sfb := 0; sfb < left.maxSFB; sfb++ {
+				leftType, rightType := left.bandTypes[g][sfb], right.bandTypes[g][sfb]
+				for w := window; w < window+left.groups[g]; w++ {
+					start, end := w*128+int(left.swb[sfb]), w*128+int(left.swb[sfb+1])
+					switch {
+					case rightType == aacIntensityBand || rightType == aacIntensityBand2:
+						scale := right.scales[g][sfb]
+						if rightType == aacIntensityBand2 {
+							scale = -scale
+						}
+						if msUsed[g][sfb] {
+							scale = -scale
+						}
+						for i := start; i < end; i++ {
+							right.spectrum[i] = scale * left.spectrum[i]
+						}
+					case msUsed[g][sfb] && leftType != aacNoiseBand && rightType != aacNoiseBand:
+						for i := start; i < end; i++ {
+							m, s := left.spectrum[i], right.spectrum[i]
+							left.spectrum[i], right.spectrum[i] = m+s, m-s
+						}
+					}
+				}
+			}
+			window += left.groups[g]
+		}
+	}
+	d.applyTNS(left)
+	d.applyTNS(right)
+	l := d.filterbank(left, &d.channels[0])
+	r := d.filterbank(right, &d.channels[1])
+	out := make([]int16, len(l))
+	for i := range out {
+		out[i] = clampFloat((l[i] + r[i]) / 2)
+	}
+	return out, nil
+}
+
+// skipProgramConfig reads past a program config element.
+func skipProgramConfig(b *aacBits) {
+	b.read(10) // element_instance_tag, object_type, sampling_frequency_index
+	front, side, back := b.read(4), b.read(4), b.read(4)
+	lfe, assoc, cc := b.read(2), b.read(3), b.read(4)
+	for i := 0; i < 3; i++ { // mono, stereo and matrix mixdown
+		if b.read(1) == 1 {
+			b.read([]int{4, 4, 3}[i])
+		}
+	}
+	b.pos += 5*(front+side+back) + 4*(lfe+assoc) + 5*cc
+	b.pos = (b.pos + 7) &^ 7
+	b.pos += 8 * b.read(8)
+}
+
+func (d *aacDecoder) readICSInfo(b *aacBits, ics *aacICS) error {
+	b.read(1) // ics_reserved_bit
+	ics.windowSequence = b.read(2)
+	ics.windowShape = b.read(1)
+	ics.groups = append(ics.groups[:0], 1)
+	if ics.windowSequence == aacEightShort {
+		ics.maxSFB = b.read(4)
+		grouping := b.read(7)
+		for i := 6; i >= 0; i-- {
+			if grouping>>i&1 == 1 {
+				ics.groups[len(ics.groups)-1]++
+			} else {
+				ics.groups = append(ics.groups, 1)
+			}
+		}
+		ics.swb = aacSwbShort[d.config.FrequencyIndex]
+	} else {
+		ics.maxSFB = b.read(6)
+		if b.read(1) == 1 { // predictor_data_present
+			return errAACUnsupported
+		}
+		ics.swb = aacSwbLong[d.config.FrequencyIndex]
+	}
+	if ics.maxSFB >= len(ics.swb) {
+		return errAACInvalid
+	}
+	return nil
+}
+
+// readICS reads an individual channel stream up to its quantized values.
+func (d *aacDecoder) readICS(b *aacBits, ics *aacICS, commonWindow bool) error {
+	globalGain := b.read(8)
+	if !commonWindow {
+		if err := d.readICSInfo(b, ics); err != nil {
+			return err
+		}
+	}
+	if err := readSections(b, ics); err != nil {
+		return err
+	}
+	if err := readScalefactors(b, ics, globalGain); err != nil {
+		return err
+	}
+
+	ics.pulses = ics.pulses[:0]
+	if b.read(1) == 1 {
+		if ics.windowSequence == aacEightShort {
+			return errAACInvalid
+		}
+		count := b.read(2) + 1
+		start := b.read(6)
+		if start >= len(ics.swb) {
+			return errAACInvalid
+		}
+		position := int(ics.swb[start])
+		for i := 0; i < count; i++ {
+			position += b.read(5)
+			amplitude := b.read(4)
+			if position >= 1024 {
+				return errAACInvalid
+			}
+			ics.pulses = append(ics.pulses, [2]int{position, amplitude})
+		}
+	}
+	for w := range ics.tns {
+		ics.tns[w] = ics.tns[w][:0]
+	}
+	if b.read(1) == 1 {
+		if err := d.readTNS(b, ics); err != nil {
+			return err
+		}
+	}
+	if b.read(1) == 1 { // gain_control_data_present
+		return errAACUnsupported
+	}
+	return readSpectralData(b, ics)
+}
+
+func readSections(b *aacBits, ics *aacICS) error {
+	bits := 5
+	if ics.windowSequence == aacEightShort {
+		bits = 3
+	}
+	escape := 1<<bits - 1
+	for g := range ics.groups {
+		for sfb := 0; sfb < ics.maxSFB; {
+			bandType := b.read(4)
+			if bandType == 12 {
+				return errAACInvalid
+			}
+			length := 0
+			for {
+				n := b.read(bits)
+				length += n
+				if n != escape {
+					break
+				}
+				if b.overrun() {
+					return errAACInvalid
+				}
+			}
+			if b.overrun() || length == 0 || sfb+length > ics.maxSFB {
+				return errAACInvalid
+			}
+			for ; length > 0; length-- {
+				ics.bandTypes[g][sfb] = bandType
+				sfb++
+			}
+		}
+	}
+	return nil
+}
+
+// readScalefactors reads the scale factors and turns them into the gain
+// of each band, the intensity scale of intensity bands and the energy of
+// noise bands.
+func readScalefactors(b *aacBits, ics *aacICS, globalGain int) error {
+	gain, position, noise := globalGain, 0, globalGain-90
+	firstNoise := true
+	for g := range ics.groups {
+		for sfb := 0; sfb < ics.maxSFB; sfb++ {
+			switch ics.bandTypes[g][sfb] {
+			case aacZeroBand:
+				ics.scales[g][sfb] = 0
+			case aacIntensityBand, aacIntensityBand2:
+				delta := aacScalefactorBook.decode(b)
+				if delta < 0 {
+					return errAACInvalid
+				}
+				position += delta - 60
+				ics.scales[g][sfb] = math.Pow(0.5, 0.25*float64(position))
+			case aacNoiseBand:
+				if firstNoise {
+					noise += b.read(9) - 256
+					firstNoise = false
+				} else {
+					delta := aacScalefactorBook.decode(b)
+					if delta < 0 {
+						return errAACInvalid
+					}
+					noise += delta - 60
+				}
+				ics.scales[g][sfb] = math.Pow(2, 0.25*float64(noise))
+			default:
+				delta := aacScalefactorBook.decode(b)
+				if delta < 0 {
+					return errAACInvalid
+				}
+				gain += delta - 60
+				if gain < 0 || gain > 255 {
+					return errAACInvalid
+				}
+				ics.scales[g][sfb] = math.Pow(2, 0.25*float64(gain-100))
+			}
+		}
+	}
+	return nil
+}
+
+func (d *aacDecoder) readTNS(b *aacBits, ics *aacICS) error {
+	windows, filterBits, lengthBits, orderBits, maxOrder := 1, 2, 6, 5, 12
+	if ics.windowSequence == aacEightShort {
+		windows, filterBits, lengthBits, orderBits, maxOrder = 8, 1, 4, 3, 7
+	}
+	for w := 0; w < windows; w++ {
+		filters := b.read(filterBits)
+		resolution := 0
+		if filters > 0 {
+			resolution = b.read(1) + 3
+		}
+		for f := 0; f < filters; f++ {
+			filter := aacTNSFilter{length: b.read(lengthBits), order: b.read(orderBits)}
+			if filter.order > maxOrder {
+				return errAACInvalid
+			}
+			if filter.order > 0 {
+				filter.backward = b.read(1) == 1
+				coefBits := resolution - b.read(1)
+				half := float64(int(1) << (resolution - 1))
+				var reflection [12]float64
+				for i := 0; i < filter.order; i++ {
+					c := b.read(coefBits)
+					if c >= 1<<(coefBits-1) {
+						c -= 1 << coefBits
+					}
+					if c >= 0 {
+						reflection[i] = math.Sin(float64(c) / ((half - 0.5) / (math.Pi / 2)))
+					} else {
+						reflection[i] = math.Sin(float64(c) / ((half + 0.5) / (math.Pi / 2)))
+					}
+				}
+				// Reflection to LPC coefficients
+				filter.lpc[0] = 1
+				for m := 1; m <= filter.order; m++ {
+					var next [13]float64
+					for i := 1; i < m; i++ {
+						next[i] = filter.lpc[i] + reflection[m-1]*filter.lpc[m-i]
+					}
+					copy(filter.lpc[1:m], next[1:m])
+					filter.lpc[m] = reflection[m-1]
+				}
+			}
+			ics.tns[w] = append(ics.tns[w], filter)
+		}
+	}
+	return nil
+}
+
+func readSpectralData(b *aacBits, ics *aacICS) error {
+	ics.quantized = [1024]int{}
+	var values [4]int
+	window := 0
+	for g, length := range ics.groups {
+		for sfb := 0; sfb < ics.maxSFB; sfb++ {
+			bandType := ics.bandTypes[g][sfb]
+			if bandType == aacZeroBand || bandType >= aacNoiseBand {
+				continue
+			}
+			book, huffman := aacBooks[bandType], aacSpectralBooks[bandType]
+			for w := window; w < window+length; w++ {
+				for k := w*128 + int(ics.swb[sfb]); k < w*128+int(ics.swb[sfb+1]); k += book.dimension {
+					symbol := huffman.decode(b)
+					if symbol < 0 {
+						return errAACInvalid
+					}
+					for i := book.dimension - 1; i >= 0; i-- {
+						values[i] = symbol%book.modulus - book.offset
+						symbol /= book.modulus
+					}
+					if book.unsigned {
+						for i := 0; i < book.dimension; i++ {
+							if values[i] != 0 && b.read(1) == 1 {
+								values[i] = -values[i]
+							}
+						}
+					}
+					if bandType == 11 {
+						for i := 0; i < 2; i++ {
+							if values[i] != 16 && values[i] != -16 {
+								continue
+							}
+							n := 4
+							for b.read(1) == 1 {
+								if n++; n > 12 {
+									return errAACInvalid
+								}
+							}
+							escaped := 1<<n | b.read(n)
+							if values[i] < 0 {
+								escaped = -escaped
+							}
+							values[i] = escaped
+						}
+					}
+					copy(ics.quantized[k:k+book.dimension], values[:book.dimension])
+				}
+			}
+		}
+		window += length
+	}
+	if b.overrun() {
+		return errAACInvalid
+	}
+	for _, pulse := range ics.pulses {
+		if ics.quantized[pulse[0]] > 0 {
+			ics.quantized[pulse[0]] += pulse[1]
+		} else {
+			ics.quantized[pulse[0]] -= pulse[1]
+		}
+	}
+	return nil
+}
+
+// dequantize scales the quantized values of a channel and fills its noise
+// bands. For the right channel of a pair, noise bands that use M/S stereo
+// reuse the noise of the left channel.
+func (d *aacDecoder) dequantize(ics, left *aacICS, msUsed *[8][64]bool) {
+	ics.spectrum = [1024]float64{}
+	window := 0
+	for g, length := range ics.groups {
+		for sfb := 0; sfb < ics.maxSFB; sfb++ {
+			bandType, scale := ics.bandTypes[g][sfb], ics.scales[g][sfb]
+			ics.noiseBands[g][sfb] = bandType == aacNoiseBand
+			for w := window; w < window+length; w++ {
+				start, end := w*128+int(ics.swb[sfb]), w*128+int(ics.swb[sfb+1])
+				switch {
+				case bandType == aacNoiseBand:
+					shared := left != nil && msUsed[g][sfb] && left.noiseBands[g][sfb]
+					energy := 0.0
+					for i := start; i < end; i++ {
+						if shared {
+							ics.spectrum[i] = left.spectrum[i]
+						} else {
+							d.random = d.random*1664525 + 1013904223
+							ics.spectrum[i] = float64(int32(d.random))
+						}
+						energy += ics.spectrum[i] * ics.spectrum[i]
+					}
+					if energy > 0 {
+						scale /= math.Sqrt(energy)
+					}
+					for i := start; i < end; i++ {
+						ics.spectrum[i] *= scale
+					}
+				case bandType > aacZeroBand && bandType < aacNoiseBand:
+					for i := start; i < end; i++ {
+						q := ics.quantized[i]
+						if q < 0 {
+							ics.spectrum[i] = -aacPow43[min(-q, len(aacPow43)-1)] * scale
+						} else {
+							ics.spectrum[i] = aacPow43[min(q, len(aacPow43)-1)] * scale
+						}
+					}
+				}
+			}
+		}
+		window += length
+	}
+}
+
+// applyTNS runs the temporal noise shaping filters of a channel over its
+// spectrum.
+func (d *aacDecoder) applyTNS(ics *aacICS) {
+	bands := len(ics.swb) - 1
+	maxBands := aacTNSMaxBandsLong[d.config.FrequencyIndex]
+	if ics.windowSequence == aacEightShort {
+		maxBands = aacTNSMaxBandsShort[d.config.FrequencyIndex]
+	}
+	maxBands = min(maxBands, ics.maxSFB)
+	for w, filters := range ics.tns {
+		bottom := bands
+		for _, filter := range filters {
+			top := bottom
+			bottom = max(top-filter.length, 0)
+			if filter.order == 0 {
+				continue
+			}
+			start, end := w*128+int(ics.swb[min(bottom, maxBands)]), w*128+int(ics.swb[min(top, maxBands)])
+			if end <= start {
+				continue
+			}
+			step, k := 1, start
+			if filter.backward {
+				step, k = -1, end-1
+			}
+			var history [12]float64
+			for n := 0; n < end-start; n, k = n+1, k+step {
+				y := ics.spectrum[k]
+				for i := 0; i < filter.order; i++ {
+					y -= filter.lpc[i+1] * history[i]
+				}
+				copy(history[1:filter.order], history[:filter.order-1])
+				history[0] = y
+				ics.spectrum[k] = y
+			}
+		}
+	}
+}
+
+// filterbank transforms a channel's spectrum to 1024 samples, windowing
+// and overlapping it with the previous frame.
+func (d *aacDecoder) filterbank(ics *aacICS, channel *aacChannel) []float64 {
+	var windowed, samples [2048]float64
+	long, short := &aacLongWindows[ics.windowShape], &aacShortWindows[ics.windowShape]
+	previousLong, previousShort := &aacLongWindows[channel.shape], &aacShortWindows[channel.shape]
+	if ics.windowSequence == aacEightShort {
+		var block [256]float64
+		for w := 0; w < 8; w++ {
+			aacShortIMDCT.transform(ics.spectrum[w*128:], block[:])
+			rising := short
+			if w == 0 {
+				rising = previousShort
+			}
+			for n := 0; n < 128; n++ {
+				windowed[448+w*128+n] += block[n] * rising[n]
+				windowed[448+w*128+128+n] += block[128+n] * short[127-n]
+			}
+		}
+	} else {
+		aacLongIMDCT.transform(ics.spectrum[:], samples[:])
+		for n := 0; n < 1024; n++ {
+			switch ics.windowSequence {
+			case aacLongStop:
+				switch {
+				case n >= 576:
+					windowed[n] = samples[n]
+				case n >= 448:
+					windowed[n] = samples[n] * previousShort[n-448]
+				}
+			default:
+				windowed[n] = samples[n] * previousLong[n]
+			}
+			switch ics.windowSequence {
+			case aacLongStart:
+				switch {
+				case n < 448:
+					windowed[1024+n] = samples[1024+n]
+				case n < 576:
+					windowed[1024+n] = samples[1024+n] * short[575-n]
+				}
+			default:
+				windowed[1024+n] = samples[1024+n] * long[1023-n]
+			}
+		}
+	}
+	out := make([]float64, 1024)
+	for n := range out {
+		out[n] = channel.overlap[n] + windowed[n]
+	}
+	copy(channel.overlap[:], windowed[1024:])
+	channel.shape = ics.windowShape
+	return out
+}
+
+func clampFloat(v float64) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(math.Round(v))
+}
@@ -0,0 +1,91 @@
+package audio
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The first two ADTS frames of a 44.1 kHz stereo AAC-LC stream (FFmpeg's
+// encoder): the first only carries an encoder tag and primes the overlap,
+// so the signal starts half way through the second.
+const aacGoldenADTS = "fff1508003dffcde02004c61766335382e35342e31303000424008c11838" +
+	"fff1508005dffc21426c9fdc02244997fd6f9e9f438db0cd03ec6ae7bbf55029df740850a15ff95f3d3e80003dbc"
+
+// aacGoldenSamples is every 8th sample of the second half of the second
+// frame, mixed down to mono, as Chrome decodes it.
+var aacGoldenSamples = []int16{
+	0, 0, 0, 0, 0, 0, 0, 0, 8, 98, 22, -58, 76, 221, 100, -70,
+	10, 75, -192, -409, -124, 196, -199, -1023, -1343, -1062, -734, -669, -568, -211, 72, -17,
+	-121, 265, 893, 974, 317, -312, -224, 276, 420, 79, -103, 224, 594, 514, 302, 557,
+	1061, 949, 22, -814, -772, -264, -240, -773, -1036, -670, -208, -239, -545, -567, -274, -54,
+}
+
+func TestSplitADTS(t *testing.T) {
+	payload, _ := hex.DecodeString(aacGoldenADTS)
+	frames := SplitADTS(payload)
+	if len(frames) != 2 {
+		t.Fatalf("%d frames, want 2", len(frames))
+	}
+	want := AACConfig{ObjectType: 2, FrequencyIndex: 4, SampleRate: 44100, Channels: 2}
+	for i, frame := range frames {
+		if frame.Config != want || frame.Blocks != 1 || frame.crc {
+			t.Errorf("frame %d: %+v, %d blocks, crc %v", i, frame.Config, frame.Blocks, frame.crc)
+		}
+	}
+	if len(frames[0].Data) != 23 || len(frames[1].Data) != 39 {
+		t.Errorf("frame data of %d and %d bytes, want 23 and 39", len(frames[0].Data), len(frames[1].Data))
+	}
+	if asc := hex.EncodeToString(want.ASC()); asc != "1210" {
+		t.Errorf("ASC %s, want 1210", asc)
+	}
+
+	if frames := SplitADTS(payload[:len(payload)-1]); len(frames) != 1 {
+		t.Errorf("%d frames of a truncated payload, want 1", len(frames))
+	}
+	if frames := SplitADTS(payload[1:]); frames != nil {
+		t.Errorf("%d frames of a payload without a header", len(frames))
+	}
+}
+
+func TestAACGoldenFrame(t *testing.T) {
+	payload, _ := hex.DecodeString(aacGoldenADTS)
+	frames := SplitADTS(payload)
+	d := &aacDecoder{config: frames[0].Config}
+	var samples []int16
+	for i, frame := range frames {
+		block, err := d.decodeBlock(&aacBits{data: frame.Data})
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if len(block) != 1024 {
+			t.Fatalf("frame %d: %d samples, want 1024", i, len(block))
+		}
+		samples = append(samples, block...)
+	}
+
+	for i, sample := range samples[:1024+512] {
+		if sample != 0 {
+			t.Fatalf("sample %d is %d before the signal starts", i, sample)
+		}
+	}
+	// Rounding may differ from Chrome's float output by one
+	for i, want := range aacGoldenSamples {
+		got := samples[1024+512+8*i]
+		if got < want-1 || got > want+1 {
+			t.Errorf("sample %d = %d, want %d", 512+8*i, got, want)
+		}
+	}
+}
+
+func TestAACDecodeResamples(t *testing.T) {
+	payload, _ := hex.DecodeString(aacGoldenADTS)
+	d := &aacDecoder{}
+	samples := d.decode(payload)
+	// 2048 samples at 44.1 kHz are 371.5 at 8 kHz; the rest waits
+	if len(samples) != 371 || len(d.pending) != 2048-371*44100/8000 {
+		t.Errorf("%d samples out, %d pending", len(samples), len(d.pending))
+	}
+	if d.config.SampleRate != 44100 {
+		t.Errorf("sample rate %d, want 44100", d.config.SampleRate)
+	}
+}
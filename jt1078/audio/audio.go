@@ -0,0 +1,726 @@
+// Package audio decodes the audio JT/T 1078 devices stream and encodes the
+// intercom audio sent back to them, for the video and twoway servers.
+package audio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"jt1078/proxyapi"
+)
+
+// JT/T 1078 audio payload types (table 12) this server decodes and encodes
+const (
+	G721        = 1 // G.726 at 32 kbit/s under its old name
+	G711A       = 6
+	G711U       = 7
+	G726        = 8
+	DVI4        = 12 // IMA ADPCM as in RFC 3551, 8 kHz
+	DVI416K     = 13 // the same at 16 kHz
+	S16BEStereo = 15
+	S16BEMono   = 16
+	LPCM        = 18 // 16-bit big endian
+	AAC         = 19
+	HEAAC       = 21
+	PCMVoice    = 22 // 16-bit little endian
+	PCMAudio    = 23 // 16-bit little endian
+	AACLC       = 24
+	ADPCMA      = 26 // IMA ADPCM in the Hisilicon layout
+)
+
+// Names of all table 12 audio payload types, for logs
+var audioCodecNames = map[int]string{
+	1: "G.721", 2: "G.722", 3: "G.723", 4: "G.728", 5: "G.729", 6: "G.711A", 7: "G.711U",
+	8: "G.726", 9: "G.729A", 10: "DVI4_3", 11: "DVI4_4", 12: "DVI4_8K", 13: "DVI4_16K",
+	14: "LPC", 15: "S16BE_STEREO", 16: "S16BE_MONO", 17: "MPEGAUDIO", 18: "LPCM",
+	19: "AAC", 20: "WMA9STD", 21: "HEAAC", 22: "PCM_VOICE", 23: "PCM_AUDIO",
+	24: "AACLC", 25: "MP3", 26: "ADPCMA", 27: "MP4AUDIO", 28: "AMR",
+}
+
+// audioAttributesTTL is how long the 0x1003 attributes of a device are
+// trusted before they are fetched again.
+const audioAttributesTTL = 5 * time.Minute
+
+var (
+	// Decoders of device audio, keyed by SIM/channel
+	audioStreamsMu sync.Mutex
+	audioStreams   = make(map[audioStreamKey]*audioDecoder)
+
+	// Formats devices send their audio in and encoders of the talk-back
+	// to them, keyed by SIM
+	talkbackMu       sync.Mutex
+	talkbackFormats  = make(map[string]Format)
+	talkbackEncoders = make(map[string]*audioEncoder)
+
+	// 0x1003 audio attributes from the proxy, keyed by SIM
+	audioAttributesMu    sync.Mutex
+	audioAttributesCache = make(map[string]*audioAttributesEntry)
+)
+
+type audioStreamKey struct {
+	sim     string
+	channel int
+}
+
+// Format is how a device codes its audio.
+type Format struct {
+	Codec      int  // table 12 payload type
+	G726Bits   int  // bits per sample of G.726 (2 to 5)
+	SampleRate int  // Hz; only PCM, DVI4_16K and AAC differ from 8000
+	Hisilicon  bool // frames start with the Hisilicon 4-byte header
+}
+
+func (f Format) String() string {
+	name, ok := audioCodecNames[f.Codec]
+	if !ok {
+		name = fmt.Sprintf("payload type %d", f.Codec)
+	}
+	switch {
+	case f.Codec == G726 && f.G726Bits > 0:
+		name += fmt.Sprintf(" %d kbit/s", f.G726Bits*8)
+	case f.SampleRate != 8000:
+		name += fmt.Sprintf(" %d Hz", f.SampleRate)
+	}
+	if f.Hisilicon {
+		name += " with Hisilicon header"
+	}
+	if !audioCodecSupported(f.Codec) && !AACCodec(f.Codec) {
+		name += " (not decoded)"
+	}
+	return name
+}
+
+// audioCodecSupported reports the payload types that are decoded and
+// encoded. AAC is decoded but not encoded, so talk-back to AAC devices
+// stays G.711A.
+func audioCodecSupported(codec int) bool {
+	switch codec {
+	case G721, G711A, G711U, G726, DVI4, DVI416K,
+		S16BEStereo, S16BEMono, LPCM, PCMVoice, PCMAudio, ADPCMA:
+		return true
+	}
+	return false
+}
+
+// AACCodec reports the AAC payload types, sent as ADTS frames.
+func AACCodec(codec int) bool {
+	return codec == AAC || codec == HEAAC || codec == AACLC
+}
+
+// audioCodecPCM reports the uncompressed payload types, the only ones
+// whose sample rate follows the 0x1003 attributes.
+func audioCodecPCM(codec int) bool {
+	switch codec {
+	case S16BEStereo, S16BEMono, LPCM, PCMVoice, PCMAudio:
+		return true
+	}
+	return false
+}
+
+// audioAttributes are the 0x1003 attributes the proxy reports of a device.
+type audioAttributes struct {
+	Codec      int `json:"audio_codec"`
+	Channels   int `json:"audio_channels"`
+	SampleRate int `json:"sample_rate"`
+}
+
+type audioAttributesEntry struct {
+	attrs   audioAttributes
+	found   bool
+	fetched time.Time
+}
+
+// deviceAudioAttributes returns the cached 0x1003 attributes of a device.
+// Missing or stale entries are fetched in the background, so the first
+// frames of a stream go by their payload type alone.
+func deviceAudioAttributes(sim string) (audioAttributes, bool) {
+	audioAttributesMu.Lock()
+	defer audioAttributesMu.Unlock()
+	entry := audioAttributesCache[sim]
+	if entry == nil {
+		entry = &audioAttributesEntry{}
+		audioAttributesCache[sim] = entry
+	}
+	if time.Since(entry.fetched) > audioAttributesTTL {
+		entry.fetched = time.Now()
+		go fetchAudioAttributes(sim)
+	}
+	return entry.attrs, entry.found
+}
+
+func fetchAudioAttributes(sim string) {
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/jt808/capabilities/%s", proxyapi.BaseURL, sim))
+	if err != nil {
+		log.Printf("Error fetching audio attributes of %s: %v", sim, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	var attrs audioAttributes
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return
+	}
+
+	audioAttributesMu.Lock()
+	defer audioAttributesMu.Unlock()
+	if entry := audioAttributesCache[sim]; entry != nil {
+		entry.attrs = attrs
+		entry.found = true
+	}
+}
+
+// detectAudioFormat reads the format of a device audio payload: the codec
+// from the payload type, or from the device's 0x1003 attributes when the
+// type is not an audio codec (some terminals send 0 or a video type).
+func detectAudioFormat(sim string, payloadType byte, payload []byte) Format {
+	format := Format{
+		Codec:      int(payloadType & 0x7F),
+		SampleRate: 8000,
+		Hisilicon:  hasHisiliconHeader(payload),
+	}
+	attrs, found := deviceAudioAttributes(sim)
+	if _, ok := audioCodecNames[format.Codec]; !ok {
+		format.Codec = G711A
+		if found {
+			if _, ok := audioCodecNames[attrs.Codec]; ok {
+				format.Codec = attrs.Codec
+			}
+		}
+	}
+
+	if format.Codec == DVI416K {
+		format.SampleRate = 16000
+	} else if audioCodecPCM(format.Codec) && found && attrs.Codec == format.Codec && attrs.SampleRate > 0 {
+		format.SampleRate = attrs.SampleRate
+	}
+	return format
+}
+
+// hasHisiliconHeader detects the 4-byte header (00 01, length in 16-bit
+// words, 00) some terminals put in front of each audio frame.
+func hasHisiliconHeader(payload []byte) bool {
+	return len(payload) > 4 && payload[0] == 0x00 && payload[1] == 0x01 && payload[3] == 0x00 &&
+		int(payload[2])*2 == len(payload)-4
+}
+
+// StripHisiliconHeader removes the Hisilicon header of an audio frame.
+func StripHisiliconHeader(payload []byte) []byte {
+	if hasHisiliconHeader(payload) {
+		return payload[4:]
+	}
+	return payload
+}
+
+// addHisiliconHeader puts the Hisilicon header in front of a frame; frames
+// its one-byte word count cannot describe are left as they are.
+func addHisiliconHeader(payload []byte) []byte {
+	if len(payload)%2 != 0 || len(payload) > 2*0xFF {
+		return payload
+	}
+	return append([]byte{0x00, 0x01, byte(len(payload) / 2), 0x00}, payload...)
+}
+
+// Decode decodes a device audio payload to 8 kHz samples, keeping
+// codec state per SIM/channel. Codecs that are not decoded give nil.
+func Decode(sim string, channel int, payloadType byte, payload []byte) ([]int16, Format) {
+	format := detectAudioFormat(sim, payloadType, payload)
+	payload = StripHisiliconHeader(payload)
+
+	audioStreamsMu.Lock()
+	key := audioStreamKey{sim, channel}
+	decoder := audioStreams[key]
+	if decoder == nil || decoder.format.Codec != format.Codec || decoder.format.SampleRate != format.SampleRate {
+		decoder = &audioDecoder{}
+		audioStreams[key] = decoder
+	}
+	decoder.format = format
+	samples := decoder.decode(payload)
+	if decoder.g726 != nil {
+		format.G726Bits = decoder.g726.bits
+	}
+	if decoder.aac != nil && decoder.aac.config.SampleRate > 0 {
+		format.SampleRate = decoder.aac.config.SampleRate
+	}
+	changed := decoder.logged != format
+	decoder.logged = format
+	audioStreamsMu.Unlock()
+
+	if changed {
+		log.Printf("Audio from %s channel %d: %s", sim, channel, format)
+	}
+
+	talkbackMu.Lock()
+	talkbackFormats[sim] = format
+	talkbackMu.Unlock()
+	return samples, format
+}
+
+// Forget drops the decoder of a stream whose connection closed.
+func Forget(sim string, channel int) {
+	audioStreamsMu.Lock()
+	delete(audioStreams, audioStreamKey{sim, channel})
+	audioStreamsMu.Unlock()
+}
+
+// talkbackFormat is the format to send a device's intercom audio in: the
+// one it streams in, else its 0x1003 codec, else G.711A.
+func talkbackFormat(sim string) Format {
+	talkbackMu.Lock()
+	format, ok := talkbackFormats[sim]
+	talkbackMu.Unlock()
+	if ok {
+		return format
+	}
+	format = Format{Codec: G711A, SampleRate: 8000}
+	if attrs, found := deviceAudioAttributes(sim); found && audioCodecSupported(attrs.Codec) {
+		format.Codec = attrs.Codec
+		if audioCodecPCM(attrs.Codec) && attrs.SampleRate > 0 {
+			format.SampleRate = attrs.SampleRate
+		}
+	}
+	if format.Codec == DVI416K {
+		format.SampleRate = 16000
+	}
+	return format
+}
+
+// TranscodeTalkback converts a G.711A audio frame from the browser to the
+// format of the device it addresses, keeping the encoder state per SIM.
+// Other frames, and frames for devices without a supported codec, are
+// returned unchanged.
+func TranscodeTalkback(frameData []byte) []byte {
+	if len(frameData) < 26 || frameData[15]>>4 != 3 || frameData[5]&0x7F != G711A {
+		return frameData
+	}
+	length := int(binary.BigEndian.Uint16(frameData[24:26]))
+	if len(frameData) < 26+length {
+		return frameData
+	}
+	sim := decodeBCD(frameData[8:14])
+	format := talkbackFormat(sim)
+	if format.Codec == G711A && !format.Hisilicon || !audioCodecSupported(format.Codec) {
+		return frameData
+	}
+
+	alaw := frameData[26 : 26+length]
+	var payload []byte
+	if format.Codec == G711A {
+		payload = addHisiliconHeader(alaw)
+	} else {
+		talkbackMu.Lock()
+		encoder := talkbackEncoders[sim]
+		if encoder == nil || encoder.format != format {
+			encoder = &audioEncoder{format: format}
+			talkbackEncoders[sim] = encoder
+		}
+		payload = encoder.encode(DecodeALaw(alaw))
+		talkbackMu.Unlock()
+	}
+
+	out := make([]byte, 26, 26+len(payload))
+	copy(out, frameData[:24])
+	out[5] = frameData[5]&0x80 | byte(format.Codec)
+	binary.BigEndian.PutUint16(out[24:26], uint16(len(payload)))
+	return append(out, payload...)
+}
+
+// audioDecoder decodes the audio of one device stream.
+type audioDecoder struct {
+	format Format
+	logged Format // last format logged
+	g726   *g726State
+	aac    *aacDecoder
+}
+
+func (d *audioDecoder) decode(payload []byte) []int16 {
+	var samples []int16
+	switch d.format.Codec {
+	case G711A:
+		samples = DecodeALaw(payload)
+	case G711U:
+		samples = decodeULaw(payload)
+	case G721, G726:
+		bits := 4
+		if d.format.Codec == G726 {
+			bits = g726Bits(len(payload))
+		}
+		if d.g726 == nil || d.g726.bits != bits {
+			d.g726 = newG726State(bits)
+		}
+		samples = d.g726.decodeFrame(payload)
+	case ADPCMA:
+		samples = decodeADPCM(payload, false)
+	case DVI4, DVI416K:
+		samples = decodeADPCM(payload, true)
+	case S16BEStereo:
+		samples = decodePCM16(payload, binary.BigEndian, 2)
+	case S16BEMono, LPCM:
+		samples = decodePCM16(payload, binary.BigEndian, 1)
+	case PCMVoice, PCMAudio:
+		samples = decodePCM16(payload, binary.LittleEndian, 1)
+	case AAC, HEAAC, AACLC:
+		// Resampled by the AAC decoder, at the rate of its ADTS headers
+		if d.aac == nil {
+			d.aac = &aacDecoder{}
+		}
+		return d.aac.decode(payload)
+	default:
+		return nil
+	}
+	return resample(samples, d.format.SampleRate, 8000)
+}
+
+// audioEncoder encodes 8 kHz samples for one device.
+type audioEncoder struct {
+	format Format
+	g726   *g726State
+	adpcm  adpcmState
+}
+
+func (e *audioEncoder) encode(samples []int16) []byte {
+	samples = resample(samples, 8000, e.format.SampleRate)
+	var payload []byte
+	switch e.format.Codec {
+	case G711A:
+		payload = EncodeALaw(samples)
+	case G711U:
+		payload = encodeULaw(samples)
+	case G721, G726:
+		if e.g726 == nil {
+			bits := e.format.G726Bits
+			if e.format.Codec == G721 {
+				bits = 4
+			} else if bits == 0 {
+				bits = g726Bits(0)
+			}
+			e.g726 = newG726State(bits)
+		}
+		payload = e.g726.encodeFrame(samples)
+	case ADPCMA:
+		payload = e.adpcm.encodeFrame(samples, false)
+	case DVI4, DVI416K:
+		payload = e.adpcm.encodeFrame(samples, true)
+	case S16BEStereo:
+		payload = encodePCM16(samples, binary.BigEndian, 2)
+	case S16BEMono, LPCM:
+		payload = encodePCM16(samples, binary.BigEndian, 1)
+	case PCMVoice, PCMAudio:
+		payload = encodePCM16(samples, binary.LittleEndian, 1)
+	default:
+		return nil
+	}
+	if e.format.Hisilicon {
+		payload = addHisiliconHeader(payload)
+	}
+	return payload
+}
+
+// decodeBCD reads the SIM number of a JT1078 header.
+func decodeBCD(data []byte) string {
+	digits := make([]byte, 0, 2*len(data))
+	for _, b := range data {
+		if b>>4 <= 9 {
+			digits = append(digits, '0'+b>>4)
+		}
+		if b&0x0F <= 9 {
+			digits = append(digits, '0'+b&0x0F)
+		}
+	}
+	return string(digits)
+}
+
+func clampSample(v int) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
+
+// alawTable is the G.711A expansion the browser client's encoder matches.
+var alawTable [256]int16
+
+func init() {
+	for i := range alawTable {
+		a := byte(i) ^ 0x55
+		t := int(a&0x0F)<<4 + 8
+		seg := int(a&0x70) >> 4
+		if seg >= 1 {
+			t += 0x100
+		}
+		if seg > 1 {
+			t <<= seg - 1
+		}
+		if a&0x80 == 0 {
+			alawTable[i] = int16(t)
+		} else {
+			alawTable[i] = int16(-t)
+		}
+	}
+}
+
+// DecodeALaw expands G.711A with the table the browser client's encoder
+// matches.
+func DecodeALaw(data []byte) []int16 {
+	samples := make([]int16, len(data))
+	for i, b := range data {
+		samples[i] = alawTable[b]
+	}
+	return samples
+}
+
+// EncodeALaw compresses samples to G.711A as Sun's g711.c does, with the
+// sign bit of DecodeALaw and the browser client so a round trip keeps the
+// polarity.
+func EncodeALaw(samples []int16) []byte {
+	out := make([]byte, len(samples))
+	for i, sample := range samples {
+		pcm := int(sample) >> 3
+		mask := byte(0x55)
+		if pcm < 0 {
+			mask = 0xD5
+			pcm = -pcm - 1
+		}
+		seg := 0
+		for seg < 8 && pcm >= 0x20<<seg {
+			seg++
+		}
+		if seg >= 8 {
+			out[i] = 0x7F ^ mask
+			continue
+		}
+		aval := byte(seg << 4)
+		if seg < 2 {
+			aval |= byte(pcm>>1) & 0x0F
+		} else {
+			aval |= byte(pcm>>seg) & 0x0F
+		}
+		out[i] = aval ^ mask
+	}
+	return out
+}
+
+// decodeULaw expands G.711U.
+func decodeULaw(data []byte) []int16 {
+	samples := make([]int16, len(data))
+	for i, b := range data {
+		u := ^b
+		t := (int(u&0x0F)<<3 + 0x84) << ((u & 0x70) >> 4)
+		if u&0x80 != 0 {
+			samples[i] = int16(0x84 - t)
+		} else {
+			samples[i] = int16(t - 0x84)
+		}
+	}
+	return samples
+}
+
+// encodeULaw compresses samples to G.711U.
+func encodeULaw(samples []int16) []byte {
+	out := make([]byte, len(samples))
+	for i, sample := range samples {
+		pcm := int(sample) >> 2
+		mask := byte(0xFF)
+		if pcm < 0 {
+			pcm = -pcm
+			mask = 0x7F
+		}
+		if pcm > 8159 {
+			pcm = 8159
+		}
+		pcm += 0x84 >> 2
+		seg := 0
+		for seg < 8 && pcm >= 0x40<<seg {
+			seg++
+		}
+		if seg >= 8 {
+			out[i] = 0x7F ^ mask
+			continue
+		}
+		out[i] = (byte(seg<<4) | byte(pcm>>(seg+1))&0x0F) ^ mask
+	}
+	return out
+}
+
+// decodePCM16 reads 16-bit PCM, mixing stereo down to mono.
+func decodePCM16(data []byte, order binary.ByteOrder, channels int) []int16 {
+	frame := 2 * channels
+	samples := make([]int16, 0, len(data)/frame)
+	for i := 0; i+frame <= len(data); i += frame {
+		sum := 0
+		for c := 0; c < channels; c++ {
+			sum += int(int16(order.Uint16(data[i+2*c:])))
+		}
+		samples = append(samples, int16(sum/channels))
+	}
+	return samples
+}
+
+// encodePCM16 writes 16-bit PCM, repeating each sample on every channel.
+func encodePCM16(samples []int16, order binary.ByteOrder, channels int) []byte {
+	out := make([]byte, len(samples)*2*channels)
+	for i, sample := range samples {
+		for c := 0; c < channels; c++ {
+			order.PutUint16(out[(i*channels+c)*2:], uint16(sample))
+		}
+	}
+	return out
+}
+
+// resample converts between sample rates, averaging when going down and
+// interpolating when going up.
+func resample(samples []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(samples) == 0 {
+		return samples
+	}
+	out := make([]int16, len(samples)*to/from)
+	for i := range out {
+		if from > to {
+			start, end := i*from/to, (i+1)*from/to
+			sum := 0
+			for _, s := range samples[start:end] {
+				sum += int(s)
+			}
+			out[i] = int16(sum / (end - start))
+			continue
+		}
+		pos := i * from
+		j, frac := pos/to, pos%to
+		a, b := int(samples[j]), int(samples[j])
+		if j+1 < len(samples) {
+			b = int(samples[j+1])
+		}
+		out[i] = int16(a + (b-a)*frac/to)
+	}
+	return out
+}
+
+var imaIndexTable = [16]int{-1, -1, -1, -1, 2, 4, 6, 8, -1, -1, -1, -1, 2, 4, 6, 8}
+
+var imaStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118, 130, 143, 157, 173, 190, 209, 230,
+	253, 279, 307, 337, 371, 408, 449, 494, 544, 598, 658, 724, 796, 876, 963,
+	1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066, 2272, 2499, 2749, 3024, 3327,
+	3660, 4026, 4428, 4871, 5358, 5894, 6484, 7132, 7845, 8630, 9493, 10442,
+	11487, 12635, 13899, 15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794,
+	32767,
+}
+
+// adpcmState is the predictor of an IMA ADPCM stream.
+type adpcmState struct {
+	predictor int
+	index     int
+}
+
+// apply moves the predictor by a code word and returns the new sample.
+func (s *adpcmState) apply(code byte) int16 {
+	step := imaStepTable[s.index]
+	diff := step >> 3
+	if code&4 != 0 {
+		diff += step
+	}
+	if code&2 != 0 {
+		diff += step >> 1
+	}
+	if code&1 != 0 {
+		diff += step >> 2
+	}
+	if code&8 != 0 {
+		diff = -diff
+	}
+	sample := clampSample(s.predictor + diff)
+	s.predictor = int(sample)
+	s.index += imaIndexTable[code&0x0F]
+	if s.index < 0 {
+		s.index = 0
+	} else if s.index > 88 {
+		s.index = 88
+	}
+	return sample
+}
+
+// encode picks the code word closest to a sample.
+func (s *adpcmState) encode(sample int16) byte {
+	step := imaStepTable[s.index]
+	diff := int(sample) - s.predictor
+	var code byte
+	if diff < 0 {
+		code = 8
+		diff = -diff
+	}
+	for bit := byte(4); bit > 0; bit >>= 1 {
+		if diff >= step {
+			code |= bit
+			diff -= step
+		}
+		step >>= 1
+	}
+	s.apply(code)
+	return code
+}
+
+// decodeADPCM decodes a frame that starts with the predictor state (sample,
+// step index, reserved byte). The Hisilicon layout has a little endian
+// sample and the first code word in the low nibble; DVI4 (RFC 3551) a big
+// endian sample and the first code word in the high nibble.
+func decodeADPCM(data []byte, dvi4 bool) []int16 {
+	if len(data) < 4 {
+		return nil
+	}
+	var s adpcmState
+	if dvi4 {
+		s.predictor = int(int16(binary.BigEndian.Uint16(data)))
+	} else {
+		s.predictor = int(int16(binary.LittleEndian.Uint16(data)))
+	}
+	s.index = int(data[2])
+	if s.index > 88 {
+		s.index = 88
+	}
+
+	samples := make([]int16, 0, 2*(len(data)-4))
+	for _, b := range data[4:] {
+		first, second := b&0x0F, b>>4
+		if dvi4 {
+			first, second = second, first
+		}
+		samples = append(samples, s.apply(first), s.apply(second))
+	}
+	return samples
+}
+
+// encodeFrame encodes samples in the layout decodeADPCM reads, carrying
+// the predictor over from the previous frame.
+func (s *adpcmState) encodeFrame(samples []int16, dvi4 bool) []byte {
+	out := make([]byte, 4, 4+(len(samples)+1)/2)
+	if dvi4 {
+		binary.BigEndian.PutUint16(out, uint16(int16(s.predictor)))
+	} else {
+		binary.LittleEndian.PutUint16(out, uint16(int16(s.predictor)))
+	}
+	out[2] = byte(s.index)
+
+	for i := 0; i < len(samples); i += 2 {
+		first := s.encode(samples[i])
+		var second byte
+		if i+1 < len(samples) {
+			second = s.encode(samples[i+1])
+		}
+		if dvi4 {
+			out = append(out, first<<4|second)
+		} else {
+			out = append(out, second<<4|first)
+		}
+	}
+	return out
+}
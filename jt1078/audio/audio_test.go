@@ -0,0 +1,199 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// testSignal is a second of 8 kHz speech-band test audio: three tones and
+// a slow amplitude sweep.
+func testSignal() []int16 {
+	samples := make([]int16, 8000)
+	for i := range samples {
+		t := float64(i) / 8000
+		envelope := 0.3 + 0.7*math.Abs(math.Sin(math.Pi*t))
+		v := 0.5*math.Sin(2*math.Pi*440*t) + 0.3*math.Sin(2*math.Pi*1250*t) + 0.2*math.Sin(2*math.Pi*2900*t)
+		samples[i] = int16(12000 * envelope * v)
+	}
+	return samples
+}
+
+// snr is the signal to noise ratio in dB of decoded against the samples
+// they were encoded from, leaving out the first frames while adaptive
+// codecs settle.
+func snr(original, decoded []int16) float64 {
+	const settle = 800
+	var signal, noise float64
+	for i := settle; i < len(original) && i < len(decoded); i++ {
+		s, d := float64(original[i]), float64(decoded[i])
+		signal += s * s
+		noise += (s - d) * (s - d)
+	}
+	if noise == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// roundTrip encodes samples in 20 ms frames and decodes them again.
+func roundTrip(samples []int16, encode func([]int16) []byte, decode func([]byte) []int16) []int16 {
+	var decoded []int16
+	for i := 0; i < len(samples); i += 160 {
+		decoded = append(decoded, decode(encode(samples[i:min(i+160, len(samples))]))...)
+	}
+	return decoded
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func([]int16) []byte
+		decode func([]byte) []int16
+	}{
+		{"A-law", EncodeALaw, DecodeALaw},
+		{"μ-law", encodeULaw, decodeULaw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := testSignal()
+			decoded := roundTrip(samples, tt.encode, tt.decode)
+			if len(decoded) != len(samples) {
+				t.Fatalf("decoded %d samples of %d", len(decoded), len(samples))
+			}
+			if got := snr(samples, decoded); got < 30 {
+				t.Errorf("SNR %.1f dB, want at least 30", got)
+			}
+		})
+	}
+}
+
+func TestULawKnownValues(t *testing.T) {
+	tests := []struct {
+		sample int16
+		code   byte
+	}{
+		{0, 0xFF},
+		{-1, 0x7E},
+		{8, 0xFE},
+		{-8, 0x7E},
+		{32767, 0x80},
+		{-32768, 0x00},
+	}
+	for _, tt := range tests {
+		if got := encodeULaw([]int16{tt.sample})[0]; got != tt.code {
+			t.Errorf("encodeULaw(%d) = %#02x, want %#02x", tt.sample, got, tt.code)
+		}
+	}
+	for code := 0; code < 256; code++ {
+		sample := decodeULaw([]byte{byte(code)})[0]
+		if again := encodeULaw([]int16{sample})[0]; again != byte(code) && !(code == 0x7F && again == 0xFF) {
+			t.Errorf("code %#02x decodes to %d, which encodes to %#02x", code, sample, again)
+		}
+	}
+}
+
+func TestG726RoundTrip(t *testing.T) {
+	tests := []struct {
+		bits   int
+		minSNR float64
+	}{
+		{2, 10},
+		{3, 16},
+		{4, 22},
+		{5, 27},
+	}
+	for _, tt := range tests {
+		for _, aal2 := range []bool{false, true} {
+			name := map[bool]string{false: "RFC 3551", true: "AAL2"}[aal2]
+			t.Run(name, func(t *testing.T) {
+				defer func(order bool) { G726AAL2 = order }(G726AAL2)
+				G726AAL2 = aal2
+
+				encoder, decoder := newG726State(tt.bits), newG726State(tt.bits)
+				samples := testSignal()
+				decoded := roundTrip(samples, encoder.encodeFrame, decoder.decodeFrame)
+				if len(decoded) != len(samples) {
+					t.Fatalf("%d bits: decoded %d samples of %d", tt.bits, len(decoded), len(samples))
+				}
+				if got := snr(samples, decoded); got < tt.minSNR {
+					t.Errorf("%d bits: SNR %.1f dB, want at least %.0f", tt.bits, got, tt.minSNR)
+				}
+			})
+		}
+	}
+}
+
+func TestG726Bits(t *testing.T) {
+	tests := []struct {
+		frameLen int
+		bits     int
+	}{
+		{40, 2},  // 20 ms at 16 kbit/s
+		{60, 3},  // 20 ms at 24 kbit/s
+		{80, 4},  // 20 ms at 32 kbit/s
+		{100, 5}, // 20 ms at 40 kbit/s
+		{120, 3}, // 40 ms at 24 kbit/s
+		{30, 3},  // 10 ms at 24 kbit/s
+		{77, 4},  // no whole frame: the common rate
+	}
+	for _, tt := range tests {
+		if got := g726Bits(tt.frameLen); got != tt.bits {
+			t.Errorf("g726Bits(%d) = %d, want %d", tt.frameLen, got, tt.bits)
+		}
+	}
+}
+
+func TestADPCMRoundTrip(t *testing.T) {
+	for _, dvi4 := range []bool{false, true} {
+		name := map[bool]string{false: "Hisilicon", true: "DVI4"}[dvi4]
+		t.Run(name, func(t *testing.T) {
+			var encoder adpcmState
+			encode := func(samples []int16) []byte { return encoder.encodeFrame(samples, dvi4) }
+			decode := func(data []byte) []int16 { return decodeADPCM(data, dvi4) }
+			samples := testSignal()
+			decoded := roundTrip(samples, encode, decode)
+			if len(decoded) != len(samples) {
+				t.Fatalf("decoded %d samples of %d", len(decoded), len(samples))
+			}
+			if got := snr(samples, decoded); got < 18 {
+				t.Errorf("SNR %.1f dB, want at least 18", got)
+			}
+		})
+	}
+}
+
+// TestCodecRoundTrip runs every encoded format through the encoder and
+// decoder the servers use, resampling included.
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		format Format
+		minSNR float64
+	}{
+		{Format{Codec: G711A, SampleRate: 8000}, 30},
+		{Format{Codec: G711U, SampleRate: 8000}, 30},
+		{Format{Codec: G721, SampleRate: 8000}, 22},
+		{Format{Codec: G726, G726Bits: 2, SampleRate: 8000}, 10},
+		{Format{Codec: G726, G726Bits: 5, SampleRate: 8000}, 27},
+		{Format{Codec: DVI4, SampleRate: 8000}, 18},
+		{Format{Codec: DVI416K, SampleRate: 16000}, 12}, // resampling loses some of the 2.9 kHz tone
+		{Format{Codec: ADPCMA, SampleRate: 8000, Hisilicon: true}, 18},
+		{Format{Codec: S16BEStereo, SampleRate: 8000}, 90},
+		{Format{Codec: LPCM, SampleRate: 8000}, 90},
+		{Format{Codec: PCMVoice, SampleRate: 16000}, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			encoder := &audioEncoder{format: tt.format}
+			decoder := &audioDecoder{format: tt.format}
+			decode := func(payload []byte) []int16 { return decoder.decode(StripHisiliconHeader(payload)) }
+			samples := testSignal()
+			decoded := roundTrip(samples, encoder.encode, decode)
+			if len(decoded) != len(samples) {
+				t.Fatalf("decoded %d samples of %d", len(decoded), len(samples))
+			}
+			if got := snr(samples, decoded); got < tt.minSNR {
+				t.Errorf("SNR %.1f dB, want at least %.0f", got, tt.minSNR)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package audio
+
+// G.726 ADPCM at 16, 24, 32 and 40 kbit/s (2 to 5 bits per sample at
+// 8 kHz), after the ITU-T reference algorithm as published in Sun's g72x
+// sources. Code words are packed as in RFC 3551 (first sample in the least
+// significant bits) unless G726AAL2 selects the ITU-T I.366.2 order.
+
+var (
+	// Forced G.726 rate in kbit/s (0 = infer from the frame length)
+	G726Kbps int
+
+	// Pack G.726 code words most significant first (AAL2, I.366.2)
+	G726AAL2 bool
+)
+
+var g726Power2 = [15]int{1, 2, 4, 8, 0x10, 0x20, 0x40, 0x80, 0x100, 0x200, 0x400, 0x800, 0x1000, 0x2000, 0x4000}
+
+// g726Tables are the quantizer and adaptation tables of one rate.
+type g726Tables struct {
+	qtab   []int // decision levels
+	dqln   []int // log of the reconstructed difference per code
+	wi     []int // scale factor multipliers
+	fi     []int // transition detector inputs
+	signal int   // sign bit of a code word
+}
+
+var g726RateTables = map[int]*g726Tables{
+	2: {
+		qtab:   []int{261},
+		dqln:   []int{116, 365, 365, 116},
+		wi:     []int{-704, 14048, 14048, -704},
+		fi:     []int{0, 0xE00, 0xE00, 0},
+		signal: 2,
+	},
+	3: {
+		qtab:   []int{8, 218, 331},
+		dqln:   []int{-2048, 135, 273, 373, 373, 273, 135, -2048},
+		wi:     []int{-128, 960, 4384, 18624, 18624, 4384, 960, -128},
+		fi:     []int{0, 0x200, 0x400, 0xE00, 0xE00, 0x400, 0x200, 0},
+		signal: 4,
+	},
+	4: {
+		qtab:   []int{-124, 80, 178, 246, 300, 349, 400},
+		dqln:   []int{-2048, 4, 135, 213, 273, 323, 373, 425, 425, 373, 323, 273, 213, 135, 4, -2048},
+		wi:     []int{-12 << 5, 18 << 5, 41 << 5, 64 << 5, 112 << 5, 198 << 5, 355 << 5, 1122 << 5, 1122 << 5, 355 << 5, 198 << 5, 112 << 5, 64 << 5, 41 << 5, 18 << 5, -12 << 5},
+		fi:     []int{0, 0, 0, 0x200, 0x200, 0x200, 0x600, 0xE00, 0xE00, 0x600, 0x200, 0x200, 0x200, 0, 0, 0},
+		signal: 8,
+	},
+	5: {
+		qtab: []int{-122, -16, 68, 139, 198, 250, 298, 339, 378, 413, 445, 475, 502, 528, 553},
+		dqln: []int{-2048, -66, 28, 104, 169, 224, 274, 318, 358, 395, 429, 459, 488, 514, 539, 566,
+			566, 539, 514, 488, 459, 429, 395, 358, 318, 274, 224, 169, 104, 28, -66, -2048},
+		wi: []int{448, 448, 768, 1248, 1280, 1312, 1856, 3200, 4512, 5728, 7008, 8960, 11456, 14080, 16928, 22272,
+			22272, 16928, 14080, 11456, 8960, 7008, 5728, 4512, 3200, 1856, 1312, 1280, 1248, 768, 448, 448},
+		fi: []int{0, 0, 0, 0, 0, 0x200, 0x200, 0x200, 0x200, 0x200, 0x400, 0x600, 0x800, 0xA00, 0xC00, 0xC00,
+			0xC00, 0xC00, 0xA00, 0x800, 0x600, 0x400, 0x200, 0x200, 0x200, 0x200, 0x200, 0, 0, 0, 0, 0},
+		signal: 0x10,
+	},
+}
+
+// g726State is the adaptive state of one direction of a G.726 stream.
+// Fields the reference keeps as 16-bit values wrap the same way here.
+type g726State struct {
+	bits   int
+	tables *g726Tables
+
+	yl  int    // locked quantizer scale factor
+	yu  int    // unlocked quantizer scale factor
+	dms int    // short term average of F(I)
+	dml int    // long term average of F(I)
+	ap  int    // linear weighting coefficient of yl and yu
+	a   [2]int // pole predictor coefficients
+	b   [6]int // zero predictor coefficients
+	pk  [2]int // signs of previous dq+sez
+	dq  [6]int // previous quantized differences, floating point format
+	sr  [2]int // previous reconstructed signals, floating point format
+	td  int    // tone detect
+}
+
+// newG726State starts a codec of 2 to 5 bits per sample.
+func newG726State(bits int) *g726State {
+	tables, ok := g726RateTables[bits]
+	if !ok {
+		bits, tables = 4, g726RateTables[4]
+	}
+	s := &g726State{bits: bits, tables: tables, yl: 34816, yu: 544}
+	for i := range s.sr {
+		s.sr[i] = 32
+	}
+	for i := range s.dq {
+		s.dq[i] = 32
+	}
+	return s
+}
+
+func int16Wrap(v int) int { return int(int16(v)) }
+
+func g726Quan(val int, table []int) int {
+	i := 0
+	for i < len(table) && val >= table[i] {
+		i++
+	}
+	return i
+}
+
+// g726FMult multiplies a predictor coefficient with a floating point value.
+func g726FMult(an, srn int) int {
+	anmag := an
+	if an <= 0 {
+		anmag = -an & 0x1FFF
+	}
+	anexp := g726Quan(anmag, g726Power2[:]) - 6
+	anmant := 32
+	if anmag != 0 {
+		if anexp >= 0 {
+			anmant = anmag >> anexp
+		} else {
+			anmant = anmag << -anexp
+		}
+	}
+	wanexp := anexp + (srn>>6)&0xF - 13
+	wanmant := (anmant*(srn&0x3F) + 0x30) >> 4
+	var retval int
+	if wanexp >= 0 {
+		retval = (wanmant << wanexp) & 0x7FFF
+	} else {
+		retval = wanmant >> -wanexp
+	}
+	if an^srn < 0 {
+		return -retval
+	}
+	return retval
+}
+
+func (s *g726State) predictorZero() int {
+	sezi := 0
+	for i := range s.b {
+		sezi += g726FMult(s.b[i]>>2, s.dq[i])
+	}
+	return sezi
+}
+
+func (s *g726State) predictorPole() int {
+	return g726FMult(s.a[1]>>2, s.sr[1]) + g726FMult(s.a[0]>>2, s.sr[0])
+}
+
+func (s *g726State) stepSize() int {
+	if s.ap >= 256 {
+		return s.yu
+	}
+	y := s.yl >> 6
+	dif := s.yu - y
+	al := s.ap >> 2
+	if dif > 0 {
+		y += (dif * al) >> 6
+	} else if dif < 0 {
+		y += (dif*al + 0x3F) >> 6
+	}
+	return y
+}
+
+// quantize maps a prediction difference to a code word.
+func (s *g726State) quantize(d, y int) int {
+	dqm := d
+	if dqm < 0 {
+		dqm = -dqm
+	}
+	exp := g726Quan(dqm>>1, g726Power2[:])
+	mant := ((dqm << 7) >> exp) & 0x7F
+	dl := (exp << 7) + mant
+	dln := int16Wrap(dl - (y >> 2))
+
+	size := len(s.tables.qtab)
+	i := g726Quan(dln, s.tables.qtab)
+	switch {
+	case d < 0:
+		i = (size << 1) + 1 - i
+	case i == 0:
+		i = (size << 1) + 1
+	}
+	// 16 kbit/s has no code for a small positive difference in the
+	// quantizer above; it is code 0
+	if s.bits == 2 && i == 3 && d >= 0 {
+		i = 0
+	}
+	return i
+}
+
+// reconstruct returns the quantized difference in sign-magnitude form.
+func (s *g726State) reconstruct(sign bool, dqln, y int) int {
+	dql := dqln + (y >> 2)
+	if dql < 0 {
+		if sign {
+			return -0x8000
+		}
+		return 0
+	}
+	dex := (dql >> 7) & 15
+	dqt := 128 + (dql & 127)
+	dq := (dqt << 7) >> (14 - dex)
+	if sign {
+		return dq - 0x8000
+	}
+	return dq
+}
+
+// g726Float converts a magnitude and sign to the 4-bit exponent, 6-bit
+// mantissa format of the predictor history.
+func g726Float(mag int, negative bool) int {
+	exp := g726Quan(mag, g726Power2[:])
+	v := (exp << 6) + ((mag << 6) >> exp)
+	if negative {
+		v -= 0x400
+	}
+	return int16Wrap(v)
+}
+
+// update adapts the state after a code word (the reference's update()).
+func (s *g726State) update(y, wi, fi, dq, sr, dqsez int) {
+	pk0 := 0
+	if dqsez < 0 {
+		pk0 = 1
+	}
+	mag := dq & 0x7FFF
+
+	// Transition detector
+	ylint := s.yl >> 15
+	ylfrac := (s.yl >> 10) & 0x1F
+	thr1 := (32 + ylfrac) << ylint
+	thr2 := thr1
+	if ylint > 9 {
+		thr2 = 31 << 10
+	}
+	dqthr := (thr2 + (thr2 >> 1)) >> 1
+	tr := s.td != 0 && mag > dqthr
+
+	// Quantizer scale factor adaptation
+	s.yu = y + ((wi - y) >> 5)
+	if s.yu < 544 {
+		s.yu = 544
+	} else if s.yu > 5120 {
+		s.yu = 5120
+	}
+	s.yl += s.yu + ((-s.yl) >> 6)
+
+	// Adaptive predictor coefficients
+	a2p := 0
+	if tr {
+		s.a = [2]int{}
+		s.b = [6]int{}
+	} else {
+		pks1 := pk0 ^ s.pk[0]
+
+		a2p = s.a[1] - (s.a[1] >> 7)
+		if dqsez != 0 {
+			fa1 := -s.a[0]
+			if pks1 != 0 {
+				fa1 = s.a[0]
+			}
+			if fa1 < -8191 {
+				a2p -= 0x100
+			} else if fa1 > 8191 {
+				a2p += 0xFF
+			} else {
+				a2p += fa1 >> 5
+			}
+
+			if pk0^s.pk[1] != 0 {
+				if a2p <= -12160 {
+					a2p = -12288
+				} else if a2p >= 12416 {
+					a2p = 12288
+				} else {
+					a2p -= 0x80
+				}
+			} else if a2p <= -12416 {
+				a2p = -12288
+			} else if a2p >= 12160 {
+				a2p = 12288
+			} else {
+				a2p += 0x80
+			}
+		}
+		a2p = int16Wrap(a2p)
+		s.a[1] = a2p
+
+		s.a[0] -= s.a[0] >> 8
+		if dqsez != 0 {
+			if pks1 == 0 {
+				s.a[0] += 192
+			} else {
+				s.a[0] -= 192
+			}
+		}
+		a1ul := 15360 - a2p
+		if s.a[0] < -a1ul {
+			s.a[0] = -a1ul
+		} else if s.a[0] > a1ul {
+			s.a[0] = a1ul
+		}
+		s.a[0] = int16Wrap(s.a[0])
+
+		for i := range s.b {
+			if s.bits == 5 {
+				s.b[i] -= s.b[i] >> 9
+			} else {
+				s.b[i] -= s.b[i] >> 8
+			}
+			if dq&0x7FFF != 0 {
+				if dq^s.dq[i] >= 0 {
+					s.b[i] += 128
+				} else {
+					s.b[i] -= 128
+				}
+			}
+			s.b[i] = int16Wrap(s.b[i])
+		}
+	}
+
+	copy(s.dq[1:], s.dq[:5])
+	if mag == 0 {
+		if dq >= 0 {
+			s.dq[0] = 0x20
+		} else {
+			s.dq[0] = int16Wrap(0xFC20)
+		}
+	} else {
+		s.dq[0] = g726Float(mag, dq < 0)
+	}
+
+	s.sr[1] = s.sr[0]
+	switch {
+	case sr == 0:
+		s.sr[0] = 0x20
+	case sr > 0:
+		s.sr[0] = g726Float(sr, false)
+	case sr > -32768:
+		s.sr[0] = g726Float(-sr, true)
+	default:
+		s.sr[0] = int16Wrap(0xFC20)
+	}
+
+	s.pk[1] = s.pk[0]
+	s.pk[0] = pk0
+
+	// Tone detector
+	switch {
+	case tr:
+		s.td = 0
+	case a2p < -11776:
+		s.td = 1
+	default:
+		s.td = 0
+	}
+
+	// Adaptation speed control
+	s.dms += (fi - s.dms) >> 5
+	s.dml += ((fi << 2) - s.dml) >> 7
+	diff := (s.dms << 2) - s.dml
+	if diff < 0 {
+		diff = -diff
+	}
+	switch {
+	case tr:
+		s.ap = 256
+	case y < 1536, s.td == 1, diff >= s.dml>>3:
+		s.ap += (0x200 - s.ap) >> 4
+	default:
+		s.ap += (-s.ap) >> 4
+	}
+}
+
+// predict returns the zero predictor share and the signal estimate.
+func (s *g726State) predict() (sez, se int) {
+	sezi := int16Wrap(s.predictorZero())
+	sez = sezi >> 1
+	se = int16Wrap(sezi+s.predictorPole()) >> 1
+	return sez, se
+}
+
+// apply runs a code word through the decoder half shared by both
+// directions and returns the reconstructed 14-bit sample.
+func (s *g726State) apply(code, y, sez, se int) int {
+	t := s.tables
+	dq := int16Wrap(s.reconstruct(code&t.signal != 0, t.dqln[code], y))
+	sr := se + dq
+	if dq < 0 {
+		sr = se - (dq & 0x3FFF)
+	}
+	sr = int16Wrap(sr)
+	dqsez := int16Wrap(sr + sez - se)
+	s.update(y, t.wi[code], t.fi[code], dq, sr, dqsez)
+	return sr
+}
+
+// encode compresses one 16-bit sample to a code word.
+func (s *g726State) encode(sample int16) int {
+	sl := int(sample) >> 2 // 14-bit dynamic range
+	sez, se := s.predict()
+	d := int16Wrap(sl - se)
+	y := s.stepSize()
+	code := s.quantize(d, y)
+	s.apply(code, y, sez, se)
+	return code
+}
+
+// decode expands a code word to a 16-bit sample.
+func (s *g726State) decode(code int) int16 {
+	code &= 1<<s.bits - 1
+	sez, se := s.predict()
+	y := s.stepSize()
+	return clampSample(s.apply(code, y, sez, se) << 2)
+}
+
+// decodeFrame expands packed code words.
+func (s *g726State) decodeFrame(data []byte) []int16 {
+	samples := make([]int16, 0, len(data)*8/s.bits)
+	unpackBits(data, s.bits, G726AAL2, func(code int) {
+		samples = append(samples, s.decode(code))
+	})
+	return samples
+}
+
+// encodeFrame compresses samples into packed code words.
+func (s *g726State) encodeFrame(samples []int16) []byte {
+	codes := make([]int, len(samples))
+	for i, sample := range samples {
+		codes[i] = s.encode(sample)
+	}
+	return packBits(codes, s.bits, G726AAL2)
+}
+
+// unpackBits calls fn for each code word of a bit-packed frame.
+func unpackBits(data []byte, bits int, msbFirst bool, fn func(code int)) {
+	var acc uint32
+	n := 0
+	mask := uint32(1)<<bits - 1
+	for _, b := range data {
+		if msbFirst {
+			acc = acc<<8 | uint32(b)
+			n += 8
+			for n >= bits {
+				fn(int(acc >> (n - bits) & mask))
+				n -= bits
+			}
+		} else {
+			acc |= uint32(b) << n
+			n += 8
+			for n >= bits {
+				fn(int(acc & mask))
+				acc >>= bits
+				n -= bits
+			}
+		}
+	}
+}
+
+// packBits packs code words, padding the last byte with zero bits.
+func packBits(codes []int, bits int, msbFirst bool) []byte {
+	out := make([]byte, 0, (len(codes)*bits+7)/8)
+	var acc uint32
+	n := 0
+	for _, code := range codes {
+		if msbFirst {
+			acc = acc<<bits | uint32(code)
+			n += bits
+			for n >= 8 {
+				out = append(out, byte(acc>>(n-8)))
+				n -= 8
+			}
+		} else {
+			acc |= uint32(code) << n
+			n += bits
+			for n >= 8 {
+				out = append(out, byte(acc))
+				acc >>= 8
+				n -= 8
+			}
+		}
+	}
+	if n > 0 {
+		if msbFirst {
+			out = append(out, byte(acc<<(8-n)))
+		} else {
+			out = append(out, byte(acc))
+		}
+	}
+	return out
+}
+
+// g726Bits is the bits per sample of a G.726 frame: the configured rate,
+// or the one that gives a 20, 40 or 10 ms frame of that length.
+func g726Bits(frameLen int) int {
+	if G726Kbps > 0 {
+		return G726Kbps / 8
+	}
+	for _, samples := range []int{160, 320, 80} {
+		if bits := frameLen * 8 / samples; frameLen*8%samples == 0 && bits >= 2 && bits <= 5 {
+			return bits
+		}
+	}
+	return 4
+}
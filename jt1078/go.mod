@@ -0,0 +1,3 @@
+module jt1078
+
+go 1.23.2
@@ -0,0 +1,37 @@
+// Package proxyapi reports what the media servers see to the proxy's REST
+// API.
+package proxyapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BaseURL is the address of the proxy API, set by the server at start-up.
+var BaseURL string
+
+// client bounds each request, so a proxy that stops answering does not hold
+// up the stream handling that reports to it.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Post sends a value as JSON to a path of the proxy API, such as
+// /api/v1/jt808/media/stream. A response other than 2xx is an error; the
+// response body is not read.
+func Post(path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(BaseURL+path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return nil
+}
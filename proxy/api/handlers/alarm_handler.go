@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"proxy/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListActiveAlarms returns the alarms currently raised on all devices
+// @Summary List active alarms
+// @Description Alarms decoded from location reports, e.g. video signal loss or occlusion per channel, storage faults and abnormal driving. Changes are also published on the tracker/alarms MQTT topic
+// @Tags alarms
+// @Produce json
+// @Success 200 {array} models.AlarmEvent
+// @Router /api/v1/jt808/alarms [get]
+func ListActiveAlarms(c *gin.Context) {
+	c.JSON(http.StatusOK, services.ListActiveAlarms())
+}
+
+// GetDeviceAlarms returns a device's alarm state
+// @Summary Get device alarms
+// @Description Returns the latest JT/T 1078 video alarm items (0x14-0x18) reported in 0x0200 and the device's active alarms
+// @Tags alarms
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.DeviceAlarms
+// @Router /api/v1/jt808/alarms/{phone} [get]
+func GetDeviceAlarms(c *gin.Context) {
+	c.JSON(http.StatusOK, services.GetDeviceAlarms(c.Param("phone")))
+}
+
+// ListActiveSafetyAlarms returns recent ADAS, DSM, TPMS and BSD alarms
+// @Summary List active safety alarms
+// @Description Alarms decoded from the 0x64-0x67 items of location reports, newest first. Each carries the alarm identification number the device uploads its attachments under. New alarms are also published on the tracker/active-safety MQTT topic, and alarms with start/end flags appear in the active alarms while ongoing
+// @Tags alarms
+// @Produce json
+// @Param device_phone query string false "Device Phone Number"
+// @Param source query string false "adas, dsm, tpms or bsd"
+// @Param type query string false "Alarm type, e.g. forward_collision, lane_departure, fatigue_driving, phone_call"
+// @Success 200 {array} models.ActiveSafetyAlarm
+// @Router /api/v1/jt808/alarms/active-safety [get]
+func ListActiveSafetyAlarms(c *gin.Context) {
+	c.JSON(http.StatusOK, services.ListActiveSafetyAlarms(c.Query("device_phone"), c.Query("source"), c.Query("type")))
+}
+
+// ListAlarmAttachments lists the alarm attachments received by the attachment server
+// @Summary List alarm attachments
+// @Description Images, audio and video a device uploaded for an active safety alarm after 0x9208 (0x1210/0x1211/0x1212), stored against the alarm identification number, newest first. Complete files are also published on the tracker/alarm-attachments MQTT topic
+// @Tags alarms
+// @Produce json
+// @Param device_phone query string false "Device Phone Number"
+// @Param alarm_number query string false "Platform alarm number, as on the active safety alarm"
+// @Param identification query string false "Alarm identification number, hex"
+// @Success 200 {array} models.AlarmAttachment
+// @Router /api/v1/jt808/alarms/attachments [get]
+func ListAlarmAttachments(c *gin.Context) {
+	c.JSON(http.StatusOK, services.ListAlarmAttachments(c.Query("device_phone"), c.Query("alarm_number"), c.Query("identification")))
+}
+
+// DownloadAlarmAttachment downloads an alarm attachment
+// @Summary Download alarm attachment
+// @Tags alarms
+// @Produce octet-stream
+// @Param id path string true "File ID"
+// @Success 200 {file} file
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/alarms/attachments/{id}/download [get]
+func DownloadAlarmAttachment(c *gin.Context) {
+	attachment, localPath, exists := services.GetAlarmAttachment(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment no longer on disk"})
+		return
+	}
+	c.FileAttachment(localPath, attachment.Name)
+}
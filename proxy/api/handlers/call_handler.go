@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"proxy/models"
+	"proxy/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartVoIPCall opens a two-way intercom with a device
+// @Summary Start a VoIP call
+// @Description Sets the device audio parameters (0x8103) and requests a two-way intercom (0x9101). The call becomes active once device audio reaches the media server
+// @Tags call
+// @Accept json
+// @Produce json
+// @Param request body models.VoIPCallRequest true "VoIP call request"
+// @Success 200 {object} models.VoIPCallResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/call/start [post]
+func StartVoIPCall(c *gin.Context) {
+	var req models.VoIPCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	log.Printf("[CALL] Start request - Device: %s, Caller: %s", req.DevicePhone, req.CallerID)
+
+	device, exists := services.GetJT808Device(req.DevicePhone)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if !device.Authenticated {
+		log.Printf("[CALL] Warning: Device %s not authenticated. Proceeding...", req.DevicePhone)
+	}
+
+	call, cmd, err := services.StartVoIPCall(req.DevicePhone, req.CallerID)
+	if errors.Is(err, services.ErrCallInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device already in call"})
+		return
+	}
+	if errors.Is(err, services.ErrNoAudioOutput) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Device does not support audio output"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := awaitDeviceAck(c, cmd); !ok {
+		return
+	}
+	if current, exists := services.GetCurrentCall(req.DevicePhone); exists && current.CallID == call.CallID {
+		call = current
+	}
+
+	c.JSON(http.StatusOK, services.VoIPCallResponse(call))
+}
+
+// ControlVoIPCall sends a control command to the device's ongoing call
+// @Summary Control a VoIP call
+// @Description Sends 0x9102 on the intercom channel (0=off, 1=switch, 2=pause, 3=resume, 4=end). Commands 0 and 4 end the call
+// @Tags call
+// @Accept json
+// @Produce json
+// @Param request body models.VoIPControlRequest true "VoIP control request"
+// @Success 200 {object} models.VoIPCallResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/call/control [post]
+func ControlVoIPCall(c *gin.Context) {
+	var req models.VoIPControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Command < 0 || req.Command > 4 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command. Use 0-4"})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	call, cmd, err := services.ControlVoIPCall(req.DevicePhone, req.Command)
+	if errors.Is(err, services.ErrNoActiveCall) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active call found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := awaitDeviceAck(c, cmd); !ok {
+		return
+	}
+	if current, exists := services.GetCurrentCall(req.DevicePhone); exists && current.CallID == call.CallID {
+		call = current
+	}
+
+	c.JSON(http.StatusOK, services.VoIPCallResponse(call))
+}
+
+// GetCallStatus returns the current or most recent call of a device
+// @Summary Get call status
+// @Tags call
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.VoIPCallResponse
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/call/status/{phone} [get]
+func GetCallStatus(c *gin.Context) {
+	call, exists := services.GetCurrentCall(c.Param("phone"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No call found"})
+		return
+	}
+	c.JSON(http.StatusOK, services.VoIPCallResponse(call))
+}
+
+// ListVoIPCalls lists ongoing and recently ended calls
+// @Summary List VoIP calls
+// @Tags call
+// @Produce json
+// @Success 200 {array} models.VoIPCallResponse
+// @Router /api/v1/jt808/calls [get]
+func ListVoIPCalls(c *gin.Context) {
+	calls := services.ListVoIPCalls()
+	response := make([]models.VoIPCallResponse, 0, len(calls))
+	for _, call := range calls {
+		response = append(response, services.VoIPCallResponse(call))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// MediaStreamNotification receives stream start/stop events from the media servers
+// @Summary Report a JT1078 stream event
+// @Description Called by the video/twoway servers when a device stream starts or stops, so call state follows the real audio
+// @Tags media
+// @Accept json
+// @Produce json
+// @Param request body models.MediaStreamEvent true "Stream event"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/jt808/media/stream [post]
+func MediaStreamNotification(c *gin.Context) {
+	var event models.MediaStreamEvent
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if event.Event != "started" && event.Event != "stopped" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event must be \"started\" or \"stopped\""})
+		return
+	}
+
+	services.HandleMediaStreamEvent(event)
+	c.JSON(http.StatusOK, gin.H{"message": "Event processed"})
+}
+
+// MediaLossNotification receives live stream packet loss from the media server
+// @Summary Report JT1078 packet loss
+// @Description Called periodically by the video server with the loss rate computed from JT1078 sequence numbers; forwarded to the device as 0x9105 (rate x 100)
+// @Tags media
+// @Accept json
+// @Produce json
+// @Param request body models.MediaLossReport true "Loss report"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /api/v1/jt808/media/loss [post]
+func MediaLossNotification(c *gin.Context) {
+	var report models.MediaLossReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if report.LossRate < 0 || report.LossRate > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "loss_rate must be between 0 and 1"})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(report.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.HandleMediaLossReport(report)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transmission status sent", "serial": cmd.Serial})
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+	"proxy/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetCANSignals returns the latest decoded CAN bus values for a device
+// @Summary Get latest CAN bus values
+// @Description Returns the most recent value of every CAN signal decoded for the device using the loaded DBC definitions
+// @Tags jt808
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {array} models.CANSignalValue
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/can/{phone} [get]
+func GetCANSignals(c *gin.Context) {
+	phone := c.Param("phone")
+	values, exists := services.GetCANSignals(phone)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No CAN data for device"})
+		return
+	}
+	c.JSON(http.StatusOK, values)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"proxy/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// capabilityQueryTimeout bounds how long a query waits for the 0x1003 reply.
+const capabilityQueryTimeout = 10 * time.Second
+
+// GetAVCapabilities returns the cached audio/video attributes of a device
+// @Summary Get device audio/video capabilities
+// @Description Returns the attributes last reported by the device in 0x1003 (codecs, sample format, audio output, channel counts)
+// @Tags jt808
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.AVCapabilities
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/capabilities/{phone} [get]
+func GetAVCapabilities(c *gin.Context) {
+	caps, exists := services.GetAVCapabilities(c.Param("phone"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No capabilities reported by device"})
+		return
+	}
+	c.JSON(http.StatusOK, caps)
+}
+
+// QueryAVCapabilities asks a device for its audio/video attributes
+// @Summary Query device audio/video capabilities
+// @Description Sends 0x9003 and waits for the device's 0x1003 reply, which is cached for channel validation and codec selection
+// @Tags jt808
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.AVCapabilities
+// @Failure 404 {object} map[string]string
+// @Failure 408 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]string
+// @Router /api/v1/jt808/capabilities/{phone}/query [post]
+func QueryAVCapabilities(c *gin.Context) {
+	phone := c.Param("phone")
+	if _, exists := services.GetJT808Device(phone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.QueryAVCapabilities(phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[AV ATTRIBUTES] Query sent to %s", phone)
+
+	if _, err := services.AwaitTerminalResponse(cmd, capabilityQueryTimeout); err != nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"status": "timeout", "error": "No response from device"})
+		return
+	}
+	// Some terminals only send a general response to 0x9003
+	caps, exists := services.GetAVCapabilities(phone)
+	if !exists {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Device answered without reporting its attributes"})
+		return
+	}
+	c.JSON(http.StatusOK, caps)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// commandResponseTimeout is how long a handler waits for the device's 0x0001
+// before answering; later replies still update state in the background.
+const commandResponseTimeout = 5 * time.Second
+
+// awaitDeviceAck waits briefly for the terminal's reply to a command. It writes
+// an error response and returns ok=false if the device rejected the command;
+// acked reports whether any reply arrived in time.
+func awaitDeviceAck(c *gin.Context, cmd *models.PendingCommand) (acked bool, ok bool) {
+	result, err := services.AwaitTerminalResponse(cmd, commandResponseTimeout)
+	if err != nil {
+		return false, true
+	}
+	if result != 0 {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":       "Device rejected command",
+			"result":      result,
+			"result_text": jt808.ResultText(result),
+		})
+		return true, false
+	}
+	return true, true
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"proxy/models"
+	"proxy/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartFileUpload asks a device to upload recordings over FTP (0x9206)
+// @Summary Request recording file upload
+// @Description Sends 0x9206 pointing the device at the embedded FTP receiver with a one-off login. Progress follows the device's 0x0001, the files arriving over FTP and the final 0x1206. Times use "2006-01-02 15:04:05" in device local time. Conditions: bit0 WiFi, bit1 LAN, bit2 3G/4G (0 = any network)
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body models.FileUploadRequest true "File upload request"
+// @Success 200 {object} models.FileUploadTaskResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Failure 503 {object} map[string]string
+// @Router /api/v1/jt808/files/upload [post]
+func StartFileUpload(c *gin.Context) {
+	var req models.FileUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	log.Printf("[FILES] Upload request - Device: %s, Channel: %d, From: %s, To: %s", req.DevicePhone, req.Channel, req.StartTime, req.EndTime)
+
+	start, end, err := parseResourceTimes(req.StartTime, req.EndTime)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.AVType < 0 || req.AVType > 3 || req.StreamType < 0 || req.StreamType > 2 || req.StorageType < 0 || req.StorageType > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "av_type must be 0-3, stream_type and storage_type 0-2"})
+		return
+	}
+	if req.Conditions < 0 || req.Conditions > 7 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "conditions must be a bit mask of 1 (WiFi), 2 (LAN) and 4 (3G/4G)"})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	task, cmd, err := services.StartFileUpload(req, start, end)
+	if errors.Is(err, services.ErrNoFileReceiver) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := awaitDeviceAck(c, cmd); !ok {
+		return
+	}
+	if current, exists := services.GetFileUpload(task.TaskID); exists {
+		task = current
+	}
+
+	c.JSON(http.StatusOK, services.FileUploadTaskResponse(task))
+}
+
+// ControlFileUpload pauses, resumes or cancels an upload task (0x9207)
+// @Summary Control recording file upload
+// @Description Sends 0x9207 for the task's 0x9206 request. Commands: 0=pause, 1=continue, 2=cancel
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body models.FileUploadControlRequest true "File upload control request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/files/upload/control [post]
+func ControlFileUpload(c *gin.Context) {
+	var req models.FileUploadControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	log.Printf("[FILES] Upload control request - Task: %s, Command: %d", req.TaskID, req.Command)
+
+	if req.Command < 0 || req.Command > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command. Use 0=pause, 1=continue, 2=cancel"})
+		return
+	}
+
+	task, cmd, err := services.ControlFileUpload(req.TaskID, req.Command)
+	if errors.Is(err, services.ErrNoUploadTask) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload task not found"})
+		return
+	}
+	if errors.Is(err, services.ErrUploadTaskClosed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	acked, ok := awaitDeviceAck(c, cmd)
+	if !ok {
+		return
+	}
+	if current, exists := services.GetFileUpload(task.TaskID); exists {
+		task = current
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "File upload control command sent successfully",
+		"task_id":      task.TaskID,
+		"command":      req.Command,
+		"status":       task.Status,
+		"acknowledged": acked,
+	})
+}
+
+// ListFileUploads lists recording upload tasks
+// @Summary List file upload tasks
+// @Description Finished tasks are kept for an hour; their files stay available under /files
+// @Tags files
+// @Produce json
+// @Param device_phone query string false "Only tasks of this device"
+// @Success 200 {array} models.FileUploadTaskResponse
+// @Router /api/v1/jt808/files/uploads [get]
+func ListFileUploads(c *gin.Context) {
+	tasks := services.ListFileUploads(c.Query("device_phone"))
+	response := make([]models.FileUploadTaskResponse, 0, len(tasks))
+	for _, task := range tasks {
+		response = append(response, services.FileUploadTaskResponse(task))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetFileUpload returns one recording upload task
+// @Summary Get file upload task
+// @Tags files
+// @Produce json
+// @Param id path string true "Task ID"
+// @Success 200 {object} models.FileUploadTaskResponse
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/files/uploads/{id} [get]
+func GetFileUpload(c *gin.Context) {
+	task, exists := services.GetFileUpload(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload task not found"})
+		return
+	}
+	c.JSON(http.StatusOK, services.FileUploadTaskResponse(task))
+}
+
+// ListRecordedFiles lists the recordings received over FTP
+// @Summary List received recording files
+// @Description Files are indexed with the device, channel and time range of the upload request. A time range matches files whose range overlaps it
+// @Tags files
+// @Produce json
+// @Param device_phone query string false "Device Phone Number"
+// @Param channel query int false "Logical channel (0 = all)"
+// @Param start_time query string false "Range start, \"2006-01-02 15:04:05\" device local time"
+// @Param end_time query string false "Range end, same layout"
+// @Success 200 {array} models.RecordedFile
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/jt808/files [get]
+func ListRecordedFiles(c *gin.Context) {
+	start, end, err := parseResourceTimes(c.Query("start_time"), c.Query("end_time"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	channel, _ := strconv.Atoi(c.Query("channel"))
+
+	c.JSON(http.StatusOK, services.ListRecordedFiles(c.Query("device_phone"), channel, start, end))
+}
+
+// DownloadRecordedFile downloads a recording received over FTP
+// @Summary Download recording file
+// @Tags files
+// @Produce octet-stream
+// @Param id path string true "File ID"
+// @Success 200 {file} file
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/files/{id}/download [get]
+func DownloadRecordedFile(c *gin.Context) {
+	file, localPath, exists := services.GetRecordedFile(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File no longer on disk"})
+		return
+	}
+	c.FileAttachment(localPath, file.Name)
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/services"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// paramsQueryTimeout bounds how long a query waits for the 0x0104 reply.
+const paramsQueryTimeout = 10 * time.Second
+
+// GetActiveSafetyParamsSchema describes the active safety parameter blocks
+// @Summary Active safety parameter schema
+// @Description JSON schemas of the ADAS (0xF364), DMS (0xF365) and BSD (0xF367) parameter blocks with each field's range, default and unit
+// @Tags params
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/params/active-safety/schema [get]
+func GetActiveSafetyParamsSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, jt808.ActiveSafetyParamsSchema())
+}
+
+// GetActiveSafetyParams returns the cached active safety parameters of a device
+// @Summary Get active safety parameters
+// @Description Returns the ADAS/DMS/BSD blocks last reported by the device in 0x0104
+// @Tags params
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.ActiveSafetyParams
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/jt808/params/active-safety/{phone} [get]
+func GetActiveSafetyParams(c *gin.Context) {
+	params, exists := services.GetActiveSafetyParams(c.Param("phone"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active safety parameters reported by device"})
+		return
+	}
+	c.JSON(http.StatusOK, params)
+}
+
+// QueryActiveSafetyParams reads the active safety parameters of a device
+// @Summary Query active safety parameters
+// @Description Sends 0x8106 for 0xF364, 0xF365 and 0xF367 and waits for the device's 0x0104 reply, which is cached
+// @Tags params
+// @Produce json
+// @Param phone path string true "Device Phone Number"
+// @Success 200 {object} models.ActiveSafetyParams
+// @Failure 404 {object} map[string]string
+// @Failure 408 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/params/active-safety/{phone}/query [post]
+func QueryActiveSafetyParams(c *gin.Context) {
+	phone := c.Param("phone")
+	if _, exists := services.GetJT808Device(phone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.QueryActiveSafetyParams(phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[PARAMS] Active safety parameter query sent to %s", phone)
+
+	result, err := services.AwaitTerminalResponse(cmd, paramsQueryTimeout)
+	if err != nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"status": "timeout", "error": "No response from device"})
+		return
+	}
+	if result != 0 {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":       "Device rejected command",
+			"result":      result,
+			"result_text": jt808.ResultText(result),
+		})
+		return
+	}
+	params, exists := services.GetActiveSafetyParams(phone)
+	if !exists {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Device answered without active safety parameters"})
+		return
+	}
+	c.JSON(http.StatusOK, params)
+}
+
+// SetActiveSafetyParams writes active safety parameters to a set of devices
+// @Summary Set active safety parameters
+// @Description Sends 0x8103 with the given ADAS/DMS/BSD blocks to every listed device, so a fleet can share one tuning. Only the fields given change; see the schema endpoint for ranges. Accepted blocks are read back with 0x8106
+// @Tags params
+// @Accept json
+// @Produce json
+// @Param request body models.ActiveSafetyParamsRequest true "Parameter write request"
+// @Success 200 {array} models.ActiveSafetyParamsResult
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/jt808/params/active-safety [post]
+func SetActiveSafetyParams(c *gin.Context) {
+	var req models.ActiveSafetyParamsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.ADAS == nil && req.DMS == nil && req.BSD == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one of adas, dms or bsd is required"})
+		return
+	}
+	if err := jt808.ValidateActiveSafetyParams(req.ADAS, req.DMS, req.BSD); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[PARAMS] Active safety parameter write for %d devices", len(req.DevicePhones))
+
+	results := make([]models.ActiveSafetyParamsResult, len(req.DevicePhones))
+	var wg sync.WaitGroup
+	for i, phone := range req.DevicePhones {
+		wg.Add(1)
+		go func(i int, phone string) {
+			defer wg.Done()
+			results[i] = setDeviceParams(phone, req)
+		}(i, phone)
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
+
+// setDeviceParams writes the request's blocks to one device and waits for its ack.
+func setDeviceParams(phone string, req models.ActiveSafetyParamsRequest) models.ActiveSafetyParamsResult {
+	result := models.ActiveSafetyParamsResult{DevicePhone: phone}
+	if _, exists := services.GetJT808Device(phone); !exists {
+		result.Status, result.Error = "failed", "Device not found"
+		return result
+	}
+
+	cmd, err := services.SetActiveSafetyParams(phone, req.ADAS, req.DMS, req.BSD)
+	if err != nil {
+		result.Status, result.Error = "failed", err.Error()
+		return result
+	}
+	code, err := services.AwaitTerminalResponse(cmd, commandResponseTimeout)
+	switch {
+	case err != nil:
+		result.Status = "no_response"
+	case code != 0:
+		result.Status, result.Result, result.Error = "rejected", int(code), jt808.ResultText(code)
+	default:
+		result.Status = "acknowledged"
+	}
+	return result
+}
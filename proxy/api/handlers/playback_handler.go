@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartPlayback requests remote playback of a recording (0x9201)
+// @Summary Start remote playback
+// @Description Sends 0x9201 pointing the device at the media server's playback listener. Times use "2006-01-02 15:04:05" in device local time. Playback mode: 0=normal, 1=fast forward, 2=rewind, 3=keyframes only, 4=single frame. Speed (modes 1 and 2): 1, 2, 4, 8 or 16
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackStartRequest true "Playback request"
+// @Success 200 {object} models.PlaybackSessionResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/start [post]
+func StartPlayback(c *gin.Context) {
+	var req models.PlaybackStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	log.Printf("[PLAYBACK] Start request - Device: %s, Channel: %d, From: %s, To: %q", req.DevicePhone, req.Channel, req.StartTime, req.EndTime)
+
+	start, end, err := parseResourceTimes(req.StartTime, req.EndTime)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.AVType < 0 || req.AVType > 3 || req.StreamType < 0 || req.StreamType > 2 || req.StorageType < 0 || req.StorageType > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "av_type must be 0-3, stream_type and storage_type 0-2"})
+		return
+	}
+	if req.PlaybackMode < 0 || req.PlaybackMode > 4 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "playback_mode must be 0-4"})
+		return
+	}
+	if req.PlaybackMode != 1 && req.PlaybackMode != 2 {
+		req.Speed = 0
+	} else if req.Speed == 0 {
+		req.Speed = 1
+	}
+	if _, err := jt808.PlaybackSpeedCode(req.Speed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	session, cmd, err := services.StartPlayback(req, start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := awaitDeviceAck(c, cmd); !ok {
+		return
+	}
+	if current, exists := services.GetPlaybackSession(req.DevicePhone, req.Channel); exists {
+		session = current
+	}
+
+	c.JSON(http.StatusOK, services.PlaybackSessionResponse(session))
+}
+
+// ControlPlayback sends a remote playback control command (0x9202)
+// @Summary Control remote playback
+// @Description Sends 0x9202. Commands: 0=resume, 1=pause, 2=stop, 3=fast forward, 4=rewind, 5=seek to seek_time, 6=keyframes only. Speed (3 and 4): 1, 2, 4, 8 or 16
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/control [post]
+func ControlPlayback(c *gin.Context) {
+	var req models.PlaybackControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	controlPlayback(c, req)
+}
+
+// PausePlayback pauses remote playback (0x9202 command 1)
+// @Summary Pause playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/pause [post]
+func PausePlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 1)
+}
+
+// ResumePlayback resumes normal-speed playback (0x9202 command 0)
+// @Summary Resume playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/resume [post]
+func ResumePlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 0)
+}
+
+// StopPlayback ends remote playback (0x9202 command 2)
+// @Summary Stop playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/stop [post]
+func StopPlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 2)
+}
+
+// FastForwardPlayback plays forward at a multiple of normal speed (0x9202 command 3)
+// @Summary Fast forward playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/forward [post]
+func FastForwardPlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 3)
+}
+
+// RewindPlayback plays keyframes backwards (0x9202 command 4)
+// @Summary Rewind playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/rewind [post]
+func RewindPlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 4)
+}
+
+// SeekPlayback jumps to seek_time (0x9202 command 5)
+// @Summary Seek playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/seek [post]
+func SeekPlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 5)
+}
+
+// KeyframePlayback switches to keyframe-only playback (0x9202 command 6)
+// @Summary Keyframe-only playback
+// @Tags playback
+// @Accept json
+// @Produce json
+// @Param request body models.PlaybackControlRequest true "Playback control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/playback/keyframe [post]
+func KeyframePlayback(c *gin.Context) {
+	bindPlaybackCommand(c, 6)
+}
+
+// ListPlaybackSessions lists all remote playback sessions
+// @Summary List playback sessions
+// @Tags playback
+// @Produce json
+// @Success 200 {array} models.PlaybackSessionResponse
+// @Router /api/v1/jt808/playback/sessions [get]
+func ListPlaybackSessions(c *gin.Context) {
+	sessions := services.ListPlaybackSessions()
+	response := make([]models.PlaybackSessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, services.PlaybackSessionResponse(session))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func bindPlaybackCommand(c *gin.Context, command int) {
+	var req models.PlaybackControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	req.Command = command
+	controlPlayback(c, req)
+}
+
+func controlPlayback(c *gin.Context, req models.PlaybackControlRequest) {
+	log.Printf("[PLAYBACK CONTROL] Request received - Device: %s, Channel: %d, Command: %d", req.DevicePhone, req.Channel, req.Command)
+
+	if req.Command < 0 || req.Command > 6 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command. Use 0=resume, 1=pause, 2=stop, 3=forward, 4=rewind, 5=seek, 6=keyframes"})
+		return
+	}
+	if req.Command == 3 || req.Command == 4 {
+		if req.Speed == 0 {
+			req.Speed = 2
+		}
+	} else {
+		req.Speed = 0
+	}
+	if _, err := jt808.PlaybackSpeedCode(req.Speed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var seek time.Time
+	if req.Command == 5 {
+		var err error
+		if seek, err = time.Parse(jt808.ResourceTimeLayout, req.SeekTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "seek_time must use the layout \"" + jt808.ResourceTimeLayout + "\""})
+			return
+		}
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.ControlPlayback(req.DevicePhone, req.Channel, req.Command, req.Speed, seek)
+	if errors.Is(err, services.ErrNoPlaybackSession) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No playback session on this channel"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	acked, ok := awaitDeviceAck(c, cmd)
+	if !ok {
+		return
+	}
+
+	status := "stopped"
+	if session, exists := services.GetPlaybackSession(req.DevicePhone, req.Channel); exists {
+		status = session.Status
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Playback control command sent successfully",
+		"command":      req.Command,
+		"channel":      req.Channel,
+		"status":       status,
+		"acknowledged": acked,
+	})
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"net/http"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PTZRotate turns a PTZ camera (0x9301)
+// @Summary Rotate PTZ camera
+// @Description Sends 0x9301. Direction: 0=stop, 1=up, 2=down, 3=left, 4=right. Speed 0-255
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZRotateRequest true "PTZ rotation request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/rotate [post]
+func PTZRotate(c *gin.Context) {
+	var req models.PTZRotateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Direction < 0 || req.Direction > 4 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid direction. Use 0=stop, 1=up, 2=down, 3=left, 4=right"})
+		return
+	}
+	if req.Speed < 0 || req.Speed > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be 0-255"})
+		return
+	}
+	sendPTZ(c, jt808.PTZRotate, req.DevicePhone, req.Channel, jt808.BuildPTZRotateBody(req.Channel, req.Direction, req.Speed))
+}
+
+// PTZFocus adjusts the lens focal length (0x9302)
+// @Summary Adjust PTZ focus
+// @Description Sends 0x9302. Action: 0=increase focal length, 1=reduce focal length
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZAdjustRequest true "PTZ adjustment request"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/focus [post]
+func PTZFocus(c *gin.Context) {
+	bindPTZAdjust(c, jt808.PTZFocus)
+}
+
+// PTZIris adjusts the lens aperture (0x9303)
+// @Summary Adjust PTZ iris
+// @Description Sends 0x9303. Action: 0=open, 1=close
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZAdjustRequest true "PTZ adjustment request"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/iris [post]
+func PTZIris(c *gin.Context) {
+	bindPTZAdjust(c, jt808.PTZIris)
+}
+
+// PTZWiper starts or stops the camera wiper (0x9304)
+// @Summary Control PTZ wiper
+// @Description Sends 0x9304. Action: 0=stop, 1=start
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZAdjustRequest true "PTZ adjustment request"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/wiper [post]
+func PTZWiper(c *gin.Context) {
+	bindPTZAdjust(c, jt808.PTZWiper)
+}
+
+// PTZInfrared switches the infrared fill light (0x9305)
+// @Summary Control infrared fill light
+// @Description Sends 0x9305. Action: 0=off, 1=on
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZAdjustRequest true "PTZ adjustment request"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/infrared [post]
+func PTZInfrared(c *gin.Context) {
+	bindPTZAdjust(c, jt808.PTZInfrared)
+}
+
+// PTZZoom zooms the camera in or out (0x9306)
+// @Summary Control PTZ zoom
+// @Description Sends 0x9306. Action: 0=zoom in, 1=zoom out
+// @Tags ptz
+// @Accept json
+// @Produce json
+// @Param request body models.PTZAdjustRequest true "PTZ adjustment request"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/ptz/zoom [post]
+func PTZZoom(c *gin.Context) {
+	bindPTZAdjust(c, jt808.PTZZoom)
+}
+
+func bindPTZAdjust(c *gin.Context, msgID uint16) {
+	var req models.PTZAdjustRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Action != 0 && req.Action != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be 0 or 1"})
+		return
+	}
+	sendPTZ(c, msgID, req.DevicePhone, req.Channel, jt808.BuildPTZAdjustBody(req.Channel, req.Action))
+}
+
+func sendPTZ(c *gin.Context, msgID uint16, phone string, channel int, body []byte) {
+	if err := services.ValidateVideoChannel(phone, channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, exists := services.GetJT808Device(phone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.SendPTZCommand(phone, msgID, channel, body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	acked, ok := awaitDeviceAck(c, cmd)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "PTZ command sent successfully",
+		"msg_id":       msgID,
+		"channel":      channel,
+		"serial":       cmd.Serial,
+		"acknowledged": acked,
+	})
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueryRecordedResources searches the recordings stored on a device
+// @Summary Search recorded audio/video
+// @Description Sends 0x9205 and returns the segments listed in the device's 0x1205 reply, reassembled if sub-packaged. Times use "2006-01-02 15:04:05" in device local time
+// @Tags jt808
+// @Accept json
+// @Produce json
+// @Param request body models.ResourceQueryRequest true "Resource list query"
+// @Success 200 {object} models.ResourceList
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 408 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/resources/query [post]
+func QueryRecordedResources(c *gin.Context) {
+	var req models.ResourceQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	start, end, err := parseResourceTimes(req.StartTime, req.EndTime)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Channel != 0 {
+		if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.AVType < 0 || req.AVType > 3 || req.StreamType < 0 || req.StreamType > 2 || req.StorageType < 0 || req.StorageType > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "av_type must be 0-3, stream_type and storage_type 0-2"})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	timeout := req.Timeout
+	if timeout == 0 {
+		timeout = 30
+	}
+
+	cmd, err := services.QueryResourceList(req.DevicePhone, req, start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A 0x0001 may arrive before the list (or instead of it on rejection)
+	deadline := time.After(time.Duration(timeout) * time.Second)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			c.JSON(http.StatusRequestTimeout, gin.H{"status": "timeout", "error": "No resource list from device"})
+			return
+		case <-ticker.C:
+			if list, ok := services.TakeResourceList(req.DevicePhone, cmd.Serial); ok {
+				log.Printf("[RESOURCES] Returning %d recordings for %s", len(list.Items), req.DevicePhone)
+				c.JSON(http.StatusOK, list)
+				return
+			}
+			select {
+			case <-cmd.Done:
+				if cmd.Result != 0 {
+					c.JSON(http.StatusBadGateway, gin.H{
+						"error":       "Device rejected command",
+						"result":      cmd.Result,
+						"result_text": jt808.ResultText(cmd.Result),
+					})
+					return
+				}
+			default:
+			}
+		}
+	}
+}
+
+// parseResourceTimes parses optional query bounds in device local time.
+func parseResourceTimes(startText, endText string) (start, end time.Time, err error) {
+	if startText != "" {
+		if start, err = time.Parse(jt808.ResourceTimeLayout, startText); err != nil {
+			return start, end, fmt.Errorf("start_time must use the layout %q", jt808.ResourceTimeLayout)
+		}
+	}
+	if endText != "" {
+		if end, err = time.Parse(jt808.ResourceTimeLayout, endText); err != nil {
+			return start, end, fmt.Errorf("end_time must use the layout %q", jt808.ResourceTimeLayout)
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return start, end, fmt.Errorf("end_time is before start_time")
+	}
+	return start, end, nil
+}
@@ -20,7 +20,7 @@ import (
 // @Accept json
 // @Produce json
 // @Param device_phone query string true "Device Phone Number"
-// @Param channel query int true "Camera Channel (1-4)"
+// @Param channel query int true "Camera Channel (1 to the device's reported video channel count, 4 if unknown)"
 // @Param resolution query int false "Resolution code (default 1)"
 // @Param quality query int false "Quality 0-10 (default 0)"
 // @Param timeout query int false "Timeout in seconds (default 90)"
@@ -43,8 +43,8 @@ func CaptureSnapshot(c *gin.Context) {
 
 	log.Printf("[IMAGE SNAPSHOT] Request received - Device: %s, Channel: %d", req.DevicePhone, req.Channel)
 
-	if req.Channel < 1 || req.Channel > 4 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel must be between 1 and 4"})
+	if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
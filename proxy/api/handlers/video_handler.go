@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"proxy/models"
+	"proxy/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartVideoStream requests a live stream from a device (0x9101)
+// @Summary Start a video stream
+// @Description Sends 0x9101 pointing the device at the configured media server. Stream type: 0=main, 1=sub. Data type: 0=audio and video, 1=video, 3=monitor
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoStartRequest true "Video start request"
+// @Success 200 {object} models.VideoStartResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/start [post]
+func StartVideoStream(c *gin.Context) {
+	var req models.VideoStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	log.Printf("[VIDEO] Start request - Device: %s, Channel: %d, StreamType: %d", req.DevicePhone, req.Channel, req.StreamType)
+
+	if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.StreamType < 0 || req.StreamType > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stream type must be 0 (main) or 1 (sub)"})
+		return
+	}
+	if err := services.ValidateVideoDataType(req.DataType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, exists := services.GetJT808Device(req.DevicePhone)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if !device.Authenticated {
+		log.Printf("[VIDEO] Warning: Device %s not authenticated. Proceeding...", req.DevicePhone)
+	}
+
+	session, cmd, err := services.StartVideoSession(req.DevicePhone, req.Channel, req.StreamType, req.DataType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := awaitDeviceAck(c, cmd); !ok {
+		return
+	}
+	if current, exists := services.GetVideoSession(req.DevicePhone, req.Channel); exists {
+		session = current
+	}
+
+	c.JSON(http.StatusOK, services.VideoSessionResponse(session))
+}
+
+// ControlVideoStream sends a real-time transmission control command (0x9102)
+// @Summary Control a video stream
+// @Description Sends 0x9102 for a live channel. Commands: 0=stop, 1=switch stream, 2=pause, 3=resume. close_av_type (stop): 0=audio and video, 1=audio only, 2=video only. switch_stream_type (switch): 0=main, 1=sub
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoControlRequest true "Video control request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Failure 502 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/control [post]
+func ControlVideoStream(c *gin.Context) {
+	var req models.VideoControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	controlVideo(c, req)
+}
+
+// StopVideoStream closes a live stream (0x9102 command 0)
+// @Summary Stop a video stream
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoControlRequest true "Video control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/stop [post]
+func StopVideoStream(c *gin.Context) {
+	bindVideoCommand(c, 0)
+}
+
+// SwitchVideoStream switches a live stream between main and sub stream (0x9102 command 1)
+// @Summary Switch video stream type
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoControlRequest true "Video control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/switch [post]
+func SwitchVideoStream(c *gin.Context) {
+	bindVideoCommand(c, 1)
+}
+
+// PauseVideoStream pauses all streams on a channel (0x9102 command 2)
+// @Summary Pause a video stream
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoControlRequest true "Video control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/pause [post]
+func PauseVideoStream(c *gin.Context) {
+	bindVideoCommand(c, 2)
+}
+
+// ResumeVideoStream resumes a paused channel (0x9102 command 3)
+// @Summary Resume a video stream
+// @Tags video
+// @Accept json
+// @Produce json
+// @Param request body models.VideoControlRequest true "Video control request (command is ignored)"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/jt808/video/resume [post]
+func ResumeVideoStream(c *gin.Context) {
+	bindVideoCommand(c, 3)
+}
+
+// ListVideoSessions lists all live video sessions
+// @Summary List video sessions
+// @Tags video
+// @Produce json
+// @Success 200 {array} models.VideoStartResponse
+// @Router /api/v1/jt808/video/sessions [get]
+func ListVideoSessions(c *gin.Context) {
+	sessions := services.ListVideoSessions()
+	response := make([]models.VideoStartResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, services.VideoSessionResponse(session))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func bindVideoCommand(c *gin.Context, command int) {
+	var req models.VideoControlRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	req.Command = command
+	controlVideo(c, req)
+}
+
+func controlVideo(c *gin.Context, req models.VideoControlRequest) {
+	log.Printf("[VIDEO CONTROL] Request received - Device: %s, Channel: %d, Command: %d", req.DevicePhone, req.Channel, req.Command)
+
+	if err := services.ValidateVideoChannel(req.DevicePhone, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Command < 0 || req.Command > 3 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command. Use 0=stop, 1=switch, 2=pause, 3=resume"})
+		return
+	}
+	if req.CloseAVType < 0 || req.CloseAVType > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "close_av_type must be 0 (all), 1 (audio) or 2 (video)"})
+		return
+	}
+	if req.SwitchStreamType < 0 || req.SwitchStreamType > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "switch_stream_type must be 0 (main) or 1 (sub)"})
+		return
+	}
+
+	if _, exists := services.GetJT808Device(req.DevicePhone); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cmd, err := services.ControlVideoSession(req.DevicePhone, req.Channel, req.Command, req.CloseAVType, req.SwitchStreamType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	acked, ok := awaitDeviceAck(c, cmd)
+	if !ok {
+		return
+	}
+
+	status := "stopped"
+	if session, exists := services.GetVideoSession(req.DevicePhone, req.Channel); exists {
+		status = session.Status
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Video control command sent successfully",
+		"command":      req.Command,
+		"channel":      req.Channel,
+		"status":       status,
+		"acknowledged": acked,
+	})
+}
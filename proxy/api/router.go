@@ -35,6 +35,72 @@ func SetupRouter() *gin.Engine {
 		{
 			jt808Group.GET("/devices", handlers.ListJT808Devices)
 			jt808Group.GET("/snapshot", handlers.CaptureSnapshot)
+			jt808Group.GET("/can/:phone", handlers.GetCANSignals)
+			jt808Group.GET("/alarms", handlers.ListActiveAlarms)
+			jt808Group.GET("/alarms/active-safety", handlers.ListActiveSafetyAlarms)
+			jt808Group.GET("/alarms/attachments", handlers.ListAlarmAttachments)
+			jt808Group.GET("/alarms/attachments/:id/download", handlers.DownloadAlarmAttachment)
+			jt808Group.GET("/alarms/:phone", handlers.GetDeviceAlarms)
+
+			// Live video (JT1078 0x9101/0x9102)
+			jt808Group.POST("/video/start", handlers.StartVideoStream)
+			jt808Group.POST("/video/control", handlers.ControlVideoStream)
+			jt808Group.POST("/video/stop", handlers.StopVideoStream)
+			jt808Group.POST("/video/switch", handlers.SwitchVideoStream)
+			jt808Group.POST("/video/pause", handlers.PauseVideoStream)
+			jt808Group.POST("/video/resume", handlers.ResumeVideoStream)
+			jt808Group.GET("/video/sessions", handlers.ListVideoSessions)
+
+			// Active safety parameters (0x8103/0x8106/0x0104)
+			jt808Group.GET("/params/active-safety/schema", handlers.GetActiveSafetyParamsSchema)
+			jt808Group.GET("/params/active-safety/:phone", handlers.GetActiveSafetyParams)
+			jt808Group.POST("/params/active-safety/:phone/query", handlers.QueryActiveSafetyParams)
+			jt808Group.POST("/params/active-safety", handlers.SetActiveSafetyParams)
+
+			// Audio/video capabilities (0x9003/0x1003)
+			jt808Group.GET("/capabilities/:phone", handlers.GetAVCapabilities)
+			jt808Group.POST("/capabilities/:phone/query", handlers.QueryAVCapabilities)
+
+			// Recorded audio/video search (0x9205/0x1205)
+			jt808Group.POST("/resources/query", handlers.QueryRecordedResources)
+
+			// Remote playback of recordings (0x9201/0x9202)
+			jt808Group.POST("/playback/start", handlers.StartPlayback)
+			jt808Group.POST("/playback/control", handlers.ControlPlayback)
+			jt808Group.POST("/playback/pause", handlers.PausePlayback)
+			jt808Group.POST("/playback/resume", handlers.ResumePlayback)
+			jt808Group.POST("/playback/stop", handlers.StopPlayback)
+			jt808Group.POST("/playback/forward", handlers.FastForwardPlayback)
+			jt808Group.POST("/playback/rewind", handlers.RewindPlayback)
+			jt808Group.POST("/playback/seek", handlers.SeekPlayback)
+			jt808Group.POST("/playback/keyframe", handlers.KeyframePlayback)
+			jt808Group.GET("/playback/sessions", handlers.ListPlaybackSessions)
+
+			// PTZ camera control (0x9301-0x9306)
+			jt808Group.POST("/ptz/rotate", handlers.PTZRotate)
+			jt808Group.POST("/ptz/focus", handlers.PTZFocus)
+			jt808Group.POST("/ptz/iris", handlers.PTZIris)
+			jt808Group.POST("/ptz/wiper", handlers.PTZWiper)
+			jt808Group.POST("/ptz/infrared", handlers.PTZInfrared)
+			jt808Group.POST("/ptz/zoom", handlers.PTZZoom)
+
+			// Recording file upload over FTP (0x9206/0x9207/0x1206) and received files
+			jt808Group.POST("/files/upload", handlers.StartFileUpload)
+			jt808Group.POST("/files/upload/control", handlers.ControlFileUpload)
+			jt808Group.GET("/files/uploads", handlers.ListFileUploads)
+			jt808Group.GET("/files/uploads/:id", handlers.GetFileUpload)
+			jt808Group.GET("/files", handlers.ListRecordedFiles)
+			jt808Group.GET("/files/:id/download", handlers.DownloadRecordedFile)
+
+			// Two-way intercom calls
+			jt808Group.POST("/call/start", handlers.StartVoIPCall)
+			jt808Group.POST("/call/control", handlers.ControlVoIPCall)
+			jt808Group.GET("/call/status/:phone", handlers.GetCallStatus)
+			jt808Group.GET("/calls", handlers.ListVoIPCalls)
+
+			// Stream notifications from the JT1078 media servers
+			jt808Group.POST("/media/stream", handlers.MediaStreamNotification)
+			jt808Group.POST("/media/loss", handlers.MediaLossNotification)
 		}
 	}
 
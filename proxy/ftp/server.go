@@ -0,0 +1,475 @@
+// Package ftp implements the small FTP server terminals upload recordings to
+// after a 0x9206 file upload request. It is a receiver only: every login is
+// confined to its own directory and files can be stored but not downloaded.
+package ftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// idleTimeout closes control connections that stop sending commands.
+	idleTimeout = 5 * time.Minute
+
+	// dataTimeout bounds waiting for the data connection of a transfer, and
+	// for the next bytes of a transfer in progress.
+	dataTimeout = 30 * time.Second
+)
+
+// Authenticator checks a login and returns the directory the session is
+// confined to.
+type Authenticator func(user, pass string) (root string, ok bool)
+
+// UploadHandler is called after a file has been stored completely. name is the
+// path inside the session root, e.g. "/CH1_20240101.mp4".
+type UploadHandler func(user, name string, size int64)
+
+// Server accepts uploads from terminals.
+type Server struct {
+	Addr         string // listen address, e.g. "0.0.0.0:2121"
+	PublicIP     string // IPv4 address announced in PASV replies; empty = local address of the control connection
+	PassiveMin   int    // passive data port range; 0 = any free port
+	PassiveMax   int
+	MaxFileSize  int64 // largest file a STOR/APPE may leave, in bytes; 0 = unlimited
+	Authenticate Authenticator
+	OnUpload     UploadHandler
+}
+
+// ListenAndServe listens on s.Addr and serves control connections until the
+// listener fails.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+type session struct {
+	server   *Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	user     string
+	root     string // empty until logged in
+	cwd      string // virtual, always absolute
+	offset   int64  // REST position for the next STOR
+	passive  net.Listener
+	activeTo string // PORT address for the next transfer
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{server: s, conn: conn, reader: bufio.NewReader(conn), cwd: "/"}
+	defer sess.closePassive()
+
+	log.Printf("[FTP] Connection from %s", conn.RemoteAddr())
+	sess.reply(220, "JT1078 file receiver ready")
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := sess.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, arg, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(command)
+
+		if command == "QUIT" {
+			sess.reply(221, "Goodbye")
+			return
+		}
+		sess.handle(command, arg)
+	}
+}
+
+func (sess *session) reply(code int, message string) {
+	fmt.Fprintf(sess.conn, "%d %s\r\n", code, message)
+}
+
+func (sess *session) handle(command, arg string) {
+	switch command {
+	case "USER":
+		sess.user, sess.root = arg, ""
+		sess.reply(331, "Password required")
+		return
+	case "PASS":
+		root, ok := "", false
+		if sess.server.Authenticate != nil {
+			root, ok = sess.server.Authenticate(sess.user, arg)
+		}
+		if !ok {
+			log.Printf("[FTP] Login refused for %q from %s", sess.user, sess.conn.RemoteAddr())
+			sess.reply(530, "Login incorrect")
+			return
+		}
+		if err := os.MkdirAll(root, 0o755); err != nil {
+			log.Printf("[FTP] Cannot create %s: %v", root, err)
+			sess.reply(550, "Upload directory unavailable")
+			return
+		}
+		sess.root, sess.cwd = root, "/"
+		log.Printf("[FTP] %s logged in from %s", sess.user, sess.conn.RemoteAddr())
+		sess.reply(230, "Logged in")
+		return
+	case "SYST":
+		sess.reply(215, "UNIX Type: L8")
+		return
+	case "FEAT":
+		fmt.Fprint(sess.conn, "211-Features:\r\n EPSV\r\n PASV\r\n REST STREAM\r\n SIZE\r\n UTF8\r\n211 End\r\n")
+		return
+	case "NOOP":
+		sess.reply(200, "OK")
+		return
+	case "OPTS":
+		sess.reply(200, "OK")
+		return
+	}
+
+	if sess.root == "" {
+		sess.reply(530, "Not logged in")
+		return
+	}
+
+	switch command {
+	case "TYPE", "MODE", "STRU":
+		sess.reply(200, "OK")
+	case "ALLO":
+		sess.reply(202, "No storage allocation necessary")
+	case "PWD", "XPWD":
+		sess.reply(257, strconv.Quote(sess.cwd))
+	case "CWD", "XCWD":
+		// Terminals often change into the upload path without creating it
+		target := sess.resolve(arg)
+		if err := os.MkdirAll(sess.localPath(target), 0o755); err != nil {
+			sess.reply(550, "Cannot change directory")
+			return
+		}
+		sess.cwd = target
+		sess.reply(250, "Directory changed to "+target)
+	case "CDUP", "XCUP":
+		sess.cwd = sess.resolve("..")
+		sess.reply(250, "Directory changed to "+sess.cwd)
+	case "MKD", "XMKD":
+		target := sess.resolve(arg)
+		if err := os.MkdirAll(sess.localPath(target), 0o755); err != nil {
+			sess.reply(550, "Cannot create directory")
+			return
+		}
+		sess.reply(257, strconv.Quote(target)+" created")
+	case "SIZE":
+		info, err := os.Stat(sess.localPath(sess.resolve(arg)))
+		if err != nil || info.IsDir() {
+			sess.reply(550, "No such file")
+			return
+		}
+		sess.reply(213, strconv.FormatInt(info.Size(), 10))
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			sess.reply(501, "Invalid offset")
+			return
+		}
+		sess.offset = offset
+		sess.reply(350, "Restarting at "+arg)
+	case "PASV":
+		sess.enterPassive(false)
+	case "EPSV":
+		sess.enterPassive(true)
+	case "PORT":
+		sess.enterActive(arg)
+	case "STOR":
+		sess.store(arg, false)
+	case "APPE":
+		sess.store(arg, true)
+	case "LIST", "NLST":
+		sess.list(command == "NLST")
+	default:
+		sess.reply(502, "Command not implemented")
+	}
+}
+
+// resolve turns a client path into a clean absolute virtual path. Cleaning an
+// absolute path drops any ".." that would climb above the session root.
+func (sess *session) resolve(name string) string {
+	if name == "" {
+		return sess.cwd
+	}
+	if !strings.HasPrefix(name, "/") {
+		name = path.Join(sess.cwd, name)
+	}
+	return path.Clean("/" + name)
+}
+
+func (sess *session) localPath(virtual string) string {
+	return filepath.Join(sess.root, filepath.FromSlash(virtual))
+}
+
+func (sess *session) enterPassive(extended bool) {
+	sess.closePassive()
+	sess.activeTo = ""
+
+	listener, err := sess.server.listenPassive()
+	if err != nil {
+		log.Printf("[FTP] No passive port available: %v", err)
+		sess.reply(425, "Cannot open data connection")
+		return
+	}
+	sess.passive = listener
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if extended {
+		sess.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+
+	host := sess.server.PublicIP
+	if host == "" {
+		host, _, _ = net.SplitHostPort(sess.conn.LocalAddr().String())
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		sess.closePassive()
+		sess.reply(425, "PASV requires an IPv4 address, use EPSV")
+		return
+	}
+	sess.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xFF))
+}
+
+func (s *Server) listenPassive() (net.Listener, error) {
+	if s.PassiveMin <= 0 || s.PassiveMax < s.PassiveMin {
+		return net.Listen("tcp", ":0")
+	}
+	var lastErr error
+	for port := s.PassiveMin; port <= s.PassiveMax; port++ {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (sess *session) closePassive() {
+	if sess.passive != nil {
+		sess.passive.Close()
+		sess.passive = nil
+	}
+}
+
+// enterActive parses a PORT argument "h1,h2,h3,h4,p1,p2".
+func (sess *session) enterActive(arg string) {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		sess.reply(501, "Invalid PORT argument")
+		return
+	}
+	values := make([]int, 6)
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 0 || value > 255 {
+			sess.reply(501, "Invalid PORT argument")
+			return
+		}
+		values[i] = value
+	}
+	// Data connections only go back to the client, so a login cannot make
+	// the server connect to other hosts (FTP bounce)
+	ip := net.IPv4(byte(values[0]), byte(values[1]), byte(values[2]), byte(values[3]))
+	if !ip.Equal(sess.peerIP()) {
+		sess.reply(501, "PORT must name the client's own address")
+		return
+	}
+	sess.closePassive()
+	host := ip.String()
+	sess.activeTo = net.JoinHostPort(host, strconv.Itoa(values[4]<<8|values[5]))
+	sess.reply(200, "PORT command successful")
+}
+
+// openData returns the data connection prepared by the last PASV/EPSV/PORT.
+func (sess *session) openData() (net.Conn, error) {
+	if sess.activeTo != "" {
+		address := sess.activeTo
+		sess.activeTo = ""
+		return net.DialTimeout("tcp", address, dataTimeout)
+	}
+	if sess.passive == nil {
+		return nil, fmt.Errorf("no data connection prepared")
+	}
+	defer sess.closePassive()
+	sess.passive.(*net.TCPListener).SetDeadline(time.Now().Add(dataTimeout))
+	for {
+		conn, err := sess.passive.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// Only the client may connect to its passive port
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; ip.Equal(sess.peerIP()) {
+			return conn, nil
+		}
+		log.Printf("[FTP] Data connection from %s refused: not the client %s", conn.RemoteAddr(), sess.peerIP())
+		conn.Close()
+	}
+}
+
+// peerIP is the address of the client's control connection.
+func (sess *session) peerIP() net.IP {
+	return sess.conn.RemoteAddr().(*net.TCPAddr).IP
+}
+
+func (sess *session) store(name string, appendMode bool) {
+	offset := sess.offset
+	sess.offset = 0
+	if name == "" {
+		sess.reply(501, "File name required")
+		return
+	}
+
+	virtual := sess.resolve(name)
+	local := sess.localPath(virtual)
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		sess.reply(550, "Cannot create directory")
+		return
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case appendMode:
+		flags |= os.O_APPEND
+	case offset == 0:
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(local, flags, 0o644)
+	if err != nil {
+		sess.reply(550, "Cannot create file")
+		return
+	}
+	defer file.Close()
+	if offset > 0 && !appendMode {
+		if err := file.Truncate(offset); err != nil {
+			sess.reply(550, "Cannot resume file")
+			return
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			sess.reply(550, "Cannot resume file")
+			return
+		}
+	}
+
+	if appendMode {
+		info, err := file.Stat()
+		if err != nil {
+			sess.reply(550, "Cannot read file")
+			return
+		}
+		offset = info.Size()
+	}
+	limit := sess.server.MaxFileSize
+	if limit > 0 && offset >= limit {
+		sess.reply(552, "File size limit exceeded")
+		return
+	}
+
+	sess.reply(150, "Ready to receive "+virtual)
+	data, err := sess.openData()
+	if err != nil {
+		sess.reply(425, "Cannot open data connection")
+		return
+	}
+	var reader io.Reader = &deadlineReader{conn: data}
+	if limit > 0 {
+		// One byte over the limit tells a file too large from one that fits
+		reader = io.LimitReader(reader, limit-offset+1)
+	}
+	written, err := io.Copy(file, reader)
+	data.Close()
+	if err == nil && limit > 0 && offset+written > limit {
+		// What this transfer wrote is dropped; a resumable part is kept
+		log.Printf("[FTP] Upload of %s by %s refused: larger than %d bytes", virtual, sess.user, limit)
+		file.Truncate(offset)
+		sess.reply(552, "File size limit exceeded")
+		return
+	}
+	if err != nil {
+		// The partial file is kept so the terminal can resume with REST or APPE
+		log.Printf("[FTP] Upload of %s by %s interrupted after %d bytes: %v", virtual, sess.user, written, err)
+		sess.reply(426, "Transfer aborted")
+		return
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		sess.reply(451, "Cannot read stored file")
+		return
+	}
+	sess.reply(226, "Transfer complete")
+	log.Printf("[FTP] %s stored %s (%d bytes)", sess.user, virtual, info.Size())
+	if sess.server.OnUpload != nil {
+		sess.server.OnUpload(sess.user, virtual, info.Size())
+	}
+}
+
+// deadlineReader reads a data connection, failing once no bytes arrived for
+// dataTimeout.
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(dataTimeout))
+	return r.conn.Read(p)
+}
+
+// list sends the current directory in "ls -l" format (or names only for NLST).
+func (sess *session) list(namesOnly bool) {
+	entries, err := os.ReadDir(sess.localPath(sess.cwd))
+	if err != nil {
+		sess.reply(550, "Cannot list directory")
+		return
+	}
+
+	sess.reply(150, "Here comes the directory listing")
+	data, err := sess.openData()
+	if err != nil {
+		sess.reply(425, "Cannot open data connection")
+		return
+	}
+	writer := bufio.NewWriter(data)
+	for _, entry := range entries {
+		if namesOnly {
+			fmt.Fprintf(writer, "%s\r\n", entry.Name())
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		mode := "-rw-r--r--"
+		if info.IsDir() {
+			mode = "drwxr-xr-x"
+		}
+		fmt.Fprintf(writer, "%s 1 ftp ftp %12d %s %s\r\n", mode, info.Size(), info.ModTime().Format("Jan _2 15:04"), entry.Name())
+	}
+	writer.Flush()
+	data.Close()
+	sess.reply(226, "Directory send OK")
+}
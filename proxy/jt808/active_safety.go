@@ -0,0 +1,228 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"proxy/models"
+	"strings"
+)
+
+// Active safety additional item IDs carried in 0x0200 by Su-standard
+// (T/JSATL 12) terminals.
+const (
+	ItemADAS byte = 0x64
+	ItemDSM  byte = 0x65
+	ItemTPMS byte = 0x66
+	ItemBSD  byte = 0x67
+)
+
+// AlarmIdentificationSize is the length of the alarm identification number
+// (Table 33) that ties an active safety alarm to its attachments.
+const AlarmIdentificationSize = 16
+
+// Minimum item lengths up to and including the alarm identification number.
+const (
+	adasItemSize = 47
+	dsmItemSize  = 47
+	tpmsItemSize = 40
+	bsdItemSize  = 41
+	tireDataSize = 9
+)
+
+// activeSafetySources names the active safety item IDs.
+var activeSafetySources = map[byte]string{
+	ItemADAS: "adas",
+	ItemDSM:  "dsm",
+	ItemTPMS: "tpms",
+	ItemBSD:  "bsd",
+}
+
+// adasAlarmNames names the ADAS alarm/event types (Table 30); 0x08-0x0F and
+// 0x12-0x1F are manufacturer defined.
+var adasAlarmNames = map[int]string{
+	0x01: "forward_collision",
+	0x02: "lane_departure",
+	0x03: "headway_too_close",
+	0x04: "pedestrian_collision",
+	0x05: "frequent_lane_change",
+	0x06: "road_sign_overrun",
+	0x07: "obstacle",
+	0x10: "road_sign_recognition",
+	0x11: "active_capture",
+}
+
+// dsmAlarmNames names the DSM alarm/event types (Table 31).
+var dsmAlarmNames = map[int]string{
+	0x01: "fatigue_driving",
+	0x02: "phone_call",
+	0x03: "smoking",
+	0x04: "distracted_driving",
+	0x05: "driver_abnormal",
+	0x10: "auto_capture",
+	0x11: "driver_change",
+}
+
+// bsdAlarmNames names the blind spot alarm types (Table 32).
+var bsdAlarmNames = map[int]string{
+	0x01: "rear_approach",
+	0x02: "left_rear_approach",
+	0x03: "right_rear_approach",
+}
+
+// tireAlarmNames names the bits of a TPMS tire alarm type.
+var tireAlarmNames = map[int]string{
+	0: "pressure_report",
+	1: "high_pressure",
+	2: "low_pressure",
+	3: "high_temperature",
+	4: "sensor_fault",
+	5: "pressure_imbalance",
+	6: "slow_leak",
+	7: "low_battery",
+}
+
+var deviationNames = map[int]string{1: "left", 2: "right"}
+
+var roadSignNames = map[int]string{1: "speed_limit", 2: "height_limit", 3: "weight_limit"}
+
+var alarmFlagStates = map[byte]string{1: "start", 2: "end"}
+
+// ParseActiveSafetyAlarms decodes the ADAS, DSM, TPMS and BSD items
+// (0x64-0x67) of a location report. Items too short to decode are reported in
+// the error; the alarms decoded from the others are still returned.
+func ParseActiveSafetyAlarms(items map[byte][]byte) ([]models.ActiveSafetyAlarm, error) {
+	var alarms []models.ActiveSafetyAlarm
+	var errs []string
+	for _, id := range []byte{ItemADAS, ItemDSM, ItemTPMS, ItemBSD} {
+		data, ok := items[id]
+		if !ok {
+			continue
+		}
+		alarm, err := parseActiveSafetyItem(id, data)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		alarms = append(alarms, *alarm)
+	}
+	if len(errs) > 0 {
+		return alarms, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return alarms, nil
+}
+
+func parseActiveSafetyItem(id byte, data []byte) (*models.ActiveSafetyAlarm, error) {
+	minSize := map[byte]int{ItemADAS: adasItemSize, ItemDSM: dsmItemSize, ItemTPMS: tpmsItemSize, ItemBSD: bsdItemSize}[id]
+	if len(data) < minSize {
+		return nil, fmt.Errorf("%s item too short: %d bytes", activeSafetySources[id], len(data))
+	}
+
+	alarm := &models.ActiveSafetyAlarm{
+		Source:  activeSafetySources[id],
+		AlarmID: binary.BigEndian.Uint32(data[0:4]),
+		Status:  alarmFlagStates[data[4]],
+	}
+
+	// Offset of the common speed, altitude, position, time and vehicle status block
+	common := 12
+	switch id {
+	case ItemADAS:
+		alarm.TypeCode = int(data[5])
+		alarm.Type = activeSafetyTypeName(adasAlarmNames, alarm.TypeCode)
+		alarm.Level = int(data[6])
+		switch alarm.TypeCode {
+		case 0x01, 0x02:
+			alarm.FrontSpeed = int(data[7])
+			alarm.FrontDistance = int(data[8])
+		case 0x04:
+			alarm.FrontDistance = int(data[8])
+		}
+		if alarm.TypeCode == 0x02 {
+			alarm.Deviation = deviationNames[int(data[9])]
+		}
+		if alarm.TypeCode == 0x06 || alarm.TypeCode == 0x10 {
+			alarm.RoadSign = roadSignNames[int(data[10])]
+			alarm.RoadSignValue = int(data[11])
+		}
+	case ItemDSM:
+		alarm.TypeCode = int(data[5])
+		alarm.Type = activeSafetyTypeName(dsmAlarmNames, alarm.TypeCode)
+		alarm.Level = int(data[6])
+		if alarm.TypeCode == 0x01 {
+			alarm.FatigueLevel = int(data[7])
+		}
+	case ItemTPMS:
+		alarm.Type = "tire_pressure"
+		common = 5
+	case ItemBSD:
+		alarm.TypeCode = int(data[5])
+		alarm.Type = activeSafetyTypeName(bsdAlarmNames, alarm.TypeCode)
+		common = 6
+	}
+
+	alarm.Speed = int(data[common])
+	alarm.Altitude = int(binary.BigEndian.Uint16(data[common+1 : common+3]))
+	alarm.Latitude = float64(binary.BigEndian.Uint32(data[common+3:common+7])) / 1e6
+	alarm.Longitude = float64(binary.BigEndian.Uint32(data[common+7:common+11])) / 1e6
+	alarm.DeviceTime = bcdToTimeString(data[common+11 : common+17])
+	alarm.VehicleStatus = binary.BigEndian.Uint16(data[common+17 : common+19])
+	alarm.Identification = ParseAlarmIdentification(data[common+19 : common+19+AlarmIdentificationSize])
+
+	if id == ItemTPMS {
+		tires, err := parseTireAlarms(data[tpmsItemSize:])
+		if err != nil {
+			return nil, err
+		}
+		alarm.Tires = tires
+	}
+	return alarm, nil
+}
+
+// parseTireAlarms decodes the tire alarm event list that follows the TPMS
+// alarm identification number.
+func parseTireAlarms(data []byte) ([]models.TireAlarm, error) {
+	tires := make([]models.TireAlarm, 0)
+	if len(data) == 0 {
+		return tires, nil
+	}
+	count := int(data[0])
+	data = data[1:]
+	if len(data) < count*tireDataSize {
+		return nil, fmt.Errorf("tpms item truncated: %d tire events in %d bytes", count, len(data))
+	}
+	for i := 0; i < count; i++ {
+		entry := data[i*tireDataSize : (i+1)*tireDataSize]
+		tire := models.TireAlarm{
+			Position:    int(entry[0]),
+			AlarmFlags:  binary.BigEndian.Uint16(entry[1:3]),
+			Alarms:      make([]string, 0),
+			Pressure:    int(binary.BigEndian.Uint16(entry[3:5])),
+			Temperature: int(int16(binary.BigEndian.Uint16(entry[5:7]))),
+			Battery:     int(binary.BigEndian.Uint16(entry[7:9])),
+		}
+		for _, bit := range setBits(uint64(tire.AlarmFlags)) {
+			tire.Alarms = append(tire.Alarms, bitName(tireAlarmNames, bit))
+		}
+		tires = append(tires, tire)
+	}
+	return tires, nil
+}
+
+// ParseAlarmIdentification decodes an alarm identification number (Table 33).
+func ParseAlarmIdentification(data []byte) models.AlarmIdentification {
+	return models.AlarmIdentification{
+		TerminalID:  trimPadding(data[0:7]),
+		Time:        bcdToTimeString(data[7:13]),
+		Serial:      int(data[13]),
+		Attachments: int(data[14]),
+		Raw:         hex.EncodeToString(data[:AlarmIdentificationSize]),
+	}
+}
+
+func activeSafetyTypeName(names map[int]string, code int) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("custom_0x%02X", code)
+}
@@ -0,0 +1,148 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"proxy/models"
+	"strings"
+)
+
+// AttachmentDataMagic starts every file data packet on the attachment
+// server connection (Table 65); everything else is a 0x7e framed message.
+var AttachmentDataMagic = []byte{0x30, 0x31, 0x63, 0x64}
+
+// AttachmentDataHeaderSize is the length of a file data packet header.
+const AttachmentDataHeaderSize = 62
+
+// AlarmNumberSize is the length of the platform-assigned alarm number.
+const AlarmNumberSize = 32
+
+// attachmentFileTypes names the file types of 0x1211/0x1212 (Table 64).
+var attachmentFileTypes = map[byte]string{
+	0: "photo",
+	1: "audio",
+	2: "video",
+	3: "text",
+	4: "other",
+}
+
+// AttachmentFileTypeName names an attachment file type byte.
+func AttachmentFileTypeName(fileType byte) string {
+	if name, ok := attachmentFileTypes[fileType]; ok {
+		return name
+	}
+	return fmt.Sprintf("type_%d", fileType)
+}
+
+// BuildAlarmAttachmentUploadBody builds the body of a 0x9208 alarm attachment
+// upload instruction (Table 61) pointing the terminal at the attachment server.
+func BuildAlarmAttachmentUploadBody(serverIP string, port int, identification []byte, alarmNumber string) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(serverIP)))
+	body.WriteString(serverIP)
+	binary.Write(&body, binary.BigEndian, uint16(port))
+	binary.Write(&body, binary.BigEndian, uint16(0)) // reserved (UDP port)
+	body.Write(fixedBytes(identification, AlarmIdentificationSize))
+	body.Write(fixedBytes([]byte(alarmNumber), AlarmNumberSize))
+	body.Write(make([]byte, 16)) // reserved
+	return body.Bytes()
+}
+
+// ParseAlarmAttachmentInfo decodes a 0x1210 alarm attachment information
+// message (Tables 62 and 63).
+func ParseAlarmAttachmentInfo(body []byte) (*models.AlarmAttachmentInfo, error) {
+	const fixedSize = 7 + AlarmIdentificationSize + AlarmNumberSize + 2
+	if len(body) < fixedSize {
+		return nil, fmt.Errorf("alarm attachment information too short: %d bytes", len(body))
+	}
+
+	info := &models.AlarmAttachmentInfo{
+		TerminalID:     trimPadding(body[0:7]),
+		Identification: ParseAlarmIdentification(body[7 : 7+AlarmIdentificationSize]),
+		AlarmNumber:    trimPadding(body[23 : 23+AlarmNumberSize]),
+		Supplementary:  body[55] == 1,
+		Files:          make([]models.AttachmentFileInfo, 0),
+	}
+	count := int(body[56])
+	offset := fixedSize
+	for i := 0; i < count; i++ {
+		if offset >= len(body) {
+			return info, fmt.Errorf("attachment list truncated after %d of %d files", i, count)
+		}
+		nameLen := int(body[offset])
+		if offset+1+nameLen+4 > len(body) {
+			return info, fmt.Errorf("attachment list truncated after %d of %d files", i, count)
+		}
+		info.Files = append(info.Files, models.AttachmentFileInfo{
+			Name: string(body[offset+1 : offset+1+nameLen]),
+			Size: binary.BigEndian.Uint32(body[offset+1+nameLen:]),
+		})
+		offset += 1 + nameLen + 4
+	}
+	return info, nil
+}
+
+// ParseAttachmentFileInfo decodes the body of a 0x1211 file information
+// upload or a 0x1212 file upload completion (Tables 64 and 66).
+func ParseAttachmentFileInfo(body []byte) (*models.AttachmentFileInfo, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("attachment file information empty")
+	}
+	nameLen := int(body[0])
+	if len(body) < 1+nameLen+5 {
+		return nil, fmt.Errorf("attachment file information too short: %d bytes", len(body))
+	}
+	fileType := body[1+nameLen]
+	return &models.AttachmentFileInfo{
+		Name:     string(body[1 : 1+nameLen]),
+		FileType: AttachmentFileTypeName(fileType),
+		TypeCode: fileType,
+		Size:     binary.BigEndian.Uint32(body[2+nameLen:]),
+	}, nil
+}
+
+// ParseAttachmentDataHeader decodes the header of a file data packet
+// (Table 65); the data body of dataLength bytes follows it.
+func ParseAttachmentDataHeader(header []byte) (name string, offset, dataLength uint32, err error) {
+	if len(header) < AttachmentDataHeaderSize || !bytes.Equal(header[0:4], AttachmentDataMagic) {
+		return "", 0, 0, fmt.Errorf("invalid attachment data header")
+	}
+	return trimPadding(header[4:54]), binary.BigEndian.Uint32(header[54:58]), binary.BigEndian.Uint32(header[58:62]), nil
+}
+
+// BuildAttachmentCompleteResponseBody builds the body of a 0x9212 file upload
+// completion response (Tables 67 and 68). An empty missing list tells the
+// terminal the file is complete; otherwise it must resend those ranges.
+func BuildAttachmentCompleteResponseBody(name string, fileType byte, missing []models.FileRange) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(name)))
+	body.WriteString(name)
+	body.WriteByte(fileType)
+	if len(missing) == 0 {
+		body.WriteByte(0x00) // finished
+		body.WriteByte(0)
+		return body.Bytes()
+	}
+	if len(missing) > 255 {
+		missing = missing[:255]
+	}
+	body.WriteByte(0x01) // supplementary upload needed
+	body.WriteByte(byte(len(missing)))
+	for _, r := range missing {
+		binary.Write(&body, binary.BigEndian, r.Offset)
+		binary.Write(&body, binary.BigEndian, r.Length)
+	}
+	return body.Bytes()
+}
+
+// fixedBytes pads or truncates data to size bytes.
+func fixedBytes(data []byte, size int) []byte {
+	out := make([]byte, size)
+	copy(out, data)
+	return out
+}
+
+func trimPadding(data []byte) string {
+	return strings.TrimRight(string(data), "\x00 ")
+}
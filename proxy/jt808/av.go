@@ -0,0 +1,108 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"proxy/models"
+)
+
+// codecNames maps JT/T 1078 Table 12 audio/video coding types to names.
+var codecNames = map[int]string{
+	1: "G.721", 2: "G.722", 3: "G.723", 4: "G.728", 5: "G.729",
+	6: "G.711A", 7: "G.711U", 8: "G.726", 9: "G.729A",
+	10: "DVI4_3", 11: "DVI4_4", 12: "DVI4_8K", 13: "DVI4_16K",
+	14: "LPC", 15: "S16BE_STEREO", 16: "S16BE_MONO", 17: "MPEGAUDIO",
+	18: "LPCM", 19: "AAC", 20: "WMA9STD", 21: "HEAAC", 22: "PCM_VOICE",
+	23: "PCM_AUDIO", 24: "AACLC", 25: "MP3", 26: "ADPCMA", 27: "MP4AUDIO",
+	28: "AMR", 91: "TRANSPARENT",
+	98: "H.264", 99: "H.265", 100: "AVS", 101: "SVAC",
+}
+
+// CodecName returns the Table 12 name of a coding type.
+func CodecName(code int) string {
+	if name, ok := codecNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", code)
+}
+
+// ParseAVAttributes decodes the body of a 0x1003 audio/video attribute upload
+// (JT/T 1078 Table 11).
+func ParseAVAttributes(body []byte) (*models.AVCapabilities, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("AV attribute upload too short: %d bytes", len(body))
+	}
+
+	sampleRates := []int{8000, 22050, 44100, 48000}
+	sampleBits := []int{8, 16, 32}
+
+	caps := &models.AVCapabilities{
+		AudioCodec:       int(body[0]),
+		AudioCodecName:   CodecName(int(body[0])),
+		AudioChannels:    int(body[1]),
+		AudioFrameLength: int(binary.BigEndian.Uint16(body[4:6])),
+		AudioOutput:      body[6] == 1,
+		VideoCodec:       int(body[7]),
+		VideoCodecName:   CodecName(int(body[7])),
+		MaxAudioChannels: int(body[8]),
+		MaxVideoChannels: int(body[9]),
+	}
+	if int(body[2]) < len(sampleRates) {
+		caps.SampleRate = sampleRates[body[2]]
+	}
+	if int(body[3]) < len(sampleBits) {
+		caps.SampleBits = sampleBits[body[3]]
+	}
+	return caps, nil
+}
+
+// BuildRealtimeAVRequestBody builds the body of a 0x9101 real-time audio/video
+// transmission request (JT/T 1078 Table 17).
+func BuildRealtimeAVRequestBody(serverIP string, tcpPort, udpPort, channel, dataType, streamType int) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(serverIP)))
+	body.WriteString(serverIP)
+	binary.Write(&body, binary.BigEndian, uint16(tcpPort))
+	binary.Write(&body, binary.BigEndian, uint16(udpPort))
+	body.WriteByte(byte(channel))
+	body.WriteByte(byte(dataType))   // 0=AV, 1=video, 2=intercom, 3=monitor, 4=broadcast, 5=transparent
+	body.WriteByte(byte(streamType)) // 0=main, 1=sub
+	return body.Bytes()
+}
+
+// BuildRealtimeAVControlBody builds the body of a 0x9102 real-time audio/video
+// transmission control (JT/T 1078 Table 18).
+func BuildRealtimeAVControlBody(channel, command, closeAVType, switchStreamType int) []byte {
+	return []byte{
+		byte(channel),
+		byte(command),          // 0=close, 1=switch stream, 2=pause, 3=resume, 4=close intercom
+		byte(closeAVType),      // 0=audio and video, 1=audio only, 2=video only
+		byte(switchStreamType), // 0=main, 1=sub
+	}
+}
+
+// BuildTransmissionStatusBody builds the body of a 0x9105 real-time
+// transmission status notice (JT/T 1078 Table 20). lossPercent is the packet
+// loss rate multiplied by 100.
+func BuildTransmissionStatusBody(channel, lossPercent int) []byte {
+	return []byte{byte(channel), byte(lossPercent)}
+}
+
+// BuildAudioParamsBody builds the 0x8103 body carrying the vendor audio parameter
+// block (ID 0x0074) our terminals expect before a two-way intercom: codec per
+// JT/T 1078 Table 12, 8 kHz, 8-bit, mono, 20 ms frames, audio output enabled.
+func BuildAudioParamsBody(codec byte) []byte {
+	var body bytes.Buffer
+	body.WriteByte(0x01) // Parameter count
+	binary.Write(&body, binary.BigEndian, uint32(0x0074))
+	body.WriteByte(0x0B) // Parameter length
+	body.WriteByte(codec)
+	body.WriteByte(0x00)                                 // Sample rate: 8 kHz
+	body.WriteByte(0x00)                                 // Bit depth: 8-bit
+	body.WriteByte(0x00)                                 // Channels: mono
+	binary.Write(&body, binary.BigEndian, uint16(20))    // Frame length (ms)
+	body.WriteByte(0x01)                                 // Audio output enabled
+	binary.Write(&body, binary.BigEndian, uint32(64000)) // Bitrate (bps)
+	return body.Bytes()
+}
@@ -0,0 +1,46 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"proxy/models"
+)
+
+// ParseCANBusData decodes the body of a 0x0705 CAN bus data upload.
+// Layout: WORD item count, BCD[5] receive time (hh mm ss msms), then per item
+// a DWORD CAN ID (bit31 channel, bit30 frame type, bit29 collection mode,
+// bits 28-0 bus ID) followed by 8 data bytes.
+func ParseCANBusData(body []byte) (*models.CANBusUpload, error) {
+	if len(body) < 7 {
+		return nil, fmt.Errorf("CAN bus upload too short: %d bytes", len(body))
+	}
+
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+	timeBCD := bcdToString(body[2:7])
+	upload := &models.CANBusUpload{
+		ReceiveTime: fmt.Sprintf("%s:%s:%s.%s", timeBCD[0:2], timeBCD[2:4], timeBCD[4:6], timeBCD[7:10]),
+		Frames:      make([]models.CANFrame, 0, count),
+	}
+
+	offset := 7
+	for i := 0; i < count; i++ {
+		if offset+12 > len(body) {
+			return upload, fmt.Errorf("CAN bus upload truncated at item %d of %d", i+1, count)
+		}
+		rawID := binary.BigEndian.Uint32(body[offset : offset+4])
+		data := make([]byte, 8)
+		copy(data, body[offset+4:offset+12])
+
+		upload.Frames = append(upload.Frames, models.CANFrame{
+			ID:       rawID & 0x1FFFFFFF,
+			Channel:  int(rawID>>31) & 0x01,
+			Extended: rawID&0x40000000 != 0,
+			Averaged: rawID&0x20000000 != 0,
+			Data:     data,
+			DataHex:  hex.EncodeToString(data),
+		})
+		offset += 12
+	}
+	return upload, nil
+}
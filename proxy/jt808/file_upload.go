@@ -0,0 +1,58 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Task execution conditions of a 0x9206 file upload (JT/T 1078 Table 26).
+const (
+	UploadOverWiFi   = 1 << 0
+	UploadOverLAN    = 1 << 1
+	UploadOverMobile = 1 << 2 // 3G/4G
+)
+
+// BuildFileUploadBody builds the body of a 0x9206 file upload request
+// (JT/T 1078 Table 26), asking the terminal to upload the recordings matching
+// the conditions to the given FTP server.
+func BuildFileUploadBody(serverIP string, port int, user, password, uploadPath string, channel int, start, end time.Time, alarmFlags uint64, avType, streamType, storageType int, conditions byte) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(serverIP)))
+	body.WriteString(serverIP)
+	binary.Write(&body, binary.BigEndian, uint16(port))
+	body.WriteByte(byte(len(user)))
+	body.WriteString(user)
+	body.WriteByte(byte(len(password)))
+	body.WriteString(password)
+	body.WriteByte(byte(len(uploadPath)))
+	body.WriteString(uploadPath)
+	body.WriteByte(byte(channel))
+	body.Write(timeToBCD(start))
+	body.Write(timeToBCD(end))
+	binary.Write(&body, binary.BigEndian, alarmFlags)
+	body.WriteByte(byte(avType))      // 0=AV, 1=audio, 2=video, 3=audio or video
+	body.WriteByte(byte(streamType))  // 0=any, 1=main, 2=sub
+	body.WriteByte(byte(storageType)) // 0=any, 1=main, 2=disaster recovery
+	body.WriteByte(conditions)
+	return body.Bytes()
+}
+
+// BuildFileUploadControlBody builds the body of a 0x9207 file upload control
+// (JT/T 1078 Table 28) for the 0x9206 request with the given serial.
+func BuildFileUploadControlBody(uploadSerial uint16, control int) []byte {
+	body := make([]byte, 3)
+	binary.BigEndian.PutUint16(body[0:2], uploadSerial)
+	body[2] = byte(control) // 0=pause, 1=continue, 2=cancel
+	return body
+}
+
+// ParseFileUploadComplete decodes a 0x1206 file upload completion notice
+// (JT/T 1078 Table 27). A zero result means every file was uploaded.
+func ParseFileUploadComplete(body []byte) (uploadSerial uint16, result byte, err error) {
+	if len(body) < 3 {
+		return 0, 0, fmt.Errorf("file upload completion too short: %d bytes", len(body))
+	}
+	return binary.BigEndian.Uint16(body[0:2]), body[2], nil
+}
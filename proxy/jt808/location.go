@@ -0,0 +1,145 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"fmt"
+	"proxy/models"
+)
+
+// locationBasicSize is the length of the basic information of a 0x0200
+// location report (JT/T 808 Table 23) before the additional items.
+const locationBasicSize = 28
+
+// JT/T 1078 Table 13 additional item IDs carried in 0x0200.
+const (
+	ItemVideoAlarm      byte = 0x14
+	ItemSignalLoss      byte = 0x15
+	ItemSignalOcclusion byte = 0x16
+	ItemStorageFault    byte = 0x17
+	ItemAbnormalDriving byte = 0x18
+)
+
+// videoAlarmNames names the bits of the 0x14 video alarm flags (JT/T 1078 Table 14).
+var videoAlarmNames = map[int]string{
+	0: "video_signal_loss",
+	1: "video_occlusion",
+	2: "storage_fault",
+	3: "video_equipment_fault",
+	4: "bus_overload",
+	5: "abnormal_driving",
+	6: "special_recording_threshold",
+}
+
+// drivingBehaviorNames names the bits of the 0x18 abnormal driving behavior
+// type (JT/T 1078 Table 15); bits 11-15 are manufacturer defined.
+var drivingBehaviorNames = map[int]string{
+	0: "fatigue",
+	1: "phone_call",
+	2: "smoking",
+}
+
+// ParseLocationReport decodes the basic information of a 0x0200 location
+// report and collects its additional items by ID.
+func ParseLocationReport(body []byte) (*models.LocationReport, error) {
+	if len(body) < locationBasicSize {
+		return nil, fmt.Errorf("location report too short: %d bytes", len(body))
+	}
+
+	status := binary.BigEndian.Uint32(body[4:8])
+	report := &models.LocationReport{
+		AlarmFlags: binary.BigEndian.Uint32(body[0:4]),
+		Status:     status,
+		Latitude:   float64(binary.BigEndian.Uint32(body[8:12])) / 1e6,
+		Longitude:  float64(binary.BigEndian.Uint32(body[12:16])) / 1e6,
+		Altitude:   int(binary.BigEndian.Uint16(body[16:18])),
+		Speed:      float64(binary.BigEndian.Uint16(body[18:20])) / 10,
+		Direction:  int(binary.BigEndian.Uint16(body[20:22])),
+		Time:       bcdToTimeString(body[22:28]),
+		Items:      make(map[byte][]byte),
+	}
+	if status&(1<<2) != 0 {
+		report.Latitude = -report.Latitude // south
+	}
+	if status&(1<<3) != 0 {
+		report.Longitude = -report.Longitude // west
+	}
+
+	offset := locationBasicSize
+	for offset+2 <= len(body) {
+		id, length := body[offset], int(body[offset+1])
+		offset += 2
+		if offset+length > len(body) {
+			return report, fmt.Errorf("additional item 0x%02X truncated", id)
+		}
+		report.Items[id] = body[offset : offset+length]
+		offset += length
+	}
+	return report, nil
+}
+
+// ParseVideoAlarms decodes the JT/T 1078 items 0x14-0x18 of a location
+// report. Slices of items the report does not carry are left nil; it returns
+// nil when none of the items is present.
+func ParseVideoAlarms(items map[byte][]byte) *models.VideoAlarmStatus {
+	status := &models.VideoAlarmStatus{}
+	found := false
+
+	if data, ok := items[ItemVideoAlarm]; ok && len(data) >= 4 {
+		found = true
+		status.AlarmFlags = binary.BigEndian.Uint32(data)
+		status.Alarms = make([]string, 0)
+		for _, bit := range setBits(uint64(status.AlarmFlags)) {
+			status.Alarms = append(status.Alarms, bitName(videoAlarmNames, bit))
+		}
+	}
+	if data, ok := items[ItemSignalLoss]; ok && len(data) >= 4 {
+		found = true
+		status.SignalLossChannels = channelBits(binary.BigEndian.Uint32(data))
+	}
+	if data, ok := items[ItemSignalOcclusion]; ok && len(data) >= 4 {
+		found = true
+		status.OcclusionChannels = channelBits(binary.BigEndian.Uint32(data))
+	}
+	if data, ok := items[ItemStorageFault]; ok && len(data) >= 2 {
+		found = true
+		status.StorageFaults = make([]string, 0)
+		for _, bit := range setBits(uint64(binary.BigEndian.Uint16(data))) {
+			if bit < 12 {
+				status.StorageFaults = append(status.StorageFaults, fmt.Sprintf("main_%d", bit+1))
+			} else {
+				status.StorageFaults = append(status.StorageFaults, fmt.Sprintf("backup_%d", bit-11))
+			}
+		}
+	}
+	if data, ok := items[ItemAbnormalDriving]; ok && len(data) >= 2 {
+		found = true
+		status.DrivingBehaviors = make([]string, 0)
+		for _, bit := range setBits(uint64(binary.BigEndian.Uint16(data))) {
+			status.DrivingBehaviors = append(status.DrivingBehaviors, bitName(drivingBehaviorNames, bit))
+		}
+		if len(data) >= 3 {
+			status.FatigueLevel = int(data[2])
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return status
+}
+
+// channelBits converts a per-channel DWORD (bit0 = channel 1) to channel numbers.
+func channelBits(flags uint32) []int {
+	channels := make([]int, 0)
+	for _, bit := range setBits(uint64(flags)) {
+		channels = append(channels, bit+1)
+	}
+	return channels
+}
+
+func bitName(names map[int]string, bit int) string {
+	if name, ok := names[bit]; ok {
+		return name
+	}
+	return fmt.Sprintf("bit_%d", bit)
+}
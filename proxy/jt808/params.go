@@ -0,0 +1,269 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"proxy/models"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Active safety parameter IDs of 0x8103/0x8106 (Table 11).
+const (
+	ParamADAS uint32 = 0xF364
+	ParamDMS  uint32 = 0xF365
+	ParamBSD  uint32 = 0xF367
+)
+
+// Lengths of the active safety parameter blocks (Tables 17-19).
+const (
+	adasParamsSize = 56
+	dmsParamsSize  = 49
+	bsdParamsSize  = 2
+)
+
+// paramField describes one field of a parameter block, from its param tag.
+type paramField struct {
+	index      int
+	name       string
+	offset     int
+	size       int
+	min, max   int
+	def        int
+	hasDefault bool
+	unit       string
+}
+
+// paramFields reads the param tags of a parameter block struct.
+func paramFields(t reflect.Type) []paramField {
+	var fields []paramField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("param")
+		if tag == "" {
+			continue
+		}
+		field := paramField{index: i, name: strings.Split(t.Field(i).Tag.Get("json"), ",")[0]}
+		for _, part := range strings.Split(tag, ",") {
+			key, value, _ := strings.Cut(part, "=")
+			n, _ := strconv.Atoi(value)
+			switch key {
+			case "offset":
+				field.offset = n
+			case "size":
+				field.size = n
+			case "min":
+				field.min = n
+			case "max":
+				field.max = n
+			case "default":
+				field.def, field.hasDefault = n, true
+			case "unit":
+				field.unit = value
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// encodeParamBlock lays out a parameter block. Fields left nil, and reserved
+// bytes, are 0xFF: "do not modify" for the terminal.
+func encodeParamBlock(block interface{}, size int) []byte {
+	data := bytes.Repeat([]byte{0xFF}, size)
+	v := reflect.ValueOf(block).Elem()
+	for _, field := range paramFields(v.Type()) {
+		value := v.Field(field.index)
+		if value.IsNil() {
+			continue
+		}
+		n := value.Elem().Int()
+		switch field.size {
+		case 1:
+			data[field.offset] = byte(n)
+		case 2:
+			binary.BigEndian.PutUint16(data[field.offset:], uint16(n))
+		case 4:
+			binary.BigEndian.PutUint32(data[field.offset:], uint32(n))
+		}
+	}
+	return data
+}
+
+// decodeParamBlock fills a parameter block from the terminal's value. Fields
+// beyond a short value are left nil.
+func decodeParamBlock(data []byte, block interface{}) {
+	v := reflect.ValueOf(block).Elem()
+	for _, field := range paramFields(v.Type()) {
+		if field.offset+field.size > len(data) {
+			continue
+		}
+		var n int
+		switch field.size {
+		case 1:
+			n = int(data[field.offset])
+		case 2:
+			n = int(binary.BigEndian.Uint16(data[field.offset:]))
+		case 4:
+			n = int(binary.BigEndian.Uint32(data[field.offset:]))
+		}
+		v.Field(field.index).Set(reflect.ValueOf(&n))
+	}
+}
+
+// validateParamBlock checks the fields that are set against their ranges.
+func validateParamBlock(prefix string, block interface{}) error {
+	v := reflect.ValueOf(block).Elem()
+	for _, field := range paramFields(v.Type()) {
+		value := v.Field(field.index)
+		if value.IsNil() {
+			continue
+		}
+		if n := int(value.Elem().Int()); n < field.min || n > field.max {
+			return fmt.Errorf("%s.%s must be %d-%d", prefix, field.name, field.min, field.max)
+		}
+	}
+	return nil
+}
+
+// paramBlockSchema describes a parameter block as a JSON schema object.
+func paramBlockSchema(title string, block interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, field := range paramFields(reflect.TypeOf(block).Elem()) {
+		property := map[string]interface{}{
+			"type":    "integer",
+			"minimum": field.min,
+			"maximum": field.max,
+		}
+		if field.hasDefault {
+			property["default"] = field.def
+		}
+		if field.unit != "" {
+			property["description"] = "unit: " + field.unit
+		}
+		properties[field.name] = property
+	}
+	return map[string]interface{}{
+		"title":                title,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// ValidateActiveSafetyParams range-checks the fields set in a parameter write.
+func ValidateActiveSafetyParams(adas *models.ADASParams, dms *models.DMSParams, bsd *models.BSDParams) error {
+	if adas != nil {
+		if err := validateParamBlock("adas", adas); err != nil {
+			return err
+		}
+	}
+	if dms != nil {
+		if err := validateParamBlock("dms", dms); err != nil {
+			return err
+		}
+	}
+	if bsd != nil {
+		if err := validateParamBlock("bsd", bsd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ActiveSafetyParamsSchema returns JSON schemas of the ADAS, DMS and BSD
+// parameter blocks, with the ranges and defaults of Tables 17-19.
+func ActiveSafetyParamsSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"adas": paramBlockSchema("ADAS parameters (0xF364)", &models.ADASParams{}),
+		"dms":  paramBlockSchema("DMS parameters (0xF365)", &models.DMSParams{}),
+		"bsd":  paramBlockSchema("BSD parameters (0xF367)", &models.BSDParams{}),
+	}
+}
+
+// BuildActiveSafetyParamItems encodes the given blocks as 0x8103 parameter items.
+func BuildActiveSafetyParamItems(adas *models.ADASParams, dms *models.DMSParams, bsd *models.BSDParams) []models.TerminalParam {
+	var items []models.TerminalParam
+	if adas != nil {
+		items = append(items, models.TerminalParam{ID: ParamADAS, Value: encodeParamBlock(adas, adasParamsSize)})
+	}
+	if dms != nil {
+		items = append(items, models.TerminalParam{ID: ParamDMS, Value: encodeParamBlock(dms, dmsParamsSize)})
+	}
+	if bsd != nil {
+		items = append(items, models.TerminalParam{ID: ParamBSD, Value: encodeParamBlock(bsd, bsdParamsSize)})
+	}
+	return items
+}
+
+// ParseActiveSafetyParams decodes the active safety blocks among parameter
+// items into params, leaving the blocks that are absent untouched. It reports
+// whether any block was found.
+func ParseActiveSafetyParams(items []models.TerminalParam, params *models.ActiveSafetyParams) bool {
+	found := false
+	for _, item := range items {
+		switch item.ID {
+		case ParamADAS:
+			params.ADAS = &models.ADASParams{}
+			decodeParamBlock(item.Value, params.ADAS)
+		case ParamDMS:
+			params.DMS = &models.DMSParams{}
+			decodeParamBlock(item.Value, params.DMS)
+		case ParamBSD:
+			params.BSD = &models.BSDParams{}
+			decodeParamBlock(item.Value, params.BSD)
+		default:
+			continue
+		}
+		found = true
+	}
+	return found
+}
+
+// BuildSetParamsBody builds the body of a 0x8103 terminal parameter setting (Table 9).
+func BuildSetParamsBody(items []models.TerminalParam) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(items)))
+	for _, item := range items {
+		binary.Write(&body, binary.BigEndian, item.ID)
+		body.WriteByte(byte(len(item.Value)))
+		body.Write(item.Value)
+	}
+	return body.Bytes()
+}
+
+// BuildQueryParamsBody builds the body of a 0x8106 query of specific terminal
+// parameters: the parameter count and their IDs.
+func BuildQueryParamsBody(ids []uint32) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(ids)))
+	for _, id := range ids {
+		binary.Write(&body, binary.BigEndian, id)
+	}
+	return body.Bytes()
+}
+
+// ParseParamsResponse decodes a 0x0104 terminal parameter query response
+// (Table 20) answering the 0x8104 or 0x8106 with replySerial.
+func ParseParamsResponse(body []byte) (replySerial uint16, items []models.TerminalParam, err error) {
+	if len(body) < 3 {
+		return 0, nil, fmt.Errorf("parameter response too short: %d bytes", len(body))
+	}
+	replySerial = binary.BigEndian.Uint16(body[0:2])
+	count := int(body[2])
+	offset := 3
+	for i := 0; i < count; i++ {
+		if offset+5 > len(body) {
+			return replySerial, items, fmt.Errorf("parameter list truncated after %d of %d items", i, count)
+		}
+		id := binary.BigEndian.Uint32(body[offset:])
+		length := int(body[offset+4])
+		if offset+5+length > len(body) {
+			return replySerial, items, fmt.Errorf("parameter 0x%04X truncated", id)
+		}
+		items = append(items, models.TerminalParam{ID: id, Value: body[offset+5 : offset+5+length]})
+		offset += 5 + length
+	}
+	return replySerial, items, nil
+}
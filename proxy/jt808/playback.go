@@ -0,0 +1,54 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// speedCodes maps fast forward/rewind multipliers to their protocol codes.
+var speedCodes = map[int]byte{1: 1, 2: 2, 4: 3, 8: 4, 16: 5}
+
+// PlaybackSpeedCode converts a multiplier (1, 2, 4, 8 or 16) to its protocol
+// code; 0 means "not applicable".
+func PlaybackSpeedCode(multiplier int) (byte, error) {
+	if multiplier == 0 {
+		return 0, nil
+	}
+	code, ok := speedCodes[multiplier]
+	if !ok {
+		return 0, fmt.Errorf("speed must be 1, 2, 4, 8 or 16")
+	}
+	return code, nil
+}
+
+// BuildPlaybackRequestBody builds the body of a 0x9201 remote playback request
+// (JT/T 1078 Table 24). A zero end time plays until the recording ends.
+func BuildPlaybackRequestBody(serverIP string, tcpPort, udpPort, channel, avType, streamType, storageType, mode int, speedCode byte, start, end time.Time) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len(serverIP)))
+	body.WriteString(serverIP)
+	binary.Write(&body, binary.BigEndian, uint16(tcpPort))
+	binary.Write(&body, binary.BigEndian, uint16(udpPort))
+	body.WriteByte(byte(channel))
+	body.WriteByte(byte(avType))      // 0=AV, 1=audio, 2=video, 3=audio or video
+	body.WriteByte(byte(streamType))  // 0=any, 1=main, 2=sub
+	body.WriteByte(byte(storageType)) // 0=any, 1=main, 2=disaster recovery
+	body.WriteByte(byte(mode))        // 0=normal, 1=fast forward, 2=rewind, 3=keyframes, 4=single frame
+	body.WriteByte(speedCode)
+	body.Write(timeToBCD(start))
+	body.Write(timeToBCD(end))
+	return body.Bytes()
+}
+
+// BuildPlaybackControlBody builds the body of a 0x9202 playback control
+// (JT/T 1078 Table 25). The seek position is only used by control 5.
+func BuildPlaybackControlBody(channel, control int, speedCode byte, seek time.Time) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(channel))
+	body.WriteByte(byte(control)) // 0=play, 1=pause, 2=stop, 3=fast forward, 4=rewind, 5=seek, 6=keyframes
+	body.WriteByte(speedCode)
+	body.Write(timeToBCD(seek))
+	return body.Bytes()
+}
@@ -127,6 +127,24 @@ func bcdToString(bcd []byte) string {
 	return hex.EncodeToString(bcd)
 }
 
+// ResultText describes the result byte of a terminal (0x0001) or platform (0x8001) general response.
+func ResultText(result byte) string {
+	switch result {
+	case 0:
+		return "success"
+	case 1:
+		return "failure"
+	case 2:
+		return "message error"
+	case 3:
+		return "not supported"
+	case 4:
+		return "alarm confirmation"
+	default:
+		return fmt.Sprintf("unknown (%d)", result)
+	}
+}
+
 func BuildGeneralResponse(phoneNumber string, replyMsgSerial uint16, replyMsgID uint16, result byte) []byte {
 	var body bytes.Buffer
 	binary.Write(&body, binary.BigEndian, replyMsgSerial)
@@ -0,0 +1,26 @@
+package jt808
+
+// PTZ control message IDs (JT/T 1078 section 5.7).
+const (
+	PTZRotate   uint16 = 0x9301
+	PTZFocus    uint16 = 0x9302
+	PTZIris     uint16 = 0x9303
+	PTZWiper    uint16 = 0x9304
+	PTZInfrared uint16 = 0x9305
+	PTZZoom     uint16 = 0x9306
+)
+
+// BuildPTZRotateBody builds the body of a 0x9301 PTZ rotation (JT/T 1078
+// Table 29). Direction 0 stops the rotation.
+func BuildPTZRotateBody(channel, direction, speed int) []byte {
+	// direction: 0=stop, 1=up, 2=down, 3=left, 4=right
+	return []byte{byte(channel), byte(direction), byte(speed)}
+}
+
+// BuildPTZAdjustBody builds the two-byte body shared by 0x9302-0x9306
+// (JT/T 1078 Tables 30-34): the channel followed by the adjustment, i.e.
+// 0=increase/1=decrease for focus, iris and zoom, 0=stop/1=start for the
+// wiper and infrared fill light.
+func BuildPTZAdjustBody(channel, action int) []byte {
+	return []byte{byte(channel), byte(action)}
+}
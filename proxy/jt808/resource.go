@@ -0,0 +1,105 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"proxy/models"
+	"time"
+)
+
+// bcdTimeLayout is the YY-MM-DD-hh-mm-ss layout of JT/T 1078 BCD[6] times.
+const bcdTimeLayout = "060102150405"
+
+// ResourceTimeLayout is how resource list times are exchanged over the API.
+const ResourceTimeLayout = "2006-01-02 15:04:05"
+
+// resourceItemSize is the length of one Table 23 entry.
+const resourceItemSize = 28
+
+// timeToBCD encodes a time as BCD[6]; the zero time encodes as all zeros,
+// meaning "no condition".
+func timeToBCD(t time.Time) []byte {
+	if t.IsZero() {
+		return make([]byte, 6)
+	}
+	b, _ := hex.DecodeString(t.Format(bcdTimeLayout))
+	return b
+}
+
+// bcdToTimeString decodes a BCD[6] time to ResourceTimeLayout, or "" if unset.
+func bcdToTimeString(bcd []byte) string {
+	t, err := time.Parse(bcdTimeLayout, bcdToString(bcd))
+	if err != nil {
+		return ""
+	}
+	return t.Format(ResourceTimeLayout)
+}
+
+// BuildResourceListQueryBody builds the body of a 0x9205 audio/video resource
+// list query (JT/T 1078 Table 21). Zero start/end times mean no time condition.
+func BuildResourceListQueryBody(channel int, start, end time.Time, alarmFlags uint64, avType, streamType, storageType int) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(channel)) // 0 = all channels
+	body.Write(timeToBCD(start))
+	body.Write(timeToBCD(end))
+	binary.Write(&body, binary.BigEndian, alarmFlags)
+	body.WriteByte(byte(avType))      // 0=AV, 1=audio, 2=video, 3=audio or video
+	body.WriteByte(byte(streamType))  // 0=all, 1=main, 2=sub
+	body.WriteByte(byte(storageType)) // 0=all, 1=main, 2=disaster recovery
+	return body.Bytes()
+}
+
+// ParseResourceList decodes a reassembled 0x1205 resource list upload
+// (JT/T 1078 Tables 22 and 23). A body that does not hold exactly the items
+// it counts is an error; the items it does hold are returned with it.
+func ParseResourceList(body []byte) (*models.ResourceList, error) {
+	if len(body) < 6 {
+		return nil, fmt.Errorf("resource list too short: %d bytes", len(body))
+	}
+
+	count := int(binary.BigEndian.Uint32(body[2:6]))
+	list := &models.ResourceList{
+		Serial: binary.BigEndian.Uint16(body[0:2]),
+		Total:  count,
+		Items:  make([]models.ResourceItem, 0, min(count, (len(body)-6)/resourceItemSize)),
+	}
+
+	offset := 6
+	for i := 0; i < count; i++ {
+		if offset+resourceItemSize > len(body) {
+			return list, fmt.Errorf("resource list truncated at item %d of %d", i+1, count)
+		}
+		item := body[offset : offset+resourceItemSize]
+		alarmFlags := binary.BigEndian.Uint64(item[13:21])
+
+		list.Items = append(list.Items, models.ResourceItem{
+			Channel:     int(item[0]),
+			StartTime:   bcdToTimeString(item[1:7]),
+			EndTime:     bcdToTimeString(item[7:13]),
+			AlarmFlags:  alarmFlags,
+			AlarmBits:   setBits(alarmFlags),
+			AVType:      int(item[21]),
+			StreamType:  int(item[22]),
+			StorageType: int(item[23]),
+			FileSize:    binary.BigEndian.Uint32(item[24:28]),
+		})
+		offset += resourceItemSize
+	}
+	if offset != len(body) {
+		return list, fmt.Errorf("resource list of %d items has %d bytes more", count, len(body)-offset)
+	}
+	return list, nil
+}
+
+// setBits lists the positions of the bits set in a flag word.
+func setBits(flags uint64) []int {
+	bits := make([]int, 0)
+	for i := 0; i < 64; i++ {
+		if flags&(1<<uint(i)) != 0 {
+			bits = append(bits, i)
+		}
+	}
+	return bits
+}
@@ -0,0 +1,102 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"proxy/models"
+)
+
+// resourceListBody builds a 0x1205 body with the given item count field.
+func resourceListBody(serial uint16, count uint32, items ...[]byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, serial)
+	body = binary.BigEndian.AppendUint32(body, count)
+	for _, item := range items {
+		body = append(body, item...)
+	}
+	return body
+}
+
+// resourceItemBytes builds one Table 23 entry.
+func resourceItemBytes(channel byte, start, end string, alarmFlags uint64, size uint32) []byte {
+	item := []byte{channel}
+	item = append(item, bcdBytes(start)...)
+	item = append(item, bcdBytes(end)...)
+	item = binary.BigEndian.AppendUint64(item, alarmFlags)
+	item = append(item, 2, 1, 1)
+	return binary.BigEndian.AppendUint32(item, size)
+}
+
+func bcdBytes(digits string) []byte {
+	b := make([]byte, len(digits)/2)
+	for i := range b {
+		b[i] = (digits[2*i]-'0')<<4 | (digits[2*i+1] - '0')
+	}
+	return b
+}
+
+func TestParseResourceList(t *testing.T) {
+	first := resourceItemBytes(1, "240131235959", "250101000010", 1<<3|1<<40, 1048576)
+	second := resourceItemBytes(2, "000000000000", "000000000000", 0, 7)
+	firstItem := models.ResourceItem{
+		Channel:     1,
+		StartTime:   "2024-01-31 23:59:59",
+		EndTime:     "2025-01-01 00:00:10",
+		AlarmFlags:  1<<3 | 1<<40,
+		AlarmBits:   []int{3, 40},
+		AVType:      2,
+		StreamType:  1,
+		StorageType: 1,
+		FileSize:    1048576,
+	}
+	secondItem := models.ResourceItem{
+		Channel:     2,
+		AlarmBits:   []int{},
+		AVType:      2,
+		StreamType:  1,
+		StorageType: 1,
+		FileSize:    7,
+	}
+
+	tests := []struct {
+		name    string
+		body    []byte
+		total   int
+		items   []models.ResourceItem
+		wantErr bool
+		noList  bool
+	}{
+		{name: "empty list", body: resourceListBody(9, 0), items: []models.ResourceItem{}},
+		{name: "two items", body: resourceListBody(9, 2, first, second), total: 2, items: []models.ResourceItem{firstItem, secondItem}},
+		{name: "too short", body: []byte{0, 9, 0, 0, 0}, wantErr: true, noList: true},
+		{name: "truncated item", body: resourceListBody(9, 2, first, second[:20]), total: 2, items: []models.ResourceItem{firstItem}, wantErr: true},
+		{name: "count above items", body: resourceListBody(9, 3, first, second), total: 3, items: []models.ResourceItem{firstItem, secondItem}, wantErr: true},
+		{name: "count below items", body: resourceListBody(9, 1, first, second), total: 1, items: []models.ResourceItem{firstItem}, wantErr: true},
+		{name: "huge count", body: resourceListBody(9, 0xFFFFFFFF, first), total: 0xFFFFFFFF, items: []models.ResourceItem{firstItem}, wantErr: true},
+		{name: "huge count without items", body: resourceListBody(9, 0xFFFFFFFF), total: 0xFFFFFFFF, items: []models.ResourceItem{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := ParseResourceList(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.noList {
+				if list != nil {
+					t.Fatalf("list = %+v, want nil", list)
+				}
+				return
+			}
+			if list.Serial != 9 || list.Total != tt.total {
+				t.Errorf("serial %d, total %d; want 9, %d", list.Serial, list.Total, tt.total)
+			}
+			if !reflect.DeepEqual(list.Items, tt.items) {
+				t.Errorf("items = %+v, want %+v", list.Items, tt.items)
+			}
+			if cap(list.Items) > (len(tt.body)-6)/resourceItemSize {
+				t.Errorf("items capacity %d for a %d byte body", cap(list.Items), len(tt.body))
+			}
+		})
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 
 	"proxy/api"
+	"proxy/ftp"
+	"proxy/models"
 	"proxy/services"
 	"proxy/shared"
 
@@ -20,19 +22,104 @@ func main() {
 	localAddress := flag.String("l", "0.0.0.0:1024", "Local address")
 	remoteAddress := flag.String("r", os.Getenv("PLATFORM_HOST"), "Remote address")
 	verbose := flag.Bool("v", false, "Enable verbose logging")
+	dbcFile := flag.String("dbc", os.Getenv("CAN_DBC_FILE"), "CAN signal definition (DBC) file")
+	videoIP := flag.String("video-ip", shared.EnvString("VIDEO_SERVER_IP", "3.13.95.26"), "JT1078 media server IP sent to devices")
+	videoPort := flag.Int("video-port", shared.EnvInt("VIDEO_SERVER_PORT", 7800), "JT1078 media server TCP port")
+	videoUDPPort := flag.Int("video-udp-port", shared.EnvInt("VIDEO_SERVER_UDP_PORT", 0), "JT1078 media server UDP port (0 = TCP only)")
+	playbackPort := flag.Int("playback-port", shared.EnvInt("PLAYBACK_SERVER_PORT", 7801), "JT1078 media server TCP port for remote playback streams")
+	audioIP := flag.String("audio-ip", shared.EnvString("AUDIO_SERVER_IP", "127.0.0.1"), "JT1078 intercom audio server IP sent to devices")
+	audioPort := flag.Int("audio-port", shared.EnvInt("AUDIO_SERVER_PORT", 7800), "JT1078 intercom audio server TCP port")
+	audioUDPPort := flag.Int("audio-udp-port", shared.EnvInt("AUDIO_SERVER_UDP_PORT", 0), "JT1078 intercom audio server UDP port (0 = TCP only)")
+	ftpListen := flag.String("ftp-listen", shared.EnvString("FTP_LISTEN", "0.0.0.0:2121"), "Embedded FTP receiver address for recording uploads (empty = disabled)")
+	ftpIP := flag.String("ftp-ip", os.Getenv("FTP_SERVER_IP"), "FTP receiver IP sent to devices (default: -video-ip)")
+	ftpPort := flag.Int("ftp-port", shared.EnvInt("FTP_SERVER_PORT", 2121), "FTP receiver port sent to devices")
+	ftpPassiveMin := flag.Int("ftp-passive-min", shared.EnvInt("FTP_PASSIVE_MIN", 50000), "First FTP passive data port (0 = any)")
+	ftpPassiveMax := flag.Int("ftp-passive-max", shared.EnvInt("FTP_PASSIVE_MAX", 50100), "Last FTP passive data port")
+	ftpMaxUpload := flag.Int("ftp-max-upload-mb", shared.EnvInt("FTP_MAX_UPLOAD_MB", 2048), "Largest file terminals may upload to the FTP receiver, in MB (0 = unlimited)")
+	ftpDir := flag.String("ftp-dir", shared.EnvString("FTP_DIR", "recordings"), "Directory uploaded recordings are stored in")
+	attachmentListen := flag.String("attachment-listen", shared.EnvString("ATTACHMENT_LISTEN", "0.0.0.0:7900"), "Alarm attachment server address (empty = disabled)")
+	attachmentIP := flag.String("attachment-ip", os.Getenv("ATTACHMENT_SERVER_IP"), "Attachment server IP sent to devices in 0x9208 (default: -video-ip)")
+	attachmentPort := flag.Int("attachment-port", shared.EnvInt("ATTACHMENT_SERVER_PORT", 7900), "Attachment server port sent to devices")
+	attachmentDir := flag.String("attachment-dir", shared.EnvString("ATTACHMENT_DIR", "attachments"), "Directory alarm attachments are stored in")
 	flag.Parse()
 
 	// Initialize shared utilities from the correct package
 	shared.InitializeUtils(*verbose, *remoteAddress)
+	shared.VideoServer = models.MediaServerConfig{IP: *videoIP, TCPPort: *videoPort, UDPPort: *videoUDPPort}
+	shared.PlaybackServer = models.MediaServerConfig{IP: *videoIP, TCPPort: *playbackPort}
+	shared.AudioServer = models.MediaServerConfig{IP: *audioIP, TCPPort: *audioPort, UDPPort: *audioUDPPort}
+	if *ftpIP == "" {
+		*ftpIP = *videoIP
+	}
+	shared.FileServer = models.MediaServerConfig{IP: *ftpIP, TCPPort: *ftpPort}
+	if *attachmentIP == "" {
+		*attachmentIP = *videoIP
+	}
+	shared.AttachmentServer = models.MediaServerConfig{IP: *attachmentIP, TCPPort: *attachmentPort}
 
-	fmt.Printf("Listening: %v\nProxying %v\n", *localAddress, *remoteAddress)
+	fmt.Printf("Listening: %v\nProxying %v\nMedia server: %s:%d\n", *localAddress, *remoteAddress, *videoIP, *videoPort)
 
 	// Initialize the MQTT client
 	services.InitializeMQTT()
 
+	// Load CAN signal definitions used to decode 0x0705 uploads
+	if *dbcFile != "" {
+		if err := services.LoadCANDefinitions(*dbcFile); err != nil {
+			log.Printf("Failed to load CAN definitions: %v", err)
+		}
+	}
+
 	// Start the background cleanup routine for old snapshots
 	go services.SnapshotCleanupRoutine()
 
+	// Drop platform commands the devices never answered
+	go services.PendingCommandCleanupRoutine()
+
+	// Time out intercom calls that never receive audio
+	go services.CallSupervisorRoutine()
+
+	// Drop incomplete or uncollected resource lists
+	go services.ResourceListCleanupRoutine()
+
+	// Drop finished or abandoned recording upload tasks
+	go services.FileUploadCleanupRoutine()
+
+	// Start the FTP receiver devices upload recordings to (0x9206)
+	if *ftpListen != "" {
+		if err := services.InitFileStore(*ftpDir); err != nil {
+			log.Fatalf("Error preparing file store %s: %v", *ftpDir, err)
+		}
+		ftpServer := &ftp.Server{
+			Addr:         *ftpListen,
+			PublicIP:     *ftpIP,
+			PassiveMin:   *ftpPassiveMin,
+			PassiveMax:   *ftpPassiveMax,
+			MaxFileSize:  int64(*ftpMaxUpload) << 20,
+			Authenticate: services.AuthenticateFTPUpload,
+			OnUpload:     services.HandleFTPUpload,
+		}
+		go func() {
+			if err := ftpServer.ListenAndServe(); err != nil {
+				log.Fatalf("Error starting FTP receiver: %v", err)
+			}
+		}()
+	}
+
+	// Drop alarm attachments the devices stopped uploading
+	go services.AttachmentCleanupRoutine()
+
+	// Start the attachment server devices upload alarm attachments to (0x9208)
+	if *attachmentListen != "" {
+		if err := services.InitAttachmentStore(*attachmentDir); err != nil {
+			log.Fatalf("Error preparing attachment store %s: %v", *attachmentDir, err)
+		}
+		go func() {
+			if err := services.ServeAttachments(*attachmentListen); err != nil {
+				log.Fatalf("Error starting attachment server: %v", err)
+			}
+		}()
+	}
+
 	// Start the Gin HTTP server
 	go func() {
 		router := api.SetupRouter()
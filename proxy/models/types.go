@@ -19,7 +19,7 @@ type VoIPCallRequest struct {
 
 type VoIPControlRequest struct {
 	DevicePhone string `json:"device_phone" binding:"required"`
-	Command     int    `json:"command" binding:"required"` // 0=off, 1=switch, 2=pause, 3=resume, 4=end
+	Command     int    `json:"command"` // 0=off, 1=switch, 2=pause, 3=resume, 4=end (0 is valid, so no required tag)
 }
 
 type VoIPCallResponse struct {
@@ -28,18 +28,43 @@ type VoIPCallResponse struct {
 	DevicePhone string `json:"device_phone"`
 	CallerID    string `json:"caller_id"`
 	StartTime   string `json:"start_time"`
+	AnswerTime  string `json:"answer_time,omitempty"`
+	EndTime     string `json:"end_time,omitempty"`
+	EndReason   string `json:"end_reason,omitempty"`
+	AudioCodec  string `json:"audio_codec,omitempty"`
+}
+
+type MediaStreamEvent struct {
+	DevicePhone string `json:"device_phone" binding:"required"` // SIM number from the JT1078 header
+	Channel     int    `json:"channel"`
+	DataType    int    `json:"data_type"`                // JT1078 data type: 0-2 video, 3 audio
+	Event       string `json:"event" binding:"required"` // "started" or "stopped"
+	Playback    bool   `json:"playback"`                 // stream arrived on the playback listener
+}
+
+// MediaLossReport is the packet loss the media server measured on a live
+// stream over its last reporting window.
+type MediaLossReport struct {
+	DevicePhone string  `json:"device_phone" binding:"required"` // SIM number from the JT1078 header
+	Channel     int     `json:"channel" binding:"required"`
+	LossRate    float64 `json:"loss_rate"` // 0-1
+	Expected    uint64  `json:"expected"`  // packets expected from the sequence numbers
+	Received    uint64  `json:"received"`
 }
 
 type VideoStartRequest struct {
 	DevicePhone string `json:"device_phone" binding:"required"`
 	Channel     int    `json:"channel" binding:"required"`
 	StreamType  int    `json:"stream_type"` // 0=main, 1=sub
+	DataType    int    `json:"data_type"`   // 0=audio and video, 1=video only, 3=monitor (audio only)
 }
 
 type VideoControlRequest struct {
-	DevicePhone string `json:"device_phone" binding:"required"`
-	Channel     int    `json:"channel" binding:"required"`
-	Command     int    `json:"command"` // 0=stop, 1=switch, 2=pause, 3=resume
+	DevicePhone      string `json:"device_phone" binding:"required"`
+	Channel          int    `json:"channel" binding:"required"`
+	Command          int    `json:"command"`            // 0=stop, 1=switch, 2=pause, 3=resume
+	CloseAVType      int    `json:"close_av_type"`      // 0=audio and video, 1=audio only, 2=video only
+	SwitchStreamType int    `json:"switch_stream_type"` // 0=main, 1=sub
 }
 
 type VideoStartResponse struct {
@@ -48,12 +73,55 @@ type VideoStartResponse struct {
 	DevicePhone string `json:"device_phone"`
 	Channel     int    `json:"channel"`
 	StreamType  int    `json:"stream_type"`
+	DataType    int    `json:"data_type"`
+	VideoServer string `json:"video_server"`
+	VideoPort   int    `json:"video_port"`
+	VideoCodec  string `json:"video_codec,omitempty"` // from the device's 0x1003 attributes, when known
+	AudioCodec  string `json:"audio_codec,omitempty"`
+	PacketLoss  int    `json:"packet_loss"` // percent, as last notified with 0x9105
 	StartTime   string `json:"start_time"`
 }
 
+type PlaybackStartRequest struct {
+	DevicePhone  string `json:"device_phone" binding:"required"`
+	Channel      int    `json:"channel" binding:"required"`
+	AVType       int    `json:"av_type"`                       // 0=audio and video, 1=audio, 2=video, 3=audio or video
+	StreamType   int    `json:"stream_type"`                   // 0=main or sub, 1=main, 2=sub
+	StorageType  int    `json:"storage_type"`                  // 0=main or disaster recovery, 1=main, 2=disaster recovery
+	PlaybackMode int    `json:"playback_mode"`                 // 0=normal, 1=fast forward, 2=rewind, 3=keyframes only, 4=single frame
+	Speed        int    `json:"speed"`                         // 1, 2, 4, 8 or 16 for modes 1 and 2
+	StartTime    string `json:"start_time" binding:"required"` // "2006-01-02 15:04:05" device local time
+	EndTime      string `json:"end_time"`                      // empty = until the recording ends
+}
+
+type PlaybackControlRequest struct {
+	DevicePhone string `json:"device_phone" binding:"required"`
+	Channel     int    `json:"channel" binding:"required"`
+	Command     int    `json:"command"`   // 0=resume, 1=pause, 2=stop, 3=fast forward, 4=rewind, 5=seek, 6=keyframes only
+	Speed       int    `json:"speed"`     // 1, 2, 4, 8 or 16 for fast forward and rewind
+	SeekTime    string `json:"seek_time"` // target position for seek, same layout as start_time
+}
+
+type PlaybackSessionResponse struct {
+	SessionID    string `json:"session_id"`
+	Status       string `json:"status"`
+	DevicePhone  string `json:"device_phone"`
+	Channel      int    `json:"channel"`
+	AVType       int    `json:"av_type"`
+	StreamType   int    `json:"stream_type"`
+	StorageType  int    `json:"storage_type"`
+	PlaybackMode int    `json:"playback_mode"`
+	Speed        int    `json:"speed,omitempty"`
+	StartTime    string `json:"start_time"`
+	EndTime      string `json:"end_time,omitempty"`
+	VideoServer  string `json:"video_server"`
+	VideoPort    int    `json:"video_port"`
+	CreatedAt    string `json:"created_at"`
+}
+
 type ImageSnapshotRequest struct {
 	DevicePhone string `json:"device_phone" binding:"required"`
-	Channel     int    `json:"channel" binding:"required"` // 1-4
+	Channel     int    `json:"channel" binding:"required"` // 1 to the device's video channel count
 	Resolution  int    `json:"resolution"`                 // Resolution code (default: 1)
 	Quality     int    `json:"quality"`                    // Quality 0-10 (default: 0)
 	Brightness  int    `json:"brightness"`                 // 0-255 (default: 0)
@@ -91,10 +159,64 @@ type VideoSession struct {
 	DevicePhone string
 	Channel     int
 	StreamType  int
-	Status      string
+	DataType    int
+	Status      string // initiated, active, paused, failed
 	StartTime   time.Time
+	UpdatedAt   time.Time
 	VideoServer string
 	VideoPort   int
+	VideoCodec  string // from cached 0x1003 attributes; empty while unknown
+	AudioCodec  string
+	PacketLoss  int // percent reported by the media server and sent in 0x9105
+}
+
+type PlaybackSession struct {
+	SessionID    string
+	DevicePhone  string
+	Channel      int
+	AVType       int
+	StreamType   int
+	StorageType  int
+	PlaybackMode int
+	Speed        int
+	StartTime    string // requested range, device local time
+	EndTime      string
+	Status       string // initiated, playing, paused, fast_forward, rewind, keyframes, failed
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	VideoServer  string
+	VideoPort    int
+}
+
+type VoIPCall struct {
+	CallID       string
+	DevicePhone  string
+	CallerID     string
+	Status       string // initiated, active, paused, ended
+	EndReason    string
+	Acknowledged bool // device accepted the 0x9101 intercom request
+	StartTime    time.Time
+	AnswerTime   time.Time // first audio received from the device
+	EndTime      time.Time
+	AudioServer  string
+	AudioPort    int
+	AudioCodec   int // JT/T 1078 Table 12 code configured via 0x8103
+}
+
+type MediaServerConfig struct {
+	IP      string `json:"ip"`
+	TCPPort int    `json:"tcp_port"`
+	UDPPort int    `json:"udp_port"`
+}
+
+type PendingCommand struct {
+	DevicePhone string
+	MsgID       uint16
+	Serial      uint16
+	SentAt      time.Time
+	Result      byte
+	Done        chan struct{}     // closed once the terminal's 0x0001 reply arrives
+	OnResponse  func(result byte) // optional, invoked with ConnMutex held
 }
 
 type ImageSnapshot struct {
@@ -127,6 +249,466 @@ type ConnectionInfo struct {
 	Protocol   string
 }
 
+// --- Audio/Video Capability Structs ---
+
+// AVCapabilities holds a terminal's 0x1003 audio/video attributes.
+type AVCapabilities struct {
+	DevicePhone      string    `json:"device_phone"`
+	AudioCodec       int       `json:"audio_codec"`
+	AudioCodecName   string    `json:"audio_codec_name"`
+	AudioChannels    int       `json:"audio_channels"`
+	SampleRate       int       `json:"sample_rate"` // Hz
+	SampleBits       int       `json:"sample_bits"`
+	AudioFrameLength int       `json:"audio_frame_length"`
+	AudioOutput      bool      `json:"audio_output"`
+	VideoCodec       int       `json:"video_codec"`
+	VideoCodecName   string    `json:"video_codec_name"`
+	MaxAudioChannels int       `json:"max_audio_channels"`
+	MaxVideoChannels int       `json:"max_video_channels"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// --- Recorded Resource Structs ---
+
+// ResourceQueryRequest selects recordings for a 0x9205 resource list query.
+type ResourceQueryRequest struct {
+	DevicePhone string `json:"device_phone" binding:"required"`
+	Channel     int    `json:"channel"`      // 0 = all channels
+	StartTime   string `json:"start_time"`   // "2006-01-02 15:04:05" device local time; empty = no condition
+	EndTime     string `json:"end_time"`     // same layout; empty = no condition
+	AlarmFlags  uint64 `json:"alarm_flags"`  // bits 0-31 per JT/T 808 alarm flags, 32-63 video alarms; 0 = any
+	AVType      int    `json:"av_type"`      // 0=audio and video, 1=audio, 2=video, 3=audio or video
+	StreamType  int    `json:"stream_type"`  // 0=all, 1=main, 2=sub
+	StorageType int    `json:"storage_type"` // 0=all, 1=main, 2=disaster recovery
+	Timeout     int    `json:"timeout"`      // seconds to wait for the list (default 30)
+}
+
+// ResourceItem is one recording segment reported in 0x1205.
+type ResourceItem struct {
+	Channel     int    `json:"channel"`
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	AlarmFlags  uint64 `json:"alarm_flags"`
+	AlarmBits   []int  `json:"alarm_bits"`
+	AVType      int    `json:"av_type"`
+	StreamType  int    `json:"stream_type"`
+	StorageType int    `json:"storage_type"`
+	FileSize    uint32 `json:"file_size"` // bytes
+}
+
+// ResourceList is a reassembled 0x1205 upload answering the 0x9205 with Serial.
+type ResourceList struct {
+	DevicePhone string         `json:"device_phone"`
+	Serial      uint16         `json:"serial"`
+	Total       int            `json:"total"`
+	Items       []ResourceItem `json:"items"`
+	ReceivedAt  time.Time      `json:"received_at"`
+}
+
+// SubPackageAssembly collects the packets of a sub-packaged JT808 message.
+type SubPackageAssembly struct {
+	Total     uint16
+	Parts     map[uint16][]byte
+	UpdatedAt time.Time
+}
+
+// --- PTZ Control Structs ---
+
+// PTZRotateRequest turns a PTZ camera (0x9301).
+type PTZRotateRequest struct {
+	DevicePhone string `json:"device_phone" binding:"required"`
+	Channel     int    `json:"channel" binding:"required"`
+	Direction   int    `json:"direction"` // 0=stop, 1=up, 2=down, 3=left, 4=right
+	Speed       int    `json:"speed"`     // 0-255
+}
+
+// PTZAdjustRequest drives focus, iris, zoom (0=increase, 1=decrease) or the
+// wiper and infrared fill light (0=stop, 1=start) of a PTZ camera.
+type PTZAdjustRequest struct {
+	DevicePhone string `json:"device_phone" binding:"required"`
+	Channel     int    `json:"channel" binding:"required"`
+	Action      int    `json:"action"`
+}
+
+// --- Recorded File Upload Structs ---
+
+// FileUploadRequest asks a device to upload recordings to the embedded FTP receiver (0x9206).
+type FileUploadRequest struct {
+	DevicePhone string `json:"device_phone" binding:"required"`
+	Channel     int    `json:"channel" binding:"required"`
+	StartTime   string `json:"start_time" binding:"required"` // "2006-01-02 15:04:05" device local time
+	EndTime     string `json:"end_time" binding:"required"`
+	AlarmFlags  uint64 `json:"alarm_flags"`  // bits 0-31 per JT/T 808 alarm flags, 32-63 video alarms; 0 = any
+	AVType      int    `json:"av_type"`      // 0=audio and video, 1=audio, 2=video, 3=audio or video
+	StreamType  int    `json:"stream_type"`  // 0=any, 1=main, 2=sub
+	StorageType int    `json:"storage_type"` // 0=any, 1=main, 2=disaster recovery
+	Conditions  int    `json:"conditions"`   // networks allowed: bit0 WiFi, bit1 LAN, bit2 3G/4G; 0 = any
+}
+
+// FileUploadControlRequest pauses, resumes or cancels an upload task (0x9207).
+type FileUploadControlRequest struct {
+	TaskID  string `json:"task_id" binding:"required"`
+	Command int    `json:"command"` // 0=pause, 1=continue, 2=cancel
+}
+
+type FileUploadTaskResponse struct {
+	TaskID      string   `json:"task_id"`
+	Status      string   `json:"status"`
+	DevicePhone string   `json:"device_phone"`
+	Channel     int      `json:"channel"`
+	StartTime   string   `json:"start_time"`
+	EndTime     string   `json:"end_time"`
+	AVType      int      `json:"av_type"`
+	StreamType  int      `json:"stream_type"`
+	StorageType int      `json:"storage_type"`
+	Conditions  int      `json:"conditions"`
+	Serial      uint16   `json:"serial"` // of the 0x9206 request
+	FTPServer   string   `json:"ftp_server"`
+	FTPPort     int      `json:"ftp_port"`
+	Files       []string `json:"files"` // IDs of the files received so far
+	CreatedAt   string   `json:"created_at"`
+	CompletedAt string   `json:"completed_at,omitempty"`
+}
+
+type FileUploadTask struct {
+	TaskID      string
+	DevicePhone string
+	Channel     int
+	StartTime   string // requested range, device local time
+	EndTime     string
+	AlarmFlags  uint64
+	AVType      int
+	StreamType  int
+	StorageType int
+	Conditions  int
+	Serial      uint16 // 0x9206 serial, referenced by 0x9207 and 0x1206
+	Status      string // requested, accepted, uploading, paused, completed, failed, cancelled
+	FTPUser     string // per-task login handed to the device
+	FTPPassword string
+	FTPServer   string
+	FTPPort     int
+	Files       []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	CompletedAt time.Time
+}
+
+// RecordedFile is a recording received over FTP, indexed with the device,
+// channel and time range of the upload task that requested it.
+type RecordedFile struct {
+	FileID      string    `json:"file_id"`
+	TaskID      string    `json:"task_id"`
+	DevicePhone string    `json:"device_phone"`
+	Channel     int       `json:"channel"`
+	StartTime   string    `json:"start_time"` // range of the upload request, device local time
+	EndTime     string    `json:"end_time"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path"` // relative to the file store directory
+	Size        int64     `json:"size"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+// --- Alarm Structs ---
+
+// LocationReport is a decoded 0x0200 location report.
+type LocationReport struct {
+	AlarmFlags uint32
+	Status     uint32
+	Latitude   float64
+	Longitude  float64
+	Altitude   int             // meters
+	Speed      float64         // km/h
+	Direction  int             // degrees from north
+	Time       string          // "2006-01-02 15:04:05" device local time
+	Items      map[byte][]byte // additional information items by ID
+}
+
+// VideoAlarmStatus is the JT/T 1078 video alarm state carried in the 0x14-0x18
+// additional items of a location report. A nil slice means the item was absent.
+type VideoAlarmStatus struct {
+	DevicePhone        string    `json:"device_phone"`
+	AlarmFlags         uint32    `json:"alarm_flags"`          // item 0x14
+	Alarms             []string  `json:"alarms"`               // named bits of alarm_flags
+	SignalLossChannels []int     `json:"signal_loss_channels"` // item 0x15
+	OcclusionChannels  []int     `json:"occlusion_channels"`   // item 0x16
+	StorageFaults      []string  `json:"storage_faults"`       // item 0x17: main_1-main_12, backup_1-backup_4
+	DrivingBehaviors   []string  `json:"driving_behaviors"`    // item 0x18: fatigue, phone_call, smoking
+	FatigueLevel       int       `json:"fatigue_level"`        // 0-100
+	DeviceTime         string    `json:"device_time"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// AlarmEvent is published on tracker/alarms when an alarm is raised or cleared.
+type AlarmEvent struct {
+	DevicePhone  string    `json:"device_phone"`
+	Type         string    `json:"type"`              // e.g. video_signal_loss, video_occlusion, storage_fault, abnormal_driving
+	Channel      int       `json:"channel,omitempty"` // logical channel, when the alarm names one
+	Detail       string    `json:"detail,omitempty"`  // storage unit, driving behavior or active safety source
+	State        string    `json:"state"`             // raised or cleared
+	FatigueLevel int       `json:"fatigue_level,omitempty"`
+	Latitude     float64   `json:"latitude"`
+	Longitude    float64   `json:"longitude"`
+	DeviceTime   string    `json:"device_time"`
+	RaisedAt     time.Time `json:"raised_at"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// DeviceAlarms is the API view of a device's alarm state.
+type DeviceAlarms struct {
+	DevicePhone string            `json:"device_phone"`
+	Video       *VideoAlarmStatus `json:"video,omitempty"`
+	Active      []AlarmEvent      `json:"active"`
+}
+
+// AlarmIdentification is the alarm identification number of an active safety
+// alarm; the device uploads the alarm's attachments under it.
+type AlarmIdentification struct {
+	TerminalID  string `json:"terminal_id"`
+	Time        string `json:"time"`
+	Serial      int    `json:"serial"`      // alarms at the same second, from 0
+	Attachments int    `json:"attachments"` // number of attachment files
+	Raw         string `json:"raw"`         // 16 bytes, hex
+}
+
+// TireAlarm is one tire's entry in a TPMS alarm.
+type TireAlarm struct {
+	Position    int      `json:"position"` // tire number, from 0 at front left
+	AlarmFlags  uint16   `json:"alarm_flags"`
+	Alarms      []string `json:"alarms"`      // named bits of alarm_flags
+	Pressure    int      `json:"pressure"`    // kPa
+	Temperature int      `json:"temperature"` // °C
+	Battery     int      `json:"battery"`     // percent
+}
+
+// ActiveSafetyAlarm is an ADAS, DSM, TPMS or BSD alarm decoded from the
+// 0x64-0x67 items of a location report, published on tracker/active-safety.
+type ActiveSafetyAlarm struct {
+	DevicePhone    string              `json:"device_phone"`
+	Source         string              `json:"source"` // adas, dsm, tpms or bsd
+	AlarmID        uint32              `json:"alarm_id"`
+	Status         string              `json:"status,omitempty"` // start or end; empty for one-off events
+	Type           string              `json:"type"`             // e.g. forward_collision, lane_departure, fatigue_driving, phone_call
+	TypeCode       int                 `json:"type_code,omitempty"`
+	Level          int                 `json:"level,omitempty"`          // 1 or 2
+	FrontSpeed     int                 `json:"front_speed,omitempty"`    // km/h, forward collision and lane departure
+	FrontDistance  int                 `json:"front_distance,omitempty"` // headway in 100 ms
+	Deviation      string              `json:"deviation,omitempty"`      // left or right
+	RoadSign       string              `json:"road_sign,omitempty"`      // speed_limit, height_limit or weight_limit
+	RoadSignValue  int                 `json:"road_sign_value,omitempty"`
+	FatigueLevel   int                 `json:"fatigue_level,omitempty"` // 1-10
+	Tires          []TireAlarm         `json:"tires,omitempty"`
+	Speed          int                 `json:"speed"`    // km/h
+	Altitude       int                 `json:"altitude"` // meters
+	Latitude       float64             `json:"latitude"`
+	Longitude      float64             `json:"longitude"`
+	DeviceTime     string              `json:"device_time"`
+	VehicleStatus  uint16              `json:"vehicle_status"`
+	Identification AlarmIdentification `json:"identification"`
+	AlarmNumber    string              `json:"alarm_number,omitempty"` // assigned when attachments are requested (0x9208)
+	ReceivedAt     time.Time           `json:"received_at"`
+}
+
+// AttachmentFileInfo is a file announced in 0x1210, 0x1211 or 0x1212.
+type AttachmentFileInfo struct {
+	Name     string
+	FileType string // photo, audio, video, text or other
+	TypeCode byte
+	Size     uint32
+}
+
+// AlarmAttachmentInfo is a decoded 0x1210 alarm attachment information message.
+type AlarmAttachmentInfo struct {
+	TerminalID     string
+	Identification AlarmIdentification
+	AlarmNumber    string
+	Supplementary  bool // resent after a broken upload, listing the unfinished files
+	Files          []AttachmentFileInfo
+}
+
+// FileRange is a byte range of an attachment file.
+type FileRange struct {
+	Offset uint32
+	Length uint32
+}
+
+// AttachmentTransfer is an attachment file being received, kept across
+// reconnects so a resumed upload only needs the missing ranges.
+type AttachmentTransfer struct {
+	DevicePhone    string
+	AlarmNumber    string
+	Identification AlarmIdentification
+	Name           string
+	FileType       string
+	Size           uint32
+	Path           string      // relative to the attachment store
+	Received       []FileRange // sorted and merged
+	UpdatedAt      time.Time
+}
+
+// AlarmAttachment is a complete alarm attachment file received by the
+// attachment server, stored against its alarm identification number.
+type AlarmAttachment struct {
+	FileID         string    `json:"file_id"`
+	DevicePhone    string    `json:"device_phone"`
+	AlarmNumber    string    `json:"alarm_number"`
+	Identification string    `json:"identification"` // alarm identification number, hex
+	Name           string    `json:"name"`
+	FileType       string    `json:"file_type"`            // photo, audio, video, text or other
+	Channel        int       `json:"channel"`              // from the file name; 64 = ADAS, 65 = DSM camera
+	AlarmType      string    `json:"alarm_type,omitempty"` // peripheral and alarm type code from the file name, e.g. 6401
+	Path           string    `json:"path"`                 // relative to the attachment store
+	Size           int64     `json:"size"`
+	ReceivedAt     time.Time `json:"received_at"`
+}
+
+// --- Active Safety Parameter Structs ---
+
+// TerminalParam is one parameter item of 0x8103 or 0x0104 (Table 10).
+type TerminalParam struct {
+	ID    uint32
+	Value []byte
+}
+
+// ADASParams is the ADAS parameter block 0xF364 (Table 17). The param tag
+// gives each field's offset, size and valid range; nil fields are sent as
+// 0xFF.. (leave unchanged).
+type ADASParams struct {
+	SpeedThreshold               *int `json:"speed_threshold,omitempty" param:"offset=0,size=1,min=0,max=60,default=30,unit=km/h"`           // alarms only trigger above this speed
+	AlarmVolume                  *int `json:"alarm_volume,omitempty" param:"offset=1,size=1,min=0,max=8,default=6"`                          // 0 = mute
+	PhotoStrategy                *int `json:"photo_strategy,omitempty" param:"offset=2,size=1,min=0,max=2,default=0"`                        // 0=off, 1=timed, 2=distance
+	PhotoInterval                *int `json:"photo_interval,omitempty" param:"offset=3,size=2,min=0,max=3600,default=60,unit=s"`             // timed photo interval
+	PhotoDistance                *int `json:"photo_distance,omitempty" param:"offset=5,size=2,min=0,max=60000,default=200,unit=m"`           // distance photo interval
+	PhotoCount                   *int `json:"photo_count,omitempty" param:"offset=7,size=1,min=1,max=10,default=3"`                          // photos per active capture
+	PhotoSpacing                 *int `json:"photo_spacing,omitempty" param:"offset=8,size=1,min=1,max=5,default=2,unit=100ms"`              // time between those photos
+	PhotoResolution              *int `json:"photo_resolution,omitempty" param:"offset=9,size=1,min=1,max=6,default=1"`                      // 1=352x288, 2=704x288, 3=704x576, 4=640x480, 5=1280x720, 6=1920x1080
+	VideoResolution              *int `json:"video_resolution,omitempty" param:"offset=10,size=1,min=1,max=7,default=1"`                     // 3=D1, 4=WD1, 5=VGA, 6=720P, 7=1080P
+	AlarmEnable                  *int `json:"alarm_enable,omitempty" param:"offset=11,size=4,min=0,max=1073741823,default=69631"`            // bit0-1 obstacle, 2-3 frequent lane change, 4-5 lane departure, 6-7 forward collision, 8-9 pedestrian collision, 10-11 headway, 16 road sign overrun (level 1/2)
+	EventEnable                  *int `json:"event_enable,omitempty" param:"offset=15,size=4,min=0,max=1073741823,default=3"`                // bit0 road sign recognition, bit1 active capture
+	LaneChangePeriod             *int `json:"lane_change_period,omitempty" param:"offset=25,size=1,min=30,max=120,default=60,unit=s"`        // frequent lane change judgement window
+	LaneChangeCount              *int `json:"lane_change_count,omitempty" param:"offset=26,size=1,min=3,max=10,default=5"`                   // lane changes within the window
+	LaneChangeLevelSpeed         *int `json:"lane_change_level_speed,omitempty" param:"offset=27,size=1,min=0,max=220,default=50,unit=km/h"` // frequent lane change alarms above this speed are level 2
+	LaneChangeVideoSeconds       *int `json:"lane_change_video_seconds,omitempty" param:"offset=28,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	LaneChangePhotoCount         *int `json:"lane_change_photo_count,omitempty" param:"offset=29,size=1,min=0,max=10,default=3"`             // 0 = no photos
+	LaneChangePhotoSpacing       *int `json:"lane_change_photo_spacing,omitempty" param:"offset=30,size=1,min=1,max=10,default=2,unit=100ms"`
+	LaneDepartureLevelSpeed      *int `json:"lane_departure_level_speed,omitempty" param:"offset=31,size=1,min=0,max=220,default=50,unit=km/h"` // lane departure warnings above this speed are level 2
+	LaneDepartureVideoSeconds    *int `json:"lane_departure_video_seconds,omitempty" param:"offset=32,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	LaneDeparturePhotoCount      *int `json:"lane_departure_photo_count,omitempty" param:"offset=33,size=1,min=0,max=10,default=3"`             // 0 = no photos
+	LaneDeparturePhotoSpacing    *int `json:"lane_departure_photo_spacing,omitempty" param:"offset=34,size=1,min=1,max=10,default=2,unit=100ms"`
+	ForwardCollisionTime         *int `json:"forward_collision_time,omitempty" param:"offset=35,size=1,min=10,max=50,default=27,unit=100ms"`       // time to collision threshold
+	ForwardCollisionLevelSpeed   *int `json:"forward_collision_level_speed,omitempty" param:"offset=36,size=1,min=0,max=220,default=50,unit=km/h"` // forward collision warnings above this speed are level 2
+	ForwardCollisionVideoSeconds *int `json:"forward_collision_video_seconds,omitempty" param:"offset=37,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	ForwardCollisionPhotoCount   *int `json:"forward_collision_photo_count,omitempty" param:"offset=38,size=1,min=0,max=10,default=3"`             // 0 = no photos
+	ForwardCollisionPhotoSpacing *int `json:"forward_collision_photo_spacing,omitempty" param:"offset=39,size=1,min=1,max=10,default=2,unit=100ms"`
+	HeadwayTime                  *int `json:"headway_time,omitempty" param:"offset=45,size=1,min=10,max=50,default=10,unit=100ms"`       // headway monitoring threshold
+	HeadwayLevelSpeed            *int `json:"headway_level_speed,omitempty" param:"offset=46,size=1,min=0,max=220,default=50,unit=km/h"` // headway alarms above this speed are level 2
+	HeadwayVideoSeconds          *int `json:"headway_video_seconds,omitempty" param:"offset=47,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	HeadwayPhotoCount            *int `json:"headway_photo_count,omitempty" param:"offset=48,size=1,min=0,max=10,default=3"`             // 0 = no photos
+	HeadwayPhotoSpacing          *int `json:"headway_photo_spacing,omitempty" param:"offset=49,size=1,min=1,max=10,default=2,unit=100ms"`
+}
+
+// DMSParams is the DMS parameter block 0xF365 (Table 18).
+type DMSParams struct {
+	SpeedThreshold         *int `json:"speed_threshold,omitempty" param:"offset=0,size=1,min=0,max=60,default=30,unit=km/h"`       // alarms only trigger above this speed
+	AlarmVolume            *int `json:"alarm_volume,omitempty" param:"offset=1,size=1,min=0,max=8,default=6"`                      // 0 = mute
+	PhotoStrategy          *int `json:"photo_strategy,omitempty" param:"offset=2,size=1,min=0,max=3,default=0"`                    // 0=off, 1=timed, 2=distance, 3=card insertion
+	PhotoInterval          *int `json:"photo_interval,omitempty" param:"offset=3,size=2,min=60,max=60000,default=3600,unit=s"`     // timed photo interval
+	PhotoDistance          *int `json:"photo_distance,omitempty" param:"offset=5,size=2,min=0,max=60000,default=200,unit=m"`       // distance photo interval
+	PhotoCount             *int `json:"photo_count,omitempty" param:"offset=7,size=1,min=1,max=10,default=3"`                      // photos per active capture
+	PhotoSpacing           *int `json:"photo_spacing,omitempty" param:"offset=8,size=1,min=1,max=5,default=2,unit=100ms"`          // time between those photos
+	PhotoResolution        *int `json:"photo_resolution,omitempty" param:"offset=9,size=1,min=1,max=6,default=1"`                  // 1=352x288, 2=704x288, 3=704x576, 4=640x480, 5=1280x720, 6=1920x1080
+	VideoResolution        *int `json:"video_resolution,omitempty" param:"offset=10,size=1,min=1,max=7,default=1"`                 // 3=D1, 4=WD1, 5=VGA, 6=720P, 7=1080P
+	AlarmEnable            *int `json:"alarm_enable,omitempty" param:"offset=11,size=4,min=0,max=1073741823,default=511"`          // bit0-1 fatigue, 2-3 phone call, 4-5 smoking, 6-7 distraction, 8-9 driver abnormal (level 1/2)
+	EventEnable            *int `json:"event_enable,omitempty" param:"offset=15,size=4,min=0,max=1073741823,default=3"`            // bit0 driver change, bit1 active capture
+	SmokingInterval        *int `json:"smoking_interval,omitempty" param:"offset=19,size=2,min=0,max=3600,default=180,unit=s"`     // at most one smoking alarm per interval
+	PhoneCallInterval      *int `json:"phone_call_interval,omitempty" param:"offset=21,size=2,min=0,max=3600,default=120,unit=s"`  // at most one phone call alarm per interval
+	FatigueLevelSpeed      *int `json:"fatigue_level_speed,omitempty" param:"offset=26,size=1,min=0,max=220,default=50,unit=km/h"` // fatigue alarms above this speed are level 2
+	FatigueVideoSeconds    *int `json:"fatigue_video_seconds,omitempty" param:"offset=27,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	FatiguePhotoCount      *int `json:"fatigue_photo_count,omitempty" param:"offset=28,size=1,min=0,max=10,default=3"`             // 0 = no photos
+	FatiguePhotoSpacing    *int `json:"fatigue_photo_spacing,omitempty" param:"offset=29,size=1,min=1,max=5,default=2,unit=100ms"`
+	PhoneCallLevelSpeed    *int `json:"phone_call_level_speed,omitempty" param:"offset=30,size=1,min=0,max=220,default=50,unit=km/h"` // phone call alarms above this speed are level 2
+	PhoneCallVideoSeconds  *int `json:"phone_call_video_seconds,omitempty" param:"offset=31,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	PhoneCallPhotoCount    *int `json:"phone_call_photo_count,omitempty" param:"offset=32,size=1,min=1,max=10,default=3"`
+	PhoneCallPhotoSpacing  *int `json:"phone_call_photo_spacing,omitempty" param:"offset=33,size=1,min=1,max=5,default=2,unit=100ms"`
+	SmokingLevelSpeed      *int `json:"smoking_level_speed,omitempty" param:"offset=34,size=1,min=0,max=220,default=50,unit=km/h"` // smoking alarms above this speed are level 2
+	SmokingVideoSeconds    *int `json:"smoking_video_seconds,omitempty" param:"offset=35,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	SmokingPhotoCount      *int `json:"smoking_photo_count,omitempty" param:"offset=36,size=1,min=1,max=10,default=3"`
+	SmokingPhotoSpacing    *int `json:"smoking_photo_spacing,omitempty" param:"offset=37,size=1,min=1,max=5,default=2,unit=100ms"`
+	DistractedLevelSpeed   *int `json:"distracted_level_speed,omitempty" param:"offset=38,size=1,min=0,max=220,default=50,unit=km/h"` // distraction alarms above this speed are level 2
+	DistractedVideoSeconds *int `json:"distracted_video_seconds,omitempty" param:"offset=39,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	DistractedPhotoCount   *int `json:"distracted_photo_count,omitempty" param:"offset=40,size=1,min=1,max=10,default=3"`
+	DistractedPhotoSpacing *int `json:"distracted_photo_spacing,omitempty" param:"offset=41,size=1,min=1,max=5,default=2,unit=100ms"`
+	AbnormalLevelSpeed     *int `json:"abnormal_level_speed,omitempty" param:"offset=42,size=1,min=0,max=220,default=50,unit=km/h"` // driver abnormal alarms above this speed are level 2
+	AbnormalVideoSeconds   *int `json:"abnormal_video_seconds,omitempty" param:"offset=43,size=1,min=0,max=60,default=5,unit=s"`    // video recorded before and after, 0 = none
+	AbnormalPhotoCount     *int `json:"abnormal_photo_count,omitempty" param:"offset=44,size=1,min=1,max=10,default=3"`
+	AbnormalPhotoSpacing   *int `json:"abnormal_photo_spacing,omitempty" param:"offset=45,size=1,min=1,max=5,default=2,unit=100ms"`
+}
+
+// BSDParams is the BSD parameter block 0xF367 (Table 19).
+type BSDParams struct {
+	RearApproachTime     *int `json:"rear_approach_time,omitempty" param:"offset=0,size=1,min=1,max=10,unit=s"`      // rear approach alarm threshold
+	SideRearApproachTime *int `json:"side_rear_approach_time,omitempty" param:"offset=1,size=1,min=1,max=10,unit=s"` // side rear approach alarm threshold
+}
+
+// ActiveSafetyParams are a device's active safety parameter blocks as last
+// read with 0x8106 or 0x8104.
+type ActiveSafetyParams struct {
+	DevicePhone string      `json:"device_phone"`
+	ADAS        *ADASParams `json:"adas,omitempty"`
+	DMS         *DMSParams  `json:"dms,omitempty"`
+	BSD         *BSDParams  `json:"bsd,omitempty"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// ActiveSafetyParamsRequest writes active safety parameters to one or more
+// devices with 0x8103. Only the blocks and fields given are changed.
+type ActiveSafetyParamsRequest struct {
+	DevicePhones []string    `json:"device_phones" binding:"required,min=1"`
+	ADAS         *ADASParams `json:"adas"`
+	DMS          *DMSParams  `json:"dms"`
+	BSD          *BSDParams  `json:"bsd"`
+}
+
+// ActiveSafetyParamsResult is the outcome of a parameter write on one device.
+type ActiveSafetyParamsResult struct {
+	DevicePhone string `json:"device_phone"`
+	Status      string `json:"status"` // acknowledged, rejected, no_response or failed
+	Result      int    `json:"result,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// --- CAN Bus Structs ---
+
+type CANFrame struct {
+	ID       uint32 `json:"id"`
+	Channel  int    `json:"channel"`  // 0=CAN1, 1=CAN2
+	Extended bool   `json:"extended"` // true=extended (29-bit) frame, false=standard
+	Averaged bool   `json:"averaged"` // true=averaged value, false=raw data
+	Data     []byte `json:"-"`
+	DataHex  string `json:"data"`
+}
+
+type CANBusUpload struct {
+	ReceiveTime string     `json:"receive_time"` // hh:mm:ss.mmm of the first frame
+	Frames      []CANFrame `json:"frames"`
+}
+
+type CANSignalValue struct {
+	Name      string    `json:"name"`
+	Message   string    `json:"message"`
+	CANID     uint32    `json:"can_id"`
+	Value     float64   `json:"value"`
+	Unit      string    `json:"unit"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type CANDataEvent struct {
+	DevicePhone string           `json:"device_phone"`
+	ReceiveTime string           `json:"receive_time"`
+	Frames      []CANFrame       `json:"frames"`
+	Signals     []CANSignalValue `json:"signals"`
+	Timestamp   time.Time        `json:"timestamp"`
+}
+
 // --- MQTT Message Structs ---
 
 type TrackerData struct {
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"sort"
+	"time"
+)
+
+// maxActiveSafetyAlarms is how many recent active safety alarms are kept per device.
+const maxActiveSafetyAlarms = 200
+
+// activeSafetyAlarmPrefix marks the active alarms opened by an active safety
+// alarm's start flag and closed by its end flag.
+const activeSafetyAlarmPrefix = "safety:"
+
+// handleActiveSafetyAlarms decodes the ADAS, DSM, TPMS and BSD items of a
+// location report, records each alarm and publishes it on
+// tracker/active-safety. Alarms carrying start/end flags also raise and clear
+// an entry in the device's active alarms, and alarms with attachments are
+// given an alarm number and the device is asked to upload them (0x9208).
+// A report that is not the latest (see latestReportLocked) is recorded but
+// does not change the active alarms.
+func handleActiveSafetyAlarms(phone string, report *models.LocationReport, latest bool) {
+	alarms, err := jt808.ParseActiveSafetyAlarms(report.Items)
+	if err != nil {
+		shared.VPrint("Error parsing active safety alarms from %s: %v", phone, err)
+	}
+	if len(alarms) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var received, withAttachments []models.ActiveSafetyAlarm
+	var events []models.AlarmEvent
+
+	shared.ConnMutex.Lock()
+	for _, alarm := range alarms {
+		alarm.DevicePhone = phone
+		alarm.ReceivedAt = now
+		// Devices repeat a report they got no answer to
+		if isRecordedActiveSafetyAlarmLocked(alarm) {
+			continue
+		}
+		if alarm.Identification.Attachments > 0 && shared.AttachmentStoreDir != "" &&
+			!attachmentsRequestedLocked(phone, alarm.Identification.Raw) {
+			alarm.AlarmNumber = newAlarmNumber()
+			withAttachments = append(withAttachments, alarm)
+		}
+		recent := append(shared.ActiveSafetyAlarms[phone], alarm)
+		if len(recent) > maxActiveSafetyAlarms {
+			recent = recent[len(recent)-maxActiveSafetyAlarms:]
+		}
+		shared.ActiveSafetyAlarms[phone] = recent
+		received = append(received, alarm)
+
+		if !latest {
+			continue
+		}
+		if event, changed := trackActiveSafetyAlarmLocked(alarm, now); changed {
+			events = append(events, event)
+		}
+	}
+	shared.ConnMutex.Unlock()
+
+	for _, alarm := range received {
+		log.Printf("[ALARM] Device %s: %s %s %s (id %d, level %d, %d attachments)",
+			phone, alarm.Source, alarm.Type, alarmStatusText(alarm.Status), alarm.AlarmID, alarm.Level, alarm.Identification.Attachments)
+		if err := PublishEvent("tracker/active-safety", alarm); err != nil {
+			log.Printf("[ALARM] Failed to publish active safety alarm for %s: %v", phone, err)
+		}
+	}
+	publishAlarmEvents(events)
+
+	for _, alarm := range withAttachments {
+		requestAlarmAttachments(alarm)
+	}
+}
+
+// isRecordedActiveSafetyAlarmLocked reports whether the device already sent
+// this alarm. Must be called with shared.ConnMutex held.
+func isRecordedActiveSafetyAlarmLocked(alarm models.ActiveSafetyAlarm) bool {
+	for _, recorded := range shared.ActiveSafetyAlarms[alarm.DevicePhone] {
+		if recorded.Source == alarm.Source && recorded.AlarmID == alarm.AlarmID &&
+			recorded.Status == alarm.Status && recorded.Identification.Raw == alarm.Identification.Raw {
+			return true
+		}
+	}
+	return false
+}
+
+// trackActiveSafetyAlarmLocked raises an active alarm on a start flag and
+// clears it on the matching end flag, returning the resulting event.
+// Must be called with shared.ConnMutex held.
+func trackActiveSafetyAlarmLocked(alarm models.ActiveSafetyAlarm, now time.Time) (models.AlarmEvent, bool) {
+	key := activeSafetyAlarmPrefix + alarm.Source + ":" + alarm.Type
+	active := shared.ActiveAlarms[alarm.DevicePhone]
+
+	switch alarm.Status {
+	case "start":
+		if _, exists := active[key]; exists {
+			return models.AlarmEvent{}, false
+		}
+		if active == nil {
+			active = make(map[string]*models.AlarmEvent)
+			shared.ActiveAlarms[alarm.DevicePhone] = active
+		}
+		event := models.AlarmEvent{
+			DevicePhone:  alarm.DevicePhone,
+			Type:         alarm.Type,
+			Detail:       alarm.Source,
+			State:        "raised",
+			FatigueLevel: alarm.FatigueLevel,
+			Latitude:     alarm.Latitude,
+			Longitude:    alarm.Longitude,
+			DeviceTime:   alarm.DeviceTime,
+			RaisedAt:     now,
+			Timestamp:    now,
+		}
+		active[key] = &event
+		return event, true
+	case "end":
+		existing, exists := active[key]
+		if !exists {
+			return models.AlarmEvent{}, false
+		}
+		delete(active, key)
+		if len(active) == 0 {
+			delete(shared.ActiveAlarms, alarm.DevicePhone)
+		}
+		cleared := *existing
+		cleared.State = "cleared"
+		cleared.Latitude, cleared.Longitude = alarm.Latitude, alarm.Longitude
+		cleared.DeviceTime = alarm.DeviceTime
+		cleared.Timestamp = now
+		return cleared, true
+	}
+	return models.AlarmEvent{}, false
+}
+
+func alarmStatusText(status string) string {
+	if status == "" {
+		return "event"
+	}
+	return status
+}
+
+// ListActiveSafetyAlarms returns the recent active safety alarms, newest
+// first, optionally filtered by device, source (adas, dsm, tpms, bsd) and type.
+func ListActiveSafetyAlarms(phone, source, alarmType string) []models.ActiveSafetyAlarm {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	alarms := make([]models.ActiveSafetyAlarm, 0)
+	for devicePhone, recent := range shared.ActiveSafetyAlarms {
+		if phone != "" && devicePhone != phone {
+			continue
+		}
+		for _, alarm := range recent {
+			if (source != "" && alarm.Source != source) || (alarmType != "" && alarm.Type != alarmType) {
+				continue
+			}
+			alarms = append(alarms, alarm)
+		}
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].ReceivedAt.After(alarms[j].ReceivedAt)
+	})
+	return alarms
+}
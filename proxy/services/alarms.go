@@ -0,0 +1,229 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"strings"
+	"time"
+)
+
+// videoAlarmPrefix marks the active alarms derived from JT/T 1078 location items.
+const videoAlarmPrefix = "video:"
+
+// alarmClockReset is how far a report may go back in device time before it
+// is taken as the device clock being reset rather than as an older report
+// overtaken by a newer one.
+const alarmClockReset = 10 * time.Minute
+
+// videoAlarmDetailBits are the 0x14 flag bits that items 0x15-0x18 describe per
+// channel or unit; the bare flag is only raised when the detail item is missing.
+var videoAlarmDetailBits = map[string]bool{
+	"video_signal_loss": true,
+	"video_occlusion":   true,
+	"storage_fault":     true,
+	"abnormal_driving":  true,
+}
+
+// handleLocationReport decodes the JT/T 1078 video alarm items of a 0x0200
+// report and publishes an event for every alarm raised or cleared since the
+// previous report. A report without the items clears the device's video alarms.
+// Active safety items are handled by handleActiveSafetyAlarms. A report older
+// than one already applied leaves the alarm state alone.
+func handleLocationReport(phone string, body []byte) {
+	report, err := jt808.ParseLocationReport(body)
+	if err != nil {
+		shared.VPrint("Error parsing location report from %s: %v", phone, err)
+		if report == nil {
+			return
+		}
+	}
+
+	video := jt808.ParseVideoAlarms(report.Items)
+	current := videoAlarmEvents(phone, video)
+
+	shared.ConnMutex.Lock()
+	latest := latestReportLocked(phone, report)
+	var events []models.AlarmEvent
+	if latest {
+		if video != nil {
+			video.DevicePhone = phone
+			video.DeviceTime = report.Time
+			video.UpdatedAt = time.Now()
+			shared.VideoAlarms[phone] = video
+		} else {
+			delete(shared.VideoAlarms, phone)
+		}
+		events = syncAlarmsLocked(phone, videoAlarmPrefix, current, report)
+	} else {
+		shared.VPrint("Location report from %s at %s is older than one already handled", phone, report.Time)
+	}
+	shared.ConnMutex.Unlock()
+
+	publishAlarmEvents(events)
+	handleActiveSafetyAlarms(phone, report, latest)
+}
+
+// latestReportLocked reports whether a location report is at least as new,
+// in device time, as those already applied to the device's alarms, and
+// records its time. Reports without a valid time are always applied.
+// Must be called with shared.ConnMutex held.
+func latestReportLocked(phone string, report *models.LocationReport) bool {
+	deviceTime, err := time.Parse("2006-01-02 15:04:05", report.Time)
+	if err != nil {
+		return true
+	}
+	if last, exists := shared.AlarmReportTimes[phone]; exists && deviceTime.Before(last) && last.Sub(deviceTime) < alarmClockReset {
+		return false
+	}
+	shared.AlarmReportTimes[phone] = deviceTime
+	return true
+}
+
+// videoAlarmEvents lists the alarms a video alarm status represents, keyed so
+// that the same alarm in consecutive reports maps to the same entry.
+func videoAlarmEvents(phone string, video *models.VideoAlarmStatus) map[string]models.AlarmEvent {
+	alarms := make(map[string]models.AlarmEvent)
+	if video == nil {
+		return alarms
+	}
+	add := func(alarmType string, channel int, detail string) {
+		key := fmt.Sprintf("%s%s:%d:%s", videoAlarmPrefix, alarmType, channel, detail)
+		alarms[key] = models.AlarmEvent{DevicePhone: phone, Type: alarmType, Channel: channel, Detail: detail}
+	}
+
+	details := map[string]bool{
+		"video_signal_loss": video.SignalLossChannels != nil,
+		"video_occlusion":   video.OcclusionChannels != nil,
+		"storage_fault":     video.StorageFaults != nil,
+		"abnormal_driving":  video.DrivingBehaviors != nil,
+	}
+	for _, name := range video.Alarms {
+		if videoAlarmDetailBits[name] && details[name] {
+			continue
+		}
+		add(name, 0, "")
+	}
+	for _, channel := range video.SignalLossChannels {
+		add("video_signal_loss", channel, "")
+	}
+	for _, channel := range video.OcclusionChannels {
+		add("video_occlusion", channel, "")
+	}
+	for _, unit := range video.StorageFaults {
+		add("storage_fault", 0, unit)
+	}
+	for _, behavior := range video.DrivingBehaviors {
+		add("abnormal_driving", 0, behavior)
+	}
+
+	if video.FatigueLevel > 0 {
+		for key, alarm := range alarms {
+			if alarm.Type == "abnormal_driving" {
+				alarm.FatigueLevel = video.FatigueLevel
+				alarms[key] = alarm
+			}
+		}
+	}
+	return alarms
+}
+
+// syncAlarmsLocked replaces the device's active alarms whose key starts with
+// prefix by current, returning a raised or cleared event for each change.
+// Must be called with shared.ConnMutex held.
+func syncAlarmsLocked(phone, prefix string, current map[string]models.AlarmEvent, report *models.LocationReport) []models.AlarmEvent {
+	active, exists := shared.ActiveAlarms[phone]
+	if !exists {
+		active = make(map[string]*models.AlarmEvent)
+		shared.ActiveAlarms[phone] = active
+	}
+
+	now := time.Now()
+	var events []models.AlarmEvent
+	for key, alarm := range current {
+		if existing, ok := active[key]; ok {
+			existing.FatigueLevel = alarm.FatigueLevel
+			continue
+		}
+		alarm.State = "raised"
+		alarm.Latitude, alarm.Longitude = report.Latitude, report.Longitude
+		alarm.DeviceTime = report.Time
+		alarm.RaisedAt = now
+		alarm.Timestamp = now
+		active[key] = &alarm
+		events = append(events, alarm)
+	}
+	for key, alarm := range active {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, ok := current[key]; ok {
+			continue
+		}
+		delete(active, key)
+		cleared := *alarm
+		cleared.State = "cleared"
+		cleared.Latitude, cleared.Longitude = report.Latitude, report.Longitude
+		cleared.DeviceTime = report.Time
+		cleared.Timestamp = now
+		events = append(events, cleared)
+	}
+	if len(active) == 0 {
+		delete(shared.ActiveAlarms, phone)
+	}
+	return events
+}
+
+// publishAlarmEvents logs alarm changes and publishes them on tracker/alarms.
+func publishAlarmEvents(events []models.AlarmEvent) {
+	for _, event := range events {
+		log.Printf("[ALARM] Device %s: %s %s%s", event.DevicePhone, event.Type, event.State, alarmSubject(event))
+		if err := PublishEvent("tracker/alarms", event); err != nil {
+			log.Printf("[ALARM] Failed to publish alarm for %s: %v", event.DevicePhone, err)
+		}
+	}
+}
+
+func alarmSubject(event models.AlarmEvent) string {
+	subject := ""
+	if event.Channel != 0 {
+		subject += fmt.Sprintf(" on channel %d", event.Channel)
+	}
+	if event.Detail != "" {
+		subject += " (" + event.Detail + ")"
+	}
+	return subject
+}
+
+// GetDeviceAlarms returns a device's latest video alarm status and the alarms
+// currently raised for it.
+func GetDeviceAlarms(phone string) models.DeviceAlarms {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	alarms := models.DeviceAlarms{DevicePhone: phone, Active: make([]models.AlarmEvent, 0)}
+	if video, exists := shared.VideoAlarms[phone]; exists {
+		copied := *video
+		alarms.Video = &copied
+	}
+	for _, alarm := range shared.ActiveAlarms[phone] {
+		alarms.Active = append(alarms.Active, *alarm)
+	}
+	return alarms
+}
+
+// ListActiveAlarms returns the alarms currently raised on every device.
+func ListActiveAlarms() []models.AlarmEvent {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	alarms := make([]models.AlarmEvent, 0)
+	for _, active := range shared.ActiveAlarms {
+		for _, alarm := range active {
+			alarms = append(alarms, *alarm)
+		}
+	}
+	return alarms
+}
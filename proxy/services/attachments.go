@@ -0,0 +1,599 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// attachmentIdleTimeout closes attachment connections that went quiet.
+	attachmentIdleTimeout = 2 * time.Minute
+
+	// attachmentTransferTTL bounds how long an unfinished attachment is kept
+	// for the terminal to resume.
+	attachmentTransferTTL = 24 * time.Hour
+
+	// maxAttachmentChunk bounds one file data packet; terminals send 64K.
+	maxAttachmentChunk = 1 << 20
+
+	// maxAttachmentFileSize and maxAttachmentSessionSize bound the files a
+	// terminal may announce with 0x1211, alone and in total per connection.
+	// Attachments are pictures and short clips of a few MB.
+	maxAttachmentFileSize    = 256 << 20
+	maxAttachmentSessionSize = 1 << 30
+)
+
+// attachmentSession is the state of one terminal connection to the
+// attachment server.
+type attachmentSession struct {
+	conn  net.Conn
+	phone string
+	info  *models.AlarmAttachmentInfo // latest 0x1210
+	files map[string]*os.File         // open attachment files by name
+	sizes map[string]uint32           // sizes of the files announced, by name
+}
+
+// InitAttachmentStore prepares the directory alarm attachments are written to
+// and loads the index of attachments received before a restart.
+func InitAttachmentStore(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	shared.AttachmentStoreDir = dir
+
+	data, err := os.ReadFile(filepath.Join(dir, fileIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var attachments []*models.AlarmAttachment
+	if err := json.Unmarshal(data, &attachments); err != nil {
+		return fmt.Errorf("invalid attachment index: %v", err)
+	}
+	for _, attachment := range attachments {
+		shared.AlarmAttachments[attachment.FileID] = attachment
+	}
+	log.Printf("[ATTACH] Loaded %d alarm attachments from %s", len(attachments), dir)
+	return nil
+}
+
+// ServeAttachments accepts terminal connections to the alarm attachment server.
+func ServeAttachments(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("[ATTACH] Attachment server listening on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[ATTACH] Failed to accept connection: %v", err)
+			continue
+		}
+		go AttachmentConnection(conn)
+	}
+}
+
+// AttachmentConnection serves one terminal uploading alarm attachments. The
+// stream mixes 0x7e framed messages (0x1210, 0x1211, 0x1212) with raw file
+// data packets starting with 30 31 63 64; both are handled in arrival order so
+// a completion is only checked after the data before it was written.
+func AttachmentConnection(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	session := &attachmentSession{conn: conn, files: make(map[string]*os.File), sizes: make(map[string]uint32)}
+	defer conn.Close()
+	defer session.closeFiles()
+
+	shared.VPrint("[ATTACH] New attachment connection from %s", remoteAddr)
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(attachmentIdleTimeout))
+		if err := session.readPacket(reader); err != nil {
+			if err != io.EOF {
+				shared.VPrint("[ATTACH] Closing attachment connection from %s: %v", remoteAddr, err)
+			}
+			break
+		}
+	}
+	shared.VPrint("[ATTACH] Attachment connection closed for %s", remoteAddr)
+}
+
+// readPacket handles the next message or file data packet, skipping bytes
+// that start neither.
+func (s *attachmentSession) readPacket(reader *bufio.Reader) error {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch first[0] {
+	case 0x7e:
+		frame, err := readJT808Frame(reader)
+		if err != nil {
+			return err
+		}
+		s.handleMessage(frame)
+	case jt808.AttachmentDataMagic[0]:
+		magic, err := reader.Peek(len(jt808.AttachmentDataMagic))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(magic, jt808.AttachmentDataMagic) {
+			_, err = reader.Discard(1)
+			return err
+		}
+		return s.handleData(reader)
+	default:
+		_, err = reader.Discard(1)
+		return err
+	}
+	return nil
+}
+
+// readJT808Frame reads one 0x7e delimited message. Back-to-back markers are
+// the end of one frame and the start of the next, so an empty frame is skipped.
+func readJT808Frame(reader *bufio.Reader) ([]byte, error) {
+	if _, err := reader.ReadByte(); err != nil {
+		return nil, err
+	}
+	rest, err := reader.ReadBytes(0x7e)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) == 1 {
+		if rest, err = reader.ReadBytes(0x7e); err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{0x7e}, rest...), nil
+}
+
+func (s *attachmentSession) handleMessage(frame []byte) {
+	msgID, phone, msgSerial, body, _, _, err := jt808.ParseJT808(frame)
+	if err != nil {
+		shared.VPrint("[ATTACH] Error parsing message: %v", err)
+		return
+	}
+	s.phone = phone
+
+	switch msgID {
+	case 0x1210: // Alarm attachment information
+		info, err := jt808.ParseAlarmAttachmentInfo(body)
+		if err != nil {
+			log.Printf("[ATTACH] Error parsing attachment information from %s: %v", phone, err)
+			if info == nil {
+				s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 2))
+				return
+			}
+		}
+		if !attachmentsExpected(phone, info) {
+			log.Printf("[ATTACH] Device %s sent attachments for alarm %s (%s) that were not requested",
+				phone, info.AlarmNumber, info.Identification.Raw)
+			s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 1))
+			return
+		}
+		s.info = info
+		log.Printf("[ATTACH] Device %s announced %d attachments for alarm %s (%s)",
+			phone, len(info.Files), info.AlarmNumber, info.Identification.Raw)
+		s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 0))
+	case 0x1211: // File information upload
+		file, err := jt808.ParseAttachmentFileInfo(body)
+		if err != nil {
+			log.Printf("[ATTACH] Error parsing file information from %s: %v", phone, err)
+			s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 2))
+			return
+		}
+		if err := s.startFile(file); err != nil {
+			log.Printf("[ATTACH] Refusing %s from %s: %v", file.Name, phone, err)
+			s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 1))
+			return
+		}
+		s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 0))
+	case 0x1212: // File upload complete
+		file, err := jt808.ParseAttachmentFileInfo(body)
+		if err != nil {
+			log.Printf("[ATTACH] Error parsing file completion from %s: %v", phone, err)
+			s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 2))
+			return
+		}
+		missing := s.finishFile(file)
+		response := jt808.BuildAttachmentCompleteResponseBody(file.Name, file.TypeCode, missing)
+		s.reply(jt808.BuildJT808Message(0x9212, phone, shared.GenerateSerial(), response, false, 0, 0))
+	default:
+		s.reply(jt808.BuildGeneralResponse(phone, msgSerial, msgID, 3))
+	}
+}
+
+// startFile prepares to receive an attachment announced by 0x1211. A file
+// already partly received for the same alarm keeps its ranges.
+func (s *attachmentSession) startFile(file *models.AttachmentFileInfo) error {
+	if s.info == nil {
+		return fmt.Errorf("no alarm attachment information (0x1210) received")
+	}
+	if file.Name == "" || file.Name != filepath.Base(file.Name) || file.Name == ".." || strings.ContainsAny(file.Name, `/\`) {
+		return fmt.Errorf("invalid file name")
+	}
+	if file.Size > maxAttachmentFileSize {
+		return fmt.Errorf("file of %d bytes exceeds %d", file.Size, maxAttachmentFileSize)
+	}
+	var total uint64
+	for name, size := range s.sizes {
+		if name != file.Name {
+			total += uint64(size)
+		}
+	}
+	if total+uint64(file.Size) > maxAttachmentSessionSize {
+		return fmt.Errorf("attachments of %d bytes exceed %d per connection", total+uint64(file.Size), maxAttachmentSessionSize)
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	relPath := path.Join(s.phone, s.info.Identification.Raw, file.Name)
+	transfer, exists := shared.AttachmentTransfers[relPath]
+	if !exists || transfer.Size != file.Size {
+		transfer = &models.AttachmentTransfer{
+			DevicePhone:    s.phone,
+			AlarmNumber:    s.info.AlarmNumber,
+			Identification: s.info.Identification,
+			Name:           file.Name,
+			FileType:       file.FileType,
+			Size:           file.Size,
+			Path:           relPath,
+		}
+		shared.AttachmentTransfers[relPath] = transfer
+	}
+	transfer.UpdatedAt = time.Now()
+
+	localPath := filepath.Join(shared.AttachmentStoreDir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		return err
+	}
+	if existing := s.files[file.Name]; existing != nil {
+		existing.Close()
+	}
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if len(transfer.Received) == 0 {
+		f.Truncate(0)
+	}
+	s.files[file.Name] = f
+	s.sizes[file.Name] = file.Size
+	return nil
+}
+
+// handleData writes one file data packet. Packets for files not announced
+// with 0x1211 are skipped; an error means the stream cannot be resynchronised.
+func (s *attachmentSession) handleData(reader *bufio.Reader) error {
+	header := make([]byte, jt808.AttachmentDataHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	name, offset, length, err := jt808.ParseAttachmentDataHeader(header)
+	if err != nil {
+		return err
+	}
+	if length > maxAttachmentChunk {
+		return fmt.Errorf("file data packet of %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+
+	f := s.files[name]
+	if f == nil || s.info == nil {
+		shared.VPrint("[ATTACH] Data for unannounced file %s from %s", name, s.phone)
+		return nil
+	}
+
+	shared.ConnMutex.Lock()
+	transfer, exists := shared.AttachmentTransfers[path.Join(s.phone, s.info.Identification.Raw, name)]
+	var size uint32
+	if exists {
+		size = transfer.Size
+	}
+	shared.ConnMutex.Unlock()
+	if !exists {
+		return nil
+	}
+	if uint64(offset)+uint64(length) > uint64(size) {
+		shared.VPrint("[ATTACH] Data for %s from %s beyond its %d bytes", name, s.phone, size)
+		return nil
+	}
+	if _, err := f.WriteAt(data, int64(offset)); err != nil {
+		log.Printf("[ATTACH] Failed to write %s from %s: %v", name, s.phone, err)
+		return nil
+	}
+
+	shared.ConnMutex.Lock()
+	transfer.Received = addFileRange(transfer.Received, models.FileRange{Offset: offset, Length: length})
+	transfer.UpdatedAt = time.Now()
+	shared.ConnMutex.Unlock()
+	return nil
+}
+
+// finishFile handles a 0x1212 completion, returning the ranges the terminal
+// still has to send. A complete file is indexed and published.
+func (s *attachmentSession) finishFile(file *models.AttachmentFileInfo) []models.FileRange {
+	if s.info == nil {
+		return []models.FileRange{{Offset: 0, Length: file.Size}}
+	}
+
+	shared.ConnMutex.Lock()
+	relPath := path.Join(s.phone, s.info.Identification.Raw, file.Name)
+	transfer, exists := shared.AttachmentTransfers[relPath]
+	if !exists {
+		shared.ConnMutex.Unlock()
+		return []models.FileRange{{Offset: 0, Length: file.Size}}
+	}
+	missing := missingFileRanges(transfer.Received, transfer.Size)
+	if len(missing) > 0 {
+		transfer.UpdatedAt = time.Now()
+		shared.ConnMutex.Unlock()
+		log.Printf("[ATTACH] %s from %s incomplete, requesting %d ranges", file.Name, s.phone, len(missing))
+		return missing
+	}
+
+	if f := s.files[file.Name]; f != nil {
+		f.Close()
+		delete(s.files, file.Name)
+	}
+	delete(shared.AttachmentTransfers, relPath)
+	attachment := indexAttachmentLocked(transfer)
+	shared.ConnMutex.Unlock()
+
+	log.Printf("[ATTACH] Received %s attachment %s from %s for alarm %s (%d bytes) as %s",
+		attachment.FileType, attachment.Name, attachment.DevicePhone, attachment.AlarmNumber, attachment.Size, attachment.FileID)
+	if err := PublishEvent("tracker/alarm-attachments", attachment); err != nil {
+		log.Printf("[ATTACH] Failed to publish attachment for %s: %v", attachment.DevicePhone, err)
+	}
+	return nil
+}
+
+func (s *attachmentSession) reply(message []byte) {
+	if _, err := s.conn.Write(message); err != nil {
+		shared.VPrint("[ATTACH] Error replying to %s: %v", s.phone, err)
+	}
+}
+
+func (s *attachmentSession) closeFiles() {
+	for _, f := range s.files {
+		f.Close()
+	}
+}
+
+// indexAttachmentLocked records a complete attachment and saves the index.
+// Must be called with shared.ConnMutex held.
+func indexAttachmentLocked(transfer *models.AttachmentTransfer) models.AlarmAttachment {
+	var attachment *models.AlarmAttachment
+	for _, existing := range shared.AlarmAttachments {
+		if existing.Path == transfer.Path {
+			attachment = existing
+			break
+		}
+	}
+	if attachment == nil {
+		attachment = &models.AlarmAttachment{FileID: shared.GenerateCallID()}
+		shared.AlarmAttachments[attachment.FileID] = attachment
+	}
+	attachment.DevicePhone = transfer.DevicePhone
+	attachment.AlarmNumber = transfer.AlarmNumber
+	attachment.Identification = transfer.Identification.Raw
+	attachment.Name = transfer.Name
+	attachment.FileType = transfer.FileType
+	attachment.Path = transfer.Path
+	attachment.Size = int64(transfer.Size)
+	attachment.ReceivedAt = time.Now()
+
+	// <file type>_<channel>_<alarm type>_<serial>_<alarm number>.<suffix>
+	if parts := strings.Split(transfer.Name, "_"); len(parts) >= 3 {
+		attachment.Channel, _ = strconv.Atoi(parts[1])
+		attachment.AlarmType = parts[2]
+	}
+
+	if err := saveAttachmentIndexLocked(); err != nil {
+		log.Printf("[ATTACH] Failed to save attachment index: %v", err)
+	}
+	return *attachment
+}
+
+// addFileRange merges r into the sorted, non-overlapping ranges.
+func addFileRange(ranges []models.FileRange, r models.FileRange) []models.FileRange {
+	if r.Length == 0 {
+		return ranges
+	}
+	ranges = append(ranges, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		lastEnd := uint64(last.Offset) + uint64(last.Length)
+		if uint64(next.Offset) > lastEnd {
+			merged = append(merged, next)
+			continue
+		}
+		if end := uint64(next.Offset) + uint64(next.Length); end > lastEnd {
+			last.Length = uint32(end - uint64(last.Offset))
+		}
+	}
+	return merged
+}
+
+// missingFileRanges lists the gaps the received ranges leave in a file.
+func missingFileRanges(received []models.FileRange, size uint32) []models.FileRange {
+	missing := make([]models.FileRange, 0)
+	var next uint32
+	for _, r := range received {
+		if r.Offset > next {
+			missing = append(missing, models.FileRange{Offset: next, Length: r.Offset - next})
+		}
+		if end := r.Offset + r.Length; end > next {
+			next = end
+		}
+	}
+	if next < size {
+		missing = append(missing, models.FileRange{Offset: next, Length: size - next})
+	}
+	return missing
+}
+
+// requestAlarmAttachments sends a 0x9208 pointing the device at the attachment
+// server for an alarm that announced attachments.
+func requestAlarmAttachments(alarm models.ActiveSafetyAlarm) {
+	server := shared.AttachmentServer
+	identification, err := hex.DecodeString(alarm.Identification.Raw)
+	if err != nil {
+		return
+	}
+
+	body := jt808.BuildAlarmAttachmentUploadBody(server.IP, server.TCPPort, identification, alarm.AlarmNumber)
+	_, err = SendTerminalCommand(alarm.DevicePhone, 0x9208, body, func(result byte) {
+		if result != 0 {
+			log.Printf("[ATTACH] Device %s rejected attachment upload for alarm %s: %s", alarm.DevicePhone, alarm.AlarmNumber, jt808.ResultText(result))
+		}
+	})
+	if err != nil {
+		log.Printf("[ATTACH] Failed to request attachments of alarm %s from %s: %v", alarm.AlarmNumber, alarm.DevicePhone, err)
+		return
+	}
+	log.Printf("[ATTACH] Requested %d attachments of %s %s alarm from %s as %s (server %s:%d)",
+		alarm.Identification.Attachments, alarm.Source, alarm.Type, alarm.DevicePhone, alarm.AlarmNumber, server.IP, server.TCPPort)
+}
+
+// attachmentsRequestedLocked reports whether attachments were already
+// requested for an alarm identification. Must be called with
+// shared.ConnMutex held.
+func attachmentsRequestedLocked(phone, identification string) bool {
+	for _, recorded := range shared.ActiveSafetyAlarms[phone] {
+		if recorded.AlarmNumber != "" && recorded.Identification.Raw == identification {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentsExpected reports whether a 0x1210 announces the attachments of
+// an alarm they were requested for with 0x9208, or resumes an unfinished
+// transfer of them.
+func attachmentsExpected(phone string, info *models.AlarmAttachmentInfo) bool {
+	if info.AlarmNumber == "" {
+		return false
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	for _, recorded := range shared.ActiveSafetyAlarms[phone] {
+		if recorded.AlarmNumber == info.AlarmNumber && recorded.Identification.Raw == info.Identification.Raw {
+			return true
+		}
+	}
+	for _, transfer := range shared.AttachmentTransfers {
+		if transfer.DevicePhone == phone && transfer.AlarmNumber == info.AlarmNumber &&
+			transfer.Identification.Raw == info.Identification.Raw {
+			return true
+		}
+	}
+	return false
+}
+
+// newAlarmNumber generates the 32 character platform alarm number.
+func newAlarmNumber() string {
+	return shared.GenerateCallID() + shared.GenerateCallID()
+}
+
+// ListAlarmAttachments returns the received attachments matching the filters,
+// newest first. Empty filters match all.
+func ListAlarmAttachments(phone, alarmNumber, identification string) []models.AlarmAttachment {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	attachments := make([]models.AlarmAttachment, 0)
+	for _, attachment := range shared.AlarmAttachments {
+		if (phone != "" && attachment.DevicePhone != phone) ||
+			(alarmNumber != "" && attachment.AlarmNumber != alarmNumber) ||
+			(identification != "" && !strings.EqualFold(attachment.Identification, identification)) {
+			continue
+		}
+		attachments = append(attachments, *attachment)
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		return attachments[i].ReceivedAt.After(attachments[j].ReceivedAt)
+	})
+	return attachments
+}
+
+// GetAlarmAttachment returns an attachment and its path on disk.
+func GetAlarmAttachment(fileID string) (models.AlarmAttachment, string, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	attachment, exists := shared.AlarmAttachments[fileID]
+	if !exists {
+		return models.AlarmAttachment{}, "", false
+	}
+	return *attachment, filepath.Join(shared.AttachmentStoreDir, filepath.FromSlash(attachment.Path)), true
+}
+
+// AttachmentCleanupRoutine drops attachment files the terminal stopped
+// uploading without finishing them.
+func AttachmentCleanupRoutine() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		shared.ConnMutex.Lock()
+		now := time.Now()
+		for relPath, transfer := range shared.AttachmentTransfers {
+			if now.Sub(transfer.UpdatedAt) <= attachmentTransferTTL {
+				continue
+			}
+			delete(shared.AttachmentTransfers, relPath)
+			os.Remove(filepath.Join(shared.AttachmentStoreDir, filepath.FromSlash(relPath)))
+			log.Printf("[ATTACH] Dropped unfinished attachment %s from %s", transfer.Name, transfer.DevicePhone)
+		}
+		shared.ConnMutex.Unlock()
+	}
+}
+
+// saveAttachmentIndexLocked writes the attachment index next to the stored
+// files. Must be called with shared.ConnMutex held.
+func saveAttachmentIndexLocked() error {
+	attachments := make([]*models.AlarmAttachment, 0, len(shared.AlarmAttachments))
+	for _, attachment := range shared.AlarmAttachments {
+		attachments = append(attachments, attachment)
+	}
+	data, err := json.MarshalIndent(attachments, "", "  ")
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(shared.AttachmentStoreDir, fileIndexName)
+	if err := os.WriteFile(indexPath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(indexPath+".tmp", indexPath)
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+const (
+	// IntercomChannel is the logical channel our terminals use for two-way talk.
+	IntercomChannel = 0x24
+
+	// callMediaTimeout ends an accepted call whose audio never reaches the media server.
+	callMediaTimeout = 30 * time.Second
+
+	// endedCallRetention keeps finished calls visible to status queries for a while.
+	endedCallRetention = 5 * time.Minute
+)
+
+var (
+	ErrCallInProgress = errors.New("device already in call")
+	ErrNoActiveCall   = errors.New("no active call found")
+)
+
+// StartVoIPCall configures the device audio codec (0x8103), chosen from its
+// cached attributes, and opens a two-way intercom (0x9101, data type 2). The
+// call stays "initiated" until audio from the device reaches the media server.
+func StartVoIPCall(phone, callerID string) (models.VoIPCall, *models.PendingCommand, error) {
+	server := shared.AudioServer
+	codec, err := SelectIntercomCodec(phone)
+	if err != nil {
+		return models.VoIPCall{}, nil, err
+	}
+
+	shared.ConnMutex.Lock()
+	if current := findCurrentCallLocked(phone); current != nil {
+		shared.ConnMutex.Unlock()
+		return models.VoIPCall{}, nil, ErrCallInProgress
+	}
+	call := &models.VoIPCall{
+		CallID:      shared.GenerateCallID(),
+		DevicePhone: phone,
+		CallerID:    callerID,
+		Status:      "initiated",
+		StartTime:   time.Now(),
+		AudioServer: server.IP,
+		AudioPort:   server.TCPPort,
+		AudioCodec:  codec,
+	}
+	shared.VoIPCalls[call.CallID] = call
+	setDeviceInCallLocked(phone, true)
+	shared.ConnMutex.Unlock()
+
+	_, err = SendTerminalCommand(phone, 0x8103, jt808.BuildAudioParamsBody(byte(codec)), func(result byte) {
+		if result != 0 {
+			log.Printf("[CALL] Device %s rejected %s parameters: %s", phone, jt808.CodecName(codec), jt808.ResultText(result))
+		}
+	})
+	if err != nil {
+		shared.ConnMutex.Lock()
+		endCallLocked(call, "send failed")
+		shared.ConnMutex.Unlock()
+		return models.VoIPCall{}, nil, err
+	}
+
+	body := jt808.BuildRealtimeAVRequestBody(server.IP, server.TCPPort, server.UDPPort, IntercomChannel, 2, 1)
+	cmd, err := SendTerminalCommand(phone, 0x9101, body, func(result byte) {
+		if call.Status == "ended" {
+			return
+		}
+		if result != 0 {
+			endCallLocked(call, "rejected: "+jt808.ResultText(result))
+			return
+		}
+		call.Acknowledged = true
+	})
+	if err != nil {
+		shared.ConnMutex.Lock()
+		endCallLocked(call, "send failed")
+		shared.ConnMutex.Unlock()
+		return models.VoIPCall{}, nil, err
+	}
+
+	log.Printf("[CALL] Intercom requested - Device: %s, Call: %s, Server: %s:%d", phone, call.CallID, server.IP, server.TCPPort)
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	return *call, cmd, nil
+}
+
+// ControlVoIPCall sends a 0x9102 control command on the intercom channel.
+// Commands 0 (off) and 4 (end) finish the call immediately; pause and resume
+// follow the device's 0x0001 reply.
+func ControlVoIPCall(phone string, command int) (models.VoIPCall, *models.PendingCommand, error) {
+	shared.ConnMutex.Lock()
+	call := findCurrentCallLocked(phone)
+	shared.ConnMutex.Unlock()
+	if call == nil {
+		return models.VoIPCall{}, nil, ErrNoActiveCall
+	}
+
+	body := jt808.BuildRealtimeAVControlBody(IntercomChannel, command, 0, 0)
+	cmd, err := SendTerminalCommand(phone, 0x9102, body, func(result byte) {
+		if result != 0 {
+			log.Printf("[CALL] Device %s rejected control %d: %s", phone, command, jt808.ResultText(result))
+			return
+		}
+		if call.Status == "ended" {
+			return
+		}
+		switch command {
+		case 2:
+			call.Status = "paused"
+		case 3:
+			if call.AnswerTime.IsZero() {
+				call.Status = "initiated"
+			} else {
+				call.Status = "active"
+			}
+		}
+	})
+	if err != nil {
+		return models.VoIPCall{}, nil, err
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	if command == 0 || command == 4 {
+		endCallLocked(call, "hangup")
+	}
+	return *call, cmd, nil
+}
+
+// HandleMediaStreamEvent updates calls from the media server's view of the
+// JT1078 stream: audio arriving answers the call, the stream closing ends it.
+// A closed playback stream finishes its playback session.
+func HandleMediaStreamEvent(event models.MediaStreamEvent) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	if event.Playback {
+		if event.Event == "stopped" {
+			endPlaybackLocked(event.DevicePhone, event.Channel)
+		}
+		return
+	}
+
+	call := findCurrentCallLocked(event.DevicePhone)
+	if call == nil {
+		return
+	}
+
+	switch event.Event {
+	case "started":
+		// Only the intercom channel answers; live listening (data type 3)
+		// or video on other channels does not
+		if event.Channel != IntercomChannel {
+			return
+		}
+		if call.Status == "initiated" {
+			call.Status = "active"
+			call.AnswerTime = time.Now()
+			log.Printf("[CALL] Call %s active - audio received from %s", call.CallID, call.DevicePhone)
+		}
+	case "stopped":
+		if event.Channel == IntercomChannel || event.Channel == 0 {
+			endCallLocked(call, "media closed")
+		}
+	}
+}
+
+// GetCurrentCall returns the device's ongoing call, or its most recent one.
+func GetCurrentCall(phone string) (models.VoIPCall, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	if call := findCurrentCallLocked(phone); call != nil {
+		return *call, true
+	}
+	var latest *models.VoIPCall
+	for _, call := range shared.VoIPCalls {
+		if call.DevicePhone == phone && (latest == nil || call.StartTime.After(latest.StartTime)) {
+			latest = call
+		}
+	}
+	if latest == nil {
+		return models.VoIPCall{}, false
+	}
+	return *latest, true
+}
+
+// ListVoIPCalls returns a copy of all tracked calls, including recently ended ones.
+func ListVoIPCalls() []models.VoIPCall {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	calls := make([]models.VoIPCall, 0, len(shared.VoIPCalls))
+	for _, call := range shared.VoIPCalls {
+		calls = append(calls, *call)
+	}
+	return calls
+}
+
+// CallSupervisorRoutine ends calls whose audio never arrived and purges old calls.
+func CallSupervisorRoutine() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		shared.ConnMutex.Lock()
+		now := time.Now()
+		for id, call := range shared.VoIPCalls {
+			switch {
+			case call.Status == "initiated" && now.Sub(call.StartTime) > callMediaTimeout:
+				endCallLocked(call, "no audio from device")
+			case call.Status == "ended" && now.Sub(call.EndTime) > endedCallRetention:
+				delete(shared.VoIPCalls, id)
+			}
+		}
+		shared.ConnMutex.Unlock()
+	}
+}
+
+// VoIPCallResponse converts a call to its API representation.
+func VoIPCallResponse(call models.VoIPCall) models.VoIPCallResponse {
+	response := models.VoIPCallResponse{
+		CallID:      call.CallID,
+		Status:      call.Status,
+		DevicePhone: call.DevicePhone,
+		CallerID:    call.CallerID,
+		StartTime:   call.StartTime.Format(time.RFC3339),
+		EndReason:   call.EndReason,
+		AudioCodec:  jt808.CodecName(call.AudioCodec),
+	}
+	if !call.AnswerTime.IsZero() {
+		response.AnswerTime = call.AnswerTime.Format(time.RFC3339)
+	}
+	if !call.EndTime.IsZero() {
+		response.EndTime = call.EndTime.Format(time.RFC3339)
+	}
+	return response
+}
+
+// findCurrentCallLocked returns the device's call that has not ended yet.
+// Must be called with shared.ConnMutex held.
+func findCurrentCallLocked(phone string) *models.VoIPCall {
+	for _, call := range shared.VoIPCalls {
+		if call.DevicePhone == phone && call.Status != "ended" {
+			return call
+		}
+	}
+	return nil
+}
+
+// endCallLocked moves a call to "ended". Must be called with shared.ConnMutex held.
+func endCallLocked(call *models.VoIPCall, reason string) {
+	if call.Status == "ended" {
+		return
+	}
+	call.Status = "ended"
+	call.EndReason = reason
+	call.EndTime = time.Now()
+	setDeviceInCallLocked(call.DevicePhone, false)
+	log.Printf("[CALL] Call %s for %s ended: %s", call.CallID, call.DevicePhone, reason)
+}
+
+// endCallsForDeviceLocked ends every open call of a device. Must be called
+// with shared.ConnMutex held.
+func endCallsForDeviceLocked(phone, reason string) {
+	for _, call := range shared.VoIPCalls {
+		if call.DevicePhone == phone {
+			endCallLocked(call, reason)
+		}
+	}
+}
+
+func setDeviceInCallLocked(phone string, inCall bool) {
+	if device, exists := shared.JT808Devices[phone]; exists {
+		device.InCall = inCall
+	}
+}
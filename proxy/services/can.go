@@ -0,0 +1,87 @@
+package services
+
+import (
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+// handleCANBusData decodes a 0x0705 upload, applies the loaded signal
+// definitions and publishes the result.
+func handleCANBusData(phone string, body []byte) {
+	upload, err := jt808.ParseCANBusData(body)
+	if err != nil {
+		shared.VPrint("Error parsing CAN bus data from %s: %v", phone, err)
+		if upload == nil {
+			return
+		}
+	}
+
+	now := time.Now()
+	event := models.CANDataEvent{
+		DevicePhone: phone,
+		ReceiveTime: upload.ReceiveTime,
+		Frames:      upload.Frames,
+		Signals:     make([]models.CANSignalValue, 0),
+		Timestamp:   now,
+	}
+
+	for _, frame := range upload.Frames {
+		def, ok := lookupCANMessage(frame.ID)
+		if !ok {
+			continue
+		}
+		for _, sig := range def.Signals {
+			value, ok := sig.Decode(frame.Data)
+			if !ok {
+				continue
+			}
+			event.Signals = append(event.Signals, models.CANSignalValue{
+				Name:      sig.Name,
+				Message:   def.Name,
+				CANID:     frame.ID,
+				Value:     value,
+				Unit:      sig.Unit,
+				Timestamp: now,
+			})
+		}
+	}
+
+	shared.VPrint("[CAN] Device %s: %d frames, %d decoded signals", phone, len(upload.Frames), len(event.Signals))
+
+	if len(event.Signals) > 0 {
+		shared.ConnMutex.Lock()
+		latest, exists := shared.CANSignals[phone]
+		if !exists {
+			latest = make(map[string]*models.CANSignalValue)
+			shared.CANSignals[phone] = latest
+		}
+		for i := range event.Signals {
+			value := event.Signals[i]
+			latest[value.Name] = &value
+		}
+		shared.ConnMutex.Unlock()
+	}
+
+	if err := PublishEvent("tracker/can", event); err != nil {
+		log.Printf("[CAN] Failed to publish CAN data for %s: %v", phone, err)
+	}
+}
+
+// GetCANSignals returns a snapshot of the latest decoded CAN values for a device.
+func GetCANSignals(phone string) ([]models.CANSignalValue, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	latest, exists := shared.CANSignals[phone]
+	if !exists {
+		return nil, false
+	}
+	values := make([]models.CANSignalValue, 0, len(latest))
+	for _, value := range latest {
+		values = append(values, *value)
+	}
+	return values, true
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+const (
+	// defaultVideoChannels is assumed until a device has reported its attributes.
+	defaultVideoChannels = 4
+
+	// capabilityQueryDelay gives the platform time to accept the device's
+	// authentication before we query its audio/video attributes.
+	capabilityQueryDelay = 5 * time.Second
+)
+
+// mediaAudioCodecs lists the Table 12 audio codecs our media servers both
+// decode and encode for talk-back. AAC is decoded but not encoded, so AAC
+// devices are configured with G.711A for calls.
+var mediaAudioCodecs = map[int]bool{
+	1:  true, // G.721
+	6:  true, // G.711A
+	7:  true, // G.711U
+	8:  true, // G.726
+	12: true, // DVI4_8K
+	13: true, // DVI4_16K
+	15: true, // S16BE_STEREO
+	16: true, // S16BE_MONO
+	18: true, // LPCM
+	22: true, // PCM_VOICE
+	23: true, // PCM_AUDIO
+	26: true, // ADPCMA
+}
+
+var ErrNoAudioOutput = errors.New("device does not support audio output")
+
+// handleAVAttributes caches a device's 0x1003 audio/video attributes and
+// completes any 0x9003 query waiting for them.
+func handleAVAttributes(phone string, body []byte) {
+	caps, err := jt808.ParseAVAttributes(body)
+	if err != nil {
+		shared.VPrint("Error parsing AV attributes from %s: %v", phone, err)
+		return
+	}
+	caps.DevicePhone = phone
+	caps.UpdatedAt = time.Now()
+
+	shared.ConnMutex.Lock()
+	shared.AVCapabilities[phone] = caps
+	shared.ConnMutex.Unlock()
+
+	log.Printf("[AV ATTRIBUTES] Device %s: audio %s %d Hz/%d-bit, output %v, video %s, %d video / %d audio channels",
+		phone, caps.AudioCodecName, caps.SampleRate, caps.SampleBits, caps.AudioOutput,
+		caps.VideoCodecName, caps.MaxVideoChannels, caps.MaxAudioChannels)
+
+	resolvePendingQuery(phone, 0x9003)
+}
+
+// QueryAVCapabilities sends a 0x9003 attribute query. The returned command
+// completes when the device's 0x1003 reply has been cached.
+func QueryAVCapabilities(phone string) (*models.PendingCommand, error) {
+	return SendTerminalCommand(phone, 0x9003, nil, nil)
+}
+
+// scheduleCapabilityQuery queries a newly authenticated device whose
+// attributes are not cached yet.
+func scheduleCapabilityQuery(phone string) {
+	if _, exists := GetAVCapabilities(phone); exists {
+		return
+	}
+	time.AfterFunc(capabilityQueryDelay, func() {
+		if _, err := QueryAVCapabilities(phone); err != nil {
+			shared.VPrint("Could not query AV attributes of %s: %v", phone, err)
+		}
+	})
+}
+
+// GetAVCapabilities returns the cached attributes of a device.
+func GetAVCapabilities(phone string) (models.AVCapabilities, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	caps, exists := shared.AVCapabilities[phone]
+	if !exists {
+		return models.AVCapabilities{}, false
+	}
+	return *caps, true
+}
+
+// ValidateVideoChannel checks a camera channel against the device's reported
+// video channel count, falling back to the default range while unknown.
+func ValidateVideoChannel(phone string, channel int) error {
+	maxChannels := defaultVideoChannels
+	if caps, exists := GetAVCapabilities(phone); exists && caps.MaxVideoChannels > 0 {
+		maxChannels = caps.MaxVideoChannels
+	}
+	if channel < 1 || channel > maxChannels {
+		return fmt.Errorf("Channel must be between 1 and %d", maxChannels)
+	}
+	return nil
+}
+
+// SelectIntercomCodec picks the audio codec to configure for a two-way call:
+// the device's own input codec when our media servers decode and encode it,
+// G.711A otherwise. It fails if the device reported it cannot play audio.
+func SelectIntercomCodec(phone string) (int, error) {
+	caps, exists := GetAVCapabilities(phone)
+	if !exists {
+		return 6, nil
+	}
+	if !caps.AudioOutput {
+		return 0, ErrNoAudioOutput
+	}
+	if mediaAudioCodecs[caps.AudioCodec] {
+		return caps.AudioCodec, nil
+	}
+	return 6, nil
+}
@@ -89,6 +89,14 @@ func DeregisterClient(remoteAddr string) {
 	for phone, device := range shared.JT808Devices {
 		if device.RemoteAddr == remoteAddr {
 			delete(shared.JT808Devices, phone)
+			cleanupVideoSessionsLocked(phone)
+			cleanupPlaybackSessionsLocked(phone)
+			endCallsForDeviceLocked(phone, "device disconnected")
+			for key, cmd := range shared.PendingCommands {
+				if cmd.DevicePhone == phone {
+					delete(shared.PendingCommands, key)
+				}
+			}
 			shared.VPrint("Deregistered JT808 device %s due to connection close from %s", phone, remoteAddr)
 		}
 	}
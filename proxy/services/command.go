@@ -0,0 +1,143 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+// pendingCommandTTL bounds how long an unanswered command is kept for correlation.
+const pendingCommandTTL = 2 * time.Minute
+
+func pendingCommandKey(phone string, serial uint16) string {
+	return fmt.Sprintf("%s_%d", phone, serial)
+}
+
+// SendTerminalCommand frames a platform command, writes it to the device and
+// registers it so the terminal's 0x0001 reply can be matched by serial number.
+// onResponse may be nil; when set it runs with shared.ConnMutex held.
+func SendTerminalCommand(phone string, msgID uint16, body []byte, onResponse func(result byte)) (*models.PendingCommand, error) {
+	device, exists := GetJT808Device(phone)
+	if !exists {
+		return nil, fmt.Errorf("device not found: %s", phone)
+	}
+	if device.Conn == nil {
+		return nil, fmt.Errorf("device connection is nil: %s", phone)
+	}
+
+	serial := shared.GenerateSerial()
+	cmd := &models.PendingCommand{
+		DevicePhone: phone,
+		MsgID:       msgID,
+		Serial:      serial,
+		SentAt:      time.Now(),
+		Done:        make(chan struct{}),
+		OnResponse:  onResponse,
+	}
+
+	// Register before writing so a fast reply cannot be missed
+	shared.ConnMutex.Lock()
+	shared.PendingCommands[pendingCommandKey(phone, serial)] = cmd
+	shared.ConnMutex.Unlock()
+
+	message := jt808.BuildJT808Message(msgID, phone, serial, body, false, 0, 0)
+	if _, err := device.Conn.Write(message); err != nil {
+		shared.ConnMutex.Lock()
+		delete(shared.PendingCommands, pendingCommandKey(phone, serial))
+		shared.ConnMutex.Unlock()
+		return nil, fmt.Errorf("failed to send command 0x%04X: %v", msgID, err)
+	}
+
+	shared.VPrint("[COMMAND] Sent 0x%04X to %s (serial %d, %d byte body)", msgID, phone, serial, len(body))
+	return cmd, nil
+}
+
+// AwaitTerminalResponse waits for the device to answer a command sent with
+// SendTerminalCommand. It returns an error if no reply arrives in time.
+func AwaitTerminalResponse(cmd *models.PendingCommand, timeout time.Duration) (byte, error) {
+	select {
+	case <-cmd.Done:
+		return cmd.Result, nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("timeout waiting for response to 0x%04X", cmd.MsgID)
+	}
+}
+
+// resolvePendingCommand completes the command matching a terminal general response.
+func resolvePendingCommand(phone string, replySerial, replyMsgID uint16, result byte) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	resolvePendingCommandLocked(phone, replySerial, replyMsgID, result)
+}
+
+// resolvePendingCommandLocked must be called with shared.ConnMutex held.
+func resolvePendingCommandLocked(phone string, replySerial, replyMsgID uint16, result byte) {
+	key := pendingCommandKey(phone, replySerial)
+	cmd, exists := shared.PendingCommands[key]
+	if !exists || cmd.MsgID != replyMsgID {
+		return
+	}
+	delete(shared.PendingCommands, key)
+
+	cmd.Result = result
+	if cmd.OnResponse != nil {
+		cmd.OnResponse(result)
+	}
+	close(cmd.Done)
+}
+
+// resolvePendingQuery completes the oldest unanswered command of a given type
+// for a device. It serves queries answered by a dedicated upload message that
+// carries no reply serial, such as 0x9003 answered by 0x1003.
+func resolvePendingQuery(phone string, msgID uint16) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	var oldestKey string
+	var oldest *models.PendingCommand
+	for key, cmd := range shared.PendingCommands {
+		if cmd.DevicePhone == phone && cmd.MsgID == msgID && (oldest == nil || cmd.SentAt.Before(oldest.SentAt)) {
+			oldestKey, oldest = key, cmd
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(shared.PendingCommands, oldestKey)
+
+	if oldest.OnResponse != nil {
+		oldest.OnResponse(0)
+	}
+	close(oldest.Done)
+}
+
+// hasPendingCommandLocked reports whether a command of the given type awaits a
+// reply from the device. Must be called with shared.ConnMutex held.
+func hasPendingCommandLocked(phone string, msgID uint16) bool {
+	for _, cmd := range shared.PendingCommands {
+		if cmd.DevicePhone == phone && cmd.MsgID == msgID {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingCommandCleanupRoutine periodically drops commands the device never answered.
+func PendingCommandCleanupRoutine() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		shared.ConnMutex.Lock()
+		now := time.Now()
+		for key, cmd := range shared.PendingCommands {
+			if now.Sub(cmd.SentAt) > pendingCommandTTL {
+				delete(shared.PendingCommands, key)
+				log.Printf("[COMMAND] No response to 0x%04X from %s (serial %d)", cmd.MsgID, cmd.DevicePhone, cmd.Serial)
+			}
+		}
+		shared.ConnMutex.Unlock()
+	}
+}
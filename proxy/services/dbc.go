@@ -0,0 +1,166 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CANSignalDef describes one signal inside a CAN message, as read from a DBC file.
+type CANSignalDef struct {
+	Name      string
+	StartBit  int
+	Length    int
+	BigEndian bool // Motorola byte order (@0); Intel (@1) otherwise
+	Signed    bool
+	Factor    float64
+	Offset    float64
+	Unit      string
+}
+
+// CANMessageDef groups the signals carried by a single CAN ID.
+type CANMessageDef struct {
+	ID      uint32
+	Name    string
+	Signals []CANSignalDef
+}
+
+var (
+	canDefsMu sync.RWMutex
+	canDefs   = make(map[uint32]*CANMessageDef)
+
+	dbcMessageRe = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:`)
+	dbcSignalRe  = regexp.MustCompile(`^SG_\s+(\w+)\s*(\S*)\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(([^,]+),([^)]+)\)\s*\[[^\]]*\]\s*"([^"]*)"`)
+)
+
+// LoadCANDefinitions loads message and signal definitions from a DBC file.
+// Only the BO_ and SG_ entries are used; multiplexed signals are skipped.
+func LoadCANDefinitions(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open DBC file: %v", err)
+	}
+	defer file.Close()
+
+	defs := make(map[uint32]*CANMessageDef)
+	var current *CANMessageDef
+	signalCount := 0
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := dbcMessageRe.FindStringSubmatch(line); m != nil {
+			id, err := strconv.ParseUint(m[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid message ID %q", lineNum, m[1])
+			}
+			// DBC marks extended frames by setting bit 31 on the ID
+			current = &CANMessageDef{ID: uint32(id) & 0x1FFFFFFF, Name: m[2]}
+			defs[current.ID] = current
+			continue
+		}
+
+		m := dbcSignalRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if current == nil {
+			return fmt.Errorf("line %d: signal %s defined outside of a message", lineNum, m[1])
+		}
+		if m[2] != "" {
+			log.Printf("[CAN] Skipping multiplexed signal %s in message %s", m[1], current.Name)
+			continue
+		}
+
+		startBit, _ := strconv.Atoi(m[3])
+		length, _ := strconv.Atoi(m[4])
+		factor, err := strconv.ParseFloat(m[7], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid factor %q", lineNum, m[7])
+		}
+		offset, err := strconv.ParseFloat(m[8], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid offset %q", lineNum, m[8])
+		}
+		if length < 1 || length > 64 {
+			return fmt.Errorf("line %d: invalid signal length %d", lineNum, length)
+		}
+
+		current.Signals = append(current.Signals, CANSignalDef{
+			Name:      m[1],
+			StartBit:  startBit,
+			Length:    length,
+			BigEndian: m[5] == "0",
+			Signed:    m[6] == "-",
+			Factor:    factor,
+			Offset:    offset,
+			Unit:      m[9],
+		})
+		signalCount++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read DBC file: %v", err)
+	}
+
+	canDefsMu.Lock()
+	canDefs = defs
+	canDefsMu.Unlock()
+
+	log.Printf("[CAN] Loaded %d messages with %d signals from %s", len(defs), signalCount, path)
+	return nil
+}
+
+// lookupCANMessage returns the definition for a CAN ID, if one was loaded.
+func lookupCANMessage(id uint32) (*CANMessageDef, bool) {
+	canDefsMu.RLock()
+	defer canDefsMu.RUnlock()
+	def, ok := canDefs[id]
+	return def, ok
+}
+
+// Decode extracts the engineering value of the signal from an 8-byte CAN payload.
+func (s CANSignalDef) Decode(data []byte) (float64, bool) {
+	var raw uint64
+	if s.BigEndian {
+		// Motorola: start bit is the MSB, walking down each byte then on to the next
+		pos := s.StartBit
+		for i := 0; i < s.Length; i++ {
+			byteIdx := pos / 8
+			if byteIdx >= len(data) {
+				return 0, false
+			}
+			bit := (data[byteIdx] >> uint(pos%8)) & 0x01
+			raw = raw<<1 | uint64(bit)
+			if pos%8 == 0 {
+				pos += 15
+			} else {
+				pos--
+			}
+		}
+	} else {
+		if (s.StartBit+s.Length+7)/8 > len(data) {
+			return 0, false
+		}
+		for i := 0; i < s.Length; i++ {
+			pos := s.StartBit + i
+			bit := (data[pos/8] >> uint(pos%8)) & 0x01
+			raw |= uint64(bit) << uint(i)
+		}
+	}
+
+	if s.Signed && s.Length < 64 && raw&(1<<uint(s.Length-1)) != 0 {
+		raw |= ^uint64(0) << uint(s.Length)
+	}
+	if s.Signed {
+		return float64(int64(raw))*s.Factor + s.Offset, true
+	}
+	return float64(raw)*s.Factor + s.Offset, true
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCANSignalDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal CANSignalDef
+		data   []byte
+		value  float64
+		ok     bool
+	}{
+		{
+			name:   "Intel 16 bits with factor",
+			signal: CANSignalDef{StartBit: 0, Length: 16, Factor: 0.125},
+			data:   []byte{0x34, 0x12, 0, 0, 0, 0, 0, 0},
+			value:  0x1234 * 0.125,
+			ok:     true,
+		},
+		{
+			name:   "Intel 12 bits across a byte",
+			signal: CANSignalDef{StartBit: 4, Length: 12, Factor: 1},
+			data:   []byte{0xA0, 0x5B, 0, 0, 0, 0, 0, 0},
+			value:  0x5BA,
+			ok:     true,
+		},
+		{
+			name:   "Intel single bit",
+			signal: CANSignalDef{StartBit: 13, Length: 1, Factor: 1},
+			data:   []byte{0, 0x20, 0, 0, 0, 0, 0, 0},
+			value:  1,
+			ok:     true,
+		},
+		{
+			name:   "Intel signed with offset",
+			signal: CANSignalDef{StartBit: 8, Length: 8, Signed: true, Factor: 1, Offset: -40},
+			data:   []byte{0, 0xFE, 0, 0, 0, 0, 0, 0},
+			value:  -42,
+			ok:     true,
+		},
+		{
+			name:   "Intel signed 64 bits",
+			signal: CANSignalDef{StartBit: 0, Length: 64, Signed: true, Factor: 1},
+			data:   []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+			value:  -1,
+			ok:     true,
+		},
+		{
+			name:   "Intel unsigned keeps the top bit",
+			signal: CANSignalDef{StartBit: 56, Length: 8, Factor: 1},
+			data:   []byte{0, 0, 0, 0, 0, 0, 0, 0x80},
+			value:  128,
+			ok:     true,
+		},
+		{
+			name:   "Intel beyond the payload",
+			signal: CANSignalDef{StartBit: 56, Length: 16, Factor: 1},
+			data:   []byte{0, 0, 0, 0, 0, 0, 0, 0xFF},
+		},
+		{
+			name:   "Motorola 16 bits",
+			signal: CANSignalDef{StartBit: 7, Length: 16, BigEndian: true, Factor: 1},
+			data:   []byte{0x12, 0x34, 0, 0, 0, 0, 0, 0},
+			value:  0x1234,
+			ok:     true,
+		},
+		{
+			name:   "Motorola 12 bits from mid byte",
+			signal: CANSignalDef{StartBit: 3, Length: 12, BigEndian: true, Factor: 1},
+			data:   []byte{0x0A, 0xBC, 0, 0, 0, 0, 0, 0},
+			value:  0xABC,
+			ok:     true,
+		},
+		{
+			name:   "Motorola signed with factor and offset",
+			signal: CANSignalDef{StartBit: 23, Length: 8, BigEndian: true, Signed: true, Factor: 0.5, Offset: -10},
+			data:   []byte{0, 0, 0xF6, 0, 0, 0, 0, 0},
+			value:  -15,
+			ok:     true,
+		},
+		{
+			name:   "Motorola beyond the payload",
+			signal: CANSignalDef{StartBit: 63, Length: 16, BigEndian: true, Factor: 1},
+			data:   []byte{0, 0, 0, 0, 0, 0, 0, 0xFF},
+		},
+		{
+			name:   "short payload",
+			signal: CANSignalDef{StartBit: 0, Length: 16, Factor: 1},
+			data:   []byte{0x01},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok := tt.signal.Decode(tt.data)
+			if ok != tt.ok || value != tt.value {
+				t.Errorf("Decode = %v, %v; want %v, %v", value, ok, tt.value, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadCANDefinitions(t *testing.T) {
+	canDefsMu.RLock()
+	saved := canDefs
+	canDefsMu.RUnlock()
+	defer func() {
+		canDefsMu.Lock()
+		canDefs = saved
+		canDefsMu.Unlock()
+	}()
+
+	const dbc = `VERSION ""
+
+BO_ 2364540158 EEC1: 8 Vector__XXX
+ SG_ EngineSpeed : 24|16@1+ (0.125,0) [0|8031.875] "rpm" Vector__XXX
+ SG_ Mode M : 0|8@1+ (1,0) [0|255] "" Vector__XXX
+ SG_ Muxed m1 : 8|8@1+ (1,0) [0|255] "" Vector__XXX
+
+BO_ 100 Motor: 8 Vector__XXX
+ SG_ Temperature : 7|8@0- (0.5,-10) [-74|53.5] "degC" Vector__XXX
+`
+	path := filepath.Join(t.TempDir(), "test.dbc")
+	if err := os.WriteFile(path, []byte(dbc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCANDefinitions(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id      uint32
+		name    string
+		signals []CANSignalDef
+	}{
+		{
+			id:   0x0CF004FE, // extended frame flag cleared
+			name: "EEC1",
+			signals: []CANSignalDef{
+				{Name: "EngineSpeed", StartBit: 24, Length: 16, Factor: 0.125, Unit: "rpm"},
+			},
+		},
+		{
+			id:   100,
+			name: "Motor",
+			signals: []CANSignalDef{
+				{Name: "Temperature", StartBit: 7, Length: 8, BigEndian: true, Signed: true, Factor: 0.5, Offset: -10, Unit: "degC"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		def, ok := lookupCANMessage(tt.id)
+		if !ok {
+			t.Errorf("message %#x not loaded", tt.id)
+			continue
+		}
+		if def.Name != tt.name || !reflect.DeepEqual(def.Signals, tt.signals) {
+			t.Errorf("message %#x = %s %+v, want %s %+v", tt.id, def.Name, def.Signals, tt.name, tt.signals)
+		}
+	}
+	if _, ok := lookupCANMessage(2364540158); ok {
+		t.Errorf("message loaded under its DBC ID with the extended frame flag")
+	}
+
+	value, ok := tests[0].signals[0].Decode([]byte{0, 0, 0, 0x80, 0x25, 0, 0, 0})
+	if !ok || value != 1200 {
+		t.Errorf("EngineSpeed = %v, %v; want 1200 rpm", value, ok)
+	}
+}
+
+func TestLoadCANDefinitionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		dbc  string
+	}{
+		{"signal outside a message", ` SG_ Speed : 0|8@1+ (1,0) [0|255] "" X`},
+		{"invalid factor", "BO_ 1 M: 8 X\n SG_ Speed : 0|8@1+ (x,0) [0|255] \"\" X"},
+		{"invalid length", "BO_ 1 M: 8 X\n SG_ Speed : 0|65@1+ (1,0) [0|255] \"\" X"},
+		{"invalid message ID", "BO_ 99999999999 M: 8 X"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.dbc")
+			if err := os.WriteFile(path, []byte(tt.dbc), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadCANDefinitions(path); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"sort"
+	"time"
+)
+
+const (
+	// uploadTaskTTL bounds how long a device may keep uploading for one task.
+	uploadTaskTTL = 24 * time.Hour
+
+	// finishedUploadRetention keeps finished tasks visible to status queries.
+	finishedUploadRetention = time.Hour
+
+	// fileIndexName is the index of received files inside the file store.
+	fileIndexName = "index.json"
+)
+
+var (
+	ErrNoUploadTask     = errors.New("no upload task found")
+	ErrUploadTaskClosed = errors.New("upload task already finished")
+	ErrNoFileReceiver   = errors.New("FTP receiver is disabled")
+)
+
+// uploadControlStatus is the task status after an accepted 0x9207 control.
+var uploadControlStatus = map[int]string{
+	0: "paused",
+	1: "uploading",
+	2: "cancelled",
+}
+
+// InitFileStore prepares the directory uploads are written to and loads the
+// index of files received before a restart.
+func InitFileStore(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	shared.FileStoreDir = dir
+
+	data, err := os.ReadFile(filepath.Join(dir, fileIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var files []*models.RecordedFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("invalid file index: %v", err)
+	}
+	for _, file := range files {
+		shared.RecordedFiles[file.FileID] = file
+	}
+	log.Printf("[FILES] Loaded %d recorded files from %s", len(files), dir)
+	return nil
+}
+
+// StartFileUpload sends a 0x9206 asking the device to upload the matching
+// recordings to the embedded FTP receiver. Each task gets its own FTP login
+// and directory, so received files can be attributed to it.
+func StartFileUpload(req models.FileUploadRequest, start, end time.Time) (models.FileUploadTask, *models.PendingCommand, error) {
+	server := shared.FileServer
+	phone := req.DevicePhone
+	if shared.FileStoreDir == "" {
+		return models.FileUploadTask{}, nil, ErrNoFileReceiver
+	}
+	conditions := req.Conditions
+	if conditions == 0 {
+		conditions = jt808.UploadOverWiFi | jt808.UploadOverLAN | jt808.UploadOverMobile
+	}
+
+	task := &models.FileUploadTask{
+		TaskID:      shared.GenerateCallID(),
+		DevicePhone: phone,
+		Channel:     req.Channel,
+		StartTime:   req.StartTime,
+		EndTime:     req.EndTime,
+		AlarmFlags:  req.AlarmFlags,
+		AVType:      req.AVType,
+		StreamType:  req.StreamType,
+		StorageType: req.StorageType,
+		Conditions:  conditions,
+		Status:      "requested",
+		FTPPassword: shared.GenerateCallID(),
+		FTPServer:   server.IP,
+		FTPPort:     server.TCPPort,
+		Files:       make([]string, 0),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+	task.FTPUser = "u" + task.TaskID
+
+	// Record the task before sending so the login and reply always find it
+	shared.ConnMutex.Lock()
+	shared.FileUploadTasks[task.TaskID] = task
+	shared.ConnMutex.Unlock()
+
+	body := jt808.BuildFileUploadBody(server.IP, server.TCPPort, task.FTPUser, task.FTPPassword, "/",
+		req.Channel, start, end, req.AlarmFlags, req.AVType, req.StreamType, req.StorageType, byte(conditions))
+	cmd, err := SendTerminalCommand(phone, 0x9206, body, func(result byte) {
+		if result != 0 {
+			finishUploadLocked(task, "failed")
+			log.Printf("[FILES] Device %s rejected upload task %s: %s", phone, task.TaskID, jt808.ResultText(result))
+			return
+		}
+		if task.Status == "requested" {
+			task.Status = "accepted"
+			task.UpdatedAt = time.Now()
+		}
+	})
+	if err != nil {
+		shared.ConnMutex.Lock()
+		delete(shared.FileUploadTasks, task.TaskID)
+		shared.ConnMutex.Unlock()
+		return models.FileUploadTask{}, nil, err
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	task.Serial = cmd.Serial
+
+	log.Printf("[FILES] Upload requested - Device: %s, Channel: %d, From: %s, To: %s, Task: %s, Server: %s:%d",
+		phone, req.Channel, req.StartTime, req.EndTime, task.TaskID, server.IP, server.TCPPort)
+	return *task, cmd, nil
+}
+
+// ControlFileUpload sends a 0x9207 pause (0), continue (1) or cancel (2) for a
+// task. The task status follows the device's 0x0001 reply.
+func ControlFileUpload(taskID string, command int) (models.FileUploadTask, *models.PendingCommand, error) {
+	shared.ConnMutex.Lock()
+	task, exists := shared.FileUploadTasks[taskID]
+	if !exists {
+		shared.ConnMutex.Unlock()
+		return models.FileUploadTask{}, nil, ErrNoUploadTask
+	}
+	if uploadFinished(task) {
+		shared.ConnMutex.Unlock()
+		return models.FileUploadTask{}, nil, ErrUploadTaskClosed
+	}
+	phone, serial := task.DevicePhone, task.Serial
+	shared.ConnMutex.Unlock()
+
+	cmd, err := SendTerminalCommand(phone, 0x9207, jt808.BuildFileUploadControlBody(serial, command), func(result byte) {
+		if result != 0 {
+			log.Printf("[FILES] Device %s rejected control %d of task %s: %s", phone, command, taskID, jt808.ResultText(result))
+			return
+		}
+		if uploadFinished(task) {
+			return
+		}
+		if command == 2 {
+			finishUploadLocked(task, "cancelled")
+			return
+		}
+		task.Status = uploadControlStatus[command]
+		task.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		return models.FileUploadTask{}, nil, err
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	return *task, cmd, nil
+}
+
+// handleFileUploadComplete processes a 0x1206 notice that the device finished
+// uploading the files of a 0x9206 request.
+func handleFileUploadComplete(conn net.Conn, phone string, msgSerial uint16, body []byte) {
+	serial, result, err := jt808.ParseFileUploadComplete(body)
+	if err != nil {
+		shared.VPrint("Error parsing file upload completion from %s: %v", phone, err)
+		return
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	task := findUploadTaskLocked(phone, serial)
+	if task == nil {
+		shared.VPrint("[FILES] Device %s completed upload %d not requested by us", phone, serial)
+		return
+	}
+
+	// The platform did not request this upload, so it will not acknowledge the notice
+	if _, err := conn.Write(jt808.BuildGeneralResponse(phone, msgSerial, 0x1206, 0)); err != nil {
+		shared.VPrint("Failed to acknowledge file upload completion from %s: %v", phone, err)
+	}
+
+	if result == 0 {
+		finishUploadLocked(task, "completed")
+	} else {
+		finishUploadLocked(task, "failed")
+	}
+	log.Printf("[FILES] Device %s finished upload task %s: %s, %d files received", phone, task.TaskID, task.Status, len(task.Files))
+}
+
+// AuthenticateFTPUpload checks an FTP login against the open upload tasks and
+// returns the directory the task's files are written to.
+func AuthenticateFTPUpload(user, password string) (string, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	task := findUploadTaskByUserLocked(user)
+	if task == nil || task.FTPPassword != password || uploadFinished(task) {
+		return "", false
+	}
+	return filepath.Join(shared.FileStoreDir, task.DevicePhone, task.TaskID), true
+}
+
+// HandleFTPUpload indexes a file stored by the FTP receiver against the
+// device, channel and time range of its upload task. A file uploaded again
+// (e.g. resumed with APPE) replaces its previous entry.
+func HandleFTPUpload(user, name string, size int64) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	task := findUploadTaskByUserLocked(user)
+	if task == nil {
+		return
+	}
+
+	relPath := path.Join(task.DevicePhone, task.TaskID, name)
+	var file *models.RecordedFile
+	for _, existing := range shared.RecordedFiles {
+		if existing.Path == relPath {
+			file = existing
+			break
+		}
+	}
+	if file == nil {
+		file = &models.RecordedFile{
+			FileID:      shared.GenerateCallID(),
+			TaskID:      task.TaskID,
+			DevicePhone: task.DevicePhone,
+			Channel:     task.Channel,
+			StartTime:   task.StartTime,
+			EndTime:     task.EndTime,
+			Name:        path.Base(name),
+			Path:        relPath,
+		}
+		shared.RecordedFiles[file.FileID] = file
+		task.Files = append(task.Files, file.FileID)
+	}
+	file.Size = size
+	file.ReceivedAt = time.Now()
+
+	if task.Status == "requested" || task.Status == "accepted" {
+		task.Status = "uploading"
+	}
+	task.UpdatedAt = time.Now()
+
+	if err := saveFileIndexLocked(); err != nil {
+		log.Printf("[FILES] Failed to save file index: %v", err)
+	}
+	log.Printf("[FILES] Indexed %s from %s channel %d (%d bytes) as %s", file.Name, task.DevicePhone, task.Channel, size, file.FileID)
+}
+
+// ListFileUploads returns a copy of the upload tasks, optionally of one device.
+func ListFileUploads(phone string) []models.FileUploadTask {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	tasks := make([]models.FileUploadTask, 0, len(shared.FileUploadTasks))
+	for _, task := range shared.FileUploadTasks {
+		if phone == "" || task.DevicePhone == phone {
+			tasks = append(tasks, *task)
+		}
+	}
+	return tasks
+}
+
+// GetFileUpload returns a copy of an upload task.
+func GetFileUpload(taskID string) (models.FileUploadTask, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	task, exists := shared.FileUploadTasks[taskID]
+	if !exists {
+		return models.FileUploadTask{}, false
+	}
+	return *task, true
+}
+
+// ListRecordedFiles returns the received files matching the filters, oldest
+// recording first. An empty phone, a zero channel and zero times match all;
+// a time range matches files whose upload range overlaps it.
+func ListRecordedFiles(phone string, channel int, start, end time.Time) []models.RecordedFile {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	files := make([]models.RecordedFile, 0)
+	for _, file := range shared.RecordedFiles {
+		if phone != "" && file.DevicePhone != phone {
+			continue
+		}
+		if channel != 0 && file.Channel != channel {
+			continue
+		}
+		fileStart, _ := time.Parse(jt808.ResourceTimeLayout, file.StartTime)
+		fileEnd, _ := time.Parse(jt808.ResourceTimeLayout, file.EndTime)
+		if !start.IsZero() && !fileEnd.IsZero() && fileEnd.Before(start) {
+			continue
+		}
+		if !end.IsZero() && !fileStart.IsZero() && fileStart.After(end) {
+			continue
+		}
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].StartTime != files[j].StartTime {
+			return files[i].StartTime < files[j].StartTime
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// GetRecordedFile returns a received file and its location on disk.
+func GetRecordedFile(fileID string) (models.RecordedFile, string, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	file, exists := shared.RecordedFiles[fileID]
+	if !exists {
+		return models.RecordedFile{}, "", false
+	}
+	return *file, filepath.Join(shared.FileStoreDir, filepath.FromSlash(file.Path)), true
+}
+
+// FileUploadCleanupRoutine expires tasks the device never finished and drops
+// finished tasks after a while. Received files stay indexed.
+func FileUploadCleanupRoutine() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		shared.ConnMutex.Lock()
+		now := time.Now()
+		for id, task := range shared.FileUploadTasks {
+			switch {
+			case uploadFinished(task) && now.Sub(task.CompletedAt) > finishedUploadRetention:
+				delete(shared.FileUploadTasks, id)
+			case !uploadFinished(task) && now.Sub(task.CreatedAt) > uploadTaskTTL:
+				finishUploadLocked(task, "failed")
+				log.Printf("[FILES] Upload task %s for %s expired with %d files received", id, task.DevicePhone, len(task.Files))
+			}
+		}
+		shared.ConnMutex.Unlock()
+	}
+}
+
+// FileUploadTaskResponse converts a task to its API representation.
+func FileUploadTaskResponse(task models.FileUploadTask) models.FileUploadTaskResponse {
+	response := models.FileUploadTaskResponse{
+		TaskID:      task.TaskID,
+		Status:      task.Status,
+		DevicePhone: task.DevicePhone,
+		Channel:     task.Channel,
+		StartTime:   task.StartTime,
+		EndTime:     task.EndTime,
+		AVType:      task.AVType,
+		StreamType:  task.StreamType,
+		StorageType: task.StorageType,
+		Conditions:  task.Conditions,
+		Serial:      task.Serial,
+		FTPServer:   task.FTPServer,
+		FTPPort:     task.FTPPort,
+		Files:       append([]string{}, task.Files...),
+		CreatedAt:   task.CreatedAt.Format(time.RFC3339),
+	}
+	if !task.CompletedAt.IsZero() {
+		response.CompletedAt = task.CompletedAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+func uploadFinished(task *models.FileUploadTask) bool {
+	switch task.Status {
+	case "completed", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// finishUploadLocked moves a task to a final status; its FTP login stops
+// working. Must be called with shared.ConnMutex held.
+func finishUploadLocked(task *models.FileUploadTask, status string) {
+	if uploadFinished(task) {
+		return
+	}
+	task.Status = status
+	task.CompletedAt = time.Now()
+	task.UpdatedAt = task.CompletedAt
+}
+
+// findUploadTaskLocked must be called with shared.ConnMutex held.
+func findUploadTaskLocked(phone string, serial uint16) *models.FileUploadTask {
+	for _, task := range shared.FileUploadTasks {
+		if task.DevicePhone == phone && task.Serial == serial {
+			return task
+		}
+	}
+	return nil
+}
+
+// findUploadTaskByUserLocked must be called with shared.ConnMutex held.
+func findUploadTaskByUserLocked(user string) *models.FileUploadTask {
+	for _, task := range shared.FileUploadTasks {
+		if task.FTPUser == user {
+			return task
+		}
+	}
+	return nil
+}
+
+// saveFileIndexLocked writes the file index next to the stored files. Must be
+// called with shared.ConnMutex held.
+func saveFileIndexLocked() error {
+	files := make([]*models.RecordedFile, 0, len(shared.RecordedFiles))
+	for _, file := range shared.RecordedFiles {
+		files = append(files, file)
+	}
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(shared.FileStoreDir, fileIndexName)
+	if err := os.WriteFile(indexPath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(indexPath+".tmp", indexPath)
+}
@@ -14,7 +14,7 @@ import (
 
 // HandleJT808Message is the main router for incoming messages from devices.
 func HandleJT808Message(conn net.Conn, data []byte, remoteAddr string) {
-	msgID, phone, _, body, total, current, err := jt808.ParseJT808(data)
+	msgID, phone, msgSerial, body, total, current, err := jt808.ParseJT808(data)
 	if err != nil {
 		shared.VPrint("Error parsing JT808 message: %v", err)
 		return
@@ -28,10 +28,22 @@ func HandleJT808Message(conn net.Conn, data []byte, remoteAddr string) {
 		handleAuthentication(phone, body)
 	case 0x0001: // Terminal general response
 		handleTerminalResponse(phone, body)
+	case 0x0104: // Terminal parameter query response
+		handleParamsResponse(phone, body)
+	case 0x0200: // Location report
+		handleLocationReport(phone, body)
 	case 0x0801: // Multimedia data upload
 		handleMultimediaUpload(conn, phone, body, total, current)
 	case 0x0805: // Camera command response
 		handleCameraResponse(body)
+	case 0x0705: // CAN bus data upload
+		handleCANBusData(phone, body)
+	case 0x1003: // Audio/video attribute upload
+		handleAVAttributes(phone, body)
+	case 0x1205: // Audio/video resource list upload
+		handleResourceList(conn, phone, msgSerial, body, total, current)
+	case 0x1206: // File upload completion notice
+		handleFileUploadComplete(conn, phone, msgSerial, body)
 	}
 }
 
@@ -42,6 +54,7 @@ func handleAuthentication(phone string, body []byte) {
 	}
 	device.AuthCode = string(body)
 	shared.VPrint("Authentication attempt tracked for device: %s", phone)
+	scheduleCapabilityQuery(phone)
 }
 
 func handleTerminalResponse(phone string, body []byte) {
@@ -52,6 +65,7 @@ func handleTerminalResponse(phone string, body []byte) {
 	replyMsgID := binary.BigEndian.Uint16(body[2:4])
 	result := body[4]
 	fmt.Printf("\033[1;36mTerminal response - Phone: %s, Serial: %d, MsgID: 0x%04X, Result: %d\033[0m\n", phone, replySerial, replyMsgID, result)
+	resolvePendingCommand(phone, replySerial, replyMsgID, result)
 }
 
 func handleCameraResponse(body []byte) {
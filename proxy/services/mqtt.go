@@ -83,3 +83,18 @@ func handleImeiAssignment(client mqtt.Client, msg mqtt.Message) {
 	}
 	shared.ConnMutex.Unlock()
 }
+
+// PublishEvent marshals a structured event and publishes it on the given topic.
+// Events are dropped silently while the broker is unreachable.
+func PublishEvent(topic string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	if shared.MQTTClient == nil || !shared.MQTTClient.IsConnected() {
+		return nil
+	}
+	token := shared.MQTTClient.Publish(topic, 0, false, payload)
+	token.Wait()
+	return token.Error()
+}
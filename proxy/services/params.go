@@ -0,0 +1,75 @@
+package services
+
+import (
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+// activeSafetyParamIDs are the blocks read by QueryActiveSafetyParams.
+var activeSafetyParamIDs = []uint32{jt808.ParamADAS, jt808.ParamDMS, jt808.ParamBSD}
+
+// handleParamsResponse caches the active safety blocks of a 0x0104 parameter
+// response, whether it answers our 0x8106 or a platform query, and completes
+// the query it replies to.
+func handleParamsResponse(phone string, body []byte) {
+	replySerial, items, err := jt808.ParseParamsResponse(body)
+	if err != nil {
+		shared.VPrint("Error parsing parameter response from %s: %v", phone, err)
+	}
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	params, exists := shared.ActiveSafetyParams[phone]
+	if !exists {
+		params = &models.ActiveSafetyParams{DevicePhone: phone}
+	}
+	if jt808.ParseActiveSafetyParams(items, params) {
+		params.UpdatedAt = time.Now()
+		shared.ActiveSafetyParams[phone] = params
+		log.Printf("[PARAMS] Device %s reported active safety parameters (ADAS %v, DMS %v, BSD %v)",
+			phone, params.ADAS != nil, params.DMS != nil, params.BSD != nil)
+	}
+
+	resolvePendingCommandLocked(phone, replySerial, 0x8106, 0)
+	resolvePendingCommandLocked(phone, replySerial, 0x8104, 0)
+}
+
+// QueryActiveSafetyParams reads the ADAS, DMS and BSD blocks with 0x8106. The
+// returned command completes when the device's 0x0104 has been cached.
+func QueryActiveSafetyParams(phone string) (*models.PendingCommand, error) {
+	return SendTerminalCommand(phone, 0x8106, jt808.BuildQueryParamsBody(activeSafetyParamIDs), nil)
+}
+
+// SetActiveSafetyParams writes the given blocks with 0x8103; fields left nil
+// keep their value on the device. Once the device accepts, the blocks are read
+// back so the cache reflects what it applied.
+func SetActiveSafetyParams(phone string, adas *models.ADASParams, dms *models.DMSParams, bsd *models.BSDParams) (*models.PendingCommand, error) {
+	items := jt808.BuildActiveSafetyParamItems(adas, dms, bsd)
+	return SendTerminalCommand(phone, 0x8103, jt808.BuildSetParamsBody(items), func(result byte) {
+		if result != 0 {
+			log.Printf("[PARAMS] Device %s rejected active safety parameters: %s", phone, jt808.ResultText(result))
+			return
+		}
+		log.Printf("[PARAMS] Device %s accepted %d active safety parameter blocks", phone, len(items))
+		go func() {
+			if _, err := QueryActiveSafetyParams(phone); err != nil {
+				shared.VPrint("Could not read back parameters of %s: %v", phone, err)
+			}
+		}()
+	})
+}
+
+// GetActiveSafetyParams returns the cached parameter blocks of a device.
+func GetActiveSafetyParams(phone string) (models.ActiveSafetyParams, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	params, exists := shared.ActiveSafetyParams[phone]
+	if !exists {
+		return models.ActiveSafetyParams{}, false
+	}
+	return *params, true
+}
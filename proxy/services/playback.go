@@ -0,0 +1,213 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+var ErrNoPlaybackSession = errors.New("no playback session found")
+
+// playbackStatus is the session status after an accepted 0x9202 control.
+var playbackStatus = map[int]string{
+	0: "playing",
+	1: "paused",
+	3: "fast_forward",
+	4: "rewind",
+	5: "playing",
+	6: "keyframes",
+}
+
+// StartPlayback sends a 0x9201 remote playback request pointing the device at
+// the playback listener of the media server. The device acknowledges with a
+// 0x1205 listing the segment it will play (or a 0x0001 on some terminals).
+func StartPlayback(req models.PlaybackStartRequest, start, end time.Time) (models.PlaybackSession, *models.PendingCommand, error) {
+	speedCode, err := jt808.PlaybackSpeedCode(req.Speed)
+	if err != nil {
+		return models.PlaybackSession{}, nil, err
+	}
+	server := shared.PlaybackServer
+	phone := req.DevicePhone
+
+	shared.ConnMutex.Lock()
+	session := findPlaybackSessionLocked(phone, req.Channel)
+	created := session == nil
+	if created {
+		session = &models.PlaybackSession{
+			SessionID:   shared.GenerateCallID(),
+			DevicePhone: phone,
+			Channel:     req.Channel,
+			CreatedAt:   time.Now(),
+		}
+		shared.PlaybackSessions[session.SessionID] = session
+	}
+	session.AVType = req.AVType
+	session.StreamType = req.StreamType
+	session.StorageType = req.StorageType
+	session.PlaybackMode = req.PlaybackMode
+	session.Speed = req.Speed
+	session.StartTime = req.StartTime
+	session.EndTime = req.EndTime
+	session.Status = "initiated"
+	session.UpdatedAt = time.Now()
+	session.VideoServer = server.IP
+	session.VideoPort = server.TCPPort
+	shared.ConnMutex.Unlock()
+
+	body := jt808.BuildPlaybackRequestBody(server.IP, server.TCPPort, server.UDPPort, req.Channel,
+		req.AVType, req.StreamType, req.StorageType, req.PlaybackMode, speedCode, start, end)
+	cmd, err := SendTerminalCommand(phone, 0x9201, body, func(result byte) {
+		if result == 0 {
+			session.Status = playbackModeStatus(req.PlaybackMode)
+		} else {
+			session.Status = "failed"
+			delete(shared.PlaybackSessions, session.SessionID)
+			log.Printf("[PLAYBACK] Device %s rejected playback on channel %d: %s", phone, req.Channel, jt808.ResultText(result))
+		}
+		session.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		if created {
+			shared.ConnMutex.Lock()
+			delete(shared.PlaybackSessions, session.SessionID)
+			shared.ConnMutex.Unlock()
+		}
+		return models.PlaybackSession{}, nil, err
+	}
+
+	log.Printf("[PLAYBACK] Requested - Device: %s, Channel: %d, From: %s, To: %q, Mode: %d, Server: %s:%d",
+		phone, req.Channel, req.StartTime, req.EndTime, req.PlaybackMode, server.IP, server.TCPPort)
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	return *session, cmd, nil
+}
+
+// ControlPlayback sends a 0x9202 playback control. The session follows the
+// device's 0x0001 reply; a stop removes it at once.
+func ControlPlayback(phone string, channel, command, speed int, seek time.Time) (*models.PendingCommand, error) {
+	speedCode, err := jt808.PlaybackSpeedCode(speed)
+	if err != nil {
+		return nil, err
+	}
+
+	shared.ConnMutex.Lock()
+	session := findPlaybackSessionLocked(phone, channel)
+	shared.ConnMutex.Unlock()
+	if session == nil {
+		return nil, ErrNoPlaybackSession
+	}
+
+	body := jt808.BuildPlaybackControlBody(channel, command, speedCode, seek)
+	cmd, err := SendTerminalCommand(phone, 0x9202, body, func(result byte) {
+		if result != 0 {
+			log.Printf("[PLAYBACK] Device %s rejected control %d on channel %d: %s", phone, command, channel, jt808.ResultText(result))
+			return
+		}
+		if status, ok := playbackStatus[command]; ok {
+			session.Status = status
+		}
+		if command == 3 || command == 4 {
+			session.Speed = speed
+		}
+		session.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if command == 2 {
+		shared.ConnMutex.Lock()
+		delete(shared.PlaybackSessions, session.SessionID)
+		shared.ConnMutex.Unlock()
+		log.Printf("[PLAYBACK] Session %s stopped", session.SessionID)
+	}
+	return cmd, nil
+}
+
+// ListPlaybackSessions returns a copy of all playback sessions.
+func ListPlaybackSessions() []models.PlaybackSession {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	sessions := make([]models.PlaybackSession, 0, len(shared.PlaybackSessions))
+	for _, session := range shared.PlaybackSessions {
+		sessions = append(sessions, *session)
+	}
+	return sessions
+}
+
+// GetPlaybackSession returns a copy of the playback session on a device channel.
+func GetPlaybackSession(phone string, channel int) (models.PlaybackSession, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	session := findPlaybackSessionLocked(phone, channel)
+	if session == nil {
+		return models.PlaybackSession{}, false
+	}
+	return *session, true
+}
+
+// PlaybackSessionResponse converts a session to its API representation.
+func PlaybackSessionResponse(session models.PlaybackSession) models.PlaybackSessionResponse {
+	return models.PlaybackSessionResponse{
+		SessionID:    session.SessionID,
+		Status:       session.Status,
+		DevicePhone:  session.DevicePhone,
+		Channel:      session.Channel,
+		AVType:       session.AVType,
+		StreamType:   session.StreamType,
+		StorageType:  session.StorageType,
+		PlaybackMode: session.PlaybackMode,
+		Speed:        session.Speed,
+		StartTime:    session.StartTime,
+		EndTime:      session.EndTime,
+		VideoServer:  session.VideoServer,
+		VideoPort:    session.VideoPort,
+		CreatedAt:    session.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func playbackModeStatus(mode int) string {
+	switch mode {
+	case 1:
+		return "fast_forward"
+	case 2:
+		return "rewind"
+	case 3:
+		return "keyframes"
+	}
+	return "playing"
+}
+
+// endPlaybackLocked removes a device's playback session once its stream has
+// closed. Must be called with shared.ConnMutex held.
+func endPlaybackLocked(phone string, channel int) {
+	if session := findPlaybackSessionLocked(phone, channel); session != nil {
+		delete(shared.PlaybackSessions, session.SessionID)
+		log.Printf("[PLAYBACK] Session %s finished - stream closed", session.SessionID)
+	}
+}
+
+// findPlaybackSessionLocked must be called with shared.ConnMutex held.
+func findPlaybackSessionLocked(phone string, channel int) *models.PlaybackSession {
+	for _, session := range shared.PlaybackSessions {
+		if session.DevicePhone == phone && session.Channel == channel {
+			return session
+		}
+	}
+	return nil
+}
+
+// cleanupPlaybackSessionsLocked drops every playback session of a device.
+// Must be called with shared.ConnMutex held.
+func cleanupPlaybackSessionsLocked(phone string) {
+	for id, session := range shared.PlaybackSessions {
+		if session.DevicePhone == phone {
+			delete(shared.PlaybackSessions, id)
+			shared.VPrint("Removed playback session %s (channel %d) for disconnected device %s", id, session.Channel, phone)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+)
+
+// ptzCommandNames labels PTZ commands in the logs.
+var ptzCommandNames = map[uint16]string{
+	jt808.PTZRotate:   "rotate",
+	jt808.PTZFocus:    "focus",
+	jt808.PTZIris:     "iris",
+	jt808.PTZWiper:    "wiper",
+	jt808.PTZInfrared: "infrared",
+	jt808.PTZZoom:     "zoom",
+}
+
+// SendPTZCommand sends one of the 0x9301-0x9306 PTZ controls. The returned
+// command completes with the device's 0x0001 reply.
+func SendPTZCommand(phone string, msgID uint16, channel int, body []byte) (*models.PendingCommand, error) {
+	name := ptzCommandNames[msgID]
+	cmd, err := SendTerminalCommand(phone, msgID, body, func(result byte) {
+		if result != 0 {
+			log.Printf("[PTZ] Device %s rejected %s on channel %d: %s", phone, name, channel, jt808.ResultText(result))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[PTZ] Sent %s (0x%04X) to %s channel %d (serial %d)", name, msgID, phone, channel, cmd.Serial)
+	return cmd, nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"log"
+	"net"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+// subPackageTimeout drops a partially received sub-packaged upload.
+const subPackageTimeout = time.Minute
+
+// QueryResourceList sends a 0x9205 resource list query. The device answers
+// with a (possibly sub-packaged) 0x1205 carrying the command's serial.
+func QueryResourceList(phone string, req models.ResourceQueryRequest, start, end time.Time) (*models.PendingCommand, error) {
+	body := jt808.BuildResourceListQueryBody(req.Channel, start, end, req.AlarmFlags, req.AVType, req.StreamType, req.StorageType)
+	cmd, err := SendTerminalCommand(phone, 0x9205, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[RESOURCES] Query sent - Device: %s, Channel: %d, Time: %q to %q, Serial: %d",
+		phone, req.Channel, req.StartTime, req.EndTime, cmd.Serial)
+	return cmd, nil
+}
+
+// handleResourceList collects the packets of a 0x1205 upload. Once complete,
+// the list is stored for the waiting query and the query (or playback
+// request) is resolved.
+func handleResourceList(conn net.Conn, phone string, msgSerial uint16, body []byte, total, current uint16) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	// The platform did not ask for this list, so it will not acknowledge the packets
+	if hasPendingCommandLocked(phone, 0x9205) || hasPendingCommandLocked(phone, 0x9201) {
+		if _, err := conn.Write(jt808.BuildGeneralResponse(phone, msgSerial, 0x1205, 0)); err != nil {
+			shared.VPrint("Failed to acknowledge resource list packet from %s: %v", phone, err)
+		}
+	}
+
+	assembly, exists := shared.ResourceListParts[phone]
+	if !exists || assembly.Total != total {
+		assembly = &models.SubPackageAssembly{Total: total, Parts: make(map[uint16][]byte)}
+		shared.ResourceListParts[phone] = assembly
+	}
+	assembly.Parts[current] = append([]byte(nil), body...)
+	assembly.UpdatedAt = time.Now()
+	shared.VPrint("[RESOURCES] Device %s: packet %d/%d", phone, current, total)
+
+	if len(assembly.Parts) < int(total) {
+		return
+	}
+	delete(shared.ResourceListParts, phone)
+
+	var data []byte
+	for i := uint16(1); i <= total; i++ {
+		data = append(data, assembly.Parts[i]...)
+	}
+
+	list, err := jt808.ParseResourceList(data)
+	if err != nil {
+		log.Printf("[RESOURCES] Error parsing resource list from %s: %v", phone, err)
+		if list == nil {
+			return
+		}
+	}
+	list.DevicePhone = phone
+	list.ReceivedAt = time.Now()
+	log.Printf("[RESOURCES] Device %s reported %d recordings (reply to serial %d)", phone, list.Total, list.Serial)
+
+	// Playback requests (0x9201) are also answered with a 0x1205 listing the
+	// segment about to be played; only query results are kept for collection
+	key := pendingCommandKey(phone, list.Serial)
+	replyTo := uint16(0x9205)
+	if cmd, exists := shared.PendingCommands[key]; exists && cmd.MsgID == 0x9201 {
+		replyTo = 0x9201
+	} else {
+		shared.ResourceLists[key] = list
+	}
+	resolvePendingCommandLocked(phone, list.Serial, replyTo, 0)
+}
+
+// TakeResourceList returns and forgets the list answering the query with the given serial.
+func TakeResourceList(phone string, serial uint16) (models.ResourceList, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+
+	key := pendingCommandKey(phone, serial)
+	list, exists := shared.ResourceLists[key]
+	if !exists {
+		return models.ResourceList{}, false
+	}
+	delete(shared.ResourceLists, key)
+	return *list, true
+}
+
+// ResourceListCleanupRoutine drops incomplete uploads and lists nobody collected.
+func ResourceListCleanupRoutine() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		shared.ConnMutex.Lock()
+		now := time.Now()
+		for phone, assembly := range shared.ResourceListParts {
+			if now.Sub(assembly.UpdatedAt) > subPackageTimeout {
+				delete(shared.ResourceListParts, phone)
+				log.Printf("[RESOURCES] Dropped incomplete resource list from %s (%d/%d packets)", phone, len(assembly.Parts), assembly.Total)
+			}
+		}
+		for key, list := range shared.ResourceLists {
+			if now.Sub(list.ReceivedAt) > pendingCommandTTL {
+				delete(shared.ResourceLists, key)
+			}
+		}
+		shared.ConnMutex.Unlock()
+	}
+}
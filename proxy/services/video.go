@@ -0,0 +1,212 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"proxy/jt808"
+	"proxy/models"
+	"proxy/shared"
+	"time"
+)
+
+// StartVideoSession sends a 0x9101 request pointing the device at the configured
+// media server and records the session. A session already open on the same
+// channel is reused so repeated start requests re-issue the command.
+func StartVideoSession(phone string, channel, streamType, dataType int) (models.VideoSession, *models.PendingCommand, error) {
+	server := shared.VideoServer
+	caps, hasCaps := GetAVCapabilities(phone)
+
+	// Record the session before sending so the reply always finds it
+	shared.ConnMutex.Lock()
+	session := findVideoSessionLocked(phone, channel)
+	created := session == nil
+	if created {
+		session = &models.VideoSession{
+			SessionID:   shared.GenerateCallID(),
+			DevicePhone: phone,
+			Channel:     channel,
+			StartTime:   time.Now(),
+		}
+		shared.VideoSessions[session.SessionID] = session
+	}
+	session.StreamType = streamType
+	session.DataType = dataType
+	session.Status = "initiated"
+	session.UpdatedAt = time.Now()
+	session.VideoServer = server.IP
+	session.VideoPort = server.TCPPort
+	if hasCaps {
+		session.VideoCodec = caps.VideoCodecName
+		session.AudioCodec = caps.AudioCodecName
+	}
+	shared.ConnMutex.Unlock()
+
+	body := jt808.BuildRealtimeAVRequestBody(server.IP, server.TCPPort, server.UDPPort, channel, dataType, streamType)
+	cmd, err := SendTerminalCommand(phone, 0x9101, body, func(result byte) {
+		if result == 0 {
+			session.Status = "active"
+		} else {
+			session.Status = "failed"
+			delete(shared.VideoSessions, session.SessionID)
+			log.Printf("[VIDEO] Device %s rejected stream on channel %d: %s", phone, channel, jt808.ResultText(result))
+		}
+		session.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		if created {
+			shared.ConnMutex.Lock()
+			delete(shared.VideoSessions, session.SessionID)
+			shared.ConnMutex.Unlock()
+		}
+		return models.VideoSession{}, nil, err
+	}
+
+	log.Printf("[VIDEO] Stream requested - Device: %s, Channel: %d, StreamType: %d, Server: %s:%d",
+		phone, channel, streamType, server.IP, server.TCPPort)
+
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	return *session, cmd, nil
+}
+
+// ControlVideoSession sends a 0x9102 control command for a live channel. The
+// session state follows the device's 0x0001 reply; a stop removes it at once.
+func ControlVideoSession(phone string, channel, command, closeAVType, switchStreamType int) (*models.PendingCommand, error) {
+	shared.ConnMutex.Lock()
+	session := findVideoSessionLocked(phone, channel)
+	shared.ConnMutex.Unlock()
+
+	body := jt808.BuildRealtimeAVControlBody(channel, command, closeAVType, switchStreamType)
+	cmd, err := SendTerminalCommand(phone, 0x9102, body, func(result byte) {
+		if result != 0 {
+			log.Printf("[VIDEO] Device %s rejected control %d on channel %d: %s", phone, command, channel, jt808.ResultText(result))
+			return
+		}
+		if session == nil {
+			return
+		}
+		switch command {
+		case 1:
+			session.StreamType = switchStreamType
+			session.Status = "active"
+		case 2:
+			session.Status = "paused"
+		case 3:
+			session.Status = "active"
+		}
+		session.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if command == 0 && closeAVType == 0 && session != nil {
+		shared.ConnMutex.Lock()
+		delete(shared.VideoSessions, session.SessionID)
+		shared.ConnMutex.Unlock()
+		log.Printf("[VIDEO] Session %s stopped", session.SessionID)
+	}
+	return cmd, nil
+}
+
+// HandleMediaLossReport forwards the loss rate measured by the media server
+// to the device as a 0x9105 transmission status notice, so it can adapt its
+// bitrate, and records it on the live session.
+func HandleMediaLossReport(report models.MediaLossReport) (*models.PendingCommand, error) {
+	lossPercent := int(report.LossRate * 100)
+	if lossPercent < 0 {
+		lossPercent = 0
+	} else if lossPercent > 100 {
+		lossPercent = 100
+	}
+
+	shared.ConnMutex.Lock()
+	if session := findVideoSessionLocked(report.DevicePhone, report.Channel); session != nil {
+		session.PacketLoss = lossPercent
+	}
+	shared.ConnMutex.Unlock()
+
+	body := jt808.BuildTransmissionStatusBody(report.Channel, lossPercent)
+	cmd, err := SendTerminalCommand(report.DevicePhone, 0x9105, body, func(result byte) {
+		if result != 0 {
+			shared.VPrint("[VIDEO] Device %s rejected transmission status for channel %d: %s", report.DevicePhone, report.Channel, jt808.ResultText(result))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared.VPrint("[VIDEO] Packet loss %d%% on %s channel %d (%d/%d received), sent 0x9105",
+		lossPercent, report.DevicePhone, report.Channel, report.Received, report.Expected)
+	return cmd, nil
+}
+
+// ListVideoSessions returns a copy of all live video sessions.
+func ListVideoSessions() []models.VideoSession {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	sessions := make([]models.VideoSession, 0, len(shared.VideoSessions))
+	for _, session := range shared.VideoSessions {
+		sessions = append(sessions, *session)
+	}
+	return sessions
+}
+
+// GetVideoSession returns a copy of the live session on a device channel.
+func GetVideoSession(phone string, channel int) (models.VideoSession, bool) {
+	shared.ConnMutex.Lock()
+	defer shared.ConnMutex.Unlock()
+	session := findVideoSessionLocked(phone, channel)
+	if session == nil {
+		return models.VideoSession{}, false
+	}
+	return *session, true
+}
+
+// findVideoSessionLocked must be called with shared.ConnMutex held.
+func findVideoSessionLocked(phone string, channel int) *models.VideoSession {
+	for _, session := range shared.VideoSessions {
+		if session.DevicePhone == phone && session.Channel == channel {
+			return session
+		}
+	}
+	return nil
+}
+
+// cleanupVideoSessionsLocked drops every session of a device. Must be called
+// with shared.ConnMutex held.
+func cleanupVideoSessionsLocked(phone string) {
+	for id, session := range shared.VideoSessions {
+		if session.DevicePhone == phone {
+			delete(shared.VideoSessions, id)
+			shared.VPrint("Removed video session %s (channel %d) for disconnected device %s", id, session.Channel, phone)
+		}
+	}
+}
+
+// VideoSessionResponse converts a session to its API representation.
+func VideoSessionResponse(session models.VideoSession) models.VideoStartResponse {
+	return models.VideoStartResponse{
+		SessionID:   session.SessionID,
+		Status:      session.Status,
+		DevicePhone: session.DevicePhone,
+		Channel:     session.Channel,
+		StreamType:  session.StreamType,
+		DataType:    session.DataType,
+		VideoServer: session.VideoServer,
+		VideoPort:   session.VideoPort,
+		VideoCodec:  session.VideoCodec,
+		AudioCodec:  session.AudioCodec,
+		PacketLoss:  session.PacketLoss,
+		StartTime:   session.StartTime.Format(time.RFC3339),
+	}
+}
+
+// ValidateVideoDataType checks the 0x9101 data type allowed for live viewing.
+func ValidateVideoDataType(dataType int) error {
+	switch dataType {
+	case 0, 1, 3:
+		return nil
+	}
+	return fmt.Errorf("data type must be 0 (audio and video), 1 (video) or 3 (monitor)")
+}
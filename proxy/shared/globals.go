@@ -4,6 +4,7 @@ import (
 	"net"
 	"proxy/models"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -22,6 +23,62 @@ var (
 	ImageChunks     = make(map[uint32]map[uint16]*models.ImageChunk)
 	EarlyChunks     = make(map[string][]*models.PendingChunk)
 
+	// Platform commands awaiting a 0x0001 reply, keyed by "phone_serial"
+	PendingCommands = make(map[string]*models.PendingCommand)
+
+	// Live video sessions keyed by session ID, and the media server handed to devices
+	VideoSessions = make(map[string]*models.VideoSession)
+	VideoServer   models.MediaServerConfig
+
+	// Remote playback sessions keyed by session ID, and the playback listener handed to devices
+	PlaybackSessions = make(map[string]*models.PlaybackSession)
+	PlaybackServer   models.MediaServerConfig
+
+	// Intercom calls keyed by call ID, and the audio server handed to devices
+	VoIPCalls   = make(map[string]*models.VoIPCall)
+	AudioServer models.MediaServerConfig
+
+	// Audio/video attributes (0x1003) reported by each device
+	AVCapabilities = make(map[string]*models.AVCapabilities)
+
+	// ADAS/DMS/BSD parameter blocks last read from each device (0x0104)
+	ActiveSafetyParams = make(map[string]*models.ActiveSafetyParams)
+
+	// Recorded resource lists (0x1205): uploads being reassembled keyed by phone,
+	// and completed lists keyed by "phone_serial" of the 0x9205 query
+	ResourceListParts = make(map[string]*models.SubPackageAssembly)
+	ResourceLists     = make(map[string]*models.ResourceList)
+
+	// Recording uploads (0x9206) keyed by task ID, received files keyed by file
+	// ID, and the embedded FTP receiver handed to devices
+	FileUploadTasks = make(map[string]*models.FileUploadTask)
+	RecordedFiles   = make(map[string]*models.RecordedFile)
+	FileServer      models.MediaServerConfig
+	FileStoreDir    string
+
+	// Latest JT/T 1078 video alarm state per device, and the alarms currently
+	// raised keyed by device phone then alarm key
+	VideoAlarms  = make(map[string]*models.VideoAlarmStatus)
+	ActiveAlarms = make(map[string]map[string]*models.AlarmEvent)
+
+	// Device time of the latest location report applied to each device's
+	// alarms, as reports are handled concurrently and may be overtaken
+	AlarmReportTimes = make(map[string]time.Time)
+
+	// Recent ADAS/DSM/TPMS/BSD alarms per device, oldest first
+	ActiveSafetyAlarms = make(map[string][]models.ActiveSafetyAlarm)
+
+	// Alarm attachment server handed to devices in 0x9208, attachment files
+	// still being received keyed by store path, and complete attachments
+	// keyed by file ID
+	AttachmentServer    models.MediaServerConfig
+	AttachmentStoreDir  string
+	AttachmentTransfers = make(map[string]*models.AttachmentTransfer)
+	AlarmAttachments    = make(map[string]*models.AlarmAttachment)
+
+	// Latest decoded CAN signal values, keyed by device phone then signal name
+	CANSignals = make(map[string]map[string]*models.CANSignalValue)
+
 	// MQTT Client
 	MQTTClient mqtt.Client
 )
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"log"
+	"os"
+	"strconv"
 )
 
 var (
@@ -51,3 +53,19 @@ func Min(a, b int) int {
 	}
 	return b
 }
+
+// EnvString returns the value of an environment variable or a default when unset.
+func EnvString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// EnvInt returns an integer environment variable or a default when unset or invalid.
+func EnvInt(name string, def int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return def
+}
@@ -17,13 +17,23 @@ type JT1078Frame struct {
 	DataType       int // 0:I-Frame, 1:P-Frame, 2:B-Frame, 3:Audio
 	SubPackageType int // 0:Atomic, 1:First, 2:Last, 3:Middle
 	Timestamp      uint64
+	PayloadType    byte // 98:H.264, 99:H.265, audio codecs otherwise
 	Payload        []byte
 	NALTypes       []int // Extracted H.264 NAL unit types
 }
 
-// H264Constructor manages the reconstruction of a raw H.264 stream.
+// JT/T 1078 payload types of the video codecs
+const (
+	payloadTypeH264 = 98
+	payloadTypeH265 = 99
+)
+
+// H264Constructor manages the reconstruction of a raw H.264 stream, or of
+// an H.265 one when the device sends payload type 99.
 type H264Constructor struct {
 	frames          []*JT1078Frame
+	hevc            bool     // Set by the first video frame's payload type
+	vpsData         [][]byte // H.265 only
 	spsData         [][]byte
 	ppsData         [][]byte
 	completeFrames  [][]byte
@@ -212,11 +222,14 @@ func processVideoFile() error {
 	fmt.Printf("✅ Parsed %d total JT1078 frames (Video: %d, Audio: %d)\n", frameCount, videoFrameCount, audioFrameCount)
 	fmt.Printf("🔊 Audio data written: %.2f KB\n", float64(totalAudioBytesWritten)/1024.0)
 
-	// Construct the final H.264 file using the proven algorithm
-	outputFile := "live_capture_output.h264"
+	// Construct the final H.264 (or H.265) file using the proven algorithm
+	codecName, encoder, outputFile := "H.264", "libx264", "live_capture_output.h264"
+	if h264Constructor.hevc {
+		codecName, encoder, outputFile = "H.265", "libx265", "live_capture_output.h265"
+	}
 	err = h264Constructor.ConstructH264File(outputFile, totalAudioBytesWritten)
 	if err != nil {
-		return fmt.Errorf("failed to construct H.264 file: %v", err)
+		return fmt.Errorf("failed to construct %s file: %v", codecName, err)
 	}
 
 	// Calculate proper frame rate based on capture duration and frame count
@@ -226,9 +239,9 @@ func processVideoFile() error {
 	expectedFPS := 15.0 // Based on device specs
 
 	fmt.Println("")
-	fmt.Println("🎉 Live capture and H.264/Audio conversion complete!")
+	fmt.Printf("🎉 Live capture and %s/Audio conversion complete!\n", codecName)
 	fmt.Printf("📁 Captured raw data: video.bin\n")
-	fmt.Printf("📁 H.264 output: %s\n", outputFile)
+	fmt.Printf("📁 %s output: %s\n", codecName, outputFile)
 	fmt.Printf("📁 G.711A audio output: live_capture_output_audio.g711a\n")
 	fmt.Printf("📊 Stream Analysis:\n")
 	fmt.Printf("   • Capture duration: %.1f seconds\n", captureDuration)
@@ -242,19 +255,23 @@ func processVideoFile() error {
 	}
 
 	fmt.Println("")
-	fmt.Println("💡 To convert H.264 to MP4:")
+	fmt.Printf("💡 To convert %s to MP4:\n", codecName)
 
 	if actualFPS < 5.0 {
 		// Very low frame rate - use expected frame rate as input, limit output
-		fmt.Printf("   ffmpeg -r %.0f -i %s -r %.0f -c:v libx264 -preset slow live_capture_output.mp4\n",
-			expectedFPS, outputFile, max(actualFPS, 1.0))
+		fmt.Printf("   ffmpeg -r %.0f -i %s -r %.0f -c:v %s -preset slow live_capture_output.mp4\n",
+			expectedFPS, outputFile, max(actualFPS, 1.0), encoder)
 		fmt.Println("   (Using device specs frame rate for input timing)")
 	} else if actualFPS < expectedFPS*0.8 {
 		// Somewhat low frame rate
-		fmt.Printf("   ffmpeg -r %.2f -i %s -c:v libx264 -preset fast live_capture_output.mp4\n", actualFPS, outputFile)
+		fmt.Printf("   ffmpeg -r %.2f -i %s -c:v %s -preset fast live_capture_output.mp4\n", actualFPS, outputFile, encoder)
 	} else {
-		// Normal frame rate - use copy for efficiency
-		fmt.Printf("   ffmpeg -r %.2f -i %s -c copy live_capture_output.mp4\n", actualFPS, outputFile)
+		// Normal frame rate - use copy for efficiency (hvc1 tag so Apple players accept H.265)
+		tag := ""
+		if h264Constructor.hevc {
+			tag = " -tag:v hvc1"
+		}
+		fmt.Printf("   ffmpeg -r %.2f -i %s -c copy%s live_capture_output.mp4\n", actualFPS, outputFile, tag)
 	}
 	fmt.Println("")
 	fmt.Println("🎵 To convert G.711A audio to WAV, run:")
@@ -283,13 +300,19 @@ func (h *H264Constructor) AddFrame(frame *JT1078Frame) {
 		return
 	}
 
+	// The first video frame tells the codec
+	if len(h.frames) == 0 && frame.PayloadType == payloadTypeH265 {
+		h.hevc = true
+		fmt.Printf("🎞️  Payload type %d: reconstructing an H.265 stream\n", frame.PayloadType)
+	}
+
 	// Analyze the payload for debugging and extract SPS/PPS
 	frameTypeNames := []string{"I-Frame", "P-Frame", "B-Frame"}
 	frameTypeName := frameTypeNames[frame.DataType]
 
 	// Log significant frames for debugging
 	if len(h.frames) < 10 || len(h.frames)%50 == 0 {
-		analyzePayload(frame.Payload, frameTypeName)
+		analyzePayload(frame.Payload, frameTypeName, h.hevc)
 	}
 
 	// Extract SPS/PPS from this frame (especially important for I-frames)
@@ -306,7 +329,8 @@ func (h *H264Constructor) AddFrame(frame *JT1078Frame) {
 // extractParameterSetsFromIFrame tries to find SPS/PPS in I-frame payloads
 func (h *H264Constructor) extractParameterSetsFromIFrame(payload []byte) {
 	// I-frames often contain SPS/PPS at the beginning
-	// Look for consecutive NAL units: SPS (7) followed by PPS (8) followed by IDR (5)
+	// Look for consecutive NAL units: SPS (7) followed by PPS (8) followed by IDR (5),
+	// or for H.265 VPS (32), SPS (33), PPS (34) and an IDR/CRA slice (16-21)
 
 	nalCount := 0
 	for i := 0; i < len(payload)-4 && nalCount < 5; { // Limit search to avoid infinite loops
@@ -325,7 +349,7 @@ func (h *H264Constructor) extractParameterSetsFromIFrame(payload []byte) {
 		if nalStart >= len(payload) {
 			break
 		}
-		nalType := payload[nalStart] & 0x1F
+		nalType := h.nalType(payload[nalStart])
 		nalCount++
 
 		// Find end of this NAL unit
@@ -338,23 +362,20 @@ func (h *H264Constructor) extractParameterSetsFromIFrame(payload []byte) {
 		}
 
 		// Process specific NAL types
-		if nalType == 7 { // SPS
-			nalData := append([]byte{0x00, 0x00, 0x00, 0x01}, payload[nalStart:nalEnd]...)
-			h.spsData = append(h.spsData, nalData)
-			fmt.Printf("📍 Found SPS in I-frame (length: %d bytes)\n", len(nalData))
-		} else if nalType == 8 { // PPS
+		if list, name := h.parameterSet(nalType); list != nil {
 			nalData := append([]byte{0x00, 0x00, 0x00, 0x01}, payload[nalStart:nalEnd]...)
-			h.ppsData = append(h.ppsData, nalData)
-			fmt.Printf("📍 Found PPS in I-frame (length: %d bytes)\n", len(nalData))
-		} else if nalType == 5 { // IDR slice
-			fmt.Printf("📍 Found IDR slice in I-frame (NAL type 5)\n")
+			*list = append(*list, nalData)
+			fmt.Printf("📍 Found %s in I-frame (length: %d bytes)\n", name, len(nalData))
+		} else if h.isKeySlice(nalType) {
+			fmt.Printf("📍 Found IDR slice in I-frame (NAL type %d)\n", nalType)
 		}
 
 		i = nalEnd
 	}
 }
 
-// extractSpsPps finds and stores SPS (7) and PPS (8) NAL units.
+// extractSpsPps finds and stores SPS (7) and PPS (8) NAL units, or VPS (32),
+// SPS (33) and PPS (34) ones of H.265.
 func (h *H264Constructor) extractSpsPps(payload []byte) {
 	for i := 0; i < len(payload)-4; {
 		// Find NAL unit start code (00 00 01 or 00 00 00 01)
@@ -372,10 +393,10 @@ func (h *H264Constructor) extractSpsPps(payload []byte) {
 		if nalStart >= len(payload) {
 			break
 		}
-		nalType := payload[nalStart] & 0x1F
+		nalType := h.nalType(payload[nalStart])
 
-		// If it's SPS or PPS, find its end and store it
-		if nalType == 7 || nalType == 8 {
+		// If it's a parameter set, find its end and store it
+		if list, _ := h.parameterSet(nalType); list != nil {
 			nalEnd := len(payload)
 			for j := nalStart; j < len(payload)-4; j++ {
 				if payload[j] == 0 && payload[j+1] == 0 && (payload[j+2] == 1 || (payload[j+2] == 0 && payload[j+3] == 1)) {
@@ -385,11 +406,7 @@ func (h *H264Constructor) extractSpsPps(payload []byte) {
 			}
 			// Re-add the 4-byte start code for the file
 			nalData := append([]byte{0x00, 0x00, 0x00, 0x01}, payload[nalStart:nalEnd]...)
-			if nalType == 7 {
-				h.spsData = append(h.spsData, nalData)
-			} else {
-				h.ppsData = append(h.ppsData, nalData)
-			}
+			*list = append(*list, nalData)
 			i = nalEnd
 		} else {
 			i++
@@ -397,6 +414,35 @@ func (h *H264Constructor) extractSpsPps(payload []byte) {
 	}
 }
 
+// nalType reads the NAL unit type from the first header byte.
+func (h *H264Constructor) nalType(header byte) int {
+	if h.hevc {
+		return int(header>>1) & 0x3F
+	}
+	return int(header & 0x1F)
+}
+
+// parameterSet returns the list a parameter set NAL type is kept in, or nil.
+func (h *H264Constructor) parameterSet(nalType int) (*[][]byte, string) {
+	switch {
+	case h.hevc && nalType == 32:
+		return &h.vpsData, "VPS"
+	case h.hevc && nalType == 33, !h.hevc && nalType == 7:
+		return &h.spsData, "SPS"
+	case h.hevc && nalType == 34, !h.hevc && nalType == 8:
+		return &h.ppsData, "PPS"
+	}
+	return nil, ""
+}
+
+// isKeySlice reports an IDR slice (H.265: any IRAP picture - BLA, IDR, CRA).
+func (h *H264Constructor) isKeySlice(nalType int) bool {
+	if h.hevc {
+		return nalType >= 16 && nalType <= 21
+	}
+	return nalType == 5
+}
+
 // ReconstructFrames assembles fragmented packets into complete video frames.
 func (h *H264Constructor) ReconstructFrames() {
 	if len(h.frames) == 0 {
@@ -546,6 +592,12 @@ func (h *H264Constructor) reconstructFramesFromPackets(packets []*JT1078Frame, t
 
 // generateBasicSPSPPS creates proper SPS/PPS headers for 1280x720 H.264 when missing
 func (h *H264Constructor) generateBasicSPSPPS() {
+	// H.265 parameter sets depend on too much of the encoder's setup to guess
+	if h.hevc {
+		fmt.Printf("⚠️  No H.265 VPS/SPS/PPS yet - frames before the first I-frame will not decode\n")
+		return
+	}
+
 	// Generate proper SPS for 1280x720 H.264 Baseline Profile Level 3.1
 	// This matches typical JT1078 device configurations
 	sps := []byte{
@@ -581,15 +633,23 @@ func (h *H264Constructor) addReconstructedFrameWithTimestamp(payload []byte, tim
 
 	// AUD NAL unit (00 00 00 01 09 10) indicates a new frame for the decoder
 	aud := []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0x10}
+	if h.hevc {
+		// H.265 AUD: type 35, pic_type 2 (any slice type)
+		aud = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+	}
 	fullFrame := append(aud, payload...)
 
 	h.completeFrames = append(h.completeFrames, fullFrame)
 	h.frameTimestamps = append(h.frameTimestamps, timestamp)
 }
 
-// ConstructH264File writes the final .h264 file.
+// ConstructH264File writes the final .h264 (or .h265) file.
 func (h *H264Constructor) ConstructH264File(filename string, totalAudioBytesWritten int) error {
-	fmt.Println("🔧 Reconstructing H.264 stream...")
+	codecName := "H.264"
+	if h.hevc {
+		codecName = "H.265"
+	}
+	fmt.Printf("🔧 Reconstructing %s stream...\n", codecName)
 	h.ReconstructFrames()
 
 	outFile, err := os.Create(filename)
@@ -598,10 +658,14 @@ func (h *H264Constructor) ConstructH264File(filename string, totalAudioBytesWrit
 	}
 	defer outFile.Close()
 
-	// Write unique SPS and PPS headers at the start of the file
+	// Write unique VPS, SPS and PPS headers at the start of the file
+	uniqueVPS := deduplicateNALs(h.vpsData)
 	uniqueSPS := deduplicateNALs(h.spsData)
 	uniquePPS := deduplicateNALs(h.ppsData)
 
+	for _, vps := range uniqueVPS {
+		_, _ = outFile.Write(vps)
+	}
 	for _, sps := range uniqueSPS {
 		_, _ = outFile.Write(sps)
 	}
@@ -621,8 +685,11 @@ func (h *H264Constructor) ConstructH264File(filename string, totalAudioBytesWrit
 
 	fmt.Printf("✅ Streams extracted successfully!\n")
 	fmt.Println("---")
-	fmt.Printf("📊 Video Statistics (H.264):\n")
+	fmt.Printf("📊 Video Statistics (%s):\n", codecName)
 	fmt.Printf("  • Total video fragments processed: %d\n", len(h.frames))
+	if h.hevc {
+		fmt.Printf("  • Unique VPS headers found: %d\n", len(uniqueVPS))
+	}
 	fmt.Printf("  • Unique SPS headers found: %d\n", len(uniqueSPS))
 	fmt.Printf("  • Unique PPS headers found: %d\n", len(uniquePPS))
 	fmt.Printf("  • Complete video frames written: %d\n", len(h.completeFrames))
@@ -712,6 +779,7 @@ func parseJT1078Frame(buf []byte) (*JT1078Frame, int) {
 		LogicChannel:   frameData[14],
 		DataType:       dataType,
 		SubPackageType: subPackageType,
+		PayloadType:    frameData[5] & 0x7F,
 		Timestamp:      0,   // Will be set properly below
 		Payload:        nil, // Will be set properly below
 	}
@@ -754,7 +822,7 @@ func max(a, b float64) float64 {
 }
 
 // analyzePayload analyzes the payload for NAL units and provides detailed info
-func analyzePayload(payload []byte, frameType string) {
+func analyzePayload(payload []byte, frameType string, hevc bool) {
 	if len(payload) < 10 {
 		return // Too small to be meaningful
 	}
@@ -776,8 +844,11 @@ func analyzePayload(payload []byte, frameType string) {
 		if nalStart >= len(payload) {
 			break
 		}
-		nalType := payload[nalStart] & 0x1F
-		nalUnits = append(nalUnits, int(nalType))
+		nalType := int(payload[nalStart] & 0x1F)
+		if hevc {
+			nalType = int(payload[nalStart]>>1) & 0x3F
+		}
+		nalUnits = append(nalUnits, nalType)
 
 		// Skip ahead to avoid finding the same start code
 		i = nalStart + 1
@@ -788,7 +859,7 @@ func analyzePayload(payload []byte, frameType string) {
 	}
 }
 
-// deduplicateNALs removes duplicate byte slices (for SPS/PPS).
+// deduplicateNALs removes duplicate byte slices (for VPS/SPS/PPS).
 func deduplicateNALs(nals [][]byte) [][]byte {
 	unique := make([][]byte, 0, len(nals))
 	seen := make(map[string]bool)
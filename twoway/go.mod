@@ -2,4 +2,9 @@ module twoway
 
 go 1.23.2
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	jt1078 v0.0.0
+)
+
+replace jt1078 => ../jt1078
@@ -15,6 +15,9 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"jt1078/audio"
+	"jt1078/proxyapi"
 )
 
 var (
@@ -94,15 +97,15 @@ func computeG711ALawToPCM16(aLawByte byte) int16 {
 	return int16(-t)
 }
 
-func DecodeG711ALaw(data []byte) []byte {
-	if len(data) == 0 {
+// encodePCM16LE turns decoded samples into the PCM the receivers play,
+// gating low-level noise and keeping peaks off full scale.
+func encodePCM16LE(samples []int16) []byte {
+	if len(samples) == 0 {
 		return nil
 	}
 
-	pcm := make([]byte, len(data)*2)
-	for i, b := range data {
-		sample := alawToPcmTable[b]
-
+	pcm := make([]byte, len(samples)*2)
+	for i, sample := range samples {
 		if sample < 80 && sample > -80 {
 			sample = 0
 		}
@@ -383,6 +386,20 @@ func apiProxyCallControl(w http.ResponseWriter, r *http.Request) {
 	log.Printf("API Proxy: Call control response forwarded successfully")
 }
 
+// notifyMediaStream tells the proxy API that a device stream started or stopped
+// so call and session state follow the media actually reaching this server.
+func notifyMediaStream(sim string, channel, dataType int, event string) {
+	err := proxyapi.Post("/api/v1/jt808/media/stream", map[string]interface{}{
+		"device_phone": sim,
+		"channel":      channel,
+		"data_type":    dataType,
+		"event":        event,
+	})
+	if err != nil {
+		log.Printf("Error reporting stream %s for %s channel %d: %v", event, sim, channel, err)
+	}
+}
+
 // Debug function to decode BCD format
 func decodeBCD(data []byte) string {
 	result := ""
@@ -816,6 +833,9 @@ func transmitHandler(w http.ResponseWriter, r *http.Request) {
 
 // Forward audio frame to all connected TCP devices
 func forwardToDevices(frameData []byte) {
+	// Devices get the browser's G.711A in the codec they send their own audio in
+	frameData = audio.TranscodeTalkback(frameData)
+
 	deviceConnsMu.RLock()
 	defer deviceConnsMu.RUnlock()
 
@@ -840,7 +860,10 @@ func main() {
 	// Parse command line flags
 	flag.BoolVar(&debugSend, "ds", false, "Debug send: show details of frames being sent to devices")
 	flag.BoolVar(&debugReceive, "dr", false, "Debug receive: show details of frames received from devices")
+	flag.IntVar(&audio.G726Kbps, "g726-kbps", 0, "G.726 rate of device audio in kbit/s: 16, 24, 32 or 40 (0 = infer from the frame length)")
+	flag.BoolVar(&audio.G726AAL2, "g726-aal2", false, "G.726 code words are packed most significant first (AAL2) instead of as in RFC 3551")
 	flag.Parse()
+	proxyapi.BaseURL = apiBaseURL
 
 	if debugSend {
 		fmt.Println("🐛 DEBUG SEND MODE ENABLED - Will show details of outgoing frames")
@@ -945,6 +968,17 @@ func handleTCPConnection(conn net.Conn) {
 	buffer := make([]byte, 0, 16384)
 	readBuffer := make([]byte, 8192)
 
+	// Channels whose audio has been reported to the proxy, keyed by SIM
+	reported := make(map[string]map[int]bool)
+	defer func() {
+		for sim, channels := range reported {
+			for channel := range channels {
+				go notifyMediaStream(sim, channel, 3, "stopped")
+				audio.Forget(sim, channel)
+			}
+		}
+	}()
+
 	log.Printf("New TCP device connection: %s", remoteAddr)
 
 	for {
@@ -979,6 +1013,13 @@ func handleTCPConnection(conn net.Conn) {
 			buffer = buffer[consumed:]
 
 			if frame != nil && isAudio {
+				if !reported[frame.SIM][frame.Channel] {
+					if reported[frame.SIM] == nil {
+						reported[frame.SIM] = make(map[int]bool)
+					}
+					reported[frame.SIM][frame.Channel] = true
+					go notifyMediaStream(frame.SIM, frame.Channel, 3, "started")
+				}
 				processAudioFrame(frame)
 			}
 
@@ -992,10 +1033,13 @@ func handleTCPConnection(conn net.Conn) {
 }
 
 type JT1078Frame struct {
-	Header     []byte
-	DataType   int
-	DataLength uint16
-	Payload    []byte
+	Header      []byte
+	SIM         string
+	Channel     int
+	DataType    int
+	DataLength  uint16
+	PayloadType byte // audio codec per JT/T 1078 table 12
+	Payload     []byte
 }
 
 func extractFrame(buffer []byte) (*JT1078Frame, int, bool) {
@@ -1021,7 +1065,10 @@ func extractFrame(buffer []byte) (*JT1078Frame, int, bool) {
 
 	frameData := buffer[headerIdx:]
 	frame := &JT1078Frame{
-		Header: frameData[:28],
+		Header:      frameData[:28],
+		SIM:         decodeBCD(frameData[8:14]),
+		Channel:     int(frameData[14]),
+		PayloadType: frameData[5] & 0x7F,
 	}
 
 	label3 := frameData[15]
@@ -1063,7 +1110,7 @@ func extractFrame(buffer []byte) (*JT1078Frame, int, bool) {
 		copy(frame.Payload, frameData[offset:offset+int(frame.DataLength)])
 	}
 
-	isAudio := frame.DataType == 3 && len(frame.Payload) >= 100
+	isAudio := frame.DataType == 3 && len(frame.Payload) > 0
 	return frame, headerIdx + totalFrameSize, isAudio
 }
 
@@ -1072,24 +1119,15 @@ func processAudioFrame(frame *JT1078Frame) {
 		return
 	}
 
-	payloadSize := len(frame.Payload)
-	if payloadSize > 320 {
-		payloadSize = 320
-	}
-
-	audioPayload := frame.Payload[:payloadSize]
-	pcmData := DecodeG711ALaw(audioPayload)
+	samples, _ := audio.Decode(frame.SIM, frame.Channel, frame.PayloadType, frame.Payload)
+	pcmData := encodePCM16LE(samples)
 
 	if len(pcmData) == 0 {
 		return
 	}
 
-	duration := float32(payloadSize) / 8000.0
-	if duration < 0.02 {
-		duration = 0.02
-	} else if duration > 0.06 {
-		duration = 0.04
-	}
+	// Decoded audio is 8000 Hz
+	duration := float32(len(samples)) / 8000.0
 
 	audioFrame := &AudioFrame{
 		PCMData:   pcmData,
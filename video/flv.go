@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"jt1078/audio"
+)
+
+// FLV tag types and codec IDs (FLV spec v10.1, E.4).
+const (
+	flvTagAudio = 8
+	flvTagVideo = 9
+
+	flvCodecAVC = 7
+	// Enhanced RTMP (v1) video: ExVideoTagHeader with a FourCC codec
+	flvExHeader            = 0x80
+	flvPacketSequenceStart = 0
+	flvPacketCodedFrames   = 1
+	// G.711 A-law, 8 kHz mono; the rate bits are ignored for this format
+	flvAudioG711A = 7<<4 | 1<<1
+	// AAC; the header always reads 44 kHz stereo, the AudioSpecificConfig
+	// of the sequence header has the real format
+	flvAudioAAC          = 10<<4 | 3<<2 | 1<<1 | 1
+	flvAACSequenceHeader = 0
+	flvAACRaw            = 1
+)
+
+// flvFourCCHEVC is the Enhanced RTMP FourCC of H.265 video.
+var flvFourCCHEVC = []byte("hvc1")
+
+// flvMuxer turns the packets of one stream into FLV tags for one viewer.
+// Output starts at a key frame with the AVC sequence header, and timestamps
+// count from that key frame's JT1078 timestamp. H.265 goes out as Enhanced
+// RTMP tags (FourCC hvc1), which ffmpeg 6.1+, OBS, SRS and mpegts.js read.
+// Audio is the device's AAC when the stream has it at that key frame, else
+// G.711A.
+type flvMuxer struct {
+	audio   bool
+	aac     *audio.AACConfig // AAC format sent in the audio sequence header
+	started bool
+	clock   mediaClock
+	params  *MediaPacket // packet whose parameter sets were sent last
+}
+
+// flvHeader is the file header followed by PreviousTagSize0.
+func flvHeader(audio bool) []byte {
+	flags := byte(0x01) // video
+	if audio {
+		flags |= 0x04
+	}
+	return []byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+}
+
+// mux returns the tags for a packet, or nil while waiting for a key frame.
+func (m *flvMuxer) mux(packet *MediaPacket) []byte {
+	if !m.started {
+		if !packet.Video || !packet.KeyFrame || !packet.hasParameterSets() {
+			return nil
+		}
+		m.started = true
+		m.clock.start(packet.Timestamp)
+		if m.audio {
+			m.aac = packet.AACConfig
+		}
+	}
+
+	var out bytes.Buffer
+	timestamp := m.clock.at(packet.Timestamp)
+
+	if !packet.Video {
+		if !m.audio {
+			return nil
+		}
+		if m.aac != nil {
+			frames, times := packet.aacFrames(m.aac, timestamp)
+			for i, frame := range frames {
+				writeFLVTag(&out, flvTagAudio, times[i], append([]byte{flvAudioAAC, flvAACRaw}, frame.Data...))
+			}
+		} else if len(packet.Audio) > 0 {
+			writeFLVTag(&out, flvTagAudio, timestamp, append([]byte{flvAudioG711A}, packet.Audio...))
+		}
+		return out.Bytes()
+	}
+
+	if m.aac != nil && m.params == nil {
+		writeFLVTag(&out, flvTagAudio, timestamp, append([]byte{flvAudioAAC, flvAACSequenceHeader}, m.aac.ASC()...))
+	}
+
+	if packet.hasParameterSets() && !packet.sameParameterSets(m.params) {
+		m.params = packet
+		writeFLVTag(&out, flvTagVideo, timestamp, flvSequenceHeader(packet))
+	}
+
+	frameType := byte(2) // inter frame
+	if packet.KeyFrame {
+		frameType = 1
+	}
+	var body bytes.Buffer
+	if packet.HEVC {
+		body.WriteByte(flvExHeader | frameType<<4 | flvPacketCodedFrames)
+		body.Write(flvFourCCHEVC)
+		body.Write([]byte{0, 0, 0}) // composition time 0
+	} else {
+		body.Write([]byte{frameType<<4 | flvCodecAVC, 1, 0, 0, 0}) // NALU, composition time 0
+	}
+	for _, nal := range packet.NALUs {
+		binary.Write(&body, binary.BigEndian, uint32(len(nal)))
+		body.Write(nal)
+	}
+	writeFLVTag(&out, flvTagVideo, timestamp, body.Bytes())
+	return out.Bytes()
+}
+
+// flvSequenceHeader builds the sequence header tag body of a packet's
+// parameter sets: an AVCDecoderConfigurationRecord (ISO/IEC 14496-15,
+// 5.2.4.1), or for H.265 an Enhanced RTMP SequenceStart with the hvcC.
+func flvSequenceHeader(packet *MediaPacket) []byte {
+	var body bytes.Buffer
+	if packet.HEVC {
+		body.WriteByte(flvExHeader | 1<<4 | flvPacketSequenceStart)
+		body.Write(flvFourCCHEVC)
+	} else {
+		body.Write([]byte{1<<4 | flvCodecAVC, 0, 0, 0, 0})
+	}
+	body.Write(videoDecoderConfig(packet))
+	return body.Bytes()
+}
+
+func avcDecoderConfig(sps, pps []byte) []byte {
+	var record bytes.Buffer
+	record.WriteByte(1) // configurationVersion
+	if len(sps) >= 4 {
+		record.Write(sps[1:4]) // profile, compatibility, level
+	} else {
+		record.Write([]byte{0x42, 0x00, 0x1E})
+	}
+	record.WriteByte(0xFF) // 4-byte NALU lengths
+	record.WriteByte(0xE1) // one SPS
+	binary.Write(&record, binary.BigEndian, uint16(len(sps)))
+	record.Write(sps)
+	record.WriteByte(1) // one PPS
+	binary.Write(&record, binary.BigEndian, uint16(len(pps)))
+	record.Write(pps)
+	return record.Bytes()
+}
+
+// writeFLVTag appends a tag and its PreviousTagSize.
+func writeFLVTag(out *bytes.Buffer, tagType byte, timestamp uint32, data []byte) {
+	header := []byte{
+		tagType,
+		byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0, // stream ID
+	}
+	out.Write(header)
+	out.Write(data)
+	binary.Write(out, binary.BigEndian, uint32(len(header)+len(data)))
+}
+
+// flvHandler serves a live SIM/channel stream as FLV:
+// /flv?device_phone=...&channel=N over chunked HTTP (VLC, ffplay, flv.js) or,
+// when the request is a WebSocket upgrade, as WebSocket-FLV (flv.js).
+// audio=0 leaves out the audio tags for players that cannot decode G.711A.
+func flvHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil || sub.SIM == "" || sub.Channel == 0 {
+		http.Error(w, "device_phone and channel are required", http.StatusBadRequest)
+		return
+	}
+	audio := r.URL.Query().Get("audio") != "0"
+
+	if websocket.IsWebSocketUpgrade(r) {
+		serveWebSocketFLV(w, r, sub, audio)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	media := subscribeMedia(sub.SIM, sub.Channel, "FLV "+r.RemoteAddr, true)
+	defer unsubscribeMedia(media)
+	log.Printf("HTTP-FLV viewer %s watching %s", r.RemoteAddr, describeSubscription(sub))
+
+	if _, err := w.Write(flvHeader(audio)); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	controller := http.NewResponseController(w)
+	muxer := &flvMuxer{audio: audio}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case packet, ok := <-media.Packets:
+			if !ok {
+				log.Printf("HTTP-FLV viewer %s fell behind, closing", r.RemoteAddr)
+				return
+			}
+			tags := muxer.mux(packet)
+			if tags == nil {
+				continue
+			}
+			controller.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := w.Write(tags); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveWebSocketFLV sends the FLV byte stream as binary WebSocket messages.
+func serveWebSocketFLV(w http.ResponseWriter, r *http.Request, sub Subscription, audio bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WS-FLV upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	media := subscribeMedia(sub.SIM, sub.Channel, "FLV "+r.RemoteAddr, true)
+	defer unsubscribeMedia(media)
+	log.Printf("WS-FLV viewer %s watching %s", r.RemoteAddr, describeSubscription(sub))
+
+	// Reading notices the viewer going away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.BinaryMessage, flvHeader(audio)); err != nil {
+		return
+	}
+
+	muxer := &flvMuxer{audio: audio}
+	for {
+		select {
+		case <-gone:
+			return
+		case packet, ok := <-media.Packets:
+			if !ok {
+				log.Printf("WS-FLV viewer %s fell behind, closing", r.RemoteAddr)
+				return
+			}
+			tags := muxer.mux(packet)
+			if tags == nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteMessage(websocket.BinaryMessage, tags); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"jt1078/audio"
+)
+
+// fmp4Timescale is the media timescale: JT1078 timestamps are milliseconds.
+const fmp4Timescale = 1000
+
+// fmp4DefaultDuration is used for the last sample of a fragment sent before
+// the next frame is known (the GOP primed to a late joiner).
+const fmp4DefaultDuration = 40
+
+// box writes an ISO BMFF box around its payloads.
+func box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], boxType)
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// fullBox is a box with a version and flags.
+func fullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// unityMatrix is the identity transformation of mvhd and tkhd.
+var unityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// fmp4InitSegment builds ftyp+moov for one H.264 video track with an avcC
+// built from the stream's SPS/PPS (ISO/IEC 14496-12 and 14496-15), or an
+// H.265 one with an hvcC. An audio track from fmp4AudioTrack follows when
+// given.
+func fmp4InitSegment(packet *MediaPacket, audioTrack []byte) []byte {
+	ftyp := box("ftyp", []byte("iso5"), be32(512), []byte("iso5iso6avc1mp41"))
+
+	traks := [][]byte{fmp4VideoTrack(packet)}
+	trex := [][]byte{fullBox("trex", 0, 0, be32(1), be32(1), be32(0), be32(0), be32(0))}
+	if audioTrack != nil {
+		traks = append(traks, audioTrack)
+		trex = append(trex, fullBox("trex", 0, 0, be32(2), be32(1), be32(0), be32(0), be32(0)))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		be32(0), be32(0), // creation, modification
+		be32(fmp4Timescale), be32(0), // timescale, duration
+		be32(0x00010000), be16(0x0100), make([]byte, 10), // rate, volume, reserved
+		unityMatrix, make([]byte, 24), // pre_defined
+		be32(uint32(len(traks)+1)), // next_track_ID
+	)
+
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, box("mvex", trex...))
+	return append(ftyp, box("moov", moov...)...)
+}
+
+// fmp4VideoTrack is the trak of video track 1.
+func fmp4VideoTrack(packet *MediaPacket) []byte {
+	width, height := videoPictureSize(packet)
+	sampleEntry, config := "avc1", "avcC"
+	if packet.HEVC {
+		sampleEntry, config = "hvc1", "hvcC"
+	}
+
+	tkhd := fullBox("tkhd", 0, 0x000003, // enabled, in movie
+		be32(0), be32(0), be32(1), be32(0), be32(0), // times, track 1, reserved, duration
+		make([]byte, 8), be16(0), be16(0), be16(0), be16(0), // layer, group, volume
+		unityMatrix,
+		be32(uint32(width)<<16), be32(uint32(height)<<16),
+	)
+	mdhd := fullBox("mdhd", 0, 0, be32(0), be32(0), be32(fmp4Timescale), be32(0), be16(0x55C4), be16(0)) // und
+	hdlr := fullBox("hdlr", 0, 0, be32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+
+	visual := box(sampleEntry,
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		be16(uint16(width)), be16(uint16(height)),
+		be32(0x00480000), be32(0x00480000), be32(0), be16(1), // 72 dpi, reserved, frame count
+		make([]byte, 32), be16(0x0018), be16(0xFFFF), // compressor name, depth, pre_defined
+		box(config, videoDecoderConfig(packet)),
+	)
+	minf := box("minf",
+		fullBox("vmhd", 0, 1, make([]byte, 8)),
+		box("dinf", fullBox("dref", 0, 0, be32(1), fullBox("url ", 0, 1))),
+		fmp4SampleTable(visual),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, minf))
+}
+
+// fmp4AudioTrack is the trak of audio track 2, timed in samples: AAC with
+// an esds when aac is set, else G.711A at 8 kHz mono, which MSE cannot
+// decode, so only recordings use it.
+func fmp4AudioTrack(aac *audio.AACConfig) []byte {
+	tkhd := fullBox("tkhd", 0, 0x000003,
+		be32(0), be32(0), be32(2), be32(0), be32(0), // times, track 2, reserved, duration
+		make([]byte, 8), be16(0), be16(1), be16(0x0100), be16(0), // layer, alternate group, full volume
+		unityMatrix,
+		be32(0), be32(0),
+	)
+	sampleEntry, rate, channels := "alaw", 8000, 1
+	var config [][]byte
+	if aac != nil {
+		sampleEntry, rate, channels = "mp4a", aac.SampleRate, max(aac.Channels, 1)
+		config = append(config, fullBox("esds", 0, 0, mp4aDescriptor(aac)))
+	}
+	mdhd := fullBox("mdhd", 0, 0, be32(0), be32(0), be32(uint32(rate)), be32(0), be16(0x55C4), be16(0))
+	hdlr := fullBox("hdlr", 0, 0, be32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+
+	sound := box(sampleEntry, append([][]byte{
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 8), be16(uint16(channels)), be16(16), // reserved, channels, sample size
+		be16(0), be16(0), be32(uint32(min(rate, 0xFFFF)) << 16), // pre_defined, reserved, sample rate
+	}, config...)...)
+	minf := box("minf",
+		fullBox("smhd", 0, 0, be16(0), be16(0)),
+		box("dinf", fullBox("dref", 0, 0, be32(1), fullBox("url ", 0, 1))),
+		fmp4SampleTable(sound),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, minf))
+}
+
+// mp4aDescriptor is the ES_Descriptor of an esds box for AAC (ISO/IEC
+// 14496-1, 7.2.6.5): MPEG-4 audio with the AudioSpecificConfig.
+func mp4aDescriptor(aac *audio.AACConfig) []byte {
+	descriptor := func(tag byte, payloads ...[]byte) []byte {
+		out := []byte{tag, 0}
+		for _, p := range payloads {
+			out = append(out, p...)
+		}
+		out[1] = byte(len(out) - 2)
+		return out
+	}
+	return descriptor(0x03, be16(2), []byte{0}, // ES_ID, no dependencies
+		descriptor(0x04,
+			[]byte{0x40, 0x15},                // MPEG-4 audio, audio stream
+			make([]byte, 3), be32(0), be32(0), // buffer size, max and average bit rate
+			descriptor(0x05, aac.ASC()),
+		),
+		descriptor(0x06, []byte{0x02}), // SLConfig predefined for MP4
+	)
+}
+
+// fmp4SampleTable is an stbl with one sample entry and no samples, which
+// are all in fragments.
+func fmp4SampleTable(sampleEntry []byte) []byte {
+	return box("stbl",
+		fullBox("stsd", 0, 0, be32(1), sampleEntry),
+		fullBox("stts", 0, 0, be32(0)),
+		fullBox("stsc", 0, 0, be32(0)),
+		fullBox("stsz", 0, 0, be32(0), be32(0)),
+		fullBox("stco", 0, 0, be32(0)),
+	)
+}
+
+// fmp4Sample is one access unit of a fragment.
+type fmp4Sample struct {
+	time     uint32
+	duration uint32 // 0 = until the next sample
+	keyFrame bool
+	data     []byte // AVCC (4-byte length prefixed NAL units), G.711A or raw AAC
+}
+
+// fmp4Run is the samples of one track in a fragment. The last sample lasts
+// until nextTime; 0 means unknown.
+type fmp4Run struct {
+	trackID  uint32
+	samples  []fmp4Sample
+	nextTime uint32
+}
+
+// fmp4Fragment builds moof+mdat with a traf per run that has samples; their
+// data follows each other in the mdat.
+func fmp4Fragment(sequence uint32, runs ...fmp4Run) []byte {
+	const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 // offset, duration, size, flags
+
+	var filled []fmp4Run
+	for _, run := range runs {
+		if len(run.samples) > 0 {
+			filled = append(filled, run)
+		}
+	}
+
+	var mdat bytes.Buffer
+	var entries [][]byte
+	var offsets []int
+	for _, run := range filled {
+		var trun bytes.Buffer
+		offsets = append(offsets, mdat.Len())
+		for i, sample := range run.samples {
+			nextTime := run.nextTime
+			if i+1 < len(run.samples) {
+				nextTime = run.samples[i+1].time
+			}
+			duration := sample.duration
+			if duration == 0 {
+				duration = fmp4DefaultDuration
+				if nextTime > sample.time {
+					duration = nextTime - sample.time
+				}
+			}
+			flags := uint32(0x01010000) // depends on others, non-sync
+			if sample.keyFrame {
+				flags = 0x02000000
+			}
+			trun.Write(be32(duration))
+			trun.Write(be32(uint32(len(sample.data))))
+			trun.Write(be32(flags))
+			mdat.Write(sample.data)
+		}
+		entries = append(entries, trun.Bytes())
+	}
+
+	build := func(dataOffset uint32) []byte {
+		payloads := [][]byte{fullBox("mfhd", 0, 0, be32(sequence))}
+		for i, run := range filled {
+			payloads = append(payloads, box("traf",
+				fullBox("tfhd", 0, 0x020000, be32(run.trackID)), // default-base-is-moof
+				fullBox("tfdt", 1, 0, be64(uint64(run.samples[0].time))),
+				fullBox("trun", 0, trunFlags, be32(uint32(len(run.samples))), be32(dataOffset+uint32(offsets[i])), entries[i]),
+			))
+		}
+		return box("moof", payloads...)
+	}
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+	return append(moof, box("mdat", mdat.Bytes())...)
+}
+
+// fmp4Muxer turns the packets of one stream into an init segment and one
+// fragment per GOP for one viewer. Streams with AAC at the first key frame
+// get it as an audio track; other audio is left out.
+type fmp4Muxer struct {
+	clock    mediaClock
+	started  bool
+	params   *MediaPacket     // packet whose parameter sets are in the init segment
+	aac      *audio.AACConfig // format of the audio track
+	sequence uint32
+	pending  []fmp4Sample
+	audio    []fmp4Sample
+}
+
+// fmp4Output is what a viewer is sent: a codec announcement with a new init
+// segment, or a fragment.
+type fmp4Output struct {
+	codec    string
+	width    int
+	height   int
+	init     []byte
+	fragment []byte
+}
+
+// mux adds a video packet; a key frame flushes the samples since the last
+// one as a fragment, with a new init segment first when the parameter sets
+// changed.
+func (m *fmp4Muxer) mux(packet *MediaPacket) []fmp4Output {
+	if !packet.Video {
+		if m.aac != nil {
+			m.audio = append(m.audio, aacSamples(packet, m.aac, m.clock.at(packet.Timestamp))...)
+		}
+		return nil
+	}
+	if !m.started {
+		if !packet.KeyFrame {
+			return nil
+		}
+		m.started = true
+		m.clock.start(packet.Timestamp)
+		m.aac = packet.AACConfig
+	}
+
+	t := m.clock.at(packet.Timestamp)
+	var out []fmp4Output
+	if packet.KeyFrame {
+		if fragment := m.flush(t); fragment != nil {
+			out = append(out, fmp4Output{fragment: fragment})
+		}
+		if !packet.sameParameterSets(m.params) {
+			m.params = packet
+			width, height := videoPictureSize(packet)
+			codec := videoCodec(packet)
+			var audioTrack []byte
+			if m.aac != nil {
+				codec += "," + m.aac.Codec()
+				audioTrack = fmp4AudioTrack(m.aac)
+			}
+			out = append(out, fmp4Output{codec: codec, width: width, height: height, init: fmp4InitSegment(packet, audioTrack)})
+		}
+	}
+
+	var data bytes.Buffer
+	for _, nal := range packet.NALUs {
+		data.Write(be32(uint32(len(nal))))
+		data.Write(nal)
+	}
+	m.pending = append(m.pending, fmp4Sample{time: t, keyFrame: packet.KeyFrame, data: data.Bytes()})
+	return out
+}
+
+// flush returns the pending samples as a fragment, or nil if there are none.
+func (m *fmp4Muxer) flush(nextTime uint32) []byte {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	m.sequence++
+	fragment := fmp4Fragment(m.sequence,
+		fmp4Run{trackID: 1, samples: m.pending, nextTime: nextTime},
+		fmp4Run{trackID: 2, samples: m.audio},
+	)
+	m.pending, m.audio = nil, nil
+	return fragment
+}
+
+// aacSamples returns the AAC frames of an audio packet at output time t
+// (ms) as samples of an audio track timed at the AAC sample rate.
+func aacSamples(packet *MediaPacket, aac *audio.AACConfig, t uint32) []fmp4Sample {
+	frames, times := packet.aacFrames(aac, t)
+	samples := make([]fmp4Sample, len(frames))
+	for i, frame := range frames {
+		samples[i] = fmp4Sample{
+			time:     uint32(uint64(times[i]) * uint64(aac.SampleRate) / 1000),
+			duration: 1024,
+			keyFrame: true,
+			data:     frame.Data,
+		}
+	}
+	return samples
+}
+
+// fmp4Handler streams a live SIM/channel as fragmented MP4 for Media Source
+// Extensions: /video/fmp4?device_phone=...&channel=N. Each init segment is
+// preceded by a text message {"codec","width","height"} for addSourceBuffer;
+// binary messages are init segments and moof+mdat fragments, one per GOP.
+// Viewers joining mid-GOP get the current GOP straight away.
+func fmp4Handler(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil || sub.SIM == "" || sub.Channel == 0 {
+		http.Error(w, "device_phone and channel are required", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("fMP4 WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// The cached GOP sits in the queue; it is sent as soon as it is drained
+	media := subscribeMedia(sub.SIM, sub.Channel, "fMP4 "+r.RemoteAddr, true)
+	defer unsubscribeMedia(media)
+	primed := len(media.Packets) > 0
+	log.Printf("fMP4 viewer %s watching %s", r.RemoteAddr, describeSubscription(sub))
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(outputs []fmp4Output) error {
+		for _, output := range outputs {
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if output.init != nil {
+				announcement, _ := json.Marshal(map[string]interface{}{
+					"codec":  output.codec,
+					"width":  output.width,
+					"height": output.height,
+				})
+				if err := conn.WriteMessage(websocket.TextMessage, announcement); err != nil {
+					return err
+				}
+				if err := conn.WriteMessage(websocket.BinaryMessage, output.init); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, output.fragment); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	muxer := &fmp4Muxer{}
+	for {
+		select {
+		case <-gone:
+			return
+		case packet, ok := <-media.Packets:
+			if !ok {
+				log.Printf("fMP4 viewer %s fell behind, closing", r.RemoteAddr)
+				return
+			}
+			if err := send(muxer.mux(packet)); err != nil {
+				return
+			}
+			// Send the primed GOP once drained rather than at the next key frame
+			if primed && len(media.Packets) == 0 {
+				primed = false
+				if fragment := muxer.flush(0); fragment != nil {
+					if err := send([]fmp4Output{{fragment: fragment}}); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Packets of the current GOP kept per live stream in mediaGOPs, to start new
+// viewers without waiting for the next I-frame (0 = no cache)
+var gopCacheSize = 256
+
+// subscribeVideoViewer switches a /video viewer to a subscription and sends
+// it the frames of the cached GOP of each live stream it newly receives
+// (every stream of the first subscription), so playback starts at once.
+// Holding mediaSubscribersMu while switching keeps frames from being missed,
+// as live frames are published to the cache before they are broadcast;
+// frames already sent from the cache are marked in info.primed, so their
+// broadcast skips the viewer.
+func subscribeVideoViewer(conn *websocket.Conn, info *ClientInfo, sub Subscription, first bool) {
+	mediaSubscribersMu.Lock()
+	clientsMu.Lock()
+	previous := info.Subscription
+	info.Subscription = sub
+	if info.primed == nil {
+		info.primed = make(map[string]time.Time)
+	}
+	var frames []*VideoFrame
+	for key, gop := range mediaGOPs {
+		sim, channel := gop[0].SIM, gop[0].Channel
+		if !sub.Matches(sim, channel) || !first && previous.Matches(sim, channel) {
+			continue
+		}
+		gopFrames := gopVideoFrames(gop)
+		if len(gopFrames) == 0 {
+			continue
+		}
+		frames = append(frames, gopFrames...)
+		info.primed[key] = gopFrames[len(gopFrames)-1].Timestamp
+	}
+	// Taken before the locks are released, so broadcasts of newer frames
+	// wait for the cached ones to be written
+	info.WriteMutex.Lock()
+	clientsMu.Unlock()
+	mediaSubscribersMu.Unlock()
+	defer info.WriteMutex.Unlock()
+
+	if len(frames) == 0 {
+		return
+	}
+	for _, videoFrame := range frames {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := conn.WriteMessage(websocket.BinaryMessage, createVideoMessageWithSPSPPS(videoFrame)); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	info.FramesSent += int64(len(frames))
+	info.LastActivity = time.Now()
+	log.Printf("Video viewer %s started with %d cached frames", info.RemoteAddr, len(frames))
+}
+
+// gopVideoFrames returns the live frames of a cached GOP from its first
+// I-frame on, the one /video sends with the parameter sets.
+func gopVideoFrames(gop []*MediaPacket) []*VideoFrame {
+	var frames []*VideoFrame
+	for _, packet := range gop {
+		if packet.Frame == nil || len(frames) == 0 && packet.Frame.FrameType != 0 {
+			continue
+		}
+		frames = append(frames, packet.Frame)
+	}
+	return frames
+}
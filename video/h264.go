@@ -0,0 +1,155 @@
+package main
+
+import "fmt"
+
+// bitReader reads the Exp-Golomb coded fields of an RBSP.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && zeros < 32 {
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// nalToRBSP removes the emulation prevention bytes (00 00 03) of a NAL unit.
+func nalToRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// h264PictureSize reads the cropped picture size from an SPS
+// (ITU-T H.264, 7.3.2.1.1).
+func h264PictureSize(sps []byte) (width, height int) {
+	if len(sps) < 4 {
+		return 0, 0
+	}
+	r := &bitReader{data: nalToRBSP(sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0; n-- {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMBs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMBsOnly := int(r.bit())
+	if frameMBsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width = widthMBs * 16
+	height = (2 - frameMBsOnly) * heightMapUnits * 16
+	if r.bit() == 1 {
+		cropX, cropY := 1, 2-frameMBsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		width -= cropX * (left + right)
+		height -= cropY * (top + bottom)
+	}
+	return width, height
+}
+
+// h264Codec is the RFC 6381 codec string of an SPS, e.g. "avc1.42c01e".
+func h264Codec(sps []byte) string {
+	if len(sps) < 4 {
+		return "avc1.42e01e"
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+}
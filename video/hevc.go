@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// JT/T 1078 payload types of the video codecs (table 12)
+const (
+	payloadTypeH264 = 98
+	payloadTypeH265 = 99
+)
+
+// H.265 NAL unit types (ITU-T H.265, table 7-1)
+const (
+	hevcNALIRAPFirst = 16 // BLA_W_LP
+	hevcNALIRAPLast  = 21 // CRA_NUT
+	hevcNALVPS       = 32
+	hevcNALSPS       = 33
+	hevcNALPPS       = 34
+	hevcNALAUD       = 35
+)
+
+// Access unit delimiters with start codes, for any slice type
+var (
+	h264AUD = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0x10}
+	hevcAUD = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+)
+
+// nalUnitType reads the NAL unit type from the first header byte.
+func nalUnitType(header byte, hevc bool) int {
+	if hevc {
+		return int(header>>1) & 0x3F
+	}
+	return int(header & 0x1F)
+}
+
+// Parameter set and key frame NAL unit types of either codec
+func isVPS(t int, hevc bool) bool { return hevc && t == hevcNALVPS }
+func isSPS(t int, hevc bool) bool { return hevc && t == hevcNALSPS || !hevc && t == 7 }
+func isPPS(t int, hevc bool) bool { return hevc && t == hevcNALPPS || !hevc && t == 8 }
+func isAUD(t int, hevc bool) bool { return hevc && t == hevcNALAUD || !hevc && t == 9 }
+
+// isKeySlice reports an IDR slice; for H.265 any IRAP picture (BLA, IDR,
+// CRA) as decoding can start at each of them.
+func isKeySlice(t int, hevc bool) bool {
+	if hevc {
+		return t >= hevcNALIRAPFirst && t <= hevcNALIRAPLast
+	}
+	return t == 5
+}
+
+// hevcSPS holds the fields of an H.265 SPS the muxers need.
+type hevcSPS struct {
+	width, height    int
+	chromaFormat     uint
+	bitDepthLuma     uint
+	bitDepthChroma   uint
+	maxSubLayers     uint
+	temporalNesting  uint
+	profileTierLevel [12]byte // general profile, compatibility, constraint and level
+}
+
+// parseHEVCSPS reads an SPS up to its bit depths (ITU-T H.265, 7.3.2.2).
+func parseHEVCSPS(sps []byte) (hevcSPS, bool) {
+	var info hevcSPS
+	if len(sps) < 15 {
+		return info, false
+	}
+	rbsp := nalToRBSP(sps[2:])
+	if len(rbsp) < 13 {
+		return info, false
+	}
+	r := &bitReader{data: rbsp}
+	r.bits(4) // sps_video_parameter_set_id
+	info.maxSubLayers = r.bits(3) + 1
+	info.temporalNesting = r.bit()
+	copy(info.profileTierLevel[:], rbsp[1:13])
+	r.pos += 96
+
+	// Sub-layer profile and level flags, then the ones present
+	subLayers := int(info.maxSubLayers) - 1
+	profilePresent := make([]uint, subLayers)
+	levelPresent := make([]uint, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.bit()
+		levelPresent[i] = r.bit()
+	}
+	if subLayers > 0 {
+		for i := subLayers; i < 8; i++ {
+			r.bits(2) // reserved_zero_2bits
+		}
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] == 1 {
+			r.pos += 88
+		}
+		if levelPresent[i] == 1 {
+			r.pos += 8
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	info.chromaFormat = r.ue()
+	separatePlanes := uint(0)
+	if info.chromaFormat == 3 {
+		separatePlanes = r.bit()
+	}
+	info.width = int(r.ue())
+	info.height = int(r.ue())
+	if r.bit() == 1 { // conformance_window_flag
+		cropX, cropY := 1, 1
+		if separatePlanes == 0 && (info.chromaFormat == 1 || info.chromaFormat == 2) {
+			cropX = 2
+		}
+		if separatePlanes == 0 && info.chromaFormat == 1 {
+			cropY = 2
+		}
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		info.width -= cropX * (left + right)
+		info.height -= cropY * (top + bottom)
+	}
+	info.bitDepthLuma = r.ue() + 8
+	info.bitDepthChroma = r.ue() + 8
+	return info, info.width > 0 && info.height > 0
+}
+
+// hevcDecoderConfig builds an HEVCDecoderConfigurationRecord
+// (ISO/IEC 14496-15, 8.3.3.1) with one array per parameter set type.
+func hevcDecoderConfig(vps, sps, pps []byte) []byte {
+	info, _ := parseHEVCSPS(sps)
+
+	var record bytes.Buffer
+	record.WriteByte(1) // configurationVersion
+	record.Write(info.profileTierLevel[:])
+	binary.Write(&record, binary.BigEndian, uint16(0xF000)) // min_spatial_segmentation_idc 0
+	record.WriteByte(0xFC)                                  // parallelismType unknown
+	record.WriteByte(0xFC | byte(info.chromaFormat&3))
+	record.WriteByte(0xF8 | byte((info.bitDepthLuma-8)&7))
+	record.WriteByte(0xF8 | byte((info.bitDepthChroma-8)&7))
+	binary.Write(&record, binary.BigEndian, uint16(0)) // avgFrameRate unknown
+	// constantFrameRate 0, numTemporalLayers, temporalIdNested, 4-byte NALU lengths
+	record.WriteByte(byte(info.maxSubLayers&7)<<3 | byte(info.temporalNesting&1)<<2 | 3)
+
+	record.WriteByte(3) // numOfArrays
+	for _, set := range []struct {
+		nalType int
+		nal     []byte
+	}{{hevcNALVPS, vps}, {hevcNALSPS, sps}, {hevcNALPPS, pps}} {
+		record.WriteByte(0x80 | byte(set.nalType)) // array_completeness
+		binary.Write(&record, binary.BigEndian, uint16(1))
+		binary.Write(&record, binary.BigEndian, uint16(len(set.nal)))
+		record.Write(set.nal)
+	}
+	return record.Bytes()
+}
+
+// hevcPictureSize reads the cropped picture size from an SPS.
+func hevcPictureSize(sps []byte) (width, height int) {
+	info, _ := parseHEVCSPS(sps)
+	return info.width, info.height
+}
+
+// hevcCodec is the codec string of an SPS (ISO/IEC 14496-15, E.3), e.g.
+// "hvc1.1.6.L93.B0".
+func hevcCodec(sps []byte) string {
+	info, ok := parseHEVCSPS(sps)
+	if !ok {
+		return "hvc1.1.6.L93.B0"
+	}
+	ptl := info.profileTierLevel
+
+	var codec strings.Builder
+	codec.WriteString("hvc1.")
+	if space := ptl[0] >> 6; space > 0 {
+		codec.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&codec, "%d.", ptl[0]&0x1F)
+
+	// Compatibility flags in reverse bit order
+	var compatibility, flags uint32 = 0, binary.BigEndian.Uint32(ptl[1:5])
+	for i := 0; i < 32; i++ {
+		compatibility = compatibility<<1 | flags>>i&1
+	}
+	fmt.Fprintf(&codec, "%X.", compatibility)
+
+	tier := byte('L')
+	if ptl[0]&0x20 != 0 {
+		tier = 'H'
+	}
+	fmt.Fprintf(&codec, "%c%d", tier, ptl[11])
+
+	// Constraint bytes, without trailing zero bytes
+	constraints := bytes.TrimRight(ptl[5:11], "\x00")
+	for _, b := range constraints {
+		fmt.Fprintf(&codec, ".%X", b)
+	}
+	return codec.String()
+}
+
+// videoCodec is the codec string of a packet's parameter sets.
+func videoCodec(packet *MediaPacket) string {
+	if packet.HEVC {
+		return hevcCodec(packet.SPS)
+	}
+	return h264Codec(packet.SPS)
+}
+
+// videoPictureSize reads the picture size from a packet's SPS.
+func videoPictureSize(packet *MediaPacket) (width, height int) {
+	if packet.HEVC {
+		return hevcPictureSize(packet.SPS)
+	}
+	return h264PictureSize(packet.SPS)
+}
+
+// videoDecoderConfig is the avcC or hvcC record of a packet's parameter sets.
+func videoDecoderConfig(packet *MediaPacket) []byte {
+	if packet.HEVC {
+		return hevcDecoderConfig(packet.VPS, packet.SPS, packet.PPS)
+	}
+	return avcDecoderConfig(packet.SPS, packet.PPS)
+}
+
+// liveStreamHEVC reports whether the live stream of a SIM/channel sends
+// H.265, going by its stored parameter sets.
+func liveStreamHEVC(sim string, channel int) bool {
+	spsPpsStoreMu.RLock()
+	defer spsPpsStoreMu.RUnlock()
+	stored, exists := spsPpsStore[parameterSetKey(sim, channel, false)]
+	return exists && stored.HEVC
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// HLS output: segment directory ("" disables HLS), target segment
+	// duration, live playlist length, and how long playlists of a stopped
+	// stream stay available
+	hlsDir             string
+	hlsSegmentDuration time.Duration
+	hlsWindow          int
+	hlsExpire          time.Duration
+
+	// HLS packagers keyed by streamKey(SIM, channel)
+	hlsStreamsMu sync.Mutex
+	hlsStreams   = make(map[string]*hlsStream)
+)
+
+// hlsSegment is one MPEG-TS segment on disk.
+type hlsSegment struct {
+	Sequence      int
+	Duration      float64
+	Discontinuity bool
+}
+
+// hlsStream packages one live SIM/channel stream into MPEG-TS segments cut
+// on key frames. index.m3u8 is a sliding window over the newest segments;
+// event.m3u8 lists every segment since the stream started.
+type hlsStream struct {
+	SIM     string
+	Channel int
+	dir     string
+
+	mu          sync.Mutex
+	refs        int // device connections carrying the stream
+	media       *mediaSubscriber
+	segments    []hlsSegment
+	nextSeq     int
+	ended       bool
+	expireTimer *time.Timer
+}
+
+// startHLS begins packaging a live stream, or resumes a stopped one whose
+// playlists have not expired yet.
+func startHLS(sim string, channel int) {
+	if hlsDir == "" {
+		return
+	}
+
+	hlsStreamsMu.Lock()
+	key := streamKey(sim, channel)
+	stream, exists := hlsStreams[key]
+	if !exists {
+		stream = &hlsStream{SIM: sim, Channel: channel, dir: filepath.Join(hlsDir, key)}
+		os.RemoveAll(stream.dir)
+		if err := os.MkdirAll(stream.dir, 0755); err != nil {
+			hlsStreamsMu.Unlock()
+			log.Printf("[HLS] Cannot create %s: %v", stream.dir, err)
+			return
+		}
+		hlsStreams[key] = stream
+	}
+	hlsStreamsMu.Unlock()
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.refs++
+	if stream.media != nil {
+		return
+	}
+	if stream.expireTimer != nil {
+		stream.expireTimer.Stop()
+		stream.expireTimer = nil
+	}
+	resumed := stream.nextSeq > 0
+	stream.ended = false
+	stream.media = subscribeMedia(sim, channel, "", false)
+	go stream.run(stream.media, resumed)
+	log.Printf("[HLS] Packaging %s channel %d", sim, channel)
+}
+
+// stopHLS ends the playlists of a stream once no connection carries it and
+// removes them after hlsExpire.
+func stopHLS(sim string, channel int) {
+	hlsStreamsMu.Lock()
+	stream, exists := hlsStreams[streamKey(sim, channel)]
+	hlsStreamsMu.Unlock()
+	if !exists {
+		return
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.refs--; stream.refs > 0 || stream.media == nil {
+		return
+	}
+	media := stream.media
+	stream.media = nil
+	unsubscribeMedia(media)
+	stream.expireTimer = time.AfterFunc(hlsExpire, stream.expire)
+}
+
+// expire removes the playlists and segments of a stopped stream.
+func (s *hlsStream) expire() {
+	hlsStreamsMu.Lock()
+	defer hlsStreamsMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.media != nil {
+		return
+	}
+	delete(hlsStreams, streamKey(s.SIM, s.Channel))
+	os.RemoveAll(s.dir)
+	log.Printf("[HLS] Expired %s channel %d", s.SIM, s.Channel)
+}
+
+// run muxes the packets of one subscription. The first segment after a
+// resume is marked as a discontinuity since timestamps restart.
+func (s *hlsStream) run(media *mediaSubscriber, discontinuity bool) {
+	muxer := newTSMuxer()
+	var clock mediaClock
+	var segment bytes.Buffer
+	started := false
+	var segmentStart, last uint32
+
+	for packet := range media.Packets {
+		if !started {
+			if !packet.Video || !packet.KeyFrame || !packet.hasParameterSets() {
+				continue
+			}
+			started = true
+			muxer.hevc = packet.HEVC
+			muxer.aac = packet.AACConfig != nil
+			clock.start(packet.Timestamp)
+			muxer.writeTables(&segment)
+		}
+
+		t := clock.at(packet.Timestamp)
+		if packet.Video && packet.KeyFrame && time.Duration(t-segmentStart)*time.Millisecond >= hlsSegmentDuration {
+			s.addSegment(segment.Bytes(), float64(t-segmentStart)/1000, discontinuity)
+			discontinuity = false
+			segment.Reset()
+			segmentStart = t
+			muxer.writeTables(&segment)
+		}
+
+		pts := uint64(t)*90 + tsPTSOffset
+		switch {
+		case packet.Video:
+			muxer.writeVideo(&segment, packet, pts)
+		case muxer.aac:
+			if len(packet.AAC) > 0 {
+				muxer.writeAudio(&segment, packet.AAC, pts)
+			}
+		case len(packet.Audio) > 0:
+			muxer.writeAudio(&segment, packet.Audio, pts)
+		}
+		if t > last {
+			last = t
+		}
+	}
+
+	if started && last > segmentStart {
+		s.addSegment(segment.Bytes(), float64(last-segmentStart)/1000, discontinuity)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.media == media {
+		// Fell behind the stream: pick it up again from the next key frame
+		s.media = subscribeMedia(s.SIM, s.Channel, "", false)
+		go s.run(s.media, true)
+		return
+	}
+	if s.media == nil {
+		s.ended = true
+	}
+}
+
+// addSegment writes a finished segment and lists it in the playlists.
+func (s *hlsStream) addSegment(data []byte, duration float64, discontinuity bool) {
+	s.mu.Lock()
+	seq := s.nextSeq
+	s.nextSeq++
+	s.mu.Unlock()
+
+	if err := os.WriteFile(filepath.Join(s.dir, fmt.Sprintf("seg-%d.ts", seq)), data, 0644); err != nil {
+		log.Printf("[HLS] Cannot write segment %d of %s channel %d: %v", seq, s.SIM, s.Channel, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.segments = append(s.segments, hlsSegment{Sequence: seq, Duration: duration, Discontinuity: discontinuity})
+	s.mu.Unlock()
+}
+
+// playlist renders index.m3u8 (event false) or event.m3u8 (event true).
+func (s *hlsStream) playlist(event bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := s.segments
+	discontinuities := 0
+	if !event && len(segments) > hlsWindow {
+		for _, segment := range segments[:len(segments)-hlsWindow+1] {
+			if segment.Discontinuity {
+				discontinuities++
+			}
+		}
+		segments = segments[len(segments)-hlsWindow:]
+	}
+	if len(segments) == 0 {
+		return "", false
+	}
+
+	target := 1.0
+	for _, segment := range segments {
+		target = math.Max(target, math.Ceil(segment.Duration))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Sequence)
+	if discontinuities > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuities)
+	}
+	if event {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	for i, segment := range segments {
+		if segment.Discontinuity && i > 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg-%d.ts\n", segment.Duration, segment.Sequence)
+	}
+	if s.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String(), true
+}
+
+// hlsHandler serves /hls/{sim}/{channel}/index.m3u8 (live window),
+// /hls/{sim}/{channel}/event.m3u8 (whole stream) and their segments.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	channel, err := strconv.Atoi(r.PathValue("channel"))
+	if err != nil {
+		http.Error(w, "channel must be a number", http.StatusBadRequest)
+		return
+	}
+	hlsStreamsMu.Lock()
+	stream, exists := hlsStreams[streamKey(r.PathValue("sim"), channel)]
+	hlsStreamsMu.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := r.PathValue("file")
+	switch {
+	case file == "index.m3u8" || file == "event.m3u8":
+		playlist, ok := stream.playlist(file == "event.m3u8")
+		if !ok {
+			http.Error(w, "No segment yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, playlist)
+	case strings.HasPrefix(file, "seg-") && strings.HasSuffix(file, ".ts"):
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, filepath.Join(stream.dir, filepath.Base(file)))
+	default:
+		http.NotFound(w, r)
+	}
+}
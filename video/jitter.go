@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reorderLateReset is how many late packets in a row are taken as the device
+// restarting its sequence numbers below the current ones.
+const reorderLateReset = 16
+
+var (
+	// Reordering: packets held while a sequence number is missing (0 = no
+	// reordering, gaps are skipped at once) and how long it is waited for
+	jitterDepth = 32
+	jitterDelay = 100 * time.Millisecond
+
+	// Reorder buffers of device streams, keyed by activeStreamKey
+	reorderMu      sync.Mutex
+	reorderBuffers = make(map[string]*reorderBuffer)
+)
+
+// StreamStats is what GET /streams/stats reports of a device stream.
+type StreamStats struct {
+	SIM              string  `json:"device_phone"`
+	Channel          int     `json:"channel"`
+	Playback         bool    `json:"playback"`
+	Received         uint64  `json:"received"`       // packets passed on in order
+	Lost             uint64  `json:"lost"`           // sequence numbers skipped
+	LossRate         float64 `json:"loss_rate"`      // lost / (received + lost)
+	Late             uint64  `json:"late"`           // dropped: already passed on or skipped
+	Reordered        uint64  `json:"reordered"`      // arrived after later packets, in time
+	Restarts         uint64  `json:"restarts"`       // sequence number jumps taken as restarts
+	FramesDropped    uint64  `json:"frames_dropped"` // video frames missing packets
+	FramesSkipped    uint64  `json:"frames_skipped"` // complete frames dropped waiting for an I-frame
+	Jitter           float64 `json:"jitter_ms"`      // RFC 3550 interarrival jitter
+	Buffered         int     `json:"buffered"`       // packets waiting for a missing one
+	AwaitingKeyFrame bool    `json:"awaiting_key_frame"`
+}
+
+// reorderBuffer puts the packets of one device stream back in the order of
+// their 16-bit JT1078 sequence numbers. Packets after a missing number are
+// held until it arrives, jitterDepth packets are waiting or the oldest has
+// waited jitterDelay, which is checked as packets arrive and by
+// reorderSweepRoutine; the gap is then skipped and video waits for the next
+// I-frame.
+type reorderBuffer struct {
+	// Held while released packets are processed, so those released by the
+	// sweep and by arriving packets are processed in order; taken before
+	// reorderMu
+	processMu sync.Mutex
+
+	stats StreamStats
+
+	started     bool
+	next        uint16 // sequence number passed on next
+	pending     map[uint16]*JT1078Frame
+	lateRun     int
+	gaps        uint64   // gaps skipped, for frames assembled across one
+	transit     [2]int64 // last arrival minus JT1078 timestamp (ms) of video and audio
+	hasTransit  [2]bool
+	awaitingKey bool
+
+	// Received and lost when the loss was last reported to the proxy
+	reportedReceived uint64
+	reportedLost     uint64
+}
+
+// reorderFrame adds a packet to its stream's buffer and processes the
+// packets that are now in sequence order.
+func reorderFrame(frame *JT1078Frame) {
+	reorderMu.Lock()
+	key := activeStreamKey(frame.SIM, frame.Channel, frame.Playback)
+	b, exists := reorderBuffers[key]
+	if !exists {
+		b = &reorderBuffer{
+			stats:   StreamStats{SIM: frame.SIM, Channel: frame.Channel, Playback: frame.Playback},
+			pending: make(map[uint16]*JT1078Frame),
+		}
+		reorderBuffers[key] = b
+	}
+	reorderMu.Unlock()
+
+	b.process(func() []*JT1078Frame { return b.addLocked(frame) })
+}
+
+// process calls release under reorderMu and processes the packets it
+// returns, in order with the packets released by other goroutines.
+func (b *reorderBuffer) process(release func() []*JT1078Frame) {
+	b.processMu.Lock()
+	defer b.processMu.Unlock()
+	reorderMu.Lock()
+	frames := release()
+	reorderMu.Unlock()
+	for _, frame := range frames {
+		processDeviceFrame(frame)
+	}
+}
+
+// addLocked holds a packet and returns the packets it releases.
+func (b *reorderBuffer) addLocked(frame *JT1078Frame) []*JT1078Frame {
+	b.measureJitterLocked(frame)
+
+	seq := frame.SequenceNum
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+	// The uint16 differences handle wraparound
+	ahead := seq - b.next
+	late := ahead >= 0x8000 && b.next-seq <= seqResetGap
+	var out []*JT1078Frame
+	switch {
+	case late && b.lateRun < reorderLateReset:
+		b.lateRun++
+		b.stats.Late++
+		return nil
+	case late || ahead > seqResetGap:
+		// The device restarted its stream: pass on what is held and start over
+		out = b.flushLocked()
+		b.next = seq
+		b.hasTransit = [2]bool{}
+		b.stats.Restarts++
+	case ahead == 0 && len(b.pending) > 0:
+		b.stats.Reordered++
+	}
+	b.lateRun = 0
+
+	if _, exists := b.pending[seq]; exists {
+		b.stats.Late++
+		return out
+	}
+	b.pending[seq] = frame
+	out = append(out, b.drainLocked()...)
+	for len(b.pending) > jitterDepth {
+		out = append(out, b.skipLocked()...)
+	}
+	return append(out, b.expireLocked()...)
+}
+
+// expireLocked gives up on missing packets while the oldest packet held
+// has waited jitterDelay.
+func (b *reorderBuffer) expireLocked() []*JT1078Frame {
+	var out []*JT1078Frame
+	for len(b.pending) > 0 && time.Since(b.oldestLocked()) >= jitterDelay {
+		out = append(out, b.skipLocked()...)
+	}
+	return out
+}
+
+// flushLocked passes on every packet held, skipping the gaps between them.
+func (b *reorderBuffer) flushLocked() []*JT1078Frame {
+	var out []*JT1078Frame
+	for len(b.pending) > 0 {
+		out = append(out, b.skipLocked()...)
+	}
+	return out
+}
+
+// reorderSweepRoutine gives up on missing packets of streams that hold
+// packets past jitterDelay, so a stream that goes quiet after a loss still
+// has its held packets processed.
+func reorderSweepRoutine() {
+	ticker := time.NewTicker(jitterDelay / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		reorderMu.Lock()
+		var expired []*reorderBuffer
+		for _, b := range reorderBuffers {
+			if len(b.pending) > 0 && time.Since(b.oldestLocked()) >= jitterDelay {
+				expired = append(expired, b)
+			}
+		}
+		reorderMu.Unlock()
+
+		for _, b := range expired {
+			b.process(b.expireLocked)
+		}
+	}
+}
+
+// drainLocked passes on the packets held from the next sequence number on.
+func (b *reorderBuffer) drainLocked() []*JT1078Frame {
+	var out []*JT1078Frame
+	for {
+		frame, exists := b.pending[b.next]
+		if !exists {
+			return out
+		}
+		delete(b.pending, b.next)
+		b.next++
+		b.stats.Received++
+		out = append(out, frame)
+	}
+}
+
+// skipLocked gives up on the missing packets before the earliest one held.
+func (b *reorderBuffer) skipLocked() []*JT1078Frame {
+	gap := uint16(math.MaxUint16)
+	for seq := range b.pending {
+		gap = min16(gap, seq-b.next)
+	}
+	b.next += gap
+	b.stats.Lost += uint64(gap)
+	b.gaps++
+	if !b.awaitingKey && debugReceive {
+		log.Printf("[JITTER] %s channel %d lost %d packets, waiting for an I-frame",
+			b.stats.SIM, b.stats.Channel, gap)
+	}
+	b.awaitingKey = true
+	return b.drainLocked()
+}
+
+func (b *reorderBuffer) oldestLocked() time.Time {
+	var oldest time.Time
+	for _, frame := range b.pending {
+		if oldest.IsZero() || frame.Timestamp.Before(oldest) {
+			oldest = frame.Timestamp
+		}
+	}
+	return oldest
+}
+
+// measureJitterLocked updates the RFC 3550 jitter estimate from a packet's
+// arrival time and JT1078 timestamp, comparing video with video and audio
+// with audio.
+func (b *reorderBuffer) measureJitterLocked(frame *JT1078Frame) {
+	kind := 0
+	switch frame.DataType {
+	case 0, 1, 2:
+	case 3:
+		kind = 1
+	default:
+		return // transparent data has no timestamp
+	}
+	transit := frame.Timestamp.UnixMilli() - int64(frame.JT1078Timestamp)
+	if b.hasTransit[kind] {
+		d := math.Abs(float64(transit - b.transit[kind]))
+		b.stats.Jitter += (d - b.stats.Jitter) / 16
+	}
+	b.transit[kind] = transit
+	b.hasTransit[kind] = true
+}
+
+func min16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// streamGaps returns how many gaps a stream has skipped, so a frame can be
+// checked for a gap while it was being assembled.
+func streamGaps(sim string, channel int, playback bool) uint64 {
+	reorderMu.Lock()
+	defer reorderMu.Unlock()
+	if b, exists := reorderBuffers[activeStreamKey(sim, channel, playback)]; exists {
+		return b.gaps
+	}
+	return 0
+}
+
+// countDroppedFrame accounts for a video frame dropped as incomplete.
+func countDroppedFrame(sim string, channel int, playback bool) {
+	reorderMu.Lock()
+	defer reorderMu.Unlock()
+	if b, exists := reorderBuffers[activeStreamKey(sim, channel, playback)]; exists {
+		b.stats.FramesDropped++
+	}
+}
+
+// admitVideoFrame reports whether a complete video frame can be decoded:
+// after a loss only an I-frame can, and it ends the wait.
+func admitVideoFrame(videoFrame *VideoFrame) bool {
+	reorderMu.Lock()
+	defer reorderMu.Unlock()
+	b, exists := reorderBuffers[activeStreamKey(videoFrame.SIM, videoFrame.Channel, videoFrame.Playback)]
+	if !exists || !b.awaitingKey {
+		return true
+	}
+	if videoFrame.FrameType != 0 {
+		b.stats.FramesSkipped++
+		return false
+	}
+	b.awaitingKey = false
+	return true
+}
+
+// forgetReorder processes the packets still held for a stream whose
+// connection closed and drops its buffer.
+func forgetReorder(sim string, channel int, playback bool) {
+	key := activeStreamKey(sim, channel, playback)
+	reorderMu.Lock()
+	b, exists := reorderBuffers[key]
+	reorderMu.Unlock()
+	if !exists {
+		return
+	}
+
+	b.process(b.flushLocked)
+	reorderMu.Lock()
+	if reorderBuffers[key] == b {
+		delete(reorderBuffers, key)
+	}
+	reorderMu.Unlock()
+}
+
+// streamStatsHandler reports loss, reordering and jitter of the device
+// streams: GET /streams/stats[?device_phone=...[&channel=N]].
+func streamStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	sub, err := parseSubscription(r)
+	if err != nil {
+		http.Error(w, "channel must be a number", http.StatusBadRequest)
+		return
+	}
+
+	reorderMu.Lock()
+	stats := make([]StreamStats, 0, len(reorderBuffers))
+	for _, b := range reorderBuffers {
+		if !sub.Matches(b.stats.SIM, b.stats.Channel) {
+			continue
+		}
+		s := b.stats
+		if total := s.Received + s.Lost; total > 0 {
+			s.LossRate = float64(s.Lost) / float64(total)
+		}
+		s.Buffered = len(b.pending)
+		s.AwaitingKeyFrame = b.awaitingKey
+		stats = append(stats, s)
+	}
+	reorderMu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SIM != stats[j].SIM {
+			return stats[i].SIM < stats[j].SIM
+		}
+		if stats[i].Channel != stats[j].Channel {
+			return stats[i].Channel < stats[j].Channel
+		}
+		return !stats[i].Playback && stats[j].Playback
+	})
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reorderPacket is a packet arriving at a reorder buffer, age ago.
+type reorderPacket struct {
+	seq uint16
+	age time.Duration
+}
+
+// packets are packets arriving now with the given sequence numbers.
+func packets(seqs ...uint16) []reorderPacket {
+	out := make([]reorderPacket, len(seqs))
+	for i, seq := range seqs {
+		out[i] = reorderPacket{seq: seq}
+	}
+	return out
+}
+
+func TestReorderBufferAdd(t *testing.T) {
+	defer func(depth int) { jitterDepth = depth }(jitterDepth)
+	jitterDepth = 4
+
+	lateRun := make([]uint16, reorderLateReset+1)
+	for i := range lateRun {
+		lateRun[i] = uint16(100 + i)
+	}
+
+	tests := []struct {
+		name     string
+		in       []reorderPacket
+		out      []uint16
+		buffered int
+		lost     uint64
+		late     uint64
+		reorder  uint64
+		restarts uint64
+	}{
+		{
+			name: "in order",
+			in:   packets(7, 8, 9),
+			out:  []uint16{7, 8, 9},
+		},
+		{
+			name: "in order across 0xFFFF",
+			in:   packets(0xFFFE, 0xFFFF, 0, 1),
+			out:  []uint16{0xFFFE, 0xFFFF, 0, 1},
+		},
+		{
+			name:    "reordered across 0xFFFF",
+			in:      packets(0xFFFE, 0, 0xFFFF, 1),
+			out:     []uint16{0xFFFE, 0xFFFF, 0, 1},
+			reorder: 1,
+		},
+		{
+			name:     "gap held",
+			in:       packets(0xFFFF, 1, 2),
+			out:      []uint16{0xFFFF},
+			buffered: 2,
+		},
+		{
+			name: "late and duplicate packets dropped",
+			in:   packets(10, 11, 12, 11, 12, 2, 9),
+			out:  []uint16{10, 11, 12},
+			late: 4,
+		},
+		{
+			name:     "duplicate of a held packet dropped",
+			in:       packets(10, 12, 12),
+			out:      []uint16{10},
+			buffered: 1,
+			late:     1,
+		},
+		{
+			name:     "forward jump restarts",
+			in:       packets(100, 101, 103, 100+seqResetGap+3, 100+seqResetGap+4),
+			out:      []uint16{100, 101, 103, 100 + seqResetGap + 3, 100 + seqResetGap + 4},
+			lost:     1,
+			restarts: 1,
+		},
+		{
+			name:     "jump back beyond the reset gap restarts",
+			in:       packets(0x8000, 0x8001, 0x10),
+			out:      []uint16{0x8000, 0x8001, 0x10},
+			restarts: 1,
+		},
+		{
+			name:     "run of late packets restarts",
+			in:       append(packets(500, 501), packets(lateRun...)...),
+			out:      []uint16{500, 501, lateRun[reorderLateReset]},
+			late:     reorderLateReset,
+			restarts: 1,
+		},
+		{
+			name: "depth overflow skips the gap",
+			in:   packets(1, 3, 4, 5, 6, 7),
+			out:  []uint16{1, 3, 4, 5, 6, 7},
+			lost: 1,
+		},
+		{
+			name:     "depth overflow across 0xFFFF",
+			in:       packets(0xFFFC, 0xFFFF, 0, 1, 3, 4),
+			out:      []uint16{0xFFFC, 0xFFFF, 0, 1},
+			buffered: 2,
+			lost:     2,
+		},
+		{
+			name: "missing packet waited for too long",
+			in:   []reorderPacket{{seq: 1}, {seq: 3, age: 2 * jitterDelay}, {seq: 4}},
+			out:  []uint16{1, 3, 4},
+			lost: 1,
+		},
+		{
+			name:    "missing packet arrives in time",
+			in:      []reorderPacket{{seq: 1}, {seq: 3, age: jitterDelay / 2}, {seq: 2}},
+			out:     []uint16{1, 2, 3},
+			reorder: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &reorderBuffer{pending: make(map[uint16]*JT1078Frame)}
+			out := make([]uint16, 0)
+			for _, packet := range tt.in {
+				frame := &JT1078Frame{SequenceNum: packet.seq, DataType: 4, Timestamp: time.Now().Add(-packet.age)}
+				for _, released := range b.addLocked(frame) {
+					out = append(out, released.SequenceNum)
+				}
+			}
+			if !reflect.DeepEqual(out, tt.out) {
+				t.Errorf("released %v, want %v", out, tt.out)
+			}
+			if len(b.pending) != tt.buffered {
+				t.Errorf("%d packets held, want %d", len(b.pending), tt.buffered)
+			}
+			s := b.stats
+			if s.Received != uint64(len(tt.out)) || s.Lost != tt.lost || s.Late != tt.late ||
+				s.Reordered != tt.reorder || s.Restarts != tt.restarts {
+				t.Errorf("received %d, lost %d, late %d, reordered %d, restarts %d; want %d, %d, %d, %d, %d",
+					s.Received, s.Lost, s.Late, s.Reordered, s.Restarts,
+					len(tt.out), tt.lost, tt.late, tt.reorder, tt.restarts)
+			}
+			if b.awaitingKey != (tt.lost > 0) {
+				t.Errorf("awaiting key frame %v after losing %d", b.awaitingKey, tt.lost)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"jt1078/proxyapi"
+)
+
+// seqResetGap is a forward jump in sequence numbers treated as the device
+// restarting its stream rather than as thousands of lost packets.
+const seqResetGap = 3000
+
+// How often loss rates are reported to the proxy (0 disables reporting)
+var lossReportInterval time.Duration
+
+func streamKey(sim string, channel int) string {
+	return fmt.Sprintf("%s_%d", sim, channel)
+}
+
+// lossReportRoutine periodically sends each live stream's loss rate over the
+// last window, as counted by its reorder buffer, to the proxy, which forwards
+// it to the device as 0x9105.
+func lossReportRoutine() {
+	ticker := time.NewTicker(lossReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		type report struct {
+			sim                string
+			channel            int
+			expected, received uint64
+		}
+		var reports []report
+
+		reorderMu.Lock()
+		for _, b := range reorderBuffers {
+			if b.stats.Playback {
+				continue
+			}
+			received := b.stats.Received - b.reportedReceived
+			lost := b.stats.Lost - b.reportedLost
+			if received+lost == 0 {
+				continue
+			}
+			reports = append(reports, report{b.stats.SIM, b.stats.Channel, received + lost, received})
+			b.reportedReceived, b.reportedLost = b.stats.Received, b.stats.Lost
+		}
+		reorderMu.Unlock()
+
+		for _, r := range reports {
+			rate := float64(r.expected-r.received) / float64(r.expected)
+			if debugReceive {
+				log.Printf("[LOSS] %s channel %d: %d/%d packets received (%.1f%% loss)",
+					r.sim, r.channel, r.received, r.expected, rate*100)
+			}
+			notifyPacketLoss(r.sim, r.channel, rate, r.expected, r.received)
+		}
+	}
+}
+
+// notifyPacketLoss reports a stream's loss rate to the proxy API.
+func notifyPacketLoss(sim string, channel int, rate float64, expected, received uint64) {
+	err := proxyapi.Post("/api/v1/jt808/media/loss", map[string]interface{}{
+		"device_phone": sim,
+		"channel":      channel,
+		"loss_rate":    rate,
+		"expected":     expected,
+		"received":     received,
+	})
+	if err != nil {
+		log.Printf("Error reporting packet loss for %s channel %d: %v", sim, channel, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -11,10 +12,14 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"jt1078/audio"
+	"jt1078/proxyapi"
 )
 
 var (
@@ -35,18 +40,24 @@ var (
 	// API proxy configuration
 	apiBaseURL = "https://ivan-proxy.armaddia.lat"
 
+	// TCP ports devices stream to: live video (0x9101) and remote playback (0x9201)
+	livePort     int
+	playbackPort int
+
 	// Video frame reassembly - CRITICAL FIX: Use timestamp-based grouping
 	videoFramesMu sync.RWMutex
 	videoFrames   = make(map[string]*VideoFrameAssembler) // key: channel_timestamp
 
-	// SPS/PPS storage for H.264
+	// SPS/PPS (and H.265 VPS) storage
 	spsPpsStoreMu sync.RWMutex
-	spsPpsStore   = make(map[int]*SPSPPSData) // channel -> SPS/PPS data
+	spsPpsStore   = make(map[string]*SPSPPSData) // parameterSetKey -> SPS/PPS data
 )
 
 type SPSPPSData struct {
-	SPS []byte
-	PPS []byte
+	HEVC bool
+	VPS  []byte // H.265 only
+	SPS  []byte
+	PPS  []byte
 }
 
 type ClientInfo struct {
@@ -54,8 +65,30 @@ type ClientInfo struct {
 	ConnectedAt  time.Time
 	FramesSent   int64
 	LastActivity time.Time
-	ClientType   string // "receiver", "transmitter", "video"
+	ClientType   string // "receiver", "transmitter", "video", "playback"
 	WriteMutex   sync.Mutex
+
+	// Video and playback viewers only receive the streams they subscribed to
+	Subscription Subscription
+
+	// Time of the last frame sent from the GOP cache, per streamKey
+	primed map[string]time.Time
+}
+
+// wantsVideo reports whether a viewer receives frames of a SIM/channel
+// stream; callers hold clientsMu.
+func (info *ClientInfo) wantsVideo(sim string, channel int, playback bool) bool {
+	if playback {
+		return info.ClientType == "playback" && info.Subscription.Matches(sim, channel)
+	}
+	return info.ClientType == "video" && info.Subscription.Matches(sim, channel)
+}
+
+// alreadySent reports whether a live frame was sent to a viewer from the
+// GOP cache; callers hold clientsMu.
+func (info *ClientInfo) alreadySent(videoFrame *VideoFrame) bool {
+	primed, exists := info.primed[streamKey(videoFrame.SIM, videoFrame.Channel)]
+	return exists && !videoFrame.Playback && !videoFrame.Timestamp.After(primed)
 }
 
 type AudioFrame struct {
@@ -65,6 +98,8 @@ type AudioFrame struct {
 }
 
 type VideoFrameAssembler struct {
+	SIM             string
+	Playback        bool
 	Channel         int
 	SequenceNum     uint16
 	FrameType       int        // 0=I-frame, 1=P-frame, 2=B-frame
@@ -74,6 +109,8 @@ type VideoFrameAssembler struct {
 	LastUpdate      time.Time
 	IsComplete      bool
 	JT1078Timestamp uint64 // JT1078 timestamp for grouping fragments
+	HEVC            bool   // payload type 99 (H.265)
+	Gaps            uint64 // streamGaps when the first fragment arrived
 }
 
 type Fragment struct {
@@ -83,11 +120,16 @@ type Fragment struct {
 }
 
 type VideoFrame struct {
+	SIM         string
 	Channel     int
 	SequenceNum uint16
 	FrameType   int
 	Data        []byte
 	Timestamp   time.Time
+	Playback    bool
+	HEVC        bool
+
+	JT1078Timestamp uint64
 }
 
 type FrameBuffer struct {
@@ -159,13 +201,19 @@ func DecodeG711ALaw(data []byte) []byte {
 	return pcm
 }
 
-// Extract SPS/PPS from payload (proven algorithm from stream-capture)
-func extractSPSPPS(payload []byte, channel int) {
+// parameterSetKey identifies the stream whose SPS/PPS are stored, so a
+// recording played back does not replace the live stream's parameter sets.
+func parameterSetKey(sim string, channel int, playback bool) string {
+	return fmt.Sprintf("%s_%d_%v", sim, channel, playback)
+}
+
+// Extract SPS/PPS (and the VPS of H.265) from payload (proven algorithm from stream-capture)
+func extractSPSPPS(payload []byte, channel int, key string, hevc bool) {
 	spsPpsStoreMu.Lock()
 	defer spsPpsStoreMu.Unlock()
 
-	if _, exists := spsPpsStore[channel]; !exists {
-		spsPpsStore[channel] = &SPSPPSData{}
+	if stored, exists := spsPpsStore[key]; !exists || stored.HEVC != hevc {
+		spsPpsStore[key] = &SPSPPSData{HEVC: hevc}
 	}
 
 	for i := 0; i < len(payload)-4; {
@@ -184,10 +232,10 @@ func extractSPSPPS(payload []byte, channel int) {
 		if nalStart >= len(payload) {
 			break
 		}
-		nalType := payload[nalStart] & 0x1F
+		nalType := nalUnitType(payload[nalStart], hevc)
 
-		// If it's SPS or PPS, find its end and store it
-		if nalType == 7 || nalType == 8 {
+		// If it's a parameter set, find its end and store it
+		if isVPS(nalType, hevc) || isSPS(nalType, hevc) || isPPS(nalType, hevc) {
 			nalEnd := len(payload)
 			for j := nalStart + 1; j < len(payload)-4; j++ {
 				if payload[j] == 0 && payload[j+1] == 0 && (payload[j+2] == 1 || (payload[j+2] == 0 && payload[j+3] == 1)) {
@@ -197,13 +245,18 @@ func extractSPSPPS(payload []byte, channel int) {
 			}
 			// Re-add the 4-byte start code for the file
 			nalData := append([]byte{0x00, 0x00, 0x00, 0x01}, payload[nalStart:nalEnd]...)
-			if nalType == 7 {
-				spsPpsStore[channel].SPS = nalData
+			if isVPS(nalType, hevc) {
+				spsPpsStore[key].VPS = nalData
+				if debugReceive {
+					fmt.Printf("📍 Found VPS for channel %d (length: %d bytes)\n", channel, len(nalData))
+				}
+			} else if isSPS(nalType, hevc) {
+				spsPpsStore[key].SPS = nalData
 				if debugReceive {
 					fmt.Printf("📍 Found SPS for channel %d (length: %d bytes)\n", channel, len(nalData))
 				}
 			} else {
-				spsPpsStore[channel].PPS = nalData
+				spsPpsStore[key].PPS = nalData
 				if debugReceive {
 					fmt.Printf("📍 Found PPS for channel %d (length: %d bytes)\n", channel, len(nalData))
 				}
@@ -446,6 +499,69 @@ func apiProxyCallControlShort(w http.ResponseWriter, r *http.Request) {
 	log.Printf("API Proxy: Call control response forwarded successfully")
 }
 
+// apiProxyPost forwards a JSON POST from the web page to the proxy API.
+func apiProxyPost(path, label string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading %s request: %v", label, err)
+			http.Error(w, "Error reading request", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("API Proxy: %s with payload: %s", label, string(body))
+
+		resp, err := http.Post(apiBaseURL+path, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			log.Printf("Error forwarding %s: %v", label, err)
+			http.Error(w, fmt.Sprintf("Error forwarding %s: %v", label, err), http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("Error reading %s response: %v", label, err)
+			http.Error(w, fmt.Sprintf("Error reading response: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		w.Write(responseBody)
+		log.Printf("API Proxy: %s response forwarded successfully", label)
+	}
+}
+
+// notifyMediaStream tells the proxy API that a device stream started or stopped
+// so call and session state follow the media actually reaching this server.
+func notifyMediaStream(sim string, channel, dataType int, event string, playback bool) {
+	err := proxyapi.Post("/api/v1/jt808/media/stream", map[string]interface{}{
+		"device_phone": sim,
+		"channel":      channel,
+		"data_type":    dataType,
+		"event":        event,
+		"playback":     playback,
+	})
+	if err != nil {
+		log.Printf("Error reporting stream %s for %s channel %d: %v", event, sim, channel, err)
+	}
+}
+
 func decodeBCD(data []byte) string {
 	result := ""
 	for _, b := range data {
@@ -492,17 +608,19 @@ func (fb *FrameBuffer) GetFrames() []*AudioFrame {
 	return frames
 }
 
-func addClient(conn *websocket.Conn, remoteAddr string, clientType string) {
+func addClient(conn *websocket.Conn, remoteAddr string, clientType string) *ClientInfo {
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
-	clients[conn] = &ClientInfo{
+	info := &ClientInfo{
 		RemoteAddr:   remoteAddr,
 		ConnectedAt:  time.Now(),
 		LastActivity: time.Now(),
 		ClientType:   clientType,
 		WriteMutex:   sync.Mutex{},
 	}
+	clients[conn] = info
 	log.Printf("%s client connected: %s", clientType, remoteAddr)
+	return info
 }
 
 func removeClient(conn *websocket.Conn) {
@@ -514,20 +632,86 @@ func removeClient(conn *websocket.Conn) {
 	}
 }
 
-// WebSocket handler for video reception
+// WebSocket handler for live video: /video?device_phone=...&channel=N
+// receives only that SIM/channel stream (all channels of the SIM without
+// channel, every live stream without device_phone). Viewers may switch
+// streams by sending {"device_phone":"...","channel":N} as a text message.
 func videoHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil {
+		http.Error(w, "channel must be a number", http.StatusBadRequest)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Video WebSocket upgrade error: %v", err)
 		return
 	}
 
-	addClient(conn, r.RemoteAddr, "video")
+	info := addClient(conn, r.RemoteAddr, "video")
+	defer func() {
+		conn.Close()
+		removeClient(conn)
+	}()
+
+	log.Printf("Video viewer %s subscribed to %s", r.RemoteAddr, describeSubscription(sub))
+	subscribeVideoViewer(conn, info, sub, true)
+	serveViewer(conn, func(message []byte) {
+		var next Subscription
+		if err := json.Unmarshal(message, &next); err != nil {
+			log.Printf("Ignoring invalid subscription from %s: %v", r.RemoteAddr, err)
+			return
+		}
+		log.Printf("Video viewer %s subscribed to %s", r.RemoteAddr, describeSubscription(next))
+		subscribeVideoViewer(conn, info, next, false)
+	})
+}
+
+func describeSubscription(sub Subscription) string {
+	switch {
+	case sub.SIM == "":
+		return "all live streams"
+	case sub.Channel == 0:
+		return fmt.Sprintf("%s all channels", sub.SIM)
+	default:
+		return fmt.Sprintf("%s channel %d", sub.SIM, sub.Channel)
+	}
+}
+
+// WebSocket handler for remote playback: /playback?device_phone=...&channel=N
+// receives only the recording streamed by that device channel.
+func playbackHandler(w http.ResponseWriter, r *http.Request) {
+	sim := r.URL.Query().Get("device_phone")
+	channel, err := strconv.Atoi(r.URL.Query().Get("channel"))
+	if sim == "" || err != nil {
+		http.Error(w, "device_phone and channel are required", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Playback WebSocket upgrade error: %v", err)
+		return
+	}
+
+	info := addClient(conn, r.RemoteAddr, "playback")
+	clientsMu.Lock()
+	info.Subscription = Subscription{SIM: sim, Channel: channel}
+	clientsMu.Unlock()
 	defer func() {
 		conn.Close()
 		removeClient(conn)
 	}()
 
+	log.Printf("Playback viewer %s watching %s channel %d", r.RemoteAddr, sim, channel)
+	serveViewer(conn, nil)
+}
+
+// serveViewer keeps a viewer WebSocket alive until the client goes away,
+// passing text messages to onText when given.
+func serveViewer(conn *websocket.Conn, onText func([]byte)) {
+
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(appData string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -558,10 +742,13 @@ func videoHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	for {
-		_, _, err := conn.ReadMessage()
+		messageType, message, err := conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		if messageType == websocket.TextMessage && onText != nil {
+			onText(message)
+		}
 	}
 }
 
@@ -662,13 +849,15 @@ func broadcastFrames() {
 }
 
 // CRITICAL FIX: Broadcast video frames with SPS/PPS
+// Frames only go to the video or playback viewers subscribed to their
+// SIM/channel.
 func broadcastVideoFrame(videoFrame *VideoFrame) {
 	clientsMu.RLock()
 	var videoClients []*websocket.Conn
 	var clientInfos []*ClientInfo
 
 	for client, info := range clients {
-		if info.ClientType == "video" {
+		if info.wantsVideo(videoFrame.SIM, videoFrame.Channel, videoFrame.Playback) && !info.alreadySent(videoFrame) {
 			videoClients = append(videoClients, client)
 			clientInfos = append(clientInfos, info)
 		}
@@ -709,17 +898,18 @@ func broadcastVideoFrame(videoFrame *VideoFrame) {
 	}
 }
 
-// CRITICAL FIX: Include SPS/PPS with I-frames
+// CRITICAL FIX: Include SPS/PPS (and the H.265 VPS) with I-frames
 func createVideoMessageWithSPSPPS(videoFrame *VideoFrame) []byte {
 	frameData := videoFrame.Data
+	hevc := videoFrame.HEVC
 
 	// For I-frames, prepend SPS/PPS if available and not already present
 	if videoFrame.FrameType == 0 { // I-frame
 		spsPpsStoreMu.RLock()
-		spsPpsData, exists := spsPpsStore[videoFrame.Channel]
+		spsPpsData, exists := spsPpsStore[parameterSetKey(videoFrame.SIM, videoFrame.Channel, videoFrame.Playback)]
 		spsPpsStoreMu.RUnlock()
 
-		if exists && spsPpsData.SPS != nil && spsPpsData.PPS != nil {
+		if exists && spsPpsData.HEVC == hevc && spsPpsData.SPS != nil && spsPpsData.PPS != nil && (!hevc || spsPpsData.VPS != nil) {
 			// Check if frame already contains SPS/PPS
 			hasSPS := false
 			hasPPS := false
@@ -733,10 +923,10 @@ func createVideoMessageWithSPSPPS(videoFrame *VideoFrame) []byte {
 						nalStart = i + 4
 					}
 					if nalStart < len(frameData) {
-						nalType := frameData[nalStart] & 0x1F
-						if nalType == 7 {
+						nalType := nalUnitType(frameData[nalStart], hevc)
+						if isSPS(nalType, hevc) {
 							hasSPS = true
-						} else if nalType == 8 {
+						} else if isPPS(nalType, hevc) {
 							hasPPS = true
 						}
 					}
@@ -746,12 +936,17 @@ func createVideoMessageWithSPSPPS(videoFrame *VideoFrame) []byte {
 			// Prepend SPS/PPS if not present
 			if !hasSPS || !hasPPS {
 				// Add Access Unit Delimiter first
-				aud := []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0x10}
-				totalLen := len(aud) + len(spsPpsData.SPS) + len(spsPpsData.PPS) + len(frameData)
+				aud := h264AUD
+				if hevc {
+					aud = hevcAUD
+				}
+				totalLen := len(aud) + len(spsPpsData.VPS) + len(spsPpsData.SPS) + len(spsPpsData.PPS) + len(frameData)
 				newData := make([]byte, totalLen)
 				offset := 0
 				copy(newData[offset:], aud)
 				offset += len(aud)
+				copy(newData[offset:], spsPpsData.VPS)
+				offset += len(spsPpsData.VPS)
 				copy(newData[offset:], spsPpsData.SPS)
 				offset += len(spsPpsData.SPS)
 				copy(newData[offset:], spsPpsData.PPS)
@@ -858,6 +1053,8 @@ func transmitHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func forwardToDevices(frameData []byte) {
+	frameData = audio.TranscodeTalkback(frameData)
+
 	deviceConnsMu.RLock()
 	defer deviceConnsMu.RUnlock()
 
@@ -880,7 +1077,29 @@ func forwardToDevices(frameData []byte) {
 func main() {
 	flag.BoolVar(&debugSend, "ds", false, "Debug send: show details of frames being sent to devices")
 	flag.BoolVar(&debugReceive, "dr", false, "Debug receive: show details of frames received from devices")
+	flag.IntVar(&livePort, "port", 7800, "TCP port for live JT1078 streams")
+	flag.IntVar(&playbackPort, "playback-port", 7801, "TCP port for remote playback JT1078 streams")
+	flag.IntVar(&jitterDepth, "jitter-depth", jitterDepth, "Packets held while waiting for a missing sequence number before it is given up (0 = no reordering)")
+	flag.DurationVar(&jitterDelay, "jitter-delay", jitterDelay, "How long a missing packet is waited for before it is given up")
+	flag.DurationVar(&lossReportInterval, "loss-interval", 10*time.Second, "How often live packet loss is reported to the proxy for 0x9105 (0 = off)")
+	flag.StringVar(&hlsDir, "hls-dir", "hls", "Directory for HLS segments of live streams (empty = HLS off)")
+	flag.DurationVar(&hlsSegmentDuration, "hls-segment", 2*time.Second, "Target HLS segment duration; segments are cut on the next I-frame")
+	flag.IntVar(&hlsWindow, "hls-window", 6, "Segments in the live HLS playlist")
+	flag.DurationVar(&hlsExpire, "hls-expire", time.Minute, "How long HLS playlists stay available after a stream stops")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory for MP4 recordings of live streams (empty = recording off)")
+	flag.StringVar(&recordMode, "record", recordDemand, "What to record: always, alarm (while the proxy reports an alarm of the device) or demand (POST /record/{sim}/{channel})")
+	flag.DurationVar(&recordFileDuration, "record-file", 10*time.Minute, "Length of recorded files; a new file starts at the next I-frame")
+	flag.DurationVar(&recordMaxAge, "record-max-age", 7*24*time.Hour, "Recordings older than this are deleted (0 = keep)")
+	flag.Int64Var(&recordQuotaMB, "record-quota", 0, "Disk quota for recordings in MB; the oldest files are deleted beyond it (0 = none)")
+	flag.DurationVar(&recordPostAlarm, "record-post-alarm", 30*time.Second, "How long alarm recordings continue after the alarm cleared")
+	flag.DurationVar(&idleStopDelay, "idle-stop", 30*time.Second, "Stop a live session through the proxy once its stream has had no viewers for this long (0 = never)")
+	flag.IntVar(&gopCacheSize, "gop-cache", gopCacheSize, "Packets (video and audio frames) of the current GOP cached per live stream to start new viewers at once (0 = off)")
+	flag.IntVar(&rtspPort, "rtsp-port", 8554, "TCP port for RTSP playback of live streams (0 = off)")
+	flag.IntVar(&audio.G726Kbps, "g726-kbps", 0, "G.726 rate of device audio in kbit/s: 16, 24, 32 or 40 (0 = infer from the frame length)")
+	flag.BoolVar(&audio.G726AAL2, "g726-aal2", false, "G.726 code words are packed most significant first (AAL2) instead of as in RFC 3551")
+	flag.IntVar(&webrtcUDPPort, "webrtc-udp-port", 0, "UDP port shared by all WebRTC (WHEP) sessions (0 = an ephemeral port per session)")
 	flag.Parse()
+	proxyapi.BaseURL = apiBaseURL
 
 	if debugSend {
 		fmt.Println("🐛 DEBUG SEND MODE ENABLED - Will show details of outgoing frames")
@@ -890,19 +1109,70 @@ func main() {
 	}
 
 	go broadcastFrames()
-	go startTCPServer()
+	go startTCPServer(livePort, false)
+	go startTCPServer(playbackPort, true)
 	go cleanupVideoFrames()
+	if jitterDepth > 0 && jitterDelay > 0 {
+		go reorderSweepRoutine()
+	}
+	if lossReportInterval > 0 {
+		go lossReportRoutine()
+	}
+	if idleStopDelay > 0 {
+		go idleStopRoutine()
+	}
+	if rtspPort > 0 {
+		go startRTSPServer(rtspPort)
+	}
+	if recordDir != "" {
+		switch recordMode {
+		case recordAlways, recordDemand:
+		case recordAlarm:
+			go recordAlarmRoutine()
+		default:
+			log.Fatalf("Unknown -record %q: use always, alarm or demand", recordMode)
+		}
+		go recordRetentionRoutine()
+	}
 
 	// Audio WebSocket endpoints
 	http.HandleFunc("/ws", wsHandler)
 	http.HandleFunc("/transmit", transmitHandler)
 
-	// Video WebSocket endpoint
+	// Video WebSocket endpoints
 	http.HandleFunc("/video", videoHandler)
+	http.HandleFunc("/playback", playbackHandler)
+	http.HandleFunc("/streams", streamsHandler)
+	http.HandleFunc("GET /streams/stats", streamStatsHandler)
+
+	// Standard player outputs per SIM/channel
+	http.HandleFunc("/flv", flvHandler)
+	http.HandleFunc("/video/fmp4", fmp4Handler)
+	http.HandleFunc("GET /hls/{sim}/{channel}/{file}", hlsHandler)
+	http.HandleFunc("/whep/{sim}/{channel}", whepHandler)
+	http.HandleFunc("/whep/{sim}/{channel}/{id}", whepHandler)
+
+	// RTMP republishing of live streams
+	http.HandleFunc("/rtmp/push", rtmpPushHandler)
+	http.HandleFunc("/rtmp/push/{id}", rtmpPushHandler)
+
+	// MP4 recording of live streams
+	http.HandleFunc("/record", recordHandler)
+	http.HandleFunc("/record/{sim}/{channel}", recordHandler)
+	http.HandleFunc("GET /recordings", recordingsHandler)
+	http.HandleFunc("GET /recordings/{sim}/{channel}/{file}", recordingsHandler)
 
 	// Video API endpoints
 	http.HandleFunc("/api/video/start", apiProxyVideoStart)
 	http.HandleFunc("/api/video/control", apiProxyVideoControl)
+	http.HandleFunc("/api/playback/start", apiProxyPost("/api/v1/jt808/playback/start", "playback start"))
+	http.HandleFunc("/api/playback/control", apiProxyPost("/api/v1/jt808/playback/control", "playback control"))
+	http.HandleFunc("/api/ptz/rotate", apiProxyPost("/api/v1/jt808/ptz/rotate", "PTZ rotate"))
+	http.HandleFunc("/api/ptz/focus", apiProxyPost("/api/v1/jt808/ptz/focus", "PTZ focus"))
+	http.HandleFunc("/api/ptz/iris", apiProxyPost("/api/v1/jt808/ptz/iris", "PTZ iris"))
+	http.HandleFunc("/api/ptz/wiper", apiProxyPost("/api/v1/jt808/ptz/wiper", "PTZ wiper"))
+	http.HandleFunc("/api/ptz/infrared", apiProxyPost("/api/v1/jt808/ptz/infrared", "PTZ infrared"))
+	http.HandleFunc("/api/ptz/zoom", apiProxyPost("/api/v1/jt808/ptz/zoom", "PTZ zoom"))
 
 	// Audio API endpoints (existing)
 	http.HandleFunc("/api/devices", apiProxyDevicesShort)
@@ -918,6 +1188,7 @@ func main() {
 		receiverCount := 0
 		transmitterCount := 0
 		videoCount := 0
+		playbackCount := 0
 		for _, info := range clients {
 			switch info.ClientType {
 			case "receiver":
@@ -926,6 +1197,8 @@ func main() {
 				transmitterCount++
 			case "video":
 				videoCount++
+			case "playback":
+				playbackCount++
 			}
 		}
 		clientsMu.RUnlock()
@@ -934,34 +1207,54 @@ func main() {
 		deviceCount := len(deviceConns)
 		deviceConnsMu.RUnlock()
 
-		fmt.Fprintf(w, "OK - Audio Receivers: %d, Transmitters: %d, Video: %d, Devices: %d",
-			receiverCount, transmitterCount, videoCount, deviceCount)
+		fmt.Fprintf(w, "OK - Audio Receivers: %d, Transmitters: %d, Video: %d, Playback: %d, Devices: %d",
+			receiverCount, transmitterCount, videoCount, playbackCount, deviceCount)
 	})
 
 	fmt.Println("🚀 JT1078 Two-Way Audio + Video Streamer with API Proxy")
 	fmt.Println("📄 Web interface: http://localhost:8081")
-	fmt.Println("🔊 TCP audio/video port: 7800")
+	fmt.Printf("🔊 TCP audio/video port: %d\n", livePort)
+	fmt.Printf("⏪ TCP playback port: %d\n", playbackPort)
 	fmt.Println("📻 Audio Reception: ws://localhost:8081/ws")
 	fmt.Println("🎤 Audio Transmission: ws://localhost:8081/transmit")
-	fmt.Println("📺 Video Reception: ws://localhost:8081/video")
+	fmt.Println("📺 Video Reception: ws://localhost:8081/video?device_phone=...&channel=N")
+	fmt.Println("📋 Active streams: http://localhost:8081/streams")
+	fmt.Println("🎞️ HTTP-FLV / WS-FLV: http://localhost:8081/flv?device_phone=...&channel=N")
+	fmt.Println("🎞️ fMP4 for MSE: ws://localhost:8081/video/fmp4?device_phone=...&channel=N")
+	if hlsDir != "" {
+		fmt.Println("📼 HLS: http://localhost:8081/hls/{sim}/{channel}/index.m3u8 (event.m3u8 for the whole stream)")
+	}
+	fmt.Println("⚡ WebRTC (WHEP): POST http://localhost:8081/whep/{sim}/{channel}")
+	if rtspPort > 0 {
+		fmt.Printf("📡 RTSP: rtsp://localhost:%d/{sim}/{channel}\n", rtspPort)
+	}
+	fmt.Println("📤 RTMP push: GET/POST http://localhost:8081/rtmp/push, DELETE /rtmp/push/{id}")
+	if recordDir != "" {
+		fmt.Printf("💾 Recording (%s) to %s: POST/DELETE /record/{sim}/{channel}, GET /recordings?device_phone=...\n", recordMode, recordDir)
+	}
+	fmt.Println("⏪ Playback Reception: ws://localhost:8081/playback?device_phone=...&channel=N")
 	fmt.Println("🔗 API Proxy endpoints:")
 	fmt.Println("   • GET  /api/devices")
 	fmt.Println("   • POST /api/call/start")
 	fmt.Println("   • POST /api/call/control")
 	fmt.Println("   • POST /api/video/start")
 	fmt.Println("   • POST /api/video/control")
+	fmt.Println("   • POST /api/playback/start")
+	fmt.Println("   • POST /api/playback/control")
 
 	log.Fatal(http.ListenAndServe(":8081", nil))
 }
 
-func startTCPServer() {
-	ln, err := net.Listen("tcp", "0.0.0.0:7800")
+// startTCPServer accepts device streams. Streams on the playback port are
+// recordings requested with 0x9201 and only go to their playback viewers.
+func startTCPServer(port int, playback bool) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
 		log.Fatalf("TCP listen error: %v", err)
 	}
 	defer ln.Close()
 
-	log.Println("TCP server listening on 0.0.0.0:7800")
+	log.Printf("TCP server listening on 0.0.0.0:%d (playback: %v)", port, playback)
 
 	for {
 		conn, err := ln.Accept()
@@ -970,29 +1263,49 @@ func startTCPServer() {
 			continue
 		}
 
-		go handleTCPConnection(conn)
+		go handleTCPConnection(conn, playback)
 	}
 }
 
-func handleTCPConnection(conn net.Conn) {
+func handleTCPConnection(conn net.Conn, playback bool) {
 	remoteAddr := conn.RemoteAddr().String()
 	defer conn.Close()
 
-	// Register device connection
-	deviceConnsMu.Lock()
-	deviceConns[remoteAddr] = conn
-	deviceConnsMu.Unlock()
-
-	defer func() {
+	// Register live device connections for audio sent from the browser
+	if !playback {
 		deviceConnsMu.Lock()
-		delete(deviceConns, remoteAddr)
+		deviceConns[remoteAddr] = conn
 		deviceConnsMu.Unlock()
-	}()
+
+		defer func() {
+			deviceConnsMu.Lock()
+			delete(deviceConns, remoteAddr)
+			deviceConnsMu.Unlock()
+		}()
+	}
 
 	buffer := make([]byte, 0, 16384)
 	readBuffer := make([]byte, 8192)
 
-	log.Printf("New TCP device connection: %s", remoteAddr)
+	// Channels already reported to the proxy, keyed by SIM
+	reported := make(map[string]map[int]int)
+	defer func() {
+		for sim, channels := range reported {
+			for channel, dataType := range channels {
+				go notifyMediaStream(sim, channel, dataType, "stopped", playback)
+				removeStream(sim, channel, playback)
+				forgetReorder(sim, channel, playback)
+				if !playback {
+					audio.Forget(sim, channel)
+					forgetMedia(sim, channel)
+					stopHLS(sim, channel)
+					stopRecording(sim, channel)
+				}
+			}
+		}
+	}()
+
+	log.Printf("New TCP device connection: %s (playback: %v)", remoteAddr, playback)
 
 	for {
 		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -1018,18 +1331,27 @@ func handleTCPConnection(conn net.Conn) {
 
 			buffer = buffer[consumed:]
 
-			if frame != nil {
-				if debugSend && frameType == "audio" {
-					log.Printf("[AUDIO-DEBUG] Dispatching audio frame for processing")
-				}
-				switch frameType {
-				case "audio":
-					processAudioFrame(frame)
-				case "video":
-					processVideoFrame(frame)
+			if frame != nil && frameType != "" {
+				trackStreamPacket(frame, remoteAddr, playback)
+				if _, ok := reported[frame.SIM][frame.Channel]; !ok {
+					if reported[frame.SIM] == nil {
+						reported[frame.SIM] = make(map[int]int)
+					}
+					reported[frame.SIM][frame.Channel] = frame.DataType
+					go notifyMediaStream(frame.SIM, frame.Channel, frame.DataType, "started", playback)
+					if !playback {
+						startHLS(frame.SIM, frame.Channel)
+						startRecording(frame.SIM, frame.Channel)
+					}
 				}
 			}
 
+			if frame != nil {
+				frame.Playback = playback
+				// Packets are processed in sequence order, after the reorder buffer
+				reorderFrame(frame)
+			}
+
 			if len(buffer) > 32768 {
 				buffer = buffer[len(buffer)-1024:]
 			}
@@ -1039,13 +1361,33 @@ func handleTCPConnection(conn net.Conn) {
 	log.Printf("TCP device disconnected: %s", remoteAddr)
 }
 
+// processDeviceFrame handles a device packet released in sequence order by
+// its reorder buffer.
+func processDeviceFrame(frame *JT1078Frame) {
+	switch frame.DataType {
+	case 3: // audio
+		if debugSend {
+			log.Printf("[AUDIO-DEBUG] Dispatching audio frame for processing")
+		}
+		// Playback audio is not relayed; live receivers must not hear it
+		if !frame.Playback {
+			processAudioFrame(frame)
+		}
+	case 0, 1, 2: // video (I, P, B)
+		processVideoFrame(frame)
+	}
+}
+
 type JT1078Frame struct {
 	Header          []byte
+	Playback        bool
+	SIM             string
 	Channel         int
 	SequenceNum     uint16
 	DataType        int
 	SubType         int
 	DataLength      uint16
+	PayloadType     byte // 98:H.264, 99:H.265, audio codecs otherwise
 	Payload         []byte
 	Timestamp       time.Time
 	JT1078Timestamp uint64
@@ -1119,10 +1461,12 @@ func extractFrame(buffer []byte) (*JT1078Frame, int, string) {
 	frame := &JT1078Frame{
 		Header:      frameData[:16],
 		SequenceNum: binary.BigEndian.Uint16(frameData[6:8]),
+		SIM:         decodeBCD(frameData[8:14]),
 		Channel:     int(frameData[14]),
 		DataType:    dataType,
 		SubType:     subPackageType,
 		DataLength:  payloadLength,
+		PayloadType: frameData[5] & 0x7F,
 		Timestamp:   time.Now(),
 	}
 
@@ -1162,28 +1506,36 @@ func processAudioFrame(frame *JT1078Frame) {
 
 	audioCounter++
 
-	payloadSize := len(frame.Payload)
-	if payloadSize > 320 {
-		payloadSize = 320
+	samples, format := audio.Decode(frame.SIM, frame.Channel, frame.PayloadType, frame.Payload)
+	if len(samples) == 0 && !audio.AACCodec(format.Codec) {
+		return
 	}
 
 	if debugSend {
-		log.Printf("[AUDIO-DEBUG] Processing audio frame #%d: PayloadSize=%d, Channel=%d, SeqNum=%d, DataType=%d",
-			audioCounter, payloadSize, frame.Channel, frame.SequenceNum, frame.DataType)
+		log.Printf("[AUDIO-DEBUG] Processing audio frame #%d: %s, PayloadSize=%d, Channel=%d, SeqNum=%d, DataType=%d",
+			audioCounter, format, len(frame.Payload), frame.Channel, frame.SequenceNum, frame.DataType)
 	}
 
-	// CRITICAL FIX: Send raw G.711A audio data (not converted PCM)
-	// This matches the JT1078 specification and stream-capture implementation
-	audioPayload := frame.Payload[:payloadSize]
-
-	// Calculate duration based on G.711A sample rate (8000 Hz, 1 byte per sample)
-	duration := float32(payloadSize) / 8000.0
-	if duration < 0.02 {
-		duration = 0.02
-	} else if duration > 0.06 {
-		duration = 0.04
+	// Browser clients and RTSP/WHEP carry G.711A; other codecs are
+	// transcoded, G.711A frames pass through without their Hisilicon header.
+	// AAC also goes to the FLV, HLS and fMP4 remuxers as sent.
+	audioPayload := audio.StripHisiliconHeader(frame.Payload)
+	var aac []byte
+	if audio.AACCodec(format.Codec) {
+		aac = audioPayload
+	}
+	if format.Codec != audio.G711A {
+		audioPayload = audio.EncodeALaw(samples)
+	}
+	publishAudioMedia(frame, audioPayload, aac)
+	if len(audioPayload) == 0 {
+		// AAC using tools the decoder lacks is only passed through
+		return
 	}
 
+	// G.711A at 8000 Hz is one byte per sample
+	duration := float32(len(audioPayload)) / 8000.0
+
 	audioFrame := &AudioFrame{
 		PCMData:   audioPayload, // Now contains raw G.711A data, not PCM
 		Duration:  duration,
@@ -1205,8 +1557,9 @@ func processVideoFrame(frame *JT1078Frame) {
 	}
 
 	// Extract SPS/PPS from I-frames
+	hevc := frame.PayloadType == payloadTypeH265
 	if frame.DataType == 0 { // I-frame
-		extractSPSPPS(frame.Payload, frame.Channel)
+		extractSPSPPS(frame.Payload, frame.Channel, parameterSetKey(frame.SIM, frame.Channel, frame.Playback), hevc)
 	}
 
 	if debugReceive {
@@ -1218,13 +1571,21 @@ func processVideoFrame(frame *JT1078Frame) {
 	// For atomic frames (subType 0), send immediately
 	if frame.SubType == 0 {
 		videoFrame := &VideoFrame{
-			Channel:     frame.Channel,
-			SequenceNum: frame.SequenceNum,
-			FrameType:   frame.DataType,
-			Data:        frame.Payload,
-			Timestamp:   time.Now(),
+			SIM:             frame.SIM,
+			Playback:        frame.Playback,
+			Channel:         frame.Channel,
+			SequenceNum:     frame.SequenceNum,
+			FrameType:       frame.DataType,
+			Data:            frame.Payload,
+			Timestamp:       time.Now(),
+			HEVC:            hevc,
+			JT1078Timestamp: frame.JT1078Timestamp,
+		}
+		if !admitVideoFrame(videoFrame) {
+			return
 		}
 
+		publishVideoMedia(videoFrame)
 		broadcastVideoFrame(videoFrame)
 		return
 	}
@@ -1234,17 +1595,21 @@ func processVideoFrame(frame *JT1078Frame) {
 	defer videoFramesMu.Unlock()
 
 	// Use JT1078 timestamp + channel as key (NOT sequence number)
-	timestampKey := fmt.Sprintf("%d_%d", frame.Channel, frame.JT1078Timestamp)
+	timestampKey := fmt.Sprintf("%s_%v_%d_%d", frame.SIM, frame.Playback, frame.Channel, frame.JT1078Timestamp)
 
 	assembler, exists := videoFrames[timestampKey]
 	if !exists {
 		assembler = &VideoFrameAssembler{
+			SIM:             frame.SIM,
+			Playback:        frame.Playback,
 			Channel:         frame.Channel,
 			SequenceNum:     frame.SequenceNum,
 			FrameType:       frame.DataType,
 			Fragments:       []Fragment{},
 			LastUpdate:      time.Now(),
 			JT1078Timestamp: frame.JT1078Timestamp,
+			HEVC:            hevc,
+			Gaps:            streamGaps(frame.SIM, frame.Channel, frame.Playback),
 		}
 		videoFrames[timestampKey] = assembler
 	}
@@ -1272,17 +1637,38 @@ func processVideoFrame(frame *JT1078Frame) {
 
 	isComplete := hasLast && hasFirst
 
+	// Packets lost while the frame arrived leave it corrupt
+	if isComplete && streamGaps(assembler.SIM, assembler.Channel, assembler.Playback) != assembler.Gaps {
+		delete(videoFrames, timestampKey)
+		countDroppedFrame(assembler.SIM, assembler.Channel, assembler.Playback)
+		if debugReceive {
+			fmt.Printf("🗑️ Dropped frame with lost packets: Ch:%d, Fragments:%d\n",
+				assembler.Channel, len(assembler.Fragments))
+		}
+		return
+	}
+
 	if isComplete {
 		// Reconstruct frame using proven chronological order
 		videoFrame := &VideoFrame{
+			SIM:         assembler.SIM,
+			Playback:    assembler.Playback,
 			Channel:     assembler.Channel,
 			SequenceNum: assembler.SequenceNum,
 			FrameType:   assembler.FrameType,
 			Data:        reconstructVideoData(assembler),
 			Timestamp:   time.Now(),
+			HEVC:        assembler.HEVC,
+
+			JT1078Timestamp: assembler.JT1078Timestamp,
 		}
 
 		delete(videoFrames, timestampKey)
+		if !admitVideoFrame(videoFrame) {
+			return
+		}
+		// Remuxers need frames in order; the WebSocket broadcast does not
+		publishVideoMedia(videoFrame)
 		go broadcastVideoFrame(videoFrame)
 
 		if debugReceive {
@@ -1308,8 +1694,9 @@ func reconstructVideoData(assembler *VideoFrameAssembler) []byte {
 		if orderI != orderJ {
 			return orderI < orderJ
 		}
-		// If same type, sort by sequence number
-		return assembler.Fragments[i].SequenceNum < assembler.Fragments[j].SequenceNum
+		// If same type, sort by sequence number, counting from the first
+		// fragment received so a wraparound within the frame keeps its order
+		return assembler.Fragments[i].SequenceNum-assembler.SequenceNum < assembler.Fragments[j].SequenceNum-assembler.SequenceNum
 	})
 
 	// Assemble data
@@ -1331,6 +1718,7 @@ func cleanupVideoFrames() {
 		for key, assembler := range videoFrames {
 			if now.Sub(assembler.LastUpdate) > 3*time.Second {
 				delete(videoFrames, key)
+				countDroppedFrame(assembler.SIM, assembler.Channel, assembler.Playback)
 				if debugReceive {
 					fmt.Printf("🗑️ Cleaned up incomplete frame: Ch:%d, Fragments:%d\n",
 						assembler.Channel, len(assembler.Fragments))
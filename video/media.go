@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"jt1078/audio"
+)
+
+// mediaQueueSize is how many packets a remuxer may fall behind before it is
+// dropped as too slow.
+const mediaQueueSize = 512
+
+// clockRebaseGap is how far (ms) a timestamp may fall behind the start of
+// the output before the device is taken to have restarted its clock.
+const clockRebaseGap = 5000
+
+// MediaPacket is one video access unit or audio frame of a live stream, as
+// handed to the remuxers (FLV, ...).
+type MediaPacket struct {
+	SIM       string
+	Channel   int
+	Video     bool
+	HEVC      bool // H.265 rather than H.264 NAL units
+	KeyFrame  bool
+	NALUs     [][]byte // video NAL units without start codes; VPS/SPS/PPS/AUD removed
+	VPS       []byte   // parameter sets in effect for the stream, without start codes;
+	SPS       []byte   // the VPS only for H.265
+	PPS       []byte
+	Audio     []byte // G.711A samples
+	AAC       []byte // ADTS frames as the device sent them, for AAC streams
+	Timestamp uint64 // JT1078 timestamp in milliseconds
+
+	// Format of the stream's AAC audio, on video packets too so muxers can
+	// pick their audio codec at the first key frame; nil for other codecs
+	AACConfig *audio.AACConfig
+
+	Frame *VideoFrame // live frame a video packet was split from, for /video viewers
+}
+
+// mediaSubscriber receives the packets of one live SIM/channel stream.
+type mediaSubscriber struct {
+	SIM     string
+	Channel int
+	Viewer  string // remote viewer fed by the subscription; "" for packagers such as HLS
+	Packets chan *MediaPacket
+	closed  bool
+}
+
+var (
+	mediaSubscribersMu sync.Mutex
+	mediaSubscribers   = make(map[*mediaSubscriber]struct{})
+
+	// Packets of each live stream since its last key frame, keyed by
+	// streamKey(SIM, channel); guarded by mediaSubscribersMu
+	mediaGOPs = make(map[string][]*MediaPacket)
+
+	// Format of the last AAC audio of each live stream, keyed by
+	// streamKey(SIM, channel); guarded by mediaSubscribersMu
+	mediaAACConfigs = make(map[string]*audio.AACConfig)
+)
+
+// mediaClock maps JT1078 timestamps onto an output timeline in milliseconds
+// starting at 0 from the first key frame sent.
+type mediaClock struct {
+	base int64
+	last uint32
+}
+
+func (c *mediaClock) start(jt1078 uint64) {
+	c.base = int64(jt1078)
+	c.last = 0
+}
+
+// at returns the output time of a packet. Audio slightly older than the
+// first key frame is placed at 0; a device clock stepping back further
+// (stream restart) continues from the last output time.
+func (c *mediaClock) at(jt1078 uint64) uint32 {
+	d := int64(jt1078) - c.base
+	if d < -clockRebaseGap {
+		c.base = int64(jt1078) - int64(c.last)
+		d = int64(c.last)
+	} else if d < 0 {
+		d = 0
+	}
+	t := uint32(d)
+	if t > c.last {
+		c.last = t
+	}
+	return t
+}
+
+// subscribeMedia starts delivering the packets of a live stream. Packets
+// stops being fed, and is closed, when the subscriber falls too far behind
+// or is unsubscribed. A primed subscriber first gets the current GOP, so it
+// can start without waiting for the next key frame; its queue has room for
+// the GOP on top of mediaQueueSize. Subscriptions with a viewer count towards
+// the viewers of the stream.
+func subscribeMedia(sim string, channel int, viewer string, primed bool) *mediaSubscriber {
+	mediaSubscribersMu.Lock()
+	defer mediaSubscribersMu.Unlock()
+	var gop []*MediaPacket
+	if primed {
+		gop = mediaGOPs[streamKey(sim, channel)]
+	}
+	sub := &mediaSubscriber{SIM: sim, Channel: channel, Viewer: viewer, Packets: make(chan *MediaPacket, len(gop)+mediaQueueSize)}
+	for _, packet := range gop {
+		sub.Packets <- packet
+	}
+	mediaSubscribers[sub] = struct{}{}
+	return sub
+}
+
+// mediaViewers counts the viewers of each live stream fed by the media hub,
+// keyed by streamKey(SIM, channel).
+func mediaViewers() map[string]int {
+	mediaSubscribersMu.Lock()
+	defer mediaSubscribersMu.Unlock()
+	viewers := make(map[string]int)
+	for sub := range mediaSubscribers {
+		if sub.Viewer != "" {
+			viewers[streamKey(sub.SIM, sub.Channel)]++
+		}
+	}
+	return viewers
+}
+
+// forgetMedia drops the cached GOP and audio format of a stream whose
+// connection closed.
+func forgetMedia(sim string, channel int) {
+	mediaSubscribersMu.Lock()
+	delete(mediaGOPs, streamKey(sim, channel))
+	delete(mediaAACConfigs, streamKey(sim, channel))
+	mediaSubscribersMu.Unlock()
+}
+
+// unsubscribeMedia stops delivery to a subscriber.
+func unsubscribeMedia(sub *mediaSubscriber) {
+	mediaSubscribersMu.Lock()
+	defer mediaSubscribersMu.Unlock()
+	sub.closeLocked()
+}
+
+func (sub *mediaSubscriber) closeLocked() {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(mediaSubscribers, sub)
+	close(sub.Packets)
+}
+
+// publishMedia caches a packet in its stream's GOP and hands it to the
+// subscribers of the stream without blocking the device connection. Video
+// packets are given the AAC format of the stream's audio so far.
+func publishMedia(packet *MediaPacket) {
+	mediaSubscribersMu.Lock()
+	defer mediaSubscribersMu.Unlock()
+
+	key := streamKey(packet.SIM, packet.Channel)
+	switch {
+	case packet.Video:
+		packet.AACConfig = mediaAACConfigs[key]
+	case packet.AACConfig != nil:
+		mediaAACConfigs[key] = packet.AACConfig
+	default:
+		delete(mediaAACConfigs, key)
+	}
+	gop := mediaGOPs[key]
+	switch {
+	case packet.Video && packet.KeyFrame && gopCacheSize > 0:
+		mediaGOPs[key] = []*MediaPacket{packet}
+	case gop == nil:
+		// waiting for a key frame
+	case len(gop) >= gopCacheSize:
+		// a longer GOP is not cached until its next key frame
+		delete(mediaGOPs, key)
+	default:
+		mediaGOPs[key] = append(gop, packet)
+	}
+
+	for sub := range mediaSubscribers {
+		if sub.SIM != packet.SIM || sub.Channel != packet.Channel {
+			continue
+		}
+		select {
+		case sub.Packets <- packet:
+		default:
+			sub.closeLocked()
+		}
+	}
+}
+
+// hasParameterSets reports whether a video packet carries all the parameter
+// sets its codec needs to start decoding.
+func (p *MediaPacket) hasParameterSets() bool {
+	return p.SPS != nil && p.PPS != nil && (!p.HEVC || p.VPS != nil)
+}
+
+// sameParameterSets reports whether two packets have the same codec and
+// parameter sets.
+func (p *MediaPacket) sameParameterSets(other *MediaPacket) bool {
+	return other != nil && p.HEVC == other.HEVC && bytes.Equal(p.VPS, other.VPS) &&
+		bytes.Equal(p.SPS, other.SPS) && bytes.Equal(p.PPS, other.PPS)
+}
+
+// publishVideoMedia splits a reassembled live frame into a video packet.
+func publishVideoMedia(videoFrame *VideoFrame) {
+	if videoFrame.Playback {
+		return
+	}
+
+	hevc := videoFrame.HEVC
+	packet := &MediaPacket{
+		SIM:       videoFrame.SIM,
+		Channel:   videoFrame.Channel,
+		Video:     true,
+		HEVC:      hevc,
+		KeyFrame:  videoFrame.FrameType == 0,
+		Timestamp: videoFrame.JT1078Timestamp,
+		Frame:     videoFrame,
+	}
+	for _, nal := range splitAnnexB(videoFrame.Data) {
+		switch t := nalUnitType(nal[0], hevc); {
+		case isVPS(t, hevc):
+			packet.VPS = nal
+		case isSPS(t, hevc):
+			packet.SPS = nal
+		case isPPS(t, hevc):
+			packet.PPS = nal
+		case isAUD(t, hevc):
+			// access unit delimiter
+		case isKeySlice(t, hevc):
+			packet.KeyFrame = true
+			packet.NALUs = append(packet.NALUs, nal)
+		default:
+			packet.NALUs = append(packet.NALUs, nal)
+		}
+	}
+
+	if !packet.hasParameterSets() {
+		spsPpsStoreMu.RLock()
+		if stored, exists := spsPpsStore[parameterSetKey(videoFrame.SIM, videoFrame.Channel, false)]; exists && stored.HEVC == hevc {
+			if packet.VPS == nil && stored.VPS != nil {
+				packet.VPS = bytes.TrimPrefix(stored.VPS, []byte{0, 0, 0, 1})
+			}
+			if packet.SPS == nil && stored.SPS != nil {
+				packet.SPS = bytes.TrimPrefix(stored.SPS, []byte{0, 0, 0, 1})
+			}
+			if packet.PPS == nil && stored.PPS != nil {
+				packet.PPS = bytes.TrimPrefix(stored.PPS, []byte{0, 0, 0, 1})
+			}
+		}
+		spsPpsStoreMu.RUnlock()
+	}
+
+	if len(packet.NALUs) > 0 && (!packet.KeyFrame || packet.hasParameterSets()) {
+		publishMedia(packet)
+	}
+}
+
+// publishAudioMedia hands a live audio frame to the remuxers: its G.711A
+// samples and, for AAC streams, the ADTS frames the device sent.
+func publishAudioMedia(frame *JT1078Frame, samples, aac []byte) {
+	packet := &MediaPacket{
+		SIM:       frame.SIM,
+		Channel:   frame.Channel,
+		Audio:     samples,
+		Timestamp: frame.JT1078Timestamp,
+	}
+	if frames := audio.SplitADTS(aac); len(frames) > 0 {
+		packet.AAC = aac
+		packet.AACConfig = &frames[0].Config
+	}
+	publishMedia(packet)
+}
+
+// aacFrames returns the ADTS frames of an audio packet in a format, with
+// their output times from t (ms). Frames of several raw data blocks, which
+// FLV and MP4 samples cannot carry, are left out.
+func (p *MediaPacket) aacFrames(config *audio.AACConfig, t uint32) ([]audio.ADTSFrame, []uint32) {
+	var frames []audio.ADTSFrame
+	var times []uint32
+	blocks := 0
+	for _, frame := range audio.SplitADTS(p.AAC) {
+		if frame.Config == *config && frame.Blocks == 1 {
+			frames = append(frames, frame)
+			times = append(times, t+uint32(blocks*1024*1000/config.SampleRate))
+		}
+		blocks += frame.Blocks
+	}
+	return frames, times
+}
+
+// splitAnnexB returns the NAL units of an Annex B byte stream without their
+// start codes.
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				nalus = appendNAL(nalus, data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		nalus = appendNAL(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendNAL adds a NAL unit, dropping the zero byte of a following 4-byte
+// start code and empty units.
+func appendNAL(nalus [][]byte, nal []byte) [][]byte {
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nalus
+	}
+	return append(nalus, nal)
+}
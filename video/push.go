@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reconnect backoff of RTMP pushes: doubled after each failure, and reset
+// once a publish lasted the maximum
+const (
+	rtmpBackoffMin = time.Second
+	rtmpBackoffMax = 30 * time.Second
+)
+
+var (
+	// RTMP pushes keyed by ID
+	rtmpPushesMu sync.Mutex
+	rtmpPushes   = make(map[string]*rtmpPush)
+)
+
+// rtmpPushStatus is what GET /rtmp/push reports of a push.
+type rtmpPushStatus struct {
+	ID              string     `json:"id"`
+	SIM             string     `json:"device_phone"`
+	Channel         int        `json:"channel"`
+	URL             string     `json:"url"` // stream key masked
+	Audio           bool       `json:"audio"`
+	State           string     `json:"state"` // waiting, connecting, publishing, retrying
+	CreatedAt       time.Time  `json:"created_at"`
+	PublishingSince *time.Time `json:"publishing_since,omitempty"`
+	Reconnects      int        `json:"reconnects"`
+	LastError       string     `json:"last_error,omitempty"`
+	BytesSent       int64      `json:"bytes_sent"`
+}
+
+// rtmpPush republishes a live SIM/channel stream to an RTMP URL until
+// stopped, reconnecting with backoff. It waits for the stream's next key
+// frame (or the cached GOP) before connecting, so an idle push holds no
+// connection to the server.
+type rtmpPush struct {
+	url  string
+	stop chan struct{}
+
+	mu     sync.Mutex
+	status rtmpPushStatus
+}
+
+// startRTMPPush starts pushing a stream, or returns the push already
+// sending it to the same URL.
+func startRTMPPush(sim string, channel int, rawURL string, audio bool) *rtmpPush {
+	rtmpPushesMu.Lock()
+	defer rtmpPushesMu.Unlock()
+	for _, push := range rtmpPushes {
+		if push.status.SIM == sim && push.status.Channel == channel && push.url == rawURL {
+			return push
+		}
+	}
+
+	push := &rtmpPush{
+		url:  rawURL,
+		stop: make(chan struct{}),
+		status: rtmpPushStatus{
+			ID:        fmt.Sprintf("%08x", rand.Uint32()),
+			SIM:       sim,
+			Channel:   channel,
+			URL:       maskRTMPURL(rawURL),
+			Audio:     audio,
+			State:     "waiting",
+			CreatedAt: time.Now(),
+		},
+	}
+	rtmpPushes[push.status.ID] = push
+	go push.run()
+	log.Printf("[RTMP] Push %s: %s channel %d to %s", push.status.ID, sim, channel, push.status.URL)
+	return push
+}
+
+// stopRTMPPush stops a push; false if there is none with that ID.
+func stopRTMPPush(id string) bool {
+	rtmpPushesMu.Lock()
+	push, exists := rtmpPushes[id]
+	delete(rtmpPushes, id)
+	rtmpPushesMu.Unlock()
+	if exists {
+		close(push.stop)
+		log.Printf("[RTMP] Push %s stopped", id)
+	}
+	return exists
+}
+
+func (p *rtmpPush) snapshot() rtmpPushStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *rtmpPush) setState(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.State = state
+	if state == "publishing" {
+		now := time.Now()
+		p.status.PublishingSince = &now
+	} else {
+		p.status.PublishingSince = nil
+	}
+}
+
+func (p *rtmpPush) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run publishes until stopped, backing off between attempts.
+func (p *rtmpPush) run() {
+	backoff := rtmpBackoffMin
+	for {
+		published, err := p.publish()
+		if p.stopped() {
+			return
+		}
+		if published >= rtmpBackoffMax {
+			backoff = rtmpBackoffMin
+		}
+
+		p.mu.Lock()
+		p.status.Reconnects++
+		p.status.LastError = err.Error()
+		p.mu.Unlock()
+		p.setState("retrying")
+		log.Printf("[RTMP] Push %s: %v; retrying in %v", p.status.ID, err, backoff)
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > rtmpBackoffMax {
+			backoff = rtmpBackoffMax
+		}
+	}
+}
+
+// publish runs one connection: it waits for a key frame, connects and
+// sends FLV-muxed tags until an error or stop. It returns how long the
+// stream was published.
+func (p *rtmpPush) publish() (time.Duration, error) {
+	p.setState("waiting")
+	media := subscribeMedia(p.status.SIM, p.status.Channel, "RTMP "+p.status.URL, true)
+	defer unsubscribeMedia(media)
+
+	muxer := &flvMuxer{audio: p.status.Audio}
+	var pending []byte
+	for pending == nil {
+		select {
+		case <-p.stop:
+			return 0, nil
+		case packet, ok := <-media.Packets:
+			if !ok {
+				return 0, errors.New("fell behind the stream")
+			}
+			pending = muxer.mux(packet)
+		}
+	}
+
+	p.setState("connecting")
+	conn, err := dialRTMP(p.url)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.publish(); err != nil {
+		return 0, err
+	}
+	width, height := videoPictureSize(muxer.params)
+	if err := conn.writeMetadata(width, height, muxer.params.HEVC, p.status.Audio, muxer.aac); err != nil {
+		return 0, err
+	}
+
+	p.setState("publishing")
+	started := time.Now()
+	served := make(chan error, 1)
+	go func() { served <- conn.serve() }()
+
+	send := func(tags []byte) error {
+		for _, tag := range splitFLVTags(tags) {
+			if err := conn.writeTag(tag.tagType, tag.timestamp, tag.body); err != nil {
+				return err
+			}
+			p.mu.Lock()
+			p.status.BytesSent += int64(len(tag.body))
+			p.mu.Unlock()
+		}
+		return nil
+	}
+	if err := send(pending); err != nil {
+		return time.Since(started), err
+	}
+	for {
+		select {
+		case <-p.stop:
+			return time.Since(started), nil
+		case err := <-served:
+			if err == nil {
+				err = errors.New("server closed the connection")
+			}
+			return time.Since(started), err
+		case packet, ok := <-media.Packets:
+			if !ok {
+				return time.Since(started), errors.New("fell behind the stream")
+			}
+			if err := send(muxer.mux(packet)); err != nil {
+				return time.Since(started), err
+			}
+		}
+	}
+}
+
+// rtmpPushHandler manages pushes: GET /rtmp/push lists them, POST /rtmp/push
+// {"device_phone","channel","url","audio"} starts one (audio defaults to
+// true; turn it off for servers that only take AAC), and DELETE
+// /rtmp/push/{id} stops one.
+func rtmpPushHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	id := r.PathValue("id")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodGet && id == "":
+		rtmpPushesMu.Lock()
+		pushes := make([]rtmpPushStatus, 0, len(rtmpPushes))
+		for _, push := range rtmpPushes {
+			pushes = append(pushes, push.snapshot())
+		}
+		rtmpPushesMu.Unlock()
+		sort.Slice(pushes, func(i, j int) bool { return pushes[i].CreatedAt.Before(pushes[j].CreatedAt) })
+		json.NewEncoder(w).Encode(pushes)
+
+	case r.Method == http.MethodPost && id == "":
+		var req struct {
+			SIM     string `json:"device_phone"`
+			Channel int    `json:"channel"`
+			URL     string `json:"url"`
+			Audio   *bool  `json:"audio"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.SIM == "" || req.Channel <= 0 {
+			http.Error(w, "device_phone and channel are required", http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" {
+			http.Error(w, "url must be rtmp://host/app/stream or rtmps://...", http.StatusBadRequest)
+			return
+		}
+		audio := req.Audio == nil || *req.Audio
+		push := startRTMPPush(req.SIM, req.Channel, req.URL, audio)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(push.snapshot())
+
+	case r.Method == http.MethodDelete && id != "":
+		if !stopRTMPPush(id) {
+			http.Error(w, "Push not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopped", "id": id})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
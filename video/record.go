@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jt1078/audio"
+)
+
+// Recording rules
+const (
+	recordAlways = "always" // every live stream
+	recordAlarm  = "alarm"  // streams of devices with an active alarm
+	recordDemand = "demand" // streams started through POST /record/{sim}/{channel}
+)
+
+const (
+	// recordAlarmPoll is how often the proxy is asked for active alarms.
+	recordAlarmPoll = 5 * time.Second
+
+	// recordRetentionInterval is how often old files are deleted.
+	recordRetentionInterval = time.Minute
+
+	// recordFileLayout names files by their UTC start time.
+	recordFileLayout = "20060102T150405.000Z"
+)
+
+var (
+	// Recording: directory ("" disables recording), rule, file length,
+	// retention by age and total size, and how long alarm recordings
+	// continue after the alarm cleared
+	recordDir          string
+	recordMode         string
+	recordFileDuration time.Duration
+	recordMaxAge       time.Duration
+	recordQuotaMB      int64
+	recordPostAlarm    time.Duration
+
+	// Recorders keyed by streamKey(SIM, channel)
+	recordersMu sync.Mutex
+	recorders   = make(map[string]*recorder)
+
+	// Files being written, which retention leaves alone
+	recordOpenMu sync.Mutex
+	recordOpen   = make(map[string]bool)
+)
+
+// recorder writes one live SIM/channel stream to rolling MP4 files while
+// the recording rule asks for it.
+type recorder struct {
+	SIM     string
+	Channel int
+
+	mu         sync.Mutex
+	refs       int       // device connections carrying the stream
+	demand     bool      // started through the API
+	alarmUntil time.Time // alarm rule: record until then
+	media      *mediaSubscriber
+}
+
+// recorderStatus is what GET /record reports of a recorder.
+type recorderStatus struct {
+	SIM        string     `json:"device_phone"`
+	Channel    int        `json:"channel"`
+	Live       bool       `json:"live"`
+	Demand     bool       `json:"demand"`
+	AlarmUntil *time.Time `json:"alarm_until,omitempty"`
+	Recording  bool       `json:"recording"`
+}
+
+// getRecorder returns the recorder of a stream, creating it.
+func getRecorder(sim string, channel int) *recorder {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	key := streamKey(sim, channel)
+	r, exists := recorders[key]
+	if !exists {
+		r = &recorder{SIM: sim, Channel: channel}
+		recorders[key] = r
+	}
+	return r
+}
+
+// startRecording tells the recorder of a stream that a connection carries it.
+func startRecording(sim string, channel int) {
+	if recordDir == "" {
+		return
+	}
+	r := getRecorder(sim, channel)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs++
+	r.updateLocked()
+}
+
+// stopRecording ends the current file once no connection carries the stream.
+func stopRecording(sim string, channel int) {
+	if recordDir == "" {
+		return
+	}
+	r := getRecorder(sim, channel)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs > 0 {
+		r.refs--
+	}
+	r.updateLocked()
+}
+
+// isRecording reports whether a live stream is being written to a file.
+func isRecording(sim string, channel int) bool {
+	recordersMu.Lock()
+	r, exists := recorders[streamKey(sim, channel)]
+	recordersMu.Unlock()
+	if !exists {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.media != nil
+}
+
+func (r *recorder) wantedLocked() bool {
+	if r.refs == 0 {
+		return false
+	}
+	return recordMode == recordAlways || r.demand || time.Now().Before(r.alarmUntil)
+}
+
+// updateLocked starts or stops writing as the rule says. A new recording
+// starts with the cached GOP, which for alarms is footage from just before.
+func (r *recorder) updateLocked() {
+	wanted := r.wantedLocked()
+	switch {
+	case wanted && r.media == nil:
+		r.media = subscribeMedia(r.SIM, r.Channel, "", true)
+		go r.run(r.media)
+		log.Printf("[RECORD] Recording %s channel %d", r.SIM, r.Channel)
+	case !wanted && r.media != nil:
+		media := r.media
+		r.media = nil
+		unsubscribeMedia(media)
+		log.Printf("[RECORD] Stopped recording %s channel %d", r.SIM, r.Channel)
+	}
+}
+
+func (r *recorder) status() recorderStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := recorderStatus{
+		SIM:       r.SIM,
+		Channel:   r.Channel,
+		Live:      r.refs > 0,
+		Demand:    r.demand,
+		Recording: r.media != nil,
+	}
+	if time.Now().Before(r.alarmUntil) {
+		until := r.alarmUntil
+		status.AlarmUntil = &until
+	}
+	return status
+}
+
+// run writes the packets of one subscription, starting a file at the first
+// key frame and a new one at the first key frame after recordFileDuration
+// or when the parameter sets change.
+func (r *recorder) run(media *mediaSubscriber) {
+	var file *recordFile
+	for packet := range media.Packets {
+		if packet.Video && packet.KeyFrame && packet.hasParameterSets() && (file == nil || file.full(packet)) {
+			if file != nil {
+				file.close()
+			}
+			var err error
+			if file, err = createRecordFile(r.SIM, r.Channel, packet); err != nil {
+				log.Printf("[RECORD] %v", err)
+			}
+		}
+		if file == nil {
+			continue
+		}
+		if err := file.write(packet); err != nil {
+			log.Printf("[RECORD] Writing %s: %v", file.path, err)
+			file.close()
+			file = nil
+		}
+	}
+	if file != nil {
+		file.close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.media == media {
+		// Fell behind the stream: continue in a new file at the next key frame
+		r.media = subscribeMedia(r.SIM, r.Channel, "", false)
+		go r.run(r.media)
+	}
+}
+
+// recordFile is one fragmented MP4 file being written: an init segment with
+// a video and an audio track, then a fragment per GOP, and on close an mfra
+// index so players can seek without reading every fragment. The audio track
+// is the device's AAC when the stream has it as the file starts, else
+// G.711A.
+type recordFile struct {
+	path     string
+	file     *os.File
+	params   *MediaPacket
+	aac      *audio.AACConfig
+	clock    mediaClock
+	sequence uint32
+	written  int64
+	video    []fmp4Sample
+	audio    []fmp4Sample
+	index    []recordFragment
+}
+
+// recordFragment locates a fragment for the mfra index.
+type recordFragment struct {
+	time   uint32
+	offset int64
+}
+
+// createRecordFile starts a file at a key frame.
+func createRecordFile(sim string, channel int, packet *MediaPacket) (*recordFile, error) {
+	dir := filepath.Join(recordDir, sim, strconv.Itoa(channel))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, time.Now().UTC().Format(recordFileLayout)+".mp4")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", path, err)
+	}
+
+	f := &recordFile{path: path, file: file, params: packet, aac: packet.AACConfig}
+	f.clock.start(packet.Timestamp)
+	recordOpenMu.Lock()
+	recordOpen[path] = true
+	recordOpenMu.Unlock()
+	if err := f.append(fmp4InitSegment(packet, fmp4AudioTrack(f.aac))); err != nil {
+		f.close()
+		return nil, fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// full reports whether a key frame should start the next file.
+func (f *recordFile) full(packet *MediaPacket) bool {
+	elapsed := time.Duration(f.clock.at(packet.Timestamp)) * time.Millisecond
+	return elapsed >= recordFileDuration || !packet.sameParameterSets(f.params)
+}
+
+// write adds a packet; a key frame writes the GOP before it as a fragment.
+func (f *recordFile) write(packet *MediaPacket) error {
+	t := f.clock.at(packet.Timestamp)
+	if !packet.Video {
+		if f.aac != nil {
+			f.audio = append(f.audio, aacSamples(packet, f.aac, t)...)
+		} else if len(packet.Audio) > 0 {
+			f.audio = append(f.audio, fmp4Sample{
+				time:     t * 8, // the audio track counts 8 kHz samples
+				duration: uint32(len(packet.Audio)),
+				keyFrame: true,
+				data:     packet.Audio,
+			})
+		}
+		return nil
+	}
+
+	if packet.KeyFrame {
+		if err := f.flush(t); err != nil {
+			return err
+		}
+	}
+	var data []byte
+	for _, nal := range packet.NALUs {
+		data = append(data, be32(uint32(len(nal)))...)
+		data = append(data, nal...)
+	}
+	f.video = append(f.video, fmp4Sample{time: t, keyFrame: packet.KeyFrame, data: data})
+	return nil
+}
+
+// flush writes the pending samples as a fragment.
+func (f *recordFile) flush(nextTime uint32) error {
+	if len(f.video) == 0 {
+		return nil
+	}
+	f.sequence++
+	f.index = append(f.index, recordFragment{time: f.video[0].time, offset: f.written})
+	fragment := fmp4Fragment(f.sequence,
+		fmp4Run{trackID: 1, samples: f.video, nextTime: nextTime},
+		fmp4Run{trackID: 2, samples: f.audio},
+	)
+	f.video, f.audio = nil, nil
+	return f.append(fragment)
+}
+
+func (f *recordFile) append(data []byte) error {
+	n, err := f.file.Write(data)
+	f.written += int64(n)
+	return err
+}
+
+// close writes the last GOP and the mfra index, and closes the file.
+func (f *recordFile) close() {
+	if err := f.flush(0); err == nil && len(f.index) > 0 {
+		var entries []byte
+		for _, fragment := range f.index {
+			entries = append(entries, be64(uint64(fragment.time))...)
+			entries = append(entries, be64(uint64(fragment.offset))...)
+			entries = append(entries, 1, 1, 1) // traf, trun and sample number
+		}
+		tfra := fullBox("tfra", 1, 0, be32(1), be32(0), be32(uint32(len(f.index))), entries)
+		mfro := fullBox("mfro", 0, 0, be32(uint32(8+len(tfra)+16)))
+		f.append(box("mfra", tfra, mfro))
+	}
+	f.file.Close()
+
+	recordOpenMu.Lock()
+	delete(recordOpen, f.path)
+	recordOpenMu.Unlock()
+}
+
+// recordAlarmRoutine keeps recording streams of devices with an active
+// alarm, polling the proxy; an alarm without a channel covers every
+// channel of the device.
+func recordAlarmRoutine() {
+	ticker := time.NewTicker(recordAlarmPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v1/jt808/alarms", apiBaseURL))
+		if err != nil {
+			log.Printf("[RECORD] Error fetching active alarms: %v", err)
+			continue
+		}
+		var alarms []struct {
+			SIM     string `json:"device_phone"`
+			Channel int    `json:"channel"`
+			State   string `json:"state"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&alarms)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("[RECORD] Error decoding active alarms: %v", err)
+			continue
+		}
+
+		until := time.Now().Add(recordPostAlarm)
+		recordersMu.Lock()
+		for _, r := range recorders {
+			r.mu.Lock()
+			for _, alarm := range alarms {
+				if alarm.SIM == r.SIM && alarm.State != "cleared" && (alarm.Channel == 0 || alarm.Channel == r.Channel) {
+					r.alarmUntil = until
+				}
+			}
+			r.updateLocked()
+			r.mu.Unlock()
+		}
+		recordersMu.Unlock()
+	}
+}
+
+// recording is a file of GET /recordings.
+type recording struct {
+	SIM       string    `json:"device_phone"`
+	Channel   int       `json:"channel"`
+	File      string    `json:"file"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"` // last write
+	Size      int64     `json:"size"`
+	Recording bool      `json:"recording"` // still being written
+	URL       string    `json:"url"`
+	path      string
+}
+
+// scanRecordings lists the files of a device ("" = all devices) and
+// channel (0 = all channels), oldest first.
+func scanRecordings(sim string, channel int) []recording {
+	simPattern, channelPattern := sim, "*"
+	if sim == "" {
+		simPattern = "*"
+	}
+	if channel > 0 {
+		channelPattern = strconv.Itoa(channel)
+	}
+	paths, _ := filepath.Glob(filepath.Join(recordDir, simPattern, channelPattern, "*.mp4"))
+
+	recordOpenMu.Lock()
+	defer recordOpenMu.Unlock()
+	var recordings []recording
+	for _, path := range paths {
+		name := filepath.Base(path)
+		start, err := time.Parse(recordFileLayout, strings.TrimSuffix(name, ".mp4"))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		channelDir := filepath.Dir(path)
+		ch, _ := strconv.Atoi(filepath.Base(channelDir))
+		device := filepath.Base(filepath.Dir(channelDir))
+		recordings = append(recordings, recording{
+			SIM:       device,
+			Channel:   ch,
+			File:      name,
+			Start:     start,
+			End:       info.ModTime().UTC(),
+			Size:      info.Size(),
+			Recording: recordOpen[path],
+			URL:       fmt.Sprintf("/recordings/%s/%d/%s", device, ch, name),
+			path:      path,
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Start.Before(recordings[j].Start) })
+	return recordings
+}
+
+// recordRetentionRoutine deletes finished files older than recordMaxAge,
+// then the oldest ones while the total exceeds recordQuotaMB.
+func recordRetentionRoutine() {
+	ticker := time.NewTicker(recordRetentionInterval)
+	defer ticker.Stop()
+	for {
+		recordings := scanRecordings("", 0)
+		var total int64
+		for _, rec := range recordings {
+			total += rec.Size
+		}
+		quota := recordQuotaMB << 20
+		for _, rec := range recordings {
+			expired := recordMaxAge > 0 && time.Since(rec.End) > recordMaxAge
+			over := quota > 0 && total > quota
+			if rec.Recording || !expired && !over {
+				continue
+			}
+			if err := os.Remove(rec.path); err != nil {
+				log.Printf("[RECORD] Cannot delete %s: %v", rec.path, err)
+				continue
+			}
+			total -= rec.Size
+			log.Printf("[RECORD] Deleted %s (expired: %v, over quota: %v)", rec.path, expired, over)
+		}
+		<-ticker.C
+	}
+}
+
+// recordHandler controls recording: GET /record lists the recorders, POST
+// /record/{sim}/{channel} records a stream on demand (whenever it is live)
+// and DELETE /record/{sim}/{channel} ends that.
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+
+	if recordDir == "" {
+		http.Error(w, "Recording is off (-record-dir)", http.StatusNotFound)
+		return
+	}
+	sim := r.PathValue("sim")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodGet && sim == "":
+		recordersMu.Lock()
+		statuses := make([]recorderStatus, 0, len(recorders))
+		for _, rec := range recorders {
+			statuses = append(statuses, rec.status())
+		}
+		recordersMu.Unlock()
+		sort.Slice(statuses, func(i, j int) bool {
+			if statuses[i].SIM != statuses[j].SIM {
+				return statuses[i].SIM < statuses[j].SIM
+			}
+			return statuses[i].Channel < statuses[j].Channel
+		})
+		json.NewEncoder(w).Encode(map[string]interface{}{"mode": recordMode, "recorders": statuses})
+
+	case (r.Method == http.MethodPost || r.Method == http.MethodDelete) && sim != "":
+		channel, err := strconv.Atoi(r.PathValue("channel"))
+		if err != nil || channel <= 0 || !isDigits(sim) {
+			http.Error(w, "device_phone must be digits and channel a positive number", http.StatusBadRequest)
+			return
+		}
+		rec := getRecorder(sim, channel)
+		rec.mu.Lock()
+		rec.demand = r.Method == http.MethodPost
+		rec.updateLocked()
+		rec.mu.Unlock()
+		json.NewEncoder(w).Encode(rec.status())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recordingsHandler serves recorded files: GET /recordings?device_phone=...
+// [&channel=N][&start=...][&end=...] lists the files overlapping the time
+// range (RFC 3339), GET /recordings/{sim}/{channel}/{file} downloads one.
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if sim := r.PathValue("sim"); sim != "" {
+		channel, err := strconv.Atoi(r.PathValue("channel"))
+		file := r.PathValue("file")
+		if err != nil || !isDigits(sim) || file != filepath.Base(file) || !strings.HasSuffix(file, ".mp4") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%d-%s", sim, channel, file)))
+		http.ServeFile(w, r, filepath.Join(recordDir, sim, strconv.Itoa(channel), file))
+		return
+	}
+
+	query := r.URL.Query()
+	sim := query.Get("device_phone")
+	if !isDigits(sim) {
+		http.Error(w, "device_phone is required", http.StatusBadRequest)
+		return
+	}
+	channel := 0
+	if value := query.Get("channel"); value != "" {
+		var err error
+		if channel, err = strconv.Atoi(value); err != nil || channel < 0 {
+			http.Error(w, "channel must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	var start, end time.Time
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &start}, {"end", &end}} {
+		if value := query.Get(bound.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, bound.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+
+	recordings := make([]recording, 0)
+	for _, rec := range scanRecordings(sim, channel) {
+		if !start.IsZero() && rec.End.Before(start) || !end.IsZero() && rec.Start.After(end) {
+			continue
+		}
+		recordings = append(recordings, rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// isDigits reports a non-empty string of decimal digits, as SIMs are.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"jt1078/audio"
+)
+
+// RTMP message types and the chunk streams used for publishing
+// (Adobe RTMP specification 1.0, 5.4 and 7.1).
+const (
+	rtmpSetChunkSize     = 1
+	rtmpAcknowledgement  = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+	rtmpUserControlPing  = 6
+	rtmpUserControlPong  = 7
+	rtmpChunkStreamCtrl  = 2
+	rtmpChunkStreamCmd   = 3
+	rtmpChunkStreamAudio = 4
+	rtmpChunkStreamData  = 5
+	rtmpChunkStreamVideo = 6
+
+	rtmpOutChunkSize = 4096
+	rtmpTimeout      = 10 * time.Second
+)
+
+// rtmpConn is a client connection publishing one stream.
+type rtmpConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	app      string
+	stream   string
+	tcURL    string
+	streamID uint32
+
+	writeMu sync.Mutex
+
+	// read side: chunk size and per chunk stream state set by the server
+	inChunkSize uint32
+	inStreams   map[uint32]*rtmpChunkStream
+	bytesRead   uint64
+	ackWindow   uint32
+	ackedBytes  uint64
+}
+
+type rtmpChunkStream struct {
+	length   uint32
+	typeID   byte
+	streamID uint32
+	extended bool
+	payload  []byte
+}
+
+// rtmpMessage is a reassembled message from the server.
+type rtmpMessage struct {
+	typeID   byte
+	streamID uint32
+	payload  []byte
+}
+
+// dialRTMP connects to rtmp://host[:port]/app[/...]/stream (rtmps:// for
+// TLS) and performs the handshake.
+func dialRTMP(rawURL string) (*rtmpConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		return nil, errors.New("URL must be rtmp://host/app/stream")
+	}
+	c := &rtmpConn{
+		app:         path[:slash],
+		stream:      path[slash+1:],
+		inChunkSize: 128,
+		inStreams:   make(map[uint32]*rtmpChunkStream),
+	}
+	if u.RawQuery != "" {
+		c.stream += "?" + u.RawQuery
+	}
+
+	host := u.Host
+	dialer := &net.Dialer{Timeout: rtmpTimeout}
+	switch u.Scheme {
+	case "rtmp":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1935")
+		}
+		c.conn, err = dialer.Dial("tcp", host)
+	case "rtmps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		c.conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.tcURL = fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, c.app)
+	c.reader = bufio.NewReader(&rtmpCountingReader{c})
+
+	if err := c.handshake(); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	if err := c.writeMessage(rtmpChunkStreamCtrl, rtmpSetChunkSize, 0, 0, be32(rtmpOutChunkSize)); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// rtmpCountingReader counts the bytes read for acknowledgements.
+type rtmpCountingReader struct{ c *rtmpConn }
+
+func (r *rtmpCountingReader) Read(p []byte) (int, error) {
+	n, err := r.c.conn.Read(p)
+	r.c.bytesRead += uint64(n)
+	return n, err
+}
+
+// handshake performs the simple (unsigned) handshake: C0+C1, S0+S1+S2, C2.
+func (c *rtmpConn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(rtmpTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c1 := make([]byte, 1+1536)
+	c1[0] = 3 // version
+	rand.Read(c1[9:])
+	if _, err := c.conn.Write(c1); err != nil {
+		return err
+	}
+	s := make([]byte, 1+1536+1536)
+	if _, err := io.ReadFull(c.reader, s); err != nil {
+		return err
+	}
+	if s[0] != 3 {
+		return fmt.Errorf("server version %d", s[0])
+	}
+	_, err := c.conn.Write(s[1 : 1+1536]) // C2 echoes S1
+	return err
+}
+
+// publish runs connect, createStream and publish, returning once the server
+// reports NetStream.Publish.Start.
+func (c *rtmpConn) publish() error {
+	c.conn.SetReadDeadline(time.Now().Add(rtmpTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	connect := amf0Object{
+		{"app", c.app},
+		{"type", "nonprivate"},
+		{"flashVer", "FMLE/3.0 (compatible; FMSc/1.0)"},
+		{"tcUrl", c.tcURL},
+	}
+	if err := c.command(0, "connect", 1, connect); err != nil {
+		return err
+	}
+	if _, err := c.awaitResult(1); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	// releaseStream/FCPublish are what encoders send; servers may not answer
+	if err := c.command(0, "releaseStream", 2, nil, c.stream); err != nil {
+		return err
+	}
+	if err := c.command(0, "FCPublish", 3, nil, c.stream); err != nil {
+		return err
+	}
+	if err := c.command(0, "createStream", 4, nil); err != nil {
+		return err
+	}
+	result, err := c.awaitResult(4)
+	if err != nil {
+		return fmt.Errorf("createStream: %w", err)
+	}
+	id, ok := result.(float64)
+	if !ok {
+		return errors.New("createStream: no stream ID")
+	}
+	c.streamID = uint32(id)
+
+	if err := c.command(c.streamID, "publish", 5, nil, c.stream, "live"); err != nil {
+		return err
+	}
+	for {
+		name, values, err := c.readCommand()
+		if err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		if name != "onStatus" || len(values) < 3 {
+			continue
+		}
+		info, _ := values[2].(map[string]interface{})
+		code, _ := info["code"].(string)
+		if code == "NetStream.Publish.Start" {
+			return nil
+		}
+		if level, _ := info["level"].(string); level == "error" {
+			description, _ := info["description"].(string)
+			return fmt.Errorf("publish: %s %s", code, description)
+		}
+	}
+}
+
+// awaitResult waits for the _result of a transaction, returning its first
+// value after the command object.
+func (c *rtmpConn) awaitResult(transaction float64) (interface{}, error) {
+	for {
+		name, values, err := c.readCommand()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 1 || values[0] != transaction {
+			continue
+		}
+		switch name {
+		case "_result":
+			if len(values) >= 3 {
+				return values[2], nil
+			}
+			return nil, nil
+		case "_error":
+			if len(values) >= 3 {
+				if info, ok := values[2].(map[string]interface{}); ok {
+					return nil, fmt.Errorf("%v %v", info["code"], info["description"])
+				}
+			}
+			return nil, errors.New("rejected")
+		}
+	}
+}
+
+// readCommand returns the next AMF0 command from the server, handling
+// protocol control messages on the way.
+func (c *rtmpConn) readCommand() (string, []interface{}, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return "", nil, err
+		}
+		if msg.typeID != rtmpCommandAMF0 {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		name, _ := values[0].(string)
+		return name, values[1:], nil
+	}
+}
+
+// serve reads from the server while publishing: pings, acknowledgements and
+// status changes. It returns when the connection fails or the server ends
+// the publish.
+func (c *rtmpConn) serve() error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.typeID != rtmpCommandAMF0 {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) < 4 || values[0] != "onStatus" {
+			continue
+		}
+		info, _ := values[3].(map[string]interface{})
+		if level, _ := info["level"].(string); level == "error" {
+			return fmt.Errorf("%v %v", info["code"], info["description"])
+		}
+	}
+}
+
+// readMessage reassembles the next message from its chunks.
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	header := make([]byte, 11)
+	for {
+		b0, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b0 >> 6
+		csid := uint32(b0 & 0x3F)
+		switch csid {
+		case 0:
+			b, err := c.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b)
+		case 1:
+			if _, err := io.ReadFull(c.reader, header[:2]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(header[0]) + uint32(header[1])<<8
+		}
+		cs := c.inStreams[csid]
+		if cs == nil {
+			cs = &rtmpChunkStream{}
+			c.inStreams[csid] = cs
+		}
+
+		sizes := [4]int{11, 7, 3, 0}
+		if _, err := io.ReadFull(c.reader, header[:sizes[format]]); err != nil {
+			return nil, err
+		}
+		if format <= 2 {
+			cs.extended = uint32(header[0])<<16|uint32(header[1])<<8|uint32(header[2]) == 0xFFFFFF
+		}
+		if format <= 1 {
+			cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			cs.typeID = header[6]
+		}
+		if format == 0 {
+			cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+		}
+		if cs.extended {
+			if _, err := io.ReadFull(c.reader, header[:4]); err != nil {
+				return nil, err
+			}
+		}
+
+		n := cs.length - uint32(len(cs.payload))
+		if n > c.inChunkSize {
+			n = c.inChunkSize
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, chunk); err != nil {
+			return nil, err
+		}
+		cs.payload = append(cs.payload, chunk...)
+		if uint32(len(cs.payload)) < cs.length {
+			continue
+		}
+
+		msg := &rtmpMessage{typeID: cs.typeID, streamID: cs.streamID, payload: cs.payload}
+		cs.payload = nil
+		if err := c.handleControl(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// handleControl applies protocol control messages and answers pings.
+func (c *rtmpConn) handleControl(msg *rtmpMessage) error {
+	switch msg.typeID {
+	case rtmpSetChunkSize:
+		if len(msg.payload) >= 4 {
+			c.inChunkSize = binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+		}
+	case rtmpWindowAckSize:
+		if len(msg.payload) >= 4 {
+			c.ackWindow = binary.BigEndian.Uint32(msg.payload)
+		}
+	case rtmpUserControl:
+		if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == rtmpUserControlPing {
+			pong := append(be16(rtmpUserControlPong), msg.payload[2:6]...)
+			if err := c.writeMessage(rtmpChunkStreamCtrl, rtmpUserControl, 0, 0, pong); err != nil {
+				return err
+			}
+		}
+	}
+	if c.ackWindow > 0 && c.bytesRead-c.ackedBytes >= uint64(c.ackWindow) {
+		c.ackedBytes = c.bytesRead
+		return c.writeMessage(rtmpChunkStreamCtrl, rtmpAcknowledgement, 0, 0, be32(uint32(c.bytesRead)))
+	}
+	return nil
+}
+
+// command sends an AMF0 command.
+func (c *rtmpConn) command(streamID uint32, name string, transaction float64, values ...interface{}) error {
+	payload := amf0Encode(append([]interface{}{name, transaction}, values...)...)
+	return c.writeMessage(rtmpChunkStreamCmd, rtmpCommandAMF0, streamID, 0, payload)
+}
+
+// writeMetadata sends @setDataFrame onMetaData describing the stream. The
+// video codec ID of H.265 is its Enhanced RTMP FourCC; audio is AAC when
+// aac is set, else G.711A.
+func (c *rtmpConn) writeMetadata(width, height int, hevc, hasAudio bool, aac *audio.AACConfig) error {
+	videoCodec := float64(flvCodecAVC)
+	if hevc {
+		videoCodec = float64(binary.BigEndian.Uint32(flvFourCCHEVC))
+	}
+	metadata := amf0ECMAArray{
+		{"width", float64(width)},
+		{"height", float64(height)},
+		{"videocodecid", videoCodec},
+		{"encoder", "JT1078 Video Server"},
+	}
+	switch {
+	case aac != nil:
+		metadata = append(metadata,
+			amf0Property{"audiocodecid", float64(flvAudioAAC >> 4)},
+			amf0Property{"audiosamplerate", float64(aac.SampleRate)},
+			amf0Property{"audiosamplesize", float64(16)},
+			amf0Property{"stereo", aac.Channels == 2},
+		)
+	case hasAudio:
+		metadata = append(metadata,
+			amf0Property{"audiocodecid", float64(flvAudioG711A >> 4)},
+			amf0Property{"audiosamplerate", float64(8000)},
+			amf0Property{"audiosamplesize", float64(16)},
+			amf0Property{"stereo", false},
+		)
+	}
+	payload := amf0Encode("@setDataFrame", "onMetaData", metadata)
+	return c.writeMessage(rtmpChunkStreamData, rtmpDataAMF0, c.streamID, 0, payload)
+}
+
+// writeTag sends the body of an FLV audio or video tag.
+func (c *rtmpConn) writeTag(tagType byte, timestamp uint32, body []byte) error {
+	if tagType == flvTagAudio {
+		return c.writeMessage(rtmpChunkStreamAudio, rtmpAudio, c.streamID, timestamp, body)
+	}
+	return c.writeMessage(rtmpChunkStreamVideo, rtmpVideo, c.streamID, timestamp, body)
+}
+
+// writeMessage sends a message as chunks: a type 0 header, then type 3
+// continuation headers.
+func (c *rtmpConn) writeMessage(csid, typeID byte, streamID, timestamp uint32, payload []byte) error {
+	var out bytes.Buffer
+	ts := timestamp
+	if ts > 0xFFFFFF {
+		ts = 0xFFFFFF
+	}
+	out.WriteByte(csid)
+	out.Write([]byte{byte(ts >> 16), byte(ts >> 8), byte(ts)})
+	out.Write([]byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload))})
+	out.WriteByte(typeID)
+	out.Write(binary.LittleEndian.AppendUint32(nil, streamID))
+	if ts == 0xFFFFFF {
+		out.Write(be32(timestamp))
+	}
+	for i := 0; i < len(payload); i += rtmpOutChunkSize {
+		if i > 0 {
+			out.WriteByte(0xC0 | csid)
+			if ts == 0xFFFFFF {
+				out.Write(be32(timestamp))
+			}
+		}
+		out.Write(payload[i:min(i+rtmpOutChunkSize, len(payload))])
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(rtmpTimeout))
+	_, err := c.conn.Write(out.Bytes())
+	return err
+}
+
+func (c *rtmpConn) Close() error {
+	return c.conn.Close()
+}
+
+// amf0Property is one key of an AMF0 object, kept in order.
+type amf0Property struct {
+	Key   string
+	Value interface{}
+}
+
+type amf0Object []amf0Property
+type amf0ECMAArray []amf0Property
+
+// amf0Encode encodes numbers, booleans, strings, nil (null) and objects.
+func amf0Encode(values ...interface{}) []byte {
+	var out bytes.Buffer
+	var encode func(v interface{})
+	properties := func(props []amf0Property) {
+		for _, p := range props {
+			out.Write(be16(uint16(len(p.Key))))
+			out.WriteString(p.Key)
+			encode(p.Value)
+		}
+		out.Write([]byte{0, 0, 9}) // object end
+	}
+	encode = func(v interface{}) {
+		switch v := v.(type) {
+		case float64:
+			out.WriteByte(0x00)
+			out.Write(be64(math.Float64bits(v)))
+		case bool:
+			out.WriteByte(0x01)
+			if v {
+				out.WriteByte(1)
+			} else {
+				out.WriteByte(0)
+			}
+		case string:
+			out.WriteByte(0x02)
+			out.Write(be16(uint16(len(v))))
+			out.WriteString(v)
+		case amf0Object:
+			out.WriteByte(0x03)
+			properties(v)
+		case amf0ECMAArray:
+			out.WriteByte(0x08)
+			out.Write(be32(uint32(len(v))))
+			properties(v)
+		default:
+			out.WriteByte(0x05) // null
+		}
+	}
+	for _, v := range values {
+		encode(v)
+	}
+	return out.Bytes()
+}
+
+// amf0Decode decodes the values of a command; objects and ECMA arrays
+// become maps.
+func amf0Decode(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := amf0DecodeValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func amf0DecodeValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readString := func(lengthBytes int) (string, error) {
+		b := make([]byte, lengthBytes)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		var n uint32
+		for _, x := range b {
+			n = n<<8 | uint32(x)
+		}
+		if int(n) > r.Len() {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, n)
+		io.ReadFull(r, s)
+		return string(s), nil
+	}
+	readObject := func() (map[string]interface{}, error) {
+		object := make(map[string]interface{})
+		for {
+			key, err := readString(2)
+			if err != nil {
+				return nil, err
+			}
+			if key == "" {
+				if end, err := r.ReadByte(); err != nil || end != 9 {
+					return nil, errors.New("bad AMF0 object end")
+				}
+				return object, nil
+			}
+			if object[key], err = amf0DecodeValue(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch marker {
+	case 0x00:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0x01:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case 0x02:
+		return readString(2)
+	case 0x0C:
+		return readString(4)
+	case 0x03:
+		return readObject()
+	case 0x08:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil { // the count is only a hint
+			return nil, err
+		}
+		return readObject()
+	case 0x0A:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0)
+		for n := binary.BigEndian.Uint32(b); n > 0; n-- {
+			v, err := amf0DecodeValue(r)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	case 0x05, 0x06:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported AMF0 type 0x%02x", marker)
+}
+
+// splitFLVTags returns the tags of FLV tag data as written by writeFLVTag.
+func splitFLVTags(data []byte) []flvTag {
+	var tags []flvTag
+	for len(data) >= 15 {
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 11+size+4 {
+			break
+		}
+		tags = append(tags, flvTag{
+			tagType:   data[0],
+			timestamp: uint32(data[7])<<24 | uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]),
+			body:      data[11 : 11+size],
+		})
+		data = data[11+size+4:]
+	}
+	return tags
+}
+
+type flvTag struct {
+	tagType   byte
+	timestamp uint32
+	body      []byte
+}
+
+// maskRTMPURL hides the stream key of a push URL in listings and logs.
+func maskRTMPURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid"
+	}
+	path := u.Path
+	if slash := strings.LastIndex(path, "/"); slash >= 0 {
+		path = path[:slash+1] + "****"
+	}
+	return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, path)
+}
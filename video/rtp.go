@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+const (
+	// rtpMaxPayload keeps RTP packets within a 1500-byte MTU; larger NAL
+	// units are sent as FU-A (H.265: FU) fragments
+	rtpMaxPayload = 1400
+
+	rtpPayloadH264 = 96
+	rtpPayloadH265 = 96 // the only video track of a session, so the same number
+	rtpPayloadPCMA = 8
+)
+
+// rtpPacketizer numbers and timestamps the RTP packets of one track (RTSP,
+// WebRTC) and hands them to output. Times are output times in milliseconds
+// from the first key frame sent.
+type rtpPacketizer struct {
+	payloadType byte
+	clockRate   uint32
+	ssrc        uint32
+	seq         uint16
+	timeOffset  uint32
+	output      func(packet []byte) error
+
+	packets  uint32
+	octets   uint32
+	lastTime uint32 // output time (ms) of the last packet
+}
+
+// newRTPPacketizer starts a track at a random SSRC, sequence number and
+// timestamp (RFC 3550, 5.1).
+func newRTPPacketizer(payloadType byte, clockRate uint32, output func(packet []byte) error) *rtpPacketizer {
+	return &rtpPacketizer{
+		payloadType: payloadType,
+		clockRate:   clockRate,
+		ssrc:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+		timeOffset:  rand.Uint32(),
+		output:      output,
+	}
+}
+
+// sendH264 sends an access unit: NAL units that fit a packet as single NAL
+// unit packets and the others as FU-A fragments (RFC 6184, 5.6 and 5.8),
+// with the marker bit on the last packet.
+func (p *rtpPacketizer) sendH264(nalus [][]byte, ms uint32) error {
+	for i, nal := range nalus {
+		if len(nal) == 0 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nal) <= rtpMaxPayload {
+			if err := p.send(nal, ms, last); err != nil {
+				return err
+			}
+			continue
+		}
+
+		indicator := nal[0]&0xE0 | 28
+		data := nal[1:]
+		for first := true; len(data) > 0; first = false {
+			n := min(len(data), rtpMaxPayload-2)
+			header := nal[0] & 0x1F
+			if first {
+				header |= 0x80
+			}
+			end := n == len(data)
+			if end {
+				header |= 0x40
+			}
+			payload := append([]byte{indicator, header}, data[:n]...)
+			if err := p.send(payload, ms, last && end); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// sendH265 sends an access unit like sendH264, with H.265 fragmentation
+// units (RFC 7798, 4.4.3): a 2-byte payload header of type 49 and a FU
+// header carrying the NAL unit type.
+func (p *rtpPacketizer) sendH265(nalus [][]byte, ms uint32) error {
+	for i, nal := range nalus {
+		if len(nal) < 2 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nal) <= rtpMaxPayload {
+			if err := p.send(nal, ms, last); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payloadHeader := []byte{nal[0]&0x81 | 49<<1, nal[1]}
+		data := nal[2:]
+		for first := true; len(data) > 0; first = false {
+			n := min(len(data), rtpMaxPayload-3)
+			header := nal[0] >> 1 & 0x3F
+			if first {
+				header |= 0x80
+			}
+			end := n == len(data)
+			if end {
+				header |= 0x40
+			}
+			payload := append(append([]byte{}, payloadHeader...), header)
+			payload = append(payload, data[:n]...)
+			if err := p.send(payload, ms, last && end); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// send writes one RTP packet at output time ms.
+func (p *rtpPacketizer) send(payload []byte, ms uint32, marker bool) error {
+	packet := make([]byte, 12, 12+len(payload))
+	packet[0] = 0x80 // version 2
+	packet[1] = p.payloadType
+	if marker {
+		packet[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(packet[2:], p.seq)
+	binary.BigEndian.PutUint32(packet[4:], p.rtpTime(ms))
+	binary.BigEndian.PutUint32(packet[8:], p.ssrc)
+	packet = append(packet, payload...)
+
+	p.seq++
+	p.packets++
+	p.octets += uint32(len(payload))
+	p.lastTime = ms
+	return p.output(packet)
+}
+
+func (p *rtpPacketizer) rtpTime(ms uint32) uint32 {
+	return p.timeOffset + uint32(uint64(ms)*uint64(p.clockRate)/1000)
+}
+
+// rtpStream sends the packets of a live stream on a video (H.264, or H.265
+// when hevc is set) and a PCMA track, either of which may be nil. Output
+// starts at a key frame, and key frames carry the parameter sets in band.
+// Video of the other codec is dropped, as the session negotiated one.
+type rtpStream struct {
+	tracks    [2]*rtpPacketizer // video, PCMA
+	hevc      bool
+	started   bool
+	clock     mediaClock
+	wallclock time.Time // when the first key frame was sent
+}
+
+func (s *rtpStream) send(packet *MediaPacket) error {
+	if !s.started {
+		if !packet.Video || !packet.KeyFrame || packet.HEVC != s.hevc {
+			return nil
+		}
+		s.started = true
+		s.clock.start(packet.Timestamp)
+		s.wallclock = time.Now()
+	}
+	t := s.clock.at(packet.Timestamp)
+
+	if packet.Video {
+		if s.tracks[0] == nil || packet.HEVC != s.hevc {
+			return nil
+		}
+		nalus := packet.NALUs
+		if packet.HEVC {
+			if packet.KeyFrame {
+				nalus = append([][]byte{packet.VPS, packet.SPS, packet.PPS}, nalus...)
+			}
+			return s.tracks[0].sendH265(nalus, t)
+		}
+		if packet.KeyFrame {
+			nalus = append([][]byte{packet.SPS, packet.PPS}, nalus...)
+		}
+		return s.tracks[0].sendH264(nalus, t)
+	}
+	if s.tracks[1] == nil || len(packet.Audio) == 0 {
+		return nil
+	}
+	return s.tracks[1].send(packet.Audio, t, false)
+}
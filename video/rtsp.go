@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RTSP server port (0 disables RTSP)
+var rtspPort int
+
+const (
+	// rtspSessionTimeout ends UDP sessions without RTSP requests or RTCP
+	// from the client for that long
+	rtspSessionTimeout = 60 * time.Second
+
+	// rtcpInterval is how often sender reports are sent for A/V sync
+	rtcpInterval = 5 * time.Second
+)
+
+var rtspStatusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+}
+
+// startRTSPServer serves live streams at rtsp://host:port/{sim}/{channel}:
+// track 0 is H.264 (RFC 6184) and track 1 G.711A (PCMA), sent over
+// TCP-interleaved or UDP transport.
+func startRTSPServer(port int) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		log.Fatalf("RTSP listen error: %v", err)
+	}
+	defer ln.Close()
+
+	log.Printf("[RTSP] Server listening on port %d", port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[RTSP] Accept error: %v", err)
+			continue
+		}
+		go serveRTSP(conn)
+	}
+}
+
+// rtspConn is one RTSP control connection and its session, if any.
+type rtspConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeMu      sync.Mutex
+	session      *rtspSession
+	lastActivity atomic.Int64 // unix nanoseconds of the last request or RTCP
+}
+
+// rtspRequest is a parsed RTSP request.
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+func serveRTSP(conn net.Conn) {
+	c := &rtspConn{conn: conn, reader: bufio.NewReader(conn)}
+	defer conn.Close()
+	defer c.teardown()
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[RTSP] %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		c.touch()
+
+		if c.session != nil {
+			if id := req.header.Get("Session"); id != "" && strings.TrimSpace(strings.Split(id, ";")[0]) != c.session.id {
+				c.respond(req, 454, nil, "")
+				continue
+			}
+		}
+
+		switch req.method {
+		case "OPTIONS":
+			err = c.respond(req, 200, []string{"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, "")
+		case "DESCRIBE":
+			err = c.describe(req)
+		case "SETUP":
+			err = c.setup(req)
+		case "PLAY":
+			err = c.play(req)
+		case "TEARDOWN":
+			c.teardown()
+			err = c.respond(req, 200, nil, "")
+		case "GET_PARAMETER":
+			// keep-alive
+			err = c.respond(req, 200, c.sessionHeader(), "")
+		default:
+			err = c.respond(req, 501, nil, "")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readRequest reads the next request, skipping the interleaved RTCP
+// receiver reports of TCP clients.
+func (c *rtspConn) readRequest() (*rtspRequest, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+		c.touch()
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	for err == nil && line == "" {
+		line, err = tp.ReadLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		if _, err := c.reader.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed URL %q", parts[1])
+	}
+	return &rtspRequest{method: parts[0], url: u, header: header}, nil
+}
+
+// respond writes a response echoing the request's CSeq.
+func (c *rtspConn) respond(req *rtspRequest, status int, headers []string, body string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", status, rtspStatusText[status])
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	b.WriteString("Server: JT1078 Video Server\r\n")
+	for _, header := range headers {
+		b.WriteString(header + "\r\n")
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// writeInterleaved sends an RTP or RTCP packet on the control connection.
+func (c *rtspConn) writeInterleaved(channel int, packet []byte) error {
+	frame := make([]byte, 4, 4+len(packet))
+	frame[0] = '$'
+	frame[1] = byte(channel)
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+	frame = append(frame, packet...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *rtspConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *rtspConn) sessionHeader() []string {
+	if c.session == nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("Session: %s;timeout=%d", c.session.id, int(rtspSessionTimeout.Seconds()))}
+}
+
+// parseRTSPPath splits /{sim}/{channel}[/trackID=N] into the stream and
+// track; track is -1 for the aggregate URL.
+func parseRTSPPath(path string) (sim string, channel, track int, err error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	track = -1
+	if len(parts) == 3 && strings.HasPrefix(parts[2], "trackID=") {
+		if track, err = strconv.Atoi(strings.TrimPrefix(parts[2], "trackID=")); err != nil || track < 0 || track > 1 {
+			return "", 0, 0, fmt.Errorf("unknown track %q", parts[2])
+		}
+		parts = parts[:2]
+	}
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, 0, fmt.Errorf("path must be /{sim}/{channel}")
+	}
+	if channel, err = strconv.Atoi(parts[1]); err != nil || channel <= 0 {
+		return "", 0, 0, fmt.Errorf("channel must be a positive number")
+	}
+	return parts[0], channel, track, nil
+}
+
+// describe answers with the SDP of a live stream, carrying its parameter
+// sets when they are already known. The video is H.265 (RFC 7798) when the
+// stream's last parameter sets were.
+func (c *rtspConn) describe(req *rtspRequest) error {
+	sim, channel, track, err := parseRTSPPath(req.url.Path)
+	if err != nil || track >= 0 {
+		return c.respond(req, 404, nil, "")
+	}
+	activeStreamsMu.RLock()
+	_, live := activeStreams[activeStreamKey(sim, channel, false)]
+	activeStreamsMu.RUnlock()
+	if !live {
+		return c.respond(req, 404, nil, "")
+	}
+
+	var hevc bool
+	var vps, sps, pps []byte
+	spsPpsStoreMu.RLock()
+	if stored, exists := spsPpsStore[parameterSetKey(sim, channel, false)]; exists {
+		hevc = stored.HEVC
+		vps = bytes.TrimPrefix(stored.VPS, []byte{0, 0, 0, 1})
+		sps = bytes.TrimPrefix(stored.SPS, []byte{0, 0, 0, 1})
+		pps = bytes.TrimPrefix(stored.PPS, []byte{0, 0, 0, 1})
+	}
+	spsPpsStoreMu.RUnlock()
+
+	encoding, payloadType, fmtp := "H264", rtpPayloadH264, "packetization-mode=1"
+	if hevc {
+		encoding, payloadType, fmtp = "H265", rtpPayloadH265, ""
+		if len(vps) > 0 && len(sps) > 0 && len(pps) > 0 {
+			fmtp = fmt.Sprintf("sprop-vps=%s;sprop-sps=%s;sprop-pps=%s", base64.StdEncoding.EncodeToString(vps),
+				base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps))
+		}
+	} else if len(sps) >= 4 && len(pps) > 0 {
+		fmtp += fmt.Sprintf(";profile-level-id=%02X%02X%02X;sprop-parameter-sets=%s,%s", sps[1], sps[2], sps[3],
+			base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps))
+	}
+
+	host := "0.0.0.0"
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		host = addr.IP.String()
+	}
+	var sdp strings.Builder
+	sdp.WriteString("v=0\r\n")
+	fmt.Fprintf(&sdp, "o=- %d 1 IN IP4 %s\r\n", time.Now().UnixNano(), host)
+	fmt.Fprintf(&sdp, "s=%s channel %d\r\n", sim, channel)
+	sdp.WriteString("c=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n")
+	fmt.Fprintf(&sdp, "m=video 0 RTP/AVP %d\r\n", payloadType)
+	fmt.Fprintf(&sdp, "a=rtpmap:%d %s/90000\r\n", payloadType, encoding)
+	if fmtp != "" {
+		fmt.Fprintf(&sdp, "a=fmtp:%d %s\r\n", payloadType, fmtp)
+	}
+	sdp.WriteString("a=control:trackID=0\r\n")
+	fmt.Fprintf(&sdp, "m=audio 0 RTP/AVP %d\r\n", rtpPayloadPCMA)
+	fmt.Fprintf(&sdp, "a=rtpmap:%d PCMA/8000\r\n", rtpPayloadPCMA)
+	sdp.WriteString("a=control:trackID=1\r\n")
+
+	base := *req.url
+	base.Path = fmt.Sprintf("/%s/%d/", sim, channel)
+	return c.respond(req, 200, []string{
+		"Content-Type: application/sdp",
+		"Content-Base: " + base.String(),
+	}, sdp.String())
+}
+
+// setup adds a track to the session, creating the session on the first
+// SETUP. Tracks cannot be added once playing.
+func (c *rtspConn) setup(req *rtspRequest) error {
+	sim, channel, track, err := parseRTSPPath(req.url.Path)
+	if err != nil {
+		return c.respond(req, 404, nil, "")
+	}
+	if track < 0 {
+		track = 0
+	}
+	if c.session != nil {
+		if c.session.sim != sim || c.session.channel != channel {
+			return c.respond(req, 459, nil, "")
+		}
+		if c.session.playing() {
+			return c.respond(req, 455, nil, "")
+		}
+	}
+
+	rtp := &rtpTrack{control: req.url.String(), conn: c}
+	output := func(packet []byte) error { return rtp.write(packet, false) }
+	if track == 1 {
+		rtp.rtpPacketizer = newRTPPacketizer(rtpPayloadPCMA, 8000, output)
+	} else {
+		rtp.rtpPacketizer = newRTPPacketizer(rtpPayloadH264, 90000, output)
+	}
+
+	transport, ok := c.negotiateTransport(rtp, track, req.header.Get("Transport"))
+	if !ok {
+		return c.respond(req, 461, nil, "")
+	}
+
+	if c.session == nil {
+		c.session = &rtspSession{id: fmt.Sprintf("%08X", rand.Uint32()), sim: sim, channel: channel}
+	}
+	if old := c.session.tracks[track]; old != nil {
+		old.close()
+	}
+	c.session.tracks[track] = rtp
+	return c.respond(req, 200, append(c.sessionHeader(), "Transport: "+transport), "")
+}
+
+// negotiateTransport picks TCP-interleaved or UDP unicast transport for a
+// track from the client's Transport header, returning the reply header.
+func (c *rtspConn) negotiateTransport(rtp *rtpTrack, track int, header string) (string, bool) {
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		var interleaved, clientPort string
+		multicast := false
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "interleaved":
+				interleaved = value
+			case "client_port":
+				clientPort = value
+			case "multicast":
+				multicast = true
+			}
+		}
+		if multicast {
+			continue
+		}
+
+		switch params[0] {
+		case "RTP/AVP/TCP":
+			rtp.interleaved = 2 * track
+			if interleaved != "" {
+				first, _, _ := strings.Cut(interleaved, "-")
+				if n, err := strconv.Atoi(first); err == nil && n >= 0 && n < 255 {
+					rtp.interleaved = n
+				}
+			}
+			return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", rtp.interleaved, rtp.interleaved+1, rtp.ssrc), true
+
+		case "RTP/AVP", "RTP/AVP/UDP":
+			first, second, _ := strings.Cut(clientPort, "-")
+			rtpPort, err := strconv.Atoi(first)
+			if err != nil || rtpPort <= 0 {
+				continue
+			}
+			rtcpPort, err := strconv.Atoi(second)
+			if err != nil {
+				rtcpPort = rtpPort + 1
+			}
+			remote, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			if rtp.rtpConn, rtp.rtcpConn, err = listenRTPPair(); err != nil {
+				log.Printf("[RTSP] %v", err)
+				return "", false
+			}
+			rtp.clientRTP = &net.UDPAddr{IP: remote.IP, Port: rtpPort}
+			rtp.clientRTCP = &net.UDPAddr{IP: remote.IP, Port: rtcpPort}
+			go rtp.readRTCP()
+			serverPort := rtp.rtpConn.LocalAddr().(*net.UDPAddr).Port
+			return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+				rtpPort, rtcpPort, serverPort, serverPort+1, rtp.ssrc), true
+		}
+	}
+	return "", false
+}
+
+// listenRTPPair opens UDP sockets on an even RTP port and the odd RTCP port
+// above it.
+func listenRTPPair() (rtp, rtcp *net.UDPConn, err error) {
+	for i := 0; i < 16; i++ {
+		rtp, err = net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcp, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+		rtp.Close()
+	}
+	return nil, nil, errors.New("no free RTP/RTCP port pair")
+}
+
+// play starts sending the tracks set up; the session counts as a viewer of
+// the stream until it is torn down.
+func (c *rtspConn) play(req *rtspRequest) error {
+	s := c.session
+	if s == nil {
+		return c.respond(req, 454, nil, "")
+	}
+	if s.playing() {
+		return c.respond(req, 200, c.sessionHeader(), "")
+	}
+
+	var info []string
+	for _, track := range s.tracks {
+		if track != nil {
+			info = append(info, fmt.Sprintf("url=%s;seq=%d;rtptime=%d", track.control, track.seq, track.timeOffset))
+		}
+	}
+	if err := c.respond(req, 200, append(c.sessionHeader(), "Range: npt=0.000-", "RTP-Info: "+strings.Join(info, ",")), ""); err != nil {
+		return err
+	}
+
+	for i, track := range s.tracks {
+		if track != nil {
+			s.rtp.tracks[i] = track.rtpPacketizer
+		}
+	}
+	s.rtp.hevc = liveStreamHEVC(s.sim, s.channel)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	s.media = subscribeMedia(s.sim, s.channel, "RTSP "+c.conn.RemoteAddr().String(), true)
+	go c.stream(s)
+	log.Printf("[RTSP] %s playing %s channel %d", c.conn.RemoteAddr(), s.sim, s.channel)
+	return nil
+}
+
+// teardown ends the session, if any.
+func (c *rtspConn) teardown() {
+	s := c.session
+	if s == nil {
+		return
+	}
+	c.session = nil
+	if s.playing() {
+		close(s.done)
+		<-s.stopped
+		unsubscribeMedia(s.media)
+		log.Printf("[RTSP] %s stopped %s channel %d", c.conn.RemoteAddr(), s.sim, s.channel)
+	}
+	for _, track := range s.tracks {
+		if track != nil {
+			track.close()
+		}
+	}
+}
+
+// stream sends the packets of the session's subscription. A session that
+// falls behind, fails to send or times out closes the connection.
+func (c *rtspConn) stream(s *rtspSession) {
+	defer close(s.stopped)
+	udp := false
+	for _, track := range s.tracks {
+		if track != nil && track.rtpConn != nil {
+			udp = true
+		}
+	}
+	ticker := time.NewTicker(rtcpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet, ok := <-s.media.Packets:
+			if !ok {
+				log.Printf("[RTSP] %s fell behind, closing", c.conn.RemoteAddr())
+				c.conn.Close()
+				return
+			}
+			if err := s.rtp.send(packet); err != nil {
+				log.Printf("[RTSP] %s: %v", c.conn.RemoteAddr(), err)
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if udp && time.Since(time.Unix(0, c.lastActivity.Load())) > rtspSessionTimeout {
+				log.Printf("[RTSP] %s timed out", c.conn.RemoteAddr())
+				c.conn.Close()
+				return
+			}
+			for _, track := range s.tracks {
+				if track != nil {
+					track.senderReport(s.rtp.wallclock)
+				}
+			}
+		}
+	}
+}
+
+// rtspSession is the playback state of one RTSP client: the video and
+// audio tracks set up and, once playing, its media subscription.
+type rtspSession struct {
+	id      string
+	sim     string
+	channel int
+	tracks  [2]*rtpTrack // H.264 or H.265, PCMA
+
+	media   *mediaSubscriber
+	done    chan struct{}
+	stopped chan struct{}
+	rtp     rtpStream // owned by the stream goroutine
+}
+
+func (s *rtspSession) playing() bool {
+	return s.done != nil
+}
+
+// rtpTrack is the RTP sender of one track, writing either interleaved on
+// the RTSP connection or to the client's UDP ports.
+type rtpTrack struct {
+	*rtpPacketizer
+	control string
+
+	conn        *rtspConn
+	interleaved int // RTP channel; RTCP uses the next one
+
+	rtpConn, rtcpConn     *net.UDPConn
+	clientRTP, clientRTCP *net.UDPAddr
+}
+
+// senderReport sends an RTCP SR tying the last packet's RTP time to
+// wallclock, so players can synchronise audio and video (RFC 3550, 6.4.1).
+func (t *rtpTrack) senderReport(start time.Time) {
+	if t.packets == 0 {
+		return
+	}
+	at := start.Add(time.Duration(t.lastTime) * time.Millisecond)
+	seconds := uint64(at.Unix() + 2208988800) // NTP epoch is 1900
+	fraction := uint64(at.Nanosecond()) << 32 / 1e9
+
+	report := make([]byte, 28)
+	report[0] = 0x80
+	report[1] = 200
+	binary.BigEndian.PutUint16(report[2:], 6)
+	binary.BigEndian.PutUint32(report[4:], t.ssrc)
+	binary.BigEndian.PutUint64(report[8:], seconds<<32|fraction)
+	binary.BigEndian.PutUint32(report[16:], t.rtpTime(t.lastTime))
+	binary.BigEndian.PutUint32(report[20:], t.packets)
+	binary.BigEndian.PutUint32(report[24:], t.octets)
+	t.write(report, true)
+}
+
+func (t *rtpTrack) write(packet []byte, rtcp bool) error {
+	if t.rtpConn == nil {
+		channel := t.interleaved
+		if rtcp {
+			channel++
+		}
+		return t.conn.writeInterleaved(channel, packet)
+	}
+	if rtcp {
+		t.rtcpConn.WriteToUDP(packet, t.clientRTCP)
+		return nil
+	}
+	// UDP clients going away are noticed by the session timeout
+	t.rtpConn.WriteToUDP(packet, t.clientRTP)
+	return nil
+}
+
+// readRTCP keeps a UDP session alive while the client sends receiver reports.
+func (t *rtpTrack) readRTCP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := t.rtcpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+		t.conn.touch()
+	}
+}
+
+func (t *rtpTrack) close() {
+	if t.rtpConn != nil {
+		t.rtpConn.Close()
+		t.rtcpConn.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"jt1078/proxyapi"
+)
+
+// idleStopPoll is how often live streams are checked for viewers.
+const idleStopPoll = 5 * time.Second
+
+var (
+	// Device streams currently reaching this server, keyed by
+	// streamKey(SIM, channel) with a "p" suffix for playback
+	activeStreamsMu sync.RWMutex
+	activeStreams   = make(map[string]*StreamInfo)
+
+	// How long a watched live stream may go without viewers before its
+	// session is stopped through the proxy (0 = never)
+	idleStopDelay time.Duration
+)
+
+// StreamInfo describes one SIM/channel stream received from a device.
+type StreamInfo struct {
+	SIM        string    `json:"device_phone"`
+	Channel    int       `json:"channel"`
+	DataType   int       `json:"data_type"`
+	Playback   bool      `json:"playback"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartedAt  time.Time `json:"started_at"`
+	Packets    int64     `json:"packets"`
+	LastPacket time.Time `json:"last_packet"`
+	Viewers    int       `json:"viewers"`
+
+	watched   bool      // had a viewer since it started
+	idleSince time.Time // when its last viewer left
+	stopped   bool      // its session was stopped for lack of viewers
+}
+
+// Subscription selects the streams a viewer receives: all channels of SIM
+// when Channel is 0, and every live stream when SIM is empty.
+type Subscription struct {
+	SIM     string `json:"device_phone"`
+	Channel int    `json:"channel"`
+}
+
+// Matches reports whether a stream belongs to the subscription.
+func (s Subscription) Matches(sim string, channel int) bool {
+	if s.SIM == "" {
+		return true
+	}
+	return s.SIM == sim && (s.Channel == 0 || s.Channel == channel)
+}
+
+// parseSubscription reads device_phone and channel from a viewer's URL.
+func parseSubscription(r *http.Request) (Subscription, error) {
+	sub := Subscription{SIM: r.URL.Query().Get("device_phone")}
+	if value := r.URL.Query().Get("channel"); value != "" {
+		channel, err := strconv.Atoi(value)
+		if err != nil {
+			return sub, err
+		}
+		sub.Channel = channel
+	}
+	return sub, nil
+}
+
+func activeStreamKey(sim string, channel int, playback bool) string {
+	if playback {
+		return streamKey(sim, channel) + "p"
+	}
+	return streamKey(sim, channel)
+}
+
+// trackStreamPacket records a packet of a device stream, registering the
+// stream on its first packet.
+func trackStreamPacket(frame *JT1078Frame, remoteAddr string, playback bool) {
+	activeStreamsMu.Lock()
+	defer activeStreamsMu.Unlock()
+
+	key := activeStreamKey(frame.SIM, frame.Channel, playback)
+	stream, exists := activeStreams[key]
+	if !exists {
+		stream = &StreamInfo{
+			SIM:        frame.SIM,
+			Channel:    frame.Channel,
+			DataType:   frame.DataType,
+			Playback:   playback,
+			RemoteAddr: remoteAddr,
+			StartedAt:  time.Now(),
+		}
+		activeStreams[key] = stream
+	}
+	stream.Packets++
+	stream.LastPacket = time.Now()
+}
+
+// removeStream drops a stream whose device connection closed.
+func removeStream(sim string, channel int, playback bool) {
+	activeStreamsMu.Lock()
+	delete(activeStreams, activeStreamKey(sim, channel, playback))
+	activeStreamsMu.Unlock()
+}
+
+// streamsHandler lists the device streams reaching this server with the
+// number of viewers subscribed to each.
+func streamsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	activeStreamsMu.RLock()
+	streams := make([]StreamInfo, 0, len(activeStreams))
+	for _, stream := range activeStreams {
+		streams = append(streams, *stream)
+	}
+	activeStreamsMu.RUnlock()
+	countViewers(streams)
+
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].SIM != streams[j].SIM {
+			return streams[i].SIM < streams[j].SIM
+		}
+		if streams[i].Channel != streams[j].Channel {
+			return streams[i].Channel < streams[j].Channel
+		}
+		return !streams[i].Playback && streams[j].Playback
+	})
+	json.NewEncoder(w).Encode(streams)
+}
+
+// countViewers sets the viewers of each stream: its /video or /playback
+// WebSocket viewers and, for live streams, the FLV, fMP4, RTSP, WebRTC and
+// RTMP push viewers fed by the media hub.
+func countViewers(streams []StreamInfo) {
+	clientsMu.RLock()
+	for i := range streams {
+		for _, info := range clients {
+			if info.wantsVideo(streams[i].SIM, streams[i].Channel, streams[i].Playback) {
+				streams[i].Viewers++
+			}
+		}
+	}
+	clientsMu.RUnlock()
+
+	viewers := mediaViewers()
+	for i := range streams {
+		if !streams[i].Playback {
+			streams[i].Viewers += viewers[streamKey(streams[i].SIM, streams[i].Channel)]
+		}
+	}
+}
+
+// idleStopRoutine stops the live session of a stream, through the proxy's
+// video session API (0x9102), once idleStopDelay has passed since its last
+// viewer left. Streams never watched (HLS only, or started for other
+// clients) and streams being recorded are left running.
+func idleStopRoutine() {
+	ticker := time.NewTicker(idleStopPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		activeStreamsMu.RLock()
+		streams := make([]StreamInfo, 0, len(activeStreams))
+		for _, stream := range activeStreams {
+			if !stream.Playback {
+				streams = append(streams, *stream)
+			}
+		}
+		activeStreamsMu.RUnlock()
+		countViewers(streams)
+
+		var idle []StreamInfo
+		activeStreamsMu.Lock()
+		for _, counted := range streams {
+			stream, exists := activeStreams[activeStreamKey(counted.SIM, counted.Channel, false)]
+			if !exists {
+				continue
+			}
+			switch {
+			case counted.Viewers > 0:
+				stream.watched = true
+				stream.idleSince = time.Time{}
+				stream.stopped = false
+			case !stream.watched || stream.stopped:
+			case stream.idleSince.IsZero():
+				stream.idleSince = time.Now()
+			case time.Since(stream.idleSince) >= idleStopDelay && !isRecording(stream.SIM, stream.Channel):
+				idle = append(idle, *stream)
+			}
+		}
+		activeStreamsMu.Unlock()
+
+		// A stop that failed is tried again at the next poll
+		for _, stream := range idle {
+			log.Printf("[STREAMS] Stopping %s channel %d: no viewers for %v", stream.SIM, stream.Channel, idleStopDelay)
+			err := proxyapi.Post("/api/v1/jt808/video/stop", map[string]interface{}{
+				"device_phone": stream.SIM,
+				"channel":      stream.Channel,
+			})
+			if err != nil {
+				log.Printf("Error stopping idle stream %s channel %d: %v", stream.SIM, stream.Channel, err)
+				continue
+			}
+			activeStreamsMu.Lock()
+			if current, exists := activeStreams[activeStreamKey(stream.SIM, stream.Channel, false)]; exists && !current.idleSince.IsZero() {
+				current.stopped = true
+			}
+			activeStreamsMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+)
+
+// MPEG-TS layout used for HLS segments: one program with H.264 or H.265
+// video and G.711A or AAC audio (ISO/IEC 13818-1).
+const (
+	tsPacketSize = 188
+
+	tsPIDPAT   = 0x0000
+	tsPIDPMT   = 0x1000
+	tsPIDVideo = 0x0100
+	tsPIDAudio = 0x0101
+
+	tsStreamTypeH264 = 0x1B
+	tsStreamTypeH265 = 0x24
+	tsStreamTypeAAC  = 0x0F // ADTS
+	// Private stream type GB/T 28181 devices and NVRs use for G.711A
+	tsStreamTypeG711A = 0x90
+
+	// PTS of the first key frame, so audio slightly ahead of it stays positive
+	tsPTSOffset = 90000
+)
+
+var crc32MPEGTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG is the CRC of PSI sections.
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// tsMuxer writes TS packets, keeping the continuity counter of each PID.
+// hevc and aac select the stream types of the PMT.
+type tsMuxer struct {
+	continuity map[uint16]byte
+	hevc       bool
+	aac        bool
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{continuity: make(map[uint16]byte)}
+}
+
+// writeTables writes the PAT and PMT; every segment starts with them.
+func (m *tsMuxer) writeTables(out *bytes.Buffer) {
+	pat := []byte{
+		0x00,       // table_id
+		0xB0, 0x0D, // section length 13
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current
+		0x00, 0x00, // section numbers
+		0x00, 0x01, // program 1
+		0xE0 | tsPIDPMT>>8, tsPIDPMT & 0xFF,
+	}
+	m.writeSection(out, tsPIDPAT, pat)
+
+	videoType := byte(tsStreamTypeH264)
+	if m.hevc {
+		videoType = tsStreamTypeH265
+	}
+	audioType := byte(tsStreamTypeG711A)
+	if m.aac {
+		audioType = tsStreamTypeAAC
+	}
+	pmt := []byte{
+		0x02,       // table_id
+		0xB0, 0x17, // section length 23
+		0x00, 0x01, // program 1
+		0xC1,
+		0x00, 0x00,
+		0xE0 | tsPIDVideo>>8, tsPIDVideo & 0xFF, // PCR PID
+		0xF0, 0x00, // no program descriptors
+		videoType, 0xE0 | tsPIDVideo>>8, tsPIDVideo & 0xFF, 0xF0, 0x00,
+		audioType, 0xE0 | tsPIDAudio>>8, tsPIDAudio & 0xFF, 0xF0, 0x00,
+	}
+	m.writeSection(out, tsPIDPMT, pmt)
+}
+
+func (m *tsMuxer) writeSection(out *bytes.Buffer, pid uint16, section []byte) {
+	crc := crc32MPEG(section)
+	payload := append([]byte{0x00}, section...) // pointer field
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	// Sections are padded with 0xFF rather than adaptation field stuffing
+	payload = append(payload, bytes.Repeat([]byte{0xFF}, tsPacketSize-4-len(payload))...)
+	m.writePackets(out, pid, payload, nil, false)
+}
+
+// writeVideo writes one access unit as a PES with an access unit delimiter,
+// the parameter sets on key frames, and the PCR.
+func (m *tsMuxer) writeVideo(out *bytes.Buffer, packet *MediaPacket, pts uint64) {
+	var es bytes.Buffer
+	parameterSets := [][]byte{packet.SPS, packet.PPS}
+	if packet.HEVC {
+		es.Write(hevcAUD)
+		parameterSets = [][]byte{packet.VPS, packet.SPS, packet.PPS}
+	} else {
+		es.Write([]byte{0, 0, 0, 1, 0x09, 0xF0})
+	}
+	if packet.KeyFrame {
+		for _, nal := range parameterSets {
+			es.Write([]byte{0, 0, 0, 1})
+			es.Write(nal)
+		}
+	}
+	for _, nal := range packet.NALUs {
+		es.Write([]byte{0, 0, 0, 1})
+		es.Write(nal)
+	}
+	pcr := pts
+	m.writePackets(out, tsPIDVideo, pesPacket(0xE0, pts, es.Bytes(), false), &pcr, packet.KeyFrame)
+}
+
+// writeAudio writes one audio frame, G.711A samples or ADTS frames, as a
+// PES.
+func (m *tsMuxer) writeAudio(out *bytes.Buffer, data []byte, pts uint64) {
+	m.writePackets(out, tsPIDAudio, pesPacket(0xC0, pts, data, true), nil, false)
+}
+
+// pesPacket wraps elementary stream data with a PTS. Video PES leave the
+// length 0 (unbounded) as they may exceed 64 KB.
+func pesPacket(streamID byte, pts uint64, data []byte, bounded bool) []byte {
+	pes := make([]byte, 0, 14+len(data))
+	pes = append(pes, 0x00, 0x00, 0x01, streamID)
+	length := 0
+	if bounded && 8+len(data) <= 0xFFFF {
+		length = 8 + len(data)
+	}
+	pes = append(pes, byte(length>>8), byte(length))
+	pes = append(pes, 0x80, 0x80, 5) // PTS only
+	pes = append(pes,
+		0x21|byte(pts>>29)&0x0E,
+		byte(pts>>22),
+		0x01|byte(pts>>14)&0xFE,
+		byte(pts>>7),
+		0x01|byte(pts<<1)&0xFE,
+	)
+	return append(pes, data...)
+}
+
+// writePackets splits a payload into TS packets; the first carries the
+// payload unit start flag and, when given, the PCR and random access flag.
+// The last is padded with adaptation field stuffing.
+func (m *tsMuxer) writePackets(out *bytes.Buffer, pid uint16, payload []byte, pcr *uint64, randomAccess bool) {
+	first := true
+	for len(payload) > 0 {
+		var adaptation []byte
+		if first && (pcr != nil || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = append(adaptation, flags)
+			if pcr != nil {
+				adaptation[0] |= 0x10
+				base := *pcr
+				adaptation = append(adaptation,
+					byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7E, 0x00)
+			}
+		}
+		if adaptation == nil && len(payload) < tsPacketSize-4 {
+			adaptation = []byte{}
+		}
+		if adaptation != nil {
+			capacity := tsPacketSize - 4 - 1 - len(adaptation)
+			if pad := capacity - len(payload); pad > 0 {
+				if len(adaptation) == 0 {
+					adaptation = append(adaptation, 0x00)
+					pad--
+				}
+				adaptation = append(adaptation, bytes.Repeat([]byte{0xFF}, pad)...)
+			}
+		}
+
+		packet := make([]byte, 4, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid>>8) & 0x1F
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid)
+		control := byte(0x10) // payload only
+		if adaptation != nil {
+			control = 0x30
+		}
+		packet[3] = control | m.continuity[pid]
+		m.continuity[pid] = (m.continuity[pid] + 1) & 0x0F
+		if adaptation != nil {
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		n := tsPacketSize - len(packet)
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		out.Write(packet)
+		first = false
+	}
+}
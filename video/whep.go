@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// whepConnectTimeout closes sessions whose peer never connects.
+const whepConnectTimeout = 30 * time.Second
+
+var (
+	// UDP port shared by all WebRTC sessions (0 = an ephemeral port per session)
+	webrtcUDPPort int
+
+	webrtcAPIOnce sync.Once
+	webrtcAPI     *webrtc.API
+	webrtcAPIErr  error
+
+	// WHEP sessions keyed by resource ID
+	whepSessionsMu sync.Mutex
+	whepSessions   = make(map[string]*whepSession)
+)
+
+// whepSession is one WebRTC viewer of a live SIM/channel stream.
+type whepSession struct {
+	ID      string
+	SIM     string
+	Channel int
+	viewer  string
+
+	pc        *webrtc.PeerConnection
+	hevc      bool // the video track is H.265
+	video     *webrtc.TrackLocalStaticRTP
+	audio     *webrtc.TrackLocalStaticRTP
+	connected sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newWebRTCAPI sets up the WebRTC stack: the default codecs and interceptors
+// (NACK, RTCP reports) and ICE with host candidates only, so LAN and
+// loopback peers connect without STUN/TURN.
+func newWebRTCAPI() (*webrtc.API, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		return nil, err
+	}
+
+	settings := webrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(true)
+	if webrtcUDPPort > 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(webrtcUDPPort, ice.UDPMuxFromPortWithLoopback())
+		if err != nil {
+			return nil, fmt.Errorf("WebRTC UDP port %d: %w", webrtcUDPPort, err)
+		}
+		settings.SetICEUDPMux(mux)
+		log.Printf("[WHEP] WebRTC media on UDP port %d", webrtcUDPPort)
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settings),
+	), nil
+}
+
+// whepHandler serves WHEP (draft-ietf-wish-whep) for live streams:
+// POST /whep/{sim}/{channel} with an SDP offer answers 201 with the SDP
+// answer and the session URL in Location; DELETE on that URL ends the
+// session. The answer carries all ICE candidates, so no PATCH is needed.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	channel, err := strconv.Atoi(r.PathValue("channel"))
+	if err != nil || channel <= 0 {
+		http.Error(w, "channel must be a positive number", http.StatusBadRequest)
+		return
+	}
+	sim := r.PathValue("sim")
+	id := r.PathValue("id")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		if id == "" {
+			w.Header().Set("Accept-Post", "application/sdp")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && id == "":
+		whepOffer(w, r, sim, channel)
+	case r.Method == http.MethodDelete && id != "":
+		whepSessionsMu.Lock()
+		session, exists := whepSessions[id]
+		whepSessionsMu.Unlock()
+		if !exists || session.SIM != sim || session.Channel != channel {
+			http.NotFound(w, r)
+			return
+		}
+		session.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// whepOffer creates a session for an SDP offer.
+func whepOffer(w http.ResponseWriter, r *http.Request, sim string, channel int) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Cannot read offer", http.StatusBadRequest)
+		return
+	}
+
+	activeStreamsMu.RLock()
+	_, live := activeStreams[activeStreamKey(sim, channel, false)]
+	activeStreamsMu.RUnlock()
+	if !live {
+		http.Error(w, "Stream not active", http.StatusNotFound)
+		return
+	}
+
+	webrtcAPIOnce.Do(func() { webrtcAPI, webrtcAPIErr = newWebRTCAPI() })
+	if webrtcAPIErr != nil {
+		log.Printf("[WHEP] %v", webrtcAPIErr)
+		http.Error(w, "WebRTC unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	session, answer, err := newWHEPSession(sim, channel, string(offer), "WebRTC "+r.RemoteAddr)
+	if err != nil {
+		log.Printf("[WHEP] Offer from %s rejected: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[WHEP] %s watching %s channel %d (session %s)", r.RemoteAddr, sim, channel, session.ID)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/whep/%s/%d/%s", sim, channel, session.ID))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// newWHEPSession answers an offer with an H.264 (or, for an H.265 stream,
+// H.265) and a PCMA track. Media starts flowing once the peer connects, at
+// the next key frame.
+func newWHEPSession(sim string, channel int, offer, viewer string) (*whepSession, string, error) {
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	s := &whepSession{
+		ID:      fmt.Sprintf("%016x", rand.Uint64()),
+		SIM:     sim,
+		Channel: channel,
+		viewer:  viewer,
+		pc:      pc,
+		hevc:    liveStreamHEVC(sim, channel),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.negotiate(offer); err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	whepSessionsMu.Lock()
+	whepSessions[s.ID] = s
+	whepSessionsMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			s.connected.Do(func() { go s.stream() })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go s.close()
+		}
+	})
+	time.AfterFunc(whepConnectTimeout, func() {
+		if s.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			s.close()
+		}
+	})
+
+	// Host candidates are gathered at once; answer with all of them
+	gathered := webrtc.GatheringCompletePromise(pc)
+	answer, err := pc.CreateAnswer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		s.close()
+		return nil, "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(5 * time.Second):
+	}
+
+	return s, pc.LocalDescription().SDP, nil
+}
+
+// negotiate applies the offer and adds the tracks the viewer can receive.
+// H.265 streams need a viewer offering H.265 (Safari, recent Chrome with
+// hardware decoding), as nothing here transcodes.
+func (s *whepSession) negotiate(offer string) error {
+	if s.hevc && !strings.Contains(strings.ToUpper(offer), " H265/90000") {
+		return errors.New("stream is H.265, which the offer does not include")
+	}
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return err
+	}
+
+	streamID := fmt.Sprintf("jt1078-%s-%d", s.SIM, s.Channel)
+	video := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: s.h264Fmtp(),
+	}
+	if s.hevc {
+		video = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000}
+	}
+	var err error
+	if s.video, err = webrtc.NewTrackLocalStaticRTP(video, "video", streamID); err != nil {
+		return err
+	}
+	if s.audio, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypePCMA,
+		ClockRate: 8000,
+	}, "audio", streamID); err != nil {
+		return err
+	}
+
+	for _, track := range []*webrtc.TrackLocalStaticRTP{s.video, s.audio} {
+		sender, err := s.pc.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		// Reading RTCP lets the interceptors handle NACKs and reports
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// h264Fmtp asks for the profile of the stream's SPS when it is known.
+func (s *whepSession) h264Fmtp() string {
+	fmtp := "level-asymmetry-allowed=1;packetization-mode=1"
+	spsPpsStoreMu.RLock()
+	defer spsPpsStoreMu.RUnlock()
+	if stored, exists := spsPpsStore[parameterSetKey(s.SIM, s.Channel, false)]; exists {
+		if sps := bytes.TrimPrefix(stored.SPS, []byte{0, 0, 0, 1}); len(sps) >= 4 {
+			fmtp += fmt.Sprintf(";profile-level-id=%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+	}
+	return fmtp
+}
+
+// stream passes the stream's video and PCMA through as RTP, starting with
+// the cached GOP so the player has an I-frame to decode at once.
+func (s *whepSession) stream() {
+	media := subscribeMedia(s.SIM, s.Channel, s.viewer, true)
+	defer unsubscribeMedia(media)
+
+	write := func(track *webrtc.TrackLocalStaticRTP) func([]byte) error {
+		return func(packet []byte) error {
+			if _, err := track.Write(packet); errors.Is(err, io.ErrClosedPipe) {
+				return err
+			}
+			return nil
+		}
+	}
+	rtp := rtpStream{tracks: [2]*rtpPacketizer{
+		newRTPPacketizer(rtpPayloadH264, 90000, write(s.video)),
+		newRTPPacketizer(rtpPayloadPCMA, 8000, write(s.audio)),
+	}, hevc: s.hevc}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet, ok := <-media.Packets:
+			if !ok {
+				log.Printf("[WHEP] Session %s fell behind, closing", s.ID)
+				go s.close()
+				return
+			}
+			if err := rtp.send(packet); err != nil {
+				go s.close()
+				return
+			}
+		}
+	}
+}
+
+// close ends the session and its peer connection.
+func (s *whepSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		whepSessionsMu.Lock()
+		delete(whepSessions, s.ID)
+		whepSessionsMu.Unlock()
+		s.pc.Close()
+		log.Printf("[WHEP] Session %s for %s channel %d closed", s.ID, s.SIM, s.Channel)
+	})
+}